@@ -9,11 +9,11 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
-	"strconv"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/trandinhkhoa/crypto-exchange/controllers"
+	"github.com/trandinhkhoa/crypto-exchange/entities"
 )
 
 type Client struct {
@@ -21,25 +21,26 @@ type Client struct {
 }
 
 type PlaceLimitOrderResponseBody struct {
-	Msg   string
-	Order controllers.OrderResponse
+	Msg     string
+	Order   controllers.OrderResponse
+	Matches []controllers.TradeResponse
 }
 type PlaceMarketOrderResponseBody struct {
 	Matches []controllers.TradeResponse
 }
 
 type CurrentPriceResponseBody struct {
-	CurrentPrice float64
+	CurrentPrice entities.Decimal
 }
 type BestAskPriceResponseBody struct {
-	BestAskPrice float64
+	BestAskPrice entities.Decimal
 }
 
 type BestBidPriceResponseBody struct {
-	BestBidPrice float64
+	BestBidPrice entities.Decimal
 }
 
-func (client Client) GetCurrentPrice() (float64, error) {
+func (client Client) GetCurrentPrice() (entities.Decimal, error) {
 	reqPrice, err := http.NewRequest(http.MethodGet, client.ExchangeServer+"/book/ETHUSD/currentPrice", nil)
 	if err != nil {
 		logrus.Error(err)
@@ -50,13 +51,13 @@ func (client Client) GetCurrentPrice() (float64, error) {
 	}
 	decodedRespPrice := &CurrentPriceResponseBody{}
 	if err := json.NewDecoder(respPrice.Body).Decode(decodedRespPrice); err != nil {
-		return 0, err
+		return entities.ZeroDecimal, err
 	}
 	fmt.Println("Current Price ", decodedRespPrice.CurrentPrice)
 	return decodedRespPrice.CurrentPrice, nil
 }
 
-func (client Client) GetBestAskPrice() (float64, error) {
+func (client Client) GetBestAskPrice() (entities.Decimal, error) {
 	reqPrice, err := http.NewRequest(http.MethodGet, client.ExchangeServer+"/book/ETHUSD/bestAsk", nil)
 	if err != nil {
 		logrus.Error(err)
@@ -67,12 +68,12 @@ func (client Client) GetBestAskPrice() (float64, error) {
 	}
 	decodedRespPrice := &BestAskPriceResponseBody{}
 	if err := json.NewDecoder(respPrice.Body).Decode(decodedRespPrice); err != nil {
-		return 0, err
+		return entities.ZeroDecimal, err
 	}
 	return decodedRespPrice.BestAskPrice, nil
 }
 
-func (client Client) GetBestBidPrice() (float64, error) {
+func (client Client) GetBestBidPrice() (entities.Decimal, error) {
 	reqPrice, err := http.NewRequest(http.MethodGet, client.ExchangeServer+"/book/ETHUSD/bestBid", nil)
 	if err != nil {
 		logrus.Error(err)
@@ -83,22 +84,22 @@ func (client Client) GetBestBidPrice() (float64, error) {
 	}
 	decodedRespPrice := &BestBidPriceResponseBody{}
 	if err := json.NewDecoder(respPrice.Body).Decode(decodedRespPrice); err != nil {
-		return 0, err
+		return entities.ZeroDecimal, err
 	}
 	return decodedRespPrice.BestBidPrice, nil
 }
 
-func simulateFetchPriceFromOtherExchange() float64 {
-	return 1000
+func simulateFetchPriceFromOtherExchange() entities.Decimal {
+	return entities.NewDecimalFromInt(1000)
 }
 
 type PlaceOrderRequest struct {
-	UserId    string  `json:"UserId"`
-	OrderType string  `json:"OrderType"`
-	IsBid     bool    `json:"IsBid"`
-	Size      float64 `json:"Size"`
-	Price     float64 `json:"Price"`
-	Ticker    string  `json:"Ticker"`
+	UserId    string           `json:"UserId"`
+	OrderType string           `json:"OrderType"`
+	IsBid     bool             `json:"IsBid"`
+	Size      entities.Decimal `json:"Size"`
+	Price     entities.Decimal `json:"Price"`
+	Ticker    string           `json:"Ticker"`
 }
 
 func (client Client) PlaceLimitFromFile() {
@@ -119,8 +120,8 @@ func (client Client) PlaceLimitFromFile() {
 			panic(fmt.Sprintf("Could not read the csv file: %s", err))
 		}
 
-		price, _ := strconv.ParseFloat(record[2], 64)
-		size, _ := strconv.ParseFloat(record[3], 64)
+		price, _ := entities.ParseDecimal(record[2])
+		size, _ := entities.ParseDecimal(record[3])
 		isBid := record[1] == "a"
 
 		order := controllers.PlaceOrderRequest{
@@ -139,29 +140,32 @@ func (client Client) PlaceLimitFromFile() {
 
 func (client Client) MakeMarket() {
 	ticker := time.NewTicker(75 * time.Millisecond)
-	const spread = 0.2
-	const halfSpread = spread / 2.0
+	spread := entities.MustParseDecimal("0.2")
+	halfSpread := spread.Div(entities.NewDecimalFromInt(2))
 
 	for {
 		<-ticker.C
 
 		lastTradedPrice, err := client.GetCurrentPrice()
-		if err != nil || lastTradedPrice == 0 {
+		if err != nil || lastTradedPrice.IsZero() {
 			lastTradedPrice = simulateFetchPriceFromOtherExchange()
 		}
 
 		// Calculate bid and ask prices centered around last traded price
-		bidPrice := lastTradedPrice - halfSpread
-		askPrice := lastTradedPrice + halfSpread
+		bidPrice := lastTradedPrice.Sub(halfSpread)
+		askPrice := lastTradedPrice.Add(halfSpread)
 
 		// Place bid order
 		bidBody := controllers.PlaceOrderRequest{
 			UserId:    "maker123",
 			OrderType: "LIMIT",
 			IsBid:     true,
-			Size:      1,
+			Size:      entities.NewDecimalFromInt(1),
 			Price:     bidPrice,
 			Ticker:    "ETHUSD",
+			// quotes must never take liquidity
+			PostOnly:        true,
+			PostOnlyReprice: true,
 		}
 		client.PlaceOrder(bidBody)
 
@@ -170,9 +174,12 @@ func (client Client) MakeMarket() {
 			UserId:    "maker123",
 			OrderType: "LIMIT",
 			IsBid:     false,
-			Size:      1,
+			Size:      entities.NewDecimalFromInt(1),
 			Price:     askPrice,
 			Ticker:    "ETHUSD",
+			// quotes must never take liquidity
+			PostOnly:        true,
+			PostOnlyReprice: true,
 		}
 		client.PlaceOrder(askBody)
 	}
@@ -242,7 +249,7 @@ func (client Client) PlaceMarketRepeat() {
 			UserId:    "traderJoe123",
 			OrderType: "MARKET",
 			IsBid:     isBid,
-			Size:      1,
+			Size:      entities.NewDecimalFromInt(1),
 			Ticker:    "ETHUSD",
 		}
 		client.PlaceOrder(orderBody)
@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -15,8 +16,8 @@ import (
 )
 
 type OrderBookResponse struct {
-	TotalAsksVolume float64
-	TotalBidsVolume float64
+	TotalAsksVolume entities.Decimal
+	TotalBidsVolume entities.Decimal
 	Asks            []*OrderResponse
 	Bids            []*OrderResponse
 }
@@ -26,28 +27,132 @@ type OrderResponse struct {
 	ID        int
 	UserId    string
 	IsBid     bool
-	Size      float64
-	Price     float64
+	Size      entities.Decimal
+	Price     entities.Decimal
 	Timestamp int64
+	OrderType entities.OrderType
+	// stop orders only
+	StopPrice *entities.Decimal `json:",omitempty"`
 }
 
 type TradeResponse struct {
-	Price        float64
-	Size         float64
+	ID           int64
+	Price        entities.Decimal
+	Size         entities.Decimal
 	IsBuyerMaker bool
 	Timestamp    int64
+	// in the base asset
+	BuyerFee entities.Decimal
+	// in the quote asset
+	SellerFee entities.Decimal
 }
 type LimitResponse struct {
-	Price  float64
-	Volume float64
+	Price  entities.Decimal
+	Volume entities.Decimal
+}
+
+// every price level, best first
+// the level changes of the l2 channel with a greater Sequence come after it
+type L2BookResponse struct {
+	Sequence int64
+	Bids     []LimitResponse
+	Asks     []LimitResponse
+}
+
+// every order, best price first then time priority, without their users
+// the order events of the l3 channel with a greater Sequence come after it
+type L3BookResponse struct {
+	Sequence int64
+	Bids     []L3OrderResponse
+	Asks     []L3OrderResponse
+}
+
+type L3OrderResponse struct {
+	OrderId   int64
+	Price     entities.Decimal
+	Size      entities.Decimal
+	Timestamp int64
+}
+
+type BalanceResponse struct {
+	Available entities.Decimal
+	Locked    entities.Decimal
+	Total     entities.Decimal
 }
 
 type UserResponse struct {
 	// TODO: e.g event: orderExecuted
-	Event      string
-	UserId     string
-	Balance    map[string]float64
-	OpenOrders []OrderResponse
+	Event               string
+	UserId              string
+	Balance             map[string]BalanceResponse
+	OpenOrders          []OrderResponse
+	SelfTradePrevention entities.SelfTradePrevention
+	// only with the selfTradePrevented event
+	SelfTradeCancels []SelfTradeCancelResponse `json:",omitempty"`
+	// only with the orderExecuted event
+	Fill *FillResponse `json:",omitempty"`
+}
+
+// event sent on /ws/userInfo when self-trade prevention cancelled orders of the user
+const selfTradePreventedEvent = "selfTradePrevented"
+
+// event sent on /ws/userInfo to both sides of a trade
+const orderExecutedEvent = "orderExecuted"
+
+// a trade seen by one of its sides
+type FillResponse struct {
+	Trade   TradeResponse
+	Ticker  string
+	OrderId int64
+	IsBid   bool
+	IsMaker bool
+	// what the user paid, already taken from what it received
+	Fee      entities.Decimal
+	FeeAsset string
+}
+
+// newest first
+type TradeHistoryResponse struct {
+	Trades []TradeResponse
+	// the cursor of the next page, none if this one is the last
+	NextCursor int64 `json:",omitempty"`
+}
+
+// newest first
+type FillHistoryResponse struct {
+	Fills      []FillResponse
+	NextCursor int64 `json:",omitempty"`
+}
+
+type CandleResponse struct {
+	Ticker   string
+	Interval entities.CandleInterval
+	// unix nano, from included to excluded
+	OpenTime  int64
+	CloseTime int64
+	Open      entities.Decimal
+	High      entities.Decimal
+	Low       entities.Decimal
+	Close     entities.Decimal
+	// in the base asset
+	Volume entities.Decimal
+	// in the quote asset
+	QuoteVolume entities.Decimal
+	Trades      int64
+}
+
+// oldest first
+type CandlesResponse struct {
+	Candles []CandleResponse
+}
+
+type SelfTradeCancelResponse struct {
+	// the order as it was just before
+	Order OrderResponse
+	// how much of it was cancelled
+	Size entities.Decimal
+	// false if it was the incoming order
+	IsResting bool
 }
 
 // fields need to be visible to outer packages since this struct will be used by package json
@@ -55,20 +160,55 @@ type PlaceOrderRequest struct {
 	UserId    string
 	OrderType entities.OrderType // limit or ticker
 	IsBid     bool
-	Size      float64
-	Price     float64
+	Size      entities.Decimal // "1.5" or 1.5, both are parsed exactly
+	Price     entities.Decimal
 	Ticker    string
+	// limit orders only, GTC if empty
+	TimeInForce entities.TimeInForce
+	// unix nano, required for GTD
+	ExpiresAt int64
+	// limit orders only, rejected with POST_ONLY_WOULD_CROSS if it would take liquidity
+	PostOnly bool
+	// with PostOnly, move the price one tick away from the other side instead of rejecting
+	PostOnlyReprice bool
+	// STOP_MARKET/STOP_LIMIT only, the order is triggered when the last traded price reaches it
+	StopPrice entities.Decimal
+	// what happens if the order would match an order of the same user, the default of the user if empty
+	SelfTradePrevention entities.SelfTradePrevention
+}
+
+type SetSelfTradePreventionRequest struct {
+	SelfTradePrevention entities.SelfTradePrevention
+}
+
+type DepositRequest struct {
+	Asset  string
+	Amount entities.Decimal
+}
+
+// what is omitted (or zero) is not changed
+type AmendOrderRequest struct {
+	// the owner of the order
+	UserId string
+	Size   entities.Decimal
+	Price  entities.Decimal
 }
 
 type WebServiceHandler struct {
 	Ex         *usecases.Exchange
 	wsConnPool map[string]*websocket.Conn
+	// the user channels of /ws
+	userStreams *userStreams
+	// how often /ws sends a heartbeat
+	HeartbeatInterval time.Duration
 }
 
 func NewWebServiceHandler(ex *usecases.Exchange) *WebServiceHandler {
 	handler := WebServiceHandler{}
 	handler.Ex = ex
 	handler.wsConnPool = make(map[string]*websocket.Conn, 0)
+	handler.userStreams = newUserStreams()
+	handler.HeartbeatInterval = 15 * time.Second
 	return &handler
 }
 
@@ -86,57 +226,310 @@ func (handler WebServiceHandler) HandlePlaceOrder(c echo.Context) error {
 		placeOrderData.Size,
 		placeOrderData.Price,
 	)
+	if placeOrderData.TimeInForce != "" {
+		incomingOrder.SetTimeInForce(placeOrderData.TimeInForce, placeOrderData.ExpiresAt)
+	}
+	incomingOrder.SetPostOnly(placeOrderData.PostOnly, placeOrderData.PostOnlyReprice)
+	incomingOrder.SetStopPrice(placeOrderData.StopPrice)
+	incomingOrder.SetSelfTradePrevention(placeOrderData.SelfTradePrevention)
+
+	if _, err := handler.Ex.GetInstrument(placeOrderData.Ticker); err != nil {
+		logrus.Info(err.Error())
+		return c.JSON(http.StatusNotFound, map[string]interface{}{"msg": err.Error()})
+	}
 
 	// TODO: check if userid exist
-	_, ok := handler.Ex.GetUsersMap()[placeOrderData.UserId]
+	_, ok := handler.Ex.GetUser(placeOrderData.UserId)
 	if !ok {
 		msg := fmt.Sprintf("userId %s does not exist", placeOrderData.UserId)
 		logrus.Info(msg)
 		return c.JSON(400, map[string]interface{}{"msg": msg})
 	}
 
-	if placeOrderData.OrderType == entities.MarketOrderType {
-		trades := handler.Ex.PlaceMarketOrder(*incomingOrder)
-		tradesDataArray := make([]TradeResponse, 0)
-		for _, trade := range trades {
-			tradeData := &TradeResponse{
-				Timestamp:    trade.GetTimeStamp(),
-				Price:        trade.GetPrice(),
-				Size:         trade.GetSize(),
-				IsBuyerMaker: trade.GetIsBuyerMaker(),
-			}
-			tradesDataArray = append(tradesDataArray, *tradeData)
-
-			buyer := handler.Ex.GetUsersMap()[trade.GetBuyer().GetUserId()]
-			seller := handler.Ex.GetUsersMap()[trade.GetSeller().GetUserId()]
-			handler.Notify(&buyer)
-			handler.Notify(&seller)
+	switch placeOrderData.OrderType {
+	case entities.MarketOrderType:
+		trades, err := handler.Ex.PlaceMarketOrder(incomingOrder)
+		if err != nil {
+			return orderErrorResponse(c, err)
 		}
-		return c.JSON(200, map[string]interface{}{"matches": tradesDataArray})
-	} else {
-		handler.Ex.PlaceLimitOrderAndPersist(*incomingOrder)
-		user := handler.Ex.GetUsersMap()[incomingOrder.GetUserId()]
+		handler.notifyCounterparties(trades)
+		return c.JSON(200, map[string]interface{}{"matches": toTradeResponses(trades)})
+	case entities.StopMarketOrderType, entities.StopLimitOrderType:
+		if err := handler.Ex.PlaceStopOrder(incomingOrder); err != nil {
+			return orderErrorResponse(c, err)
+		}
+		user, _ := handler.Ex.GetUser(incomingOrder.GetUserId())
+		handler.Notify(&user)
+		return c.JSON(200, map[string]interface{}{
+			"msg":   "stop order placed",
+			"order": toOrderResponse(*incomingOrder),
+		})
+	case entities.LimitOrderType:
+		trades, err := handler.Ex.PlaceLimitOrderAndPersist(incomingOrder)
+		if err != nil {
+			return orderErrorResponse(c, err)
+		}
+		handler.notifyCounterparties(trades)
+		user, _ := handler.Ex.GetUser(incomingOrder.GetUserId())
 		handler.Notify(&user)
 		return c.JSON(200, map[string]interface{}{
-			"msg": "limit order placed",
-			"order": OrderResponse{
-				ID:        int(incomingOrder.GetId()),
-				UserId:    incomingOrder.GetUserId(),
-				IsBid:     incomingOrder.GetIsBid(),
-				Size:      incomingOrder.Size,
-				Price:     incomingOrder.GetLimitPrice(),
-				Timestamp: incomingOrder.GetTimeStamp(),
-			},
+			"msg":     "limit order placed",
+			"status":  limitOrderStatus(user, *incomingOrder, trades),
+			"order":   toOrderResponse(*incomingOrder),
+			"matches": toTradeResponses(trades),
+		})
+	default:
+		msg := fmt.Sprintf("unknown order type %s", placeOrderData.OrderType)
+		logrus.Info(msg)
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{"msg": msg})
+	}
+}
+
+func toOrderResponse(order entities.Order) OrderResponse {
+	response := OrderResponse{
+		ID:        int(order.GetId()),
+		UserId:    order.GetUserId(),
+		IsBid:     order.GetIsBid(),
+		Size:      order.GetSize(),
+		Price:     order.GetLimitPrice(),
+		Timestamp: order.GetTimeStamp(),
+		OrderType: order.GetOrderType(),
+	}
+	if order.GetOrderType().IsStop() {
+		stopPrice := order.GetStopPrice()
+		response.StopPrice = &stopPrice
+	}
+	return response
+}
+
+// OPEN: (what is left of) the order rests in the book
+// FILLED: fully matched
+// CANCELLED: IOC/FOK or self-trade prevention, what was not matched has been cancelled
+func limitOrderStatus(user entities.User, order entities.Order, trades []entities.Trade) string {
+	if _, ok := user.OpenOrders[order.GetId()]; ok {
+		return "OPEN"
+	}
+	filled := entities.ZeroDecimal
+	for _, trade := range trades {
+		filled = filled.Add(trade.GetSize())
+	}
+	if filled.Cmp(order.GetSize()) == 0 {
+		return "FILLED"
+	}
+	return "CANCELLED"
+}
+
+// rejected orders are the client's fault, anything else is ours
+func orderErrorResponse(c echo.Context, err error) error {
+	var rejectedErr *usecases.OrderRejectedError
+	var unknownTickerErr *usecases.UnknownTickerError
+	if errors.As(err, &unknownTickerErr) {
+		logrus.Info(unknownTickerErr.Error())
+		return c.JSON(http.StatusNotFound, map[string]interface{}{
+			"msg": unknownTickerErr.Error(),
+		})
+	}
+	if errors.As(err, &rejectedErr) {
+		logrus.Info(rejectedErr.Error())
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"msg":    rejectedErr.Error(),
+			"reason": rejectedErr.Reason,
+		})
+	}
+	logrus.Error(err)
+	return c.JSON(http.StatusInternalServerError, map[string]interface{}{
+		"msg": err.Error(),
+	})
+}
+
+func toTradeResponses(trades []entities.Trade) []TradeResponse {
+	tradesDataArray := make([]TradeResponse, 0)
+	for _, trade := range trades {
+		tradeData := &TradeResponse{
+			ID:           trade.GetId(),
+			Timestamp:    trade.GetTimeStamp(),
+			Price:        trade.GetPrice(),
+			Size:         trade.GetSize(),
+			IsBuyerMaker: trade.GetIsBuyerMaker(),
+			BuyerFee:     trade.GetBuyerFee(),
+			SellerFee:    trade.GetSellerFee(),
+		}
+		tradesDataArray = append(tradesDataArray, *tradeData)
+	}
+	return tradesDataArray
+}
+
+// the side of the trade the buyer or the seller was on
+func (handler WebServiceHandler) toFillResponse(trade entities.Trade, isBid bool) FillResponse {
+	instrument, _ := handler.Ex.GetInstrument(trade.GetTicker())
+	fill := FillResponse{
+		Trade:  toTradeResponses([]entities.Trade{trade})[0],
+		Ticker: trade.GetTicker(),
+		IsBid:  isBid,
+	}
+	if isBid {
+		fill.OrderId = trade.GetBuyerOrderId()
+		fill.IsMaker = trade.GetIsBuyerMaker()
+		fill.Fee = trade.GetBuyerFee()
+		fill.FeeAsset = instrument.BaseAsset
+	} else {
+		fill.OrderId = trade.GetSellerOrderId()
+		fill.IsMaker = !trade.GetIsBuyerMaker()
+		fill.Fee = trade.GetSellerFee()
+		fill.FeeAsset = instrument.QuoteAsset
+	}
+	return fill
+}
+
+// send each side of each trade its balance and the fill, with the fee it paid
+func (handler WebServiceHandler) notifyCounterparties(trades []entities.Trade) {
+	for _, trade := range trades {
+		buyer, _ := handler.Ex.GetUser(trade.GetBuyerUserId())
+		buyerResponse := toUserResponse(buyer)
+		buyerResponse.Event = orderExecutedEvent
+		buyerFill := handler.toFillResponse(trade, true)
+		buyerResponse.Fill = &buyerFill
+		handler.send(buyer.GetUserId(), buyerResponse)
+
+		seller, _ := handler.Ex.GetUser(trade.GetSellerUserId())
+		sellerResponse := toUserResponse(seller)
+		sellerResponse.Event = orderExecutedEvent
+		sellerFill := handler.toFillResponse(trade, false)
+		sellerResponse.Fill = &sellerFill
+		handler.send(seller.GetUserId(), sellerResponse)
+	}
+}
+
+// from and to in unix nano, cursor the NextCursor of the page before, limit 100 if omitted and at most 1000
+func tradeHistoryQuery(c echo.Context) (usecases.TradeHistoryQuery, error) {
+	var query usecases.TradeHistoryQuery
+	params := []struct {
+		name  string
+		value *int64
+	}{
+		{"from", &query.From},
+		{"to", &query.To},
+		{"cursor", &query.Before},
+	}
+	for _, param := range params {
+		str := c.QueryParam(param.name)
+		if str == "" {
+			continue
+		}
+		value, err := strconv.ParseInt(str, 10, 64)
+		if err != nil || value < 0 {
+			return query, fmt.Errorf("%s must be a positive integer", param.name)
+		}
+		*param.value = value
+	}
+	if str := c.QueryParam("limit"); str != "" {
+		limit, err := strconv.Atoi(str)
+		if err != nil || limit <= 0 {
+			return query, errors.New("limit must be a positive integer")
+		}
+		query.Limit = limit
+	}
+	return query, nil
+}
+
+func (handler WebServiceHandler) HandleGetTradeHistory(c echo.Context) error {
+	query, err := tradeHistoryQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"msg": err.Error(),
+		})
+	}
+	trades, nextCursor := handler.Ex.GetTradeHistory(c.Param("ticker"), query)
+	return c.JSON(http.StatusOK, TradeHistoryResponse{
+		Trades:     toTradeResponses(trades),
+		NextCursor: nextCursor,
+	})
+}
+
+// from, to and limit like the trade history, 1m if the interval is omitted
+func candleQuery(c echo.Context) (entities.CandleInterval, usecases.CandleQuery, error) {
+	interval := entities.OneMinute
+	if str := c.QueryParam("interval"); str != "" {
+		parsed, err := entities.ParseCandleInterval(str)
+		if err != nil {
+			return interval, usecases.CandleQuery{}, err
+		}
+		interval = parsed
+	}
+	query, err := tradeHistoryQuery(c)
+	if err != nil {
+		return interval, usecases.CandleQuery{}, err
+	}
+	return interval, usecases.CandleQuery{From: query.From, To: query.To, Limit: query.Limit}, nil
+}
+
+func (handler WebServiceHandler) HandleGetCandles(c echo.Context) error {
+	interval, query, err := candleQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"msg": err.Error(),
 		})
 	}
+	candles := handler.Ex.GetCandles(c.Param("ticker"), interval, query)
+	responsesArr := make([]CandleResponse, 0, len(candles))
+	for _, candle := range candles {
+		responsesArr = append(responsesArr, toCandleResponse(candle))
+	}
+	return c.JSON(http.StatusOK, CandlesResponse{Candles: responsesArr})
+}
+
+func toCandleResponse(candle entities.Candle) CandleResponse {
+	return CandleResponse{
+		Ticker:      candle.Ticker,
+		Interval:    candle.Interval,
+		OpenTime:    candle.OpenTime,
+		CloseTime:   candle.CloseTime(),
+		Open:        candle.Open,
+		High:        candle.High,
+		Low:         candle.Low,
+		Close:       candle.Close,
+		Volume:      candle.Volume,
+		QuoteVolume: candle.QuoteVolume,
+		Trades:      candle.Trades,
+	}
+}
+
+func (handler WebServiceHandler) HandleGetUserTrades(c echo.Context) error {
+	userId := c.Param("userId")
+	if _, ok := handler.Ex.GetUser(userId); !ok {
+		return c.JSON(http.StatusNotFound, map[string]interface{}{
+			"msg": fmt.Sprintf("UserId %s does not exist", userId),
+		})
+	}
+	query, err := tradeHistoryQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"msg": err.Error(),
+		})
+	}
+	trades, nextCursor := handler.Ex.GetUserTrades(userId, query)
+	fills := make([]FillResponse, 0, len(trades))
+	for _, trade := range trades {
+		// both sides of a self-trade
+		if trade.GetBuyerUserId() == userId {
+			fills = append(fills, handler.toFillResponse(trade, true))
+		}
+		if trade.GetSellerUserId() == userId {
+			fills = append(fills, handler.toFillResponse(trade, false))
+		}
+	}
+	return c.JSON(http.StatusOK, FillHistoryResponse{
+		Fills:      fills,
+		NextCursor: nextCursor,
+	})
 }
 
 func (handler WebServiceHandler) HandleGetBook(c echo.Context) error {
 	// TODO: should not need to convert to usescase.TIcker
 	ticker := usecases.Ticker(c.Param("ticker"))
 	orderBookData := OrderBookResponse{
-		TotalAsksVolume: 0.0,
-		TotalBidsVolume: 0.0,
+		TotalAsksVolume: entities.ZeroDecimal,
+		TotalBidsVolume: entities.ZeroDecimal,
 		Asks:            make([]*OrderResponse, 0),
 		Bids:            make([]*OrderResponse, 0),
 	}
@@ -145,27 +538,19 @@ func (handler WebServiceHandler) HandleGetBook(c echo.Context) error {
 	for _, limit := range buybook {
 		ordersList := limit.GetAllOrders()
 		for _, order := range ordersList {
-			orderData := &OrderResponse{
-				ID:        int(order.GetId()),
-				IsBid:     order.GetIsBid(),
-				Size:      order.GetSize(),
-				Price:     order.GetLimitPrice(),
-				Timestamp: order.GetTimeStamp(),
-			}
-			orderBookData.Bids = append(orderBookData.Bids, orderData)
+			orderData := toOrderResponse(order)
+			// other users are anonymous in the book
+			orderData.UserId = ""
+			orderBookData.Bids = append(orderBookData.Bids, &orderData)
 		}
 	}
 	for _, limit := range sellbook {
 		ordersList := limit.GetAllOrders()
 		for _, order := range ordersList {
-			orderData := &OrderResponse{
-				ID:        int(order.GetId()),
-				IsBid:     order.GetIsBid(),
-				Size:      order.GetSize(),
-				Price:     order.GetLimitPrice(),
-				Timestamp: order.GetTimeStamp(),
-			}
-			orderBookData.Asks = append(orderBookData.Asks, orderData)
+			orderData := toOrderResponse(order)
+			// other users are anonymous in the book
+			orderData.UserId = ""
+			orderBookData.Asks = append(orderBookData.Asks, &orderData)
 		}
 	}
 	orderBookData.TotalAsksVolume = sVolume
@@ -174,6 +559,55 @@ func (handler WebServiceHandler) HandleGetBook(c echo.Context) error {
 	return c.JSON(200, orderBookData)
 }
 
+func (handler WebServiceHandler) HandleGetL2Book(c echo.Context) error {
+	book, err := handler.Ex.GetL2Book(c.Param("ticker"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]interface{}{
+			"msg": err.Error(),
+		})
+	}
+	return c.JSON(http.StatusOK, toL2BookResponse(book))
+}
+
+func toL2BookResponse(book usecases.L2Book) L2BookResponse {
+	return L2BookResponse{
+		Sequence: book.Sequence,
+		Bids:     toLimitResponses(book.Bids),
+		Asks:     toLimitResponses(book.Asks),
+	}
+}
+
+func (handler WebServiceHandler) HandleGetL3Book(c echo.Context) error {
+	book, err := handler.Ex.GetL3Book(c.Param("ticker"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]interface{}{
+			"msg": err.Error(),
+		})
+	}
+	return c.JSON(http.StatusOK, toL3BookResponse(book))
+}
+
+func toL3BookResponse(book usecases.L3Book) L3BookResponse {
+	return L3BookResponse{
+		Sequence: book.Sequence,
+		Bids:     toL3OrderResponses(book.Bids),
+		Asks:     toL3OrderResponses(book.Asks),
+	}
+}
+
+func toL3OrderResponses(orders []usecases.L3Order) []L3OrderResponse {
+	responsesArr := make([]L3OrderResponse, 0, len(orders))
+	for _, order := range orders {
+		responsesArr = append(responsesArr, L3OrderResponse{
+			OrderId:   order.OrderId,
+			Price:     order.Price,
+			Size:      order.Size,
+			Timestamp: order.Timestamp,
+		})
+	}
+	return responsesArr
+}
+
 func (handler WebServiceHandler) HandleGetCurrentPrice(c echo.Context) error {
 	ticker := c.Param("ticker")
 	lastTrades := handler.Ex.GetLastTrades(ticker, 1)
@@ -214,112 +648,230 @@ func (handler WebServiceHandler) HandleCancelOrder(c echo.Context) error {
 	}
 	ticker := c.Param("ticker")
 	user := handler.Ex.CancelOrder(int64(orderId), ticker)
+	if user == nil {
+		return c.JSON(404, map[string]interface{}{
+			"msg": fmt.Sprintf("order %d does not exist", orderId),
+		})
+	}
 	handler.Notify(user)
 	return c.JSON(200, map[string]interface{}{
 		"msg": "order cancelled",
 	})
 }
 
-// this function is called everytime a client connect to the websocket
-func (handler WebServiceHandler) WebSocketHandlerCurrentPrice(ws *websocket.Conn) {
-	// TODO: let client choose ticker
-	ticker := "ETHUSD"
-	lastCurrentPrice := 0.0
-	currentPrice := lastCurrentPrice
-
-	for {
-		// NOTE: reading the last value of the slice orderbook.lastTrades introduce race condition.
-		// because i might be reading an   entry that has just been allocated by the other goroutine for orderprocessing and the it has yet to be filled
-		// TODO: use channel
-		currentPrice = handler.Ex.GetLastPrice(ticker)
-		if currentPrice != lastCurrentPrice {
-			lastCurrentPrice = currentPrice
-			msg := fmt.Sprint(currentPrice)
-
-			if err := websocket.Message.Send(ws, msg); err != nil {
-				fmt.Println("Can't send:", err)
-				break
-			} else {
-				logrus.WithFields(logrus.Fields{
-					"msg": msg,
-				}).Info("Sent to client")
-			}
+func (handler WebServiceHandler) HandleAmendOrder(c echo.Context) error {
+	orderId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(400, map[string]interface{}{
+			"msg": "id not numeric",
+		})
+	}
+	var amendOrderData AmendOrderRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&amendOrderData); err != nil {
+		return c.JSON(400, map[string]interface{}{
+			"msg": err.Error(),
+		})
+	}
+	ticker := c.Param("ticker")
+	order, trades, err := handler.Ex.AmendOrder(int64(orderId), ticker, amendOrderData.UserId, amendOrderData.Size, amendOrderData.Price)
+	if err != nil {
+		var notFoundErr *usecases.OrderNotFoundError
+		if errors.As(err, &notFoundErr) {
+			return c.JSON(404, map[string]interface{}{
+				"msg": notFoundErr.Error(),
+			})
+		}
+		var notOwnedErr *usecases.OrderNotOwnedError
+		if errors.As(err, &notOwnedErr) {
+			return c.JSON(403, map[string]interface{}{
+				"msg": notOwnedErr.Error(),
+			})
 		}
+		return orderErrorResponse(c, err)
 	}
+	handler.notifyCounterparties(trades)
+	user, _ := handler.Ex.GetUser(order.GetUserId())
+	handler.Notify(&user)
+	return c.JSON(200, map[string]interface{}{
+		"msg":     "order amended",
+		"status":  limitOrderStatus(user, order, trades),
+		"order":   toOrderResponse(order),
+		"matches": toTradeResponses(trades),
+	})
 }
 
-func (handler WebServiceHandler) WebSocketHandlerLastTrade(ws *websocket.Conn) {
-	ticker := "ETHUSD"
+func (handler WebServiceHandler) HandleGetInstruments(c echo.Context) error {
+	return c.JSON(http.StatusOK, handler.Ex.GetInstruments())
+}
 
-	for {
-		arr := handler.Ex.GetLastTrades(ticker, 15)
-		responsesArr := make([]TradeResponse, 0)
-		for _, trade := range arr {
-			response := TradeResponse{
-				Price:        trade.GetPrice(),
-				Size:         trade.GetSize(),
-				IsBuyerMaker: trade.GetIsBuyerMaker(),
-				Timestamp:    trade.GetTimeStamp(),
-			}
-			responsesArr = append(responsesArr, response)
+// 404 for the routes about a ticker that is not traded on the exchange
+func (handler WebServiceHandler) RequireKnownTicker(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ticker := c.Param("ticker")
+		if ticker == "" {
+			ticker = tickerFromRequest(c.Request())
 		}
-
-		arrayJSON, _ := json.Marshal(responsesArr)
-
-		if err := websocket.Message.Send(ws, string(arrayJSON)); err != nil {
-			fmt.Println("Can't send:", err)
-			break
+		if _, err := handler.Ex.GetInstrument(ticker); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]interface{}{
+				"msg": err.Error(),
+			})
 		}
-		time.Sleep(500 * time.Millisecond)
+		return next(c)
 	}
 }
 
-func (handler WebServiceHandler) WebSocketHandlerBestBuys(ws *websocket.Conn) {
-	ticker := "ETHUSD"
+// websockets take the ticker as a query parameter .e.g. /ws/lastTrades?ticker=BTCUSDT
+func tickerFromRequest(req *http.Request) string {
+	ticker := req.URL.Query().Get("ticker")
+	if ticker == "" {
+		return string(usecases.ETHUSD)
+	}
+	return ticker
+}
 
-	for {
-		arr := handler.Ex.GetBestBuys(ticker, 15)
-		responsesArr := make([]LimitResponse, 0)
-		for _, limit := range arr {
-			response := LimitResponse{
-				Price:  limit.GetLimitPrice(),
-				Volume: limit.GetTotalVolume(),
-			}
-			responsesArr = append(responsesArr, response)
+// plugged in usecases.Exchange.OnStopOrderTriggered
+func (handler *WebServiceHandler) HandleStopOrderTriggered(triggered usecases.StopOrderTriggered) {
+	user, _ := handler.Ex.GetUser(triggered.Order.GetUserId())
+	handler.Notify(&user)
+	handler.notifyCounterparties(triggered.Trades)
+}
+
+// plugged in usecases.Exchange.OnSelfTradePrevented
+func (handler *WebServiceHandler) HandleSelfTradePrevented(selfTradePrevented usecases.SelfTradePrevented) {
+	user, _ := handler.Ex.GetUser(selfTradePrevented.UserId)
+	userResponse := toUserResponse(user)
+	userResponse.Event = selfTradePreventedEvent
+	for _, selfTradeCancel := range selfTradePrevented.Cancels {
+		userResponse.SelfTradeCancels = append(userResponse.SelfTradeCancels, SelfTradeCancelResponse{
+			Order:     toOrderResponse(selfTradeCancel.Order),
+			Size:      selfTradeCancel.Size,
+			IsResting: selfTradeCancel.IsResting,
+		})
+	}
+	handler.send(user.GetUserId(), userResponse)
+}
+
+// expire the GTD orders and tell their owners, blocks forever
+func (handler *WebServiceHandler) ExpireOrdersEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		for _, user := range handler.Ex.ExpireOrders(now.UnixNano()) {
+			handler.Notify(&user)
 		}
+	}
+}
+
+// number of market data events a websocket can be behind before it is disconnected
+const marketDataBuffer = 64
 
-		arrayJSON, _ := json.Marshal(responsesArr)
+// number of trades and price levels of the /ws/* websockets
+const legacyDepth = 15
 
-		if err := websocket.Message.Send(ws, string(arrayJSON)); err != nil {
-			fmt.Println("Can't send:", err)
-			break
+// send what onEvent makes of each market data event of the ticker, nothing when it returns ""
+// the websocket is closed when it is too slow to keep up with the market, matching does not wait for it
+func (handler WebServiceHandler) streamMarketData(ws *websocket.Conn, onEvent func(usecases.MarketDataEvent) string) {
+	ticker := tickerFromRequest(ws.Request())
+	sub, err := handler.Ex.SubscribeMarketData(ticker, marketDataBuffer)
+	if err != nil {
+		logrus.Info(err.Error())
+		return
+	}
+	defer sub.Close()
+
+	lastMsg := ""
+	for event := range sub.Events() {
+		// the part of the market the websocket shows might not have changed
+		msg := onEvent(event)
+		if msg == "" || msg == lastMsg {
+			continue
 		}
-		time.Sleep(500 * time.Millisecond)
+		lastMsg = msg
+		if err := websocket.Message.Send(ws, msg); err != nil {
+			// most likely the client is gone
+			logrus.Debugf("Websocket %s of %s closed, can't send: %s", ws.Request().URL.Path, ticker, err)
+			return
+		}
+	}
+	if sub.Dropped() {
+		logrus.Warnf("Websocket %s of %s too slow, disconnected", ws.Request().URL.Path, ticker)
 	}
 }
 
-func (handler WebServiceHandler) WebSocketHandlerBestSells(ws *websocket.Conn) {
-	ticker := "ETHUSD"
+// this function is called everytime a client connect to the websocket
+func (handler WebServiceHandler) WebSocketHandlerCurrentPrice(ws *websocket.Conn) {
+	lastCurrentPrice := entities.ZeroDecimal
+	handler.streamMarketData(ws, func(event usecases.MarketDataEvent) string {
+		if len(event.Trades) == 0 {
+			return ""
+		}
+		currentPrice := event.Trades[len(event.Trades)-1].GetPrice()
+		if currentPrice == lastCurrentPrice {
+			return ""
+		}
+		lastCurrentPrice = currentPrice
+		return currentPrice.String()
+	})
+}
 
-	for {
-		arr := handler.Ex.GetBestSells(ticker, 15)
-		responsesArr := make([]LimitResponse, 0)
-		for _, limit := range arr {
-			response := LimitResponse{
-				Price:  limit.GetLimitPrice(),
-				Volume: limit.GetTotalVolume(),
-			}
-			responsesArr = append(responsesArr, response)
+// the last 15 trades, oldest first, on connection then every time there are new ones
+func (handler WebServiceHandler) WebSocketHandlerLastTrade(ws *websocket.Conn) {
+	lastTrades := make([]entities.Trade, 0, legacyDepth)
+	first := true
+	handler.streamMarketData(ws, func(event usecases.MarketDataEvent) string {
+		// the first one is sent even without trades yet
+		if len(event.Trades) == 0 && !first {
+			return ""
 		}
+		first = false
+		lastTrades = append(lastTrades, event.Trades...)
+		if len(lastTrades) > legacyDepth {
+			lastTrades = lastTrades[len(lastTrades)-legacyDepth:]
+		}
+		arrayJSON, _ := json.Marshal(toTradeResponses(lastTrades))
+		return string(arrayJSON)
+	})
+}
 
-		arrayJSON, _ := json.Marshal(responsesArr)
+func (handler WebServiceHandler) WebSocketHandlerBestBuys(ws *websocket.Conn) {
+	handler.streamMarketData(ws, func(event usecases.MarketDataEvent) string {
+		if !event.BuysChanged {
+			return ""
+		}
+		return toLimitResponsesJSON(topPriceLevels(event.BestBuys, legacyDepth))
+	})
+}
 
-		if err := websocket.Message.Send(ws, string(arrayJSON)); err != nil {
-			fmt.Println("Can't send:", err)
-			break
+func (handler WebServiceHandler) WebSocketHandlerBestSells(ws *websocket.Conn) {
+	handler.streamMarketData(ws, func(event usecases.MarketDataEvent) string {
+		if !event.SellsChanged {
+			return ""
 		}
-		time.Sleep(500 * time.Millisecond)
+		return toLimitResponsesJSON(topPriceLevels(event.BestSells, legacyDepth))
+	})
+}
+
+func toLimitResponses(levels []usecases.PriceLevel) []LimitResponse {
+	responsesArr := make([]LimitResponse, 0)
+	for _, level := range levels {
+		responsesArr = append(responsesArr, LimitResponse{
+			Price:  level.Price,
+			Volume: level.Volume,
+		})
 	}
+	return responsesArr
+}
+
+func toLimitResponsesJSON(levels []usecases.PriceLevel) string {
+	arrayJSON, _ := json.Marshal(toLimitResponses(levels))
+	return string(arrayJSON)
+}
+
+func topPriceLevels(levels []usecases.PriceLevel, depth int) []usecases.PriceLevel {
+	if len(levels) > depth {
+		return levels[:depth]
+	}
+	return levels
 }
 
 // TODO:
@@ -329,45 +881,70 @@ func (handler WebServiceHandler) registerUser(c echo.Context) {
 // TODO: dont return all details about users ?
 // or maybe check the right of the requester
 func (handler WebServiceHandler) HandleGetUsers(c echo.Context) error {
-	return c.JSON(200, handler.Ex.GetUsersMap())
+	usersResponse := make(map[string]UserResponse, 0)
+	for userId, user := range handler.Ex.GetUsersMap() {
+		usersResponse[userId] = *toUserResponse(user)
+	}
+	return c.JSON(200, usersResponse)
+}
+
+// the default self-trade prevention of the orders of the user
+func (handler WebServiceHandler) HandleSetSelfTradePrevention(c echo.Context) error {
+	userId := c.Param("userId")
+	if _, ok := handler.Ex.GetUser(userId); !ok {
+		return c.JSON(404, map[string]interface{}{
+			"msg": fmt.Sprintf("userId %s does not exist", userId),
+		})
+	}
+	var setSelfTradePreventionData SetSelfTradePreventionRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&setSelfTradePreventionData); err != nil {
+		return c.JSON(400, map[string]interface{}{
+			"msg": err.Error(),
+		})
+	}
+	if err := handler.Ex.SetSelfTradePrevention(userId, setSelfTradePreventionData.SelfTradePrevention); err != nil {
+		return orderErrorResponse(c, err)
+	}
+	user, _ := handler.Ex.GetUser(userId)
+	handler.Notify(&user)
+	return c.JSON(200, toUserResponse(user))
+}
+
+func (handler WebServiceHandler) HandleDeposit(c echo.Context) error {
+	userId := c.Param("userId")
+	var depositData DepositRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&depositData); err != nil {
+		return c.JSON(400, map[string]interface{}{
+			"msg": err.Error(),
+		})
+	}
+	if err := handler.Ex.Deposit(userId, depositData.Asset, depositData.Amount); err != nil {
+		return orderErrorResponse(c, err)
+	}
+	user, _ := handler.Ex.GetUser(userId)
+	handler.Notify(&user)
+	return c.JSON(200, toUserResponse(user))
 }
 
 // TODO: dont return all details about users ?
 func (handler WebServiceHandler) HandleGetUser(c echo.Context) error {
 	userId := c.Param("userId")
-	user, ok := handler.Ex.GetUsersMap()[userId]
+	user, ok := handler.Ex.GetUser(userId)
 	if !ok {
 		return c.JSON(404, fmt.Sprintf("UserId %s does not exist", userId))
 	}
-	return c.JSON(200, user)
+	return c.JSON(200, toUserResponse(user))
 }
 
 func (handler *WebServiceHandler) WebSocketHandlerUserInfo(ws *websocket.Conn) {
 	userId := ws.Request().URL.Query().Get("userId")
 	handler.wsConnPool[userId] = ws
 
-	user, ok := handler.Ex.GetUsersMap()[userId]
+	user, ok := handler.Ex.GetUser(userId)
 	if !ok {
 		logrus.Debugf("userId %s does not exists", userId)
 	}
-	openOrders := handler.Ex.RetrieveOpenOrdersForUsers(user.GetUserId())
-	openOrderResponseArray := make([]OrderResponse, 0)
-	for _, order := range openOrders {
-		response := OrderResponse{
-			UserId:    order.GetUserId(),
-			Size:      order.GetSize(),
-			Price:     order.GetLimitPrice(),
-			Timestamp: order.GetTimeStamp(),
-			IsBid:     order.GetIsBid(),
-			ID:        int(order.GetId()),
-		}
-		openOrderResponseArray = append(openOrderResponseArray, response)
-	}
-	userResponse := &UserResponse{
-		UserId:     user.GetUserId(),
-		Balance:    user.Balance,
-		OpenOrders: openOrderResponseArray,
-	}
+	userResponse := toUserResponse(user)
 
 	jsonResponse, _ := json.Marshal(userResponse)
 
@@ -382,28 +959,16 @@ func (handler *WebServiceHandler) WebSocketHandlerUserInfo(ws *websocket.Conn) {
 }
 
 func (handler *WebServiceHandler) Notify(user *entities.User) {
-	wsConn, ok := handler.wsConnPool[user.GetUserId()]
+	handler.send(user.GetUserId(), toUserResponse(*user))
+}
+
+func (handler *WebServiceHandler) send(userId string, userResponse *UserResponse) {
+	handler.userStreams.publish(userId, userResponse)
+	wsConn, ok := handler.wsConnPool[userId]
 	if !ok {
 		// user is not connected.
 		return
 	}
-	openOrderResponseArray := make([]OrderResponse, 0)
-	for _, order := range user.OpenOrders {
-		response := OrderResponse{
-			UserId:    order.GetUserId(),
-			Size:      order.GetSize(),
-			Price:     order.GetLimitPrice(),
-			Timestamp: order.GetTimeStamp(),
-			IsBid:     order.GetIsBid(),
-			ID:        int(order.GetId()),
-		}
-		openOrderResponseArray = append(openOrderResponseArray, response)
-	}
-	userResponse := &UserResponse{
-		UserId:     user.GetUserId(),
-		Balance:    user.Balance,
-		OpenOrders: openOrderResponseArray,
-	}
 
 	jsonResponse, _ := json.Marshal(userResponse)
 
@@ -411,3 +976,24 @@ func (handler *WebServiceHandler) Notify(user *entities.User) {
 		logrus.Error("Can't send notif to user through websocket:", err)
 	}
 }
+
+func toUserResponse(user entities.User) *UserResponse {
+	openOrderResponseArray := make([]OrderResponse, 0)
+	for _, order := range user.OpenOrders {
+		openOrderResponseArray = append(openOrderResponseArray, toOrderResponse(order))
+	}
+	balanceResponse := make(map[string]BalanceResponse, 0)
+	for asset, balance := range user.Balance {
+		balanceResponse[asset] = BalanceResponse{
+			Available: balance.Available,
+			Locked:    balance.Locked,
+			Total:     balance.Total(),
+		}
+	}
+	return &UserResponse{
+		UserId:              user.GetUserId(),
+		Balance:             balanceResponse,
+		OpenOrders:          openOrderResponseArray,
+		SelfTradePrevention: user.GetSelfTradePrevention(),
+	}
+}
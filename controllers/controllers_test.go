@@ -2,23 +2,39 @@ package controllers_test
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/trandinhkhoa/crypto-exchange/controllers"
+	"github.com/trandinhkhoa/crypto-exchange/entities"
 	"github.com/trandinhkhoa/crypto-exchange/infrastructure"
 	"github.com/trandinhkhoa/crypto-exchange/usecases"
+	"golang.org/x/net/websocket"
 )
 
 var ex *usecases.Exchange
 
+// shorthand for the literals in the tests
+func dec(f float64) entities.Decimal {
+	return entities.NewDecimalFromFloat(f)
+}
+
 func deleteDb(filePath string) {
 	if _, err := os.Stat(filePath); err == nil {
 		err := os.Remove(filePath)
@@ -48,7 +64,16 @@ func setup() (string, controllers.SqlDbHandler) {
 	ex.OrdersRepo = ordersRepoImpl
 	usersRepoImpl := controllers.NewUsersRepoImpl(dbHandler)
 	ex.UsersRepo = usersRepoImpl
+	sequencesRepoImpl := controllers.NewSequencesRepoImpl(dbHandler)
+	ex.SequencesRepo = sequencesRepoImpl
+	ex.LastTradesRepo = controllers.NewLastTradesRepoImpl(dbHandler)
+	ex.FeesRepo = controllers.NewFeesRepoImpl(dbHandler)
+	ex.CandlesRepo = controllers.NewCandlesRepoImpl(dbHandler)
+	ex.TransactionManager = dbHandler
 	logrus.SetOutput(io.Discard)
+	if err := controllers.Migrate(dbHandler); err != nil {
+		panic(err)
+	}
 
 	return filePath, dbHandler
 }
@@ -90,16 +115,16 @@ func TestControllersHandlePlaceOrder(t *testing.T) {
 	c := e.NewContext(req, rec)
 
 	ex.RegisterUserWithBalance("jane",
-		map[string]float64{
-			"ETH": 2000.0,
-			"USD": 2000.0,
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(20000.0),
 		})
 
 	handler := controllers.NewWebServiceHandler(ex)
 	// TODO: return error if request body is not in correct format .e.g wrong json field name
 	if assert.NoError(t, handler.HandlePlaceOrder(c)) {
 		assert.Equal(t, http.StatusOK, rec.Code)
-		pattern := `^{"msg":"limit order placed","order":{"ID":\d+,"UserId":"jane","IsBid":true,"Size":1,"Price":10000,"Timestamp":\d+}}\n$`
+		pattern := `^{"matches":\[\],"msg":"limit order placed","order":{"ID":\d+,"UserId":"jane","IsBid":true,"Size":"1","Price":"10000","Timestamp":\d+,"OrderType":"LIMIT"},"status":"OPEN"}\n$`
 
 		re, err := regexp.Compile(pattern)
 		assert.NoError(t, err)
@@ -107,3 +132,832 @@ func TestControllersHandlePlaceOrder(t *testing.T) {
 		assert.True(t, re.MatchString(rec.Body.String()), "\nExpected: %s \nActual: %s", pattern, rec.Body.String())
 	}
 }
+
+func TestControllersHandlePlaceOrderRejected(t *testing.T) {
+	defer setupTest()()
+	e := echo.New()
+
+	orderBody := `{
+		"UserId" : "jane",
+		"OrderType": "LIMIT",
+		"IsBid": true,
+		"Size": 1,
+		"Price": 10000,
+		"Ticker": "ETHUSD"
+	}`
+
+	req := httptest.NewRequest(http.MethodPost, "/order", bytes.NewReader([]byte(orderBody)))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	ex.RegisterUserWithBalance("jane",
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
+		})
+
+	handler := controllers.NewWebServiceHandler(ex)
+	if assert.NoError(t, handler.HandlePlaceOrder(c)) {
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"reason":"INSUFFICIENT_BALANCE"`)
+	}
+}
+
+func TestControllersUnknownTicker(t *testing.T) {
+	defer setupTest()()
+	e := echo.New()
+	handler := controllers.NewWebServiceHandler(ex)
+	e.GET("/book/:ticker", handler.HandleGetBook, handler.RequireKnownTicker)
+	e.POST("/order", handler.HandlePlaceOrder)
+
+	ex.RegisterUserWithBalance("jane",
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
+		})
+
+	req := httptest.NewRequest(http.MethodGet, "/book/DOGEUSD", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/book/ETHUSD", nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	orderBody := `{
+		"UserId" : "jane",
+		"OrderType": "LIMIT",
+		"IsBid": true,
+		"Size": "1",
+		"Price": "1",
+		"Ticker": "DOGEUSD"
+	}`
+	req = httptest.NewRequest(http.MethodPost, "/order", bytes.NewReader([]byte(orderBody)))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	filePath := "./legacy.db"
+	deleteDb(filePath)
+	dbHandler := infrastructure.NewSqliteDbHandler(filePath)
+	defer teardown(filePath, dbHandler)
+	logrus.SetOutput(io.Discard)
+
+	// written by the first version: no version, float amounts, no ticker
+	for _, statement := range []string{
+		`CREATE TABLE users ("userid" TEXT PRIMARY KEY, "ETH" FLOAT, "USD" FLOAT)`,
+		`CREATE TABLE buyOrders ("id" INTEGER PRIMARY KEY, "userid" TEXT, "size" INTEGER, "price" INTEGER, "timestamp" INTEGER)`,
+		`CREATE TABLE sellOrders ("id" INTEGER PRIMARY KEY, "userid" TEXT, "size" INTEGER, "price" INTEGER, "timestamp" INTEGER)`,
+		`CREATE TABLE lastTrades ("id" INTEGER PRIMARY KEY AUTOINCREMENT, "price" FLOAT, "size" FLOAT, "isBuyerMaker" BOOLEAN, "timestamp" INTEGER)`,
+	} {
+		assert.NoError(t, dbHandler.Exec(statement))
+	}
+	assert.NoError(t, dbHandler.Exec(`INSERT INTO users VALUES (?,?,?)`, "john", 1.5, 1000.25))
+	assert.NoError(t, dbHandler.Exec(`INSERT INTO buyOrders VALUES (?,?,?,?,?)`, 7, "john", 0.5, 99.5, 42))
+	assert.NoError(t, dbHandler.Exec(`INSERT INTO lastTrades VALUES (?,?,?,?,?)`, 3, 100.1, 0.25, true, 41))
+
+	assert.NoError(t, controllers.Migrate(dbHandler))
+	// nothing left to do
+	assert.NoError(t, controllers.Migrate(dbHandler))
+	rows := dbHandler.Query(`SELECT version FROM schemaMigrations ORDER BY version`)
+	versions := make([]int, 0)
+	for rows.Next() {
+		var version int
+		assert.NoError(t, rows.Scan(&version))
+		versions = append(versions, version)
+	}
+	assert.NoError(t, rows.Err())
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6, 7, 8}, versions)
+
+	users := controllers.NewUsersRepoImpl(dbHandler).ReadAll()
+	if assert.Equal(t, 1, len(users)) {
+		assert.Equal(t, dec(1.5), users[0].GetAvailable("ETH"))
+		assert.Equal(t, dec(1000.25), users[0].GetAvailable("USD"))
+		assert.Equal(t, dec(0), users[0].GetLocked("USD"))
+		assert.Equal(t, entities.SelfTradeAllowed, users[0].GetSelfTradePrevention())
+	}
+	orders := controllers.NewOrdersRepoImpl(dbHandler).ReadAll("buy")
+	if assert.Equal(t, 1, len(orders)) {
+		assert.Equal(t, int64(7), orders[0].GetId())
+		assert.Equal(t, "ETHUSD", orders[0].GetTicker())
+		assert.Equal(t, dec(0.5), orders[0].GetSize())
+		assert.Equal(t, dec(99.5), orders[0].GetLimitPrice())
+		assert.Equal(t, entities.GoodTillCancelled, orders[0].GetTimeInForce())
+	}
+	trades := controllers.NewLastTradesRepoImpl(dbHandler).ReadAfter(0)
+	if assert.Equal(t, 1, len(trades)) {
+		assert.Equal(t, dec(100.1), trades[0].GetPrice())
+		assert.Equal(t, dec(0.25), trades[0].GetSize())
+		assert.Equal(t, dec(0), trades[0].GetBuyerFee())
+		// saved before the users of the trades were
+		assert.Equal(t, "", trades[0].GetBuyerUserId())
+	}
+	assert.Equal(t, 0, len(controllers.NewOrdersRepoImpl(dbHandler).ReadAll("stop")))
+	assert.Equal(t, int64(0), controllers.NewSequencesRepoImpl(dbHandler).Read("orders"))
+}
+
+func TestRepositoriesBindValues(t *testing.T) {
+	filePath, dbHandler := setup()
+	defer teardown(filePath, dbHandler)
+	usersRepo := controllers.NewUsersRepoImpl(dbHandler)
+	ordersRepo := controllers.NewOrdersRepoImpl(dbHandler)
+
+	// a quote in the user id is a value like any other
+	userId := `o'brien'); DROP TABLE users; --`
+	user := entities.NewUser(userId, map[string]entities.Balance{"USD": {Available: dec(10)}})
+	usersRepo.Create(*user)
+	user.Credit("USD", dec(5))
+	usersRepo.Update(*user)
+	order := entities.NewOrderWithIdAndTimeStamp(1, userId, "ETHUSD", true, entities.LimitOrderType, dec(1), dec(100), 42)
+	ordersRepo.Create(*order)
+
+	users := usersRepo.ReadAll()
+	if assert.Equal(t, 1, len(users)) {
+		assert.Equal(t, userId, users[0].GetUserId())
+		assert.Equal(t, dec(15), users[0].GetAvailable("USD"))
+	}
+	orders := ordersRepo.ReadAll("buy")
+	if assert.Equal(t, 1, len(orders)) {
+		assert.Equal(t, userId, orders[0].GetUserId())
+	}
+}
+
+func TestResetDatabase(t *testing.T) {
+	filePath, dbHandler := setup()
+	defer teardown(filePath, dbHandler)
+	usersRepo := controllers.NewUsersRepoImpl(dbHandler)
+	ordersRepo := controllers.NewOrdersRepoImpl(dbHandler)
+	sequencesRepo := controllers.NewSequencesRepoImpl(dbHandler)
+
+	usersRepo.Create(*entities.NewUser("john", map[string]entities.Balance{"USD": {Available: dec(10)}}))
+	ordersRepo.Create(*entities.NewOrderWithIdAndTimeStamp(1, "john", "ETHUSD", true, entities.LimitOrderType, dec(1), dec(100), 42))
+	sequencesRepo.Update("orders", 1)
+
+	assert.NoError(t, controllers.ResetDatabase(dbHandler))
+	assert.Equal(t, 0, len(usersRepo.ReadAll()))
+	assert.Equal(t, 0, len(ordersRepo.ReadAll("buy")))
+	assert.Equal(t, int64(0), sequencesRepo.Read("orders"))
+	// the schema is kept
+	assert.NoError(t, controllers.Migrate(dbHandler))
+	usersRepo.Create(*entities.NewUser("john", map[string]entities.Balance{"USD": {Available: dec(10)}}))
+	assert.Equal(t, 1, len(usersRepo.ReadAll()))
+}
+
+func TestUsersRepoAnyAsset(t *testing.T) {
+	filePath, dbHandler := setup()
+	defer teardown(filePath, dbHandler)
+	usersRepo := controllers.NewUsersRepoImpl(dbHandler)
+
+	user := entities.NewUser("john", map[string]entities.Balance{
+		"BTC":  {Available: dec(0.5), Locked: dec(0.25)},
+		"USDT": {Available: dec(20000)},
+	})
+	usersRepo.Create(*user)
+	// an asset the user did not have yet
+	user.Credit("SOL", dec(3))
+	user.Debit("USDT", dec(100))
+	usersRepo.Update(*user)
+
+	users := usersRepo.ReadAll()
+	if assert.Equal(t, 1, len(users)) {
+		assert.Equal(t, user.Balance, users[0].Balance)
+	}
+}
+
+// a PostgreSQL server: POSTGRES_TEST_DSN, or one started in a temporary directory when initdb and pg_ctl are installed
+// the test is skipped otherwise
+func postgresServerDsn(t *testing.T) string {
+	if dsn := os.Getenv("POSTGRES_TEST_DSN"); dsn != "" {
+		return dsn
+	}
+	initdb, err := exec.LookPath("initdb")
+	if err != nil {
+		t.Skip("no PostgreSQL: set POSTGRES_TEST_DSN or install initdb and pg_ctl")
+	}
+	pgCtl, err := exec.LookPath("pg_ctl")
+	if err != nil {
+		t.Skip("no PostgreSQL: set POSTGRES_TEST_DSN or install initdb and pg_ctl")
+	}
+
+	dir := t.TempDir()
+	dataDir := filepath.Join(dir, "data")
+	if out, err := exec.Command(initdb, "-D", dataDir, "-U", "postgres", "--auth=trust").CombinedOutput(); err != nil {
+		t.Skipf("unable to init a PostgreSQL cluster: %s %s", err, out)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	options := fmt.Sprintf("-p %d -k %s -c listen_addresses=127.0.0.1", port, dir)
+	if out, err := exec.Command(pgCtl, "start", "-w", "-D", dataDir, "-l", filepath.Join(dir, "log"), "-o", options).CombinedOutput(); err != nil {
+		t.Skipf("unable to start PostgreSQL: %s %s", err, out)
+	}
+	t.Cleanup(func() {
+		exec.Command(pgCtl, "stop", "-m", "fast", "-D", dataDir).Run()
+	})
+	return fmt.Sprintf("postgres://postgres@127.0.0.1:%d/postgres?sslmode=disable", port)
+}
+
+// a database of its own on the server, dropped at the end of the test
+func setupPostgres(t *testing.T) controllers.SqlDbHandler {
+	logrus.SetOutput(io.Discard)
+	serverDsn := postgresServerDsn(t)
+	admin, err := infrastructure.NewPostgresDbHandler(serverDsn, infrastructure.DefaultPostgresPoolConfig)
+	if err != nil {
+		t.Skipf("unable to connect to PostgreSQL: %s", err)
+	}
+	dbName := fmt.Sprintf("exchange_test_%d_%d", time.Now().Unix(), rand.Intn(1000000))
+	if err := admin.Exec("CREATE DATABASE " + dbName); err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+
+	dsn, err := url.Parse(serverDsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsn.Path = "/" + dbName
+	dbHandler, err := infrastructure.OpenDbHandler(dsn.String(), infrastructure.DefaultPostgresPoolConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dbHandler.Close()
+		admin.Exec("DROP DATABASE " + dbName)
+		admin.Close()
+	})
+	return dbHandler
+}
+
+func TestPostgresRepositories(t *testing.T) {
+	dbHandler := setupPostgres(t)
+	assert.Equal(t, controllers.PostgresDialect, dbHandler.Dialect())
+	assert.Nil(t, controllers.Migrate(dbHandler))
+	// nothing left to do the second time
+	assert.Nil(t, controllers.Migrate(dbHandler))
+	// the tables of version 6 at once, then the steps after it
+	rows := dbHandler.Query(`SELECT version FROM schemaMigrations ORDER BY version`)
+	versions := make([]int, 0)
+	for rows.Next() {
+		var version int
+		assert.Nil(t, rows.Scan(&version))
+		versions = append(versions, version)
+	}
+	assert.Equal(t, []int{6, 7, 8}, versions)
+
+	usersRepo := controllers.NewUsersRepoImpl(dbHandler)
+	ordersRepo := controllers.NewOrdersRepoImpl(dbHandler)
+	lastTradesRepo := controllers.NewLastTradesRepoImpl(dbHandler)
+	sequencesRepo := controllers.NewSequencesRepoImpl(dbHandler)
+	feesRepo := controllers.NewFeesRepoImpl(dbHandler)
+	candlesRepo := controllers.NewCandlesRepoImpl(dbHandler)
+
+	userId := `o'brien'); DROP TABLE users; --`
+	user := entities.NewUser(userId, map[string]entities.Balance{"USD": {Available: dec(10), Locked: dec(2)}})
+	user.SetSelfTradePrevention(entities.CancelOldest)
+	usersRepo.Create(*user)
+	user.Credit("BTC", dec(0.5))
+	usersRepo.Update(*user)
+	users := usersRepo.ReadAll()
+	if assert.Equal(t, 1, len(users)) {
+		assert.Equal(t, userId, users[0].GetUserId())
+		assert.Equal(t, user.Balance, users[0].Balance)
+		assert.Equal(t, entities.CancelOldest, users[0].GetSelfTradePrevention())
+	}
+
+	order := entities.NewOrderWithIdAndTimeStamp(1, userId, "ETHUSD", true, entities.LimitOrderType, dec(1), dec(100), 42)
+	ordersRepo.Create(*order)
+	orders := ordersRepo.ReadAll("buy")
+	if assert.Equal(t, 1, len(orders)) {
+		assert.Equal(t, int64(1), orders[0].GetId())
+		assert.Equal(t, dec(100), orders[0].GetLimitPrice())
+	}
+	order.SetLimitPrice(dec(101))
+	order.Size = dec(0.5)
+	ordersRepo.Update(*order)
+	orders = ordersRepo.ReadAll("buy")
+	if assert.Equal(t, 1, len(orders)) {
+		assert.Equal(t, dec(101), orders[0].GetLimitPrice())
+		assert.Equal(t, dec(0.5), orders[0].GetSize())
+	}
+	sellOrder := entities.NewOrderWithIdAndTimeStamp(2, userId, "ETHUSD", false, entities.LimitOrderType, dec(1), dec(120), 42)
+	sellOrder.SetTimeInForce(entities.GoodTillDate, 99)
+	ordersRepo.Create(*sellOrder)
+	orders = ordersRepo.ReadAll("sell")
+	if assert.Equal(t, 1, len(orders)) {
+		assert.Equal(t, entities.GoodTillDate, orders[0].GetTimeInForce())
+		assert.Equal(t, int64(99), orders[0].GetExpiresAt())
+	}
+	ordersRepo.Delete(*sellOrder)
+	assert.Equal(t, 0, len(ordersRepo.ReadAll("sell")))
+	stopOrder := entities.NewOrderWithIdAndTimeStamp(3, userId, "ETHUSD", false, entities.StopMarketOrderType, dec(1), dec(0), 42)
+	stopOrder.SetStopPrice(dec(90))
+	ordersRepo.Create(*stopOrder)
+	orders = ordersRepo.ReadAll("stop")
+	if assert.Equal(t, 1, len(orders)) {
+		assert.Equal(t, entities.StopMarketOrderType, orders[0].GetOrderType())
+		assert.Equal(t, dec(90), orders[0].GetStopPrice())
+		assert.False(t, orders[0].GetIsBid())
+	}
+
+	trade := entities.NewTradeRecord(7, "ETHUSD", 1, userId, 2, "jane", dec(100), dec(0.25), true, 43)
+	trade.SetFees(dec(0.01), dec(0.02))
+	lastTradesRepo.Create(*trade)
+	trades := lastTradesRepo.ReadAfter(0)
+	if assert.Equal(t, 1, len(trades)) {
+		assert.Equal(t, int64(7), trades[0].GetId())
+		assert.Equal(t, dec(0.25), trades[0].GetSize())
+		assert.Equal(t, dec(0.02), trades[0].GetSellerFee())
+		assert.Equal(t, "jane", trades[0].GetSellerUserId())
+	}
+	assert.Equal(t, 1, len(lastTradesRepo.ReadForUser(userId, usecases.TradeHistoryQuery{From: 43, Limit: 10})))
+	assert.Equal(t, 0, len(lastTradesRepo.ReadForTicker("ETHUSD", usecases.TradeHistoryQuery{Before: 7, Limit: 10})))
+
+	sequencesRepo.Update("order", 5)
+	sequencesRepo.Update("order", 6)
+	assert.Equal(t, int64(6), sequencesRepo.Read("order"))
+
+	entry := entities.FeeLedgerEntry{TradeId: 7, UserId: userId, Ticker: "ETHUSD", Asset: "USD", Fee: dec(0.01), Notional: dec(25), IsMaker: true, Timestamp: 43}
+	feesRepo.Create(entry)
+	assert.Equal(t, []entities.FeeLedgerEntry{entry}, feesRepo.ReadSince(0))
+
+	candle := entities.NewCandle(entities.OneMinute, *trade)
+	candlesRepo.Save(candle)
+	candle.AddTrade(*trade)
+	candlesRepo.Save(candle)
+	assert.Equal(t, []entities.Candle{candle}, candlesRepo.Read("ETHUSD", entities.OneMinute, usecases.CandleQuery{Limit: 10}))
+
+	// a transaction rolled back leaves nothing behind
+	assert.Nil(t, dbHandler.Begin())
+	usersRepo.Create(*entities.NewUser("ghost", map[string]entities.Balance{"USD": {Available: dec(1)}}))
+	assert.Nil(t, dbHandler.Rollback())
+	assert.Equal(t, 1, len(usersRepo.ReadAll()))
+
+	// the tables are emptied, the schema is kept
+	assert.Nil(t, controllers.ResetDatabase(dbHandler))
+	assert.Equal(t, 0, len(usersRepo.ReadAll()))
+	for _, side := range []string{"buy", "sell", "stop"} {
+		assert.Equal(t, 0, len(ordersRepo.ReadAll(side)))
+	}
+	assert.Equal(t, 0, len(lastTradesRepo.ReadAfter(0)))
+	assert.Equal(t, int64(0), sequencesRepo.Read("order"))
+	assert.Equal(t, 0, len(feesRepo.ReadSince(0)))
+	assert.Equal(t, 0, len(candlesRepo.Read("ETHUSD", entities.OneMinute, usecases.CandleQuery{Limit: 10})))
+	assert.Nil(t, controllers.Migrate(dbHandler))
+	usersRepo.Create(*user)
+	assert.Equal(t, 1, len(usersRepo.ReadAll()))
+}
+
+func TestControllersTradeHistory(t *testing.T) {
+	defer setupTest()()
+	e := echo.New()
+	handler := controllers.NewWebServiceHandler(ex)
+	e.GET("/trades/:ticker", handler.HandleGetTradeHistory, handler.RequireKnownTicker)
+	e.GET("/users/:userId/trades", handler.HandleGetUserTrades)
+
+	ex.RegisterUserWithBalance("jane", map[string]entities.Decimal{"ETH": dec(10)})
+	ex.RegisterUserWithBalance("john", map[string]entities.Decimal{"USD": dec(10000)})
+	ex.RegisterUserWithBalance("lily", map[string]entities.Decimal{"USD": dec(10000)})
+	for i := 0; i < 3; i++ {
+		ex.PlaceLimitOrderAndPersist(entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(100)))
+	}
+	buyOrder := entities.NewOrder("john", "ETHUSD", true, entities.LimitOrderType, dec(3), dec(100))
+	trades, err := ex.PlaceLimitOrderAndPersist(buyOrder)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(trades))
+
+	get := func(target string, response interface{}) int {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code == http.StatusOK {
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), response))
+		}
+		return rec.Code
+	}
+
+	// newest first, a page at a time
+	var page controllers.TradeHistoryResponse
+	assert.Equal(t, http.StatusOK, get("/trades/ETHUSD?limit=2", &page))
+	if assert.Equal(t, 2, len(page.Trades)) {
+		assert.Equal(t, trades[2].GetId(), page.Trades[0].ID)
+		assert.Equal(t, trades[1].GetId(), page.Trades[1].ID)
+		assert.Equal(t, trades[1].GetId(), page.NextCursor)
+	}
+	var lastPage controllers.TradeHistoryResponse
+	assert.Equal(t, http.StatusOK, get(fmt.Sprintf("/trades/ETHUSD?limit=2&cursor=%d", page.NextCursor), &lastPage))
+	if assert.Equal(t, 1, len(lastPage.Trades)) {
+		assert.Equal(t, trades[0].GetId(), lastPage.Trades[0].ID)
+		assert.Equal(t, int64(0), lastPage.NextCursor)
+	}
+	var beforeAnyTrade controllers.TradeHistoryResponse
+	assert.Equal(t, http.StatusOK, get(fmt.Sprintf("/trades/ETHUSD?to=%d", trades[0].GetTimeStamp()), &beforeAnyTrade))
+	assert.Equal(t, 0, len(beforeAnyTrade.Trades))
+	assert.Equal(t, http.StatusBadRequest, get("/trades/ETHUSD?limit=ten", &page))
+	assert.Equal(t, http.StatusNotFound, get("/trades/DOGEUSD", &page))
+
+	var fills controllers.FillHistoryResponse
+	assert.Equal(t, http.StatusOK, get("/users/jane/trades", &fills))
+	if assert.Equal(t, 3, len(fills.Fills)) {
+		assert.Equal(t, trades[2].GetId(), fills.Fills[0].Trade.ID)
+		assert.Equal(t, "ETHUSD", fills.Fills[0].Ticker)
+		assert.Equal(t, trades[2].GetSeller().GetId(), fills.Fills[0].OrderId)
+		assert.False(t, fills.Fills[0].IsBid)
+		assert.True(t, fills.Fills[0].IsMaker)
+		assert.Equal(t, "USD", fills.Fills[0].FeeAsset)
+	}
+	assert.Equal(t, http.StatusOK, get("/users/john/trades?limit=1", &fills))
+	if assert.Equal(t, 1, len(fills.Fills)) {
+		assert.Equal(t, buyOrder.GetId(), fills.Fills[0].OrderId)
+		assert.True(t, fills.Fills[0].IsBid)
+		assert.False(t, fills.Fills[0].IsMaker)
+		assert.Equal(t, trades[2].GetId(), fills.NextCursor)
+	}
+	var noFills controllers.FillHistoryResponse
+	assert.Equal(t, http.StatusOK, get("/users/lily/trades", &noFills))
+	assert.Equal(t, 0, len(noFills.Fills))
+	assert.Equal(t, http.StatusNotFound, get("/users/nobody/trades", &noFills))
+}
+
+func TestControllersWebSocketPushesOnChange(t *testing.T) {
+	defer setupTest()()
+	e := echo.New()
+	handler := controllers.NewWebServiceHandler(ex)
+	e.GET("/ws/bestSells", echo.WrapHandler(websocket.Handler(handler.WebSocketHandlerBestSells)), handler.RequireKnownTicker)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	ex.RegisterUserWithBalance("jane", map[string]entities.Decimal{"ETH": dec(10)})
+	ex.RegisterUserWithBalance("john", map[string]entities.Decimal{"USD": dec(10000)})
+	ws, err := websocket.Dial("ws"+server.URL[len("http"):]+"/ws/bestSells?ticker=ETHUSD", "", server.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ws.Close()
+	receive := func() string {
+		var msg string
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		assert.NoError(t, websocket.Message.Receive(ws, &msg))
+		return msg
+	}
+
+	assert.Equal(t, `[]`, receive())
+	// the buy side is not pushed on this websocket
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", true, entities.LimitOrderType, dec(1), dec(90)))
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, dec(2), dec(100)))
+	assert.Equal(t, `[{"Price":"100","Volume":"2"}]`, receive())
+}
+
+func TestControllersMultiplexedWebSocket(t *testing.T) {
+	defer setupTest()()
+	e := echo.New()
+	handler := controllers.NewWebServiceHandler(ex)
+	handler.HeartbeatInterval = 50 * time.Millisecond
+	e.GET("/ws", echo.WrapHandler(websocket.Handler(handler.WebSocketHandler)))
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	ex.RegisterUserWithBalance("jane", map[string]entities.Decimal{"ETH": dec(10)})
+	ex.RegisterUserWithBalance("john", map[string]entities.Decimal{"USD": dec(10000)})
+	ws, err := websocket.Dial("ws"+server.URL[len("http"):]+"/ws", "", server.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ws.Close()
+	request := func(body string) {
+		assert.NoError(t, websocket.Message.Send(ws, body))
+	}
+	// the next message but the heartbeats
+	receive := func() map[string]interface{} {
+		for {
+			var raw string
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if !assert.NoError(t, websocket.Message.Receive(ws, &raw)) {
+				return nil
+			}
+			var msg map[string]interface{}
+			assert.NoError(t, json.Unmarshal([]byte(raw), &msg))
+			if msg["Type"] != "heartbeat" {
+				return msg
+			}
+		}
+	}
+
+	request(`{"Op": "subscribe", "Id": 1, "Channels": ["trades:DOGEUSD"]}`)
+	msg := receive()
+	assert.Equal(t, "error", msg["Type"])
+	assert.Equal(t, float64(1), msg["Id"])
+	request(`{"Op": "subscribe", "Id": 2, "Channels": ["book:ETHUSD:depth1000"]}`)
+	assert.Equal(t, "error", receive()["Type"])
+
+	request(`{"Op": "subscribe", "Id": 3, "Channels": ["book:ETHUSD:depth1", "ticker:*", "user"], "UserId": "john"}`)
+	msg = receive()
+	assert.Equal(t, "ack", msg["Type"])
+	assert.Equal(t, float64(3), msg["Id"])
+	// the snapshots
+	snapshots := make(map[string]interface{}, 0)
+	for i := 0; i < 3; i++ {
+		msg = receive()
+		assert.Equal(t, "update", msg["Type"])
+		assert.Equal(t, true, msg["Snapshot"])
+		assert.Equal(t, float64(1), msg["Seq"])
+		snapshots[msg["Channel"].(string)] = msg["Data"]
+	}
+	assert.Equal(t, map[string]interface{}{"Bids": []interface{}{}, "Asks": []interface{}{}}, snapshots["book:ETHUSD:depth1"])
+	assert.Equal(t, "ETHUSD", snapshots["ticker:*"].(map[string]interface{})["Ticker"])
+	assert.Equal(t, "john", snapshots["user"].(map[string]interface{})["UserId"])
+
+	// a level below the depth changes nothing on the book channel
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, dec(2), dec(100)))
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(110)))
+	updates := make([]map[string]interface{}, 0)
+	for i := 0; i < 2; i++ {
+		updates = append(updates, receive())
+	}
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i]["Channel"].(string) < updates[j]["Channel"].(string)
+	})
+	assert.Equal(t, "book:ETHUSD:depth1", updates[0]["Channel"])
+	assert.Equal(t, float64(2), updates[0]["Seq"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"Price": "100", "Volume": "2"}}, updates[0]["Data"].(map[string]interface{})["Asks"])
+	assert.Equal(t, "ticker:*", updates[1]["Channel"])
+	assert.Equal(t, "100", updates[1]["Data"].(map[string]interface{})["BestAsk"])
+
+	request(`{"Op": "unsubscribe", "Id": 4, "Channels": ["book:ETHUSD:depth1", "ticker:*"]}`)
+	msg = receive()
+	assert.Equal(t, "ack", msg["Type"])
+	assert.Equal(t, "unsubscribe", msg["Op"])
+	request(`{"Op": "ping", "Id": 5}`)
+	assert.Equal(t, "pong", receive()["Type"])
+
+	// only the user channel is left
+	trades, _ := ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", true, entities.LimitOrderType, dec(1), dec(100)))
+	assert.Equal(t, 1, len(trades))
+	john := handler.Ex.GetUsersMap()["john"]
+	handler.Notify(&john)
+	msg = receive()
+	assert.Equal(t, "user", msg["Channel"])
+	assert.Equal(t, float64(2), msg["Seq"])
+	assert.Equal(t, "9900", msg["Data"].(map[string]interface{})["Balance"].(map[string]interface{})["USD"].(map[string]interface{})["Available"])
+
+	var raw string
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	assert.NoError(t, websocket.Message.Receive(ws, &raw))
+	assert.Contains(t, raw, `"Type":"heartbeat"`)
+}
+
+func TestControllersL2Book(t *testing.T) {
+	defer setupTest()()
+	e := echo.New()
+	handler := controllers.NewWebServiceHandler(ex)
+	e.GET("/book/:ticker/l2", handler.HandleGetL2Book, handler.RequireKnownTicker)
+	e.GET("/ws", echo.WrapHandler(websocket.Handler(handler.WebSocketHandler)))
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	ex.RegisterUserWithBalance("jane", map[string]entities.Decimal{"ETH": dec(10)})
+	ex.RegisterUserWithBalance("john", map[string]entities.Decimal{"USD": dec(10000)})
+	sellOrder := entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, dec(2), dec(100))
+	ex.PlaceLimitOrderAndPersist(sellOrder)
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", true, entities.LimitOrderType, dec(1), dec(90)))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/book/DOGEUSD/l2", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/book/ETHUSD/l2", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var book controllers.L2BookResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &book))
+	assert.Equal(t, int64(2), book.Sequence)
+	assert.Equal(t, []controllers.LimitResponse{{Price: dec(90), Volume: dec(1)}}, book.Bids)
+	assert.Equal(t, []controllers.LimitResponse{{Price: dec(100), Volume: dec(2)}}, book.Asks)
+
+	ws, err := websocket.Dial("ws"+server.URL[len("http"):]+"/ws", "", server.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ws.Close()
+	assert.NoError(t, websocket.Message.Send(ws, `{"Op": "subscribe", "Id": 1, "Channels": ["l2:ETHUSD"]}`))
+	type l2Message struct {
+		Type     string
+		Seq      int64
+		Snapshot bool
+		Data     json.RawMessage
+	}
+	receive := func() l2Message {
+		for {
+			var msg l2Message
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if !assert.NoError(t, websocket.JSON.Receive(ws, &msg)) || msg.Type != "heartbeat" {
+				return msg
+			}
+		}
+	}
+	assert.Equal(t, "ack", receive().Type)
+
+	// the same book as the REST snapshot
+	msg := receive()
+	assert.True(t, msg.Snapshot)
+	var snapshot controllers.L2BookResponse
+	assert.NoError(t, json.Unmarshal(msg.Data, &snapshot))
+	assert.Equal(t, book, snapshot)
+
+	// then only the levels that changed, the sequence following the snapshot's
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", true, entities.LimitOrderType, dec(0.5), dec(100)))
+	msg = receive()
+	assert.False(t, msg.Snapshot)
+	var update controllers.L2UpdateResponse
+	assert.NoError(t, json.Unmarshal(msg.Data, &update))
+	assert.Equal(t, book.Sequence+1, update.Sequence)
+	assert.Equal(t, []controllers.LevelChangeResponse{{IsBid: false, Price: dec(100), Volume: dec(1.5)}}, update.Changes)
+
+	ex.CancelOrder(sellOrder.GetId(), "ETHUSD")
+	msg = receive()
+	assert.NoError(t, json.Unmarshal(msg.Data, &update))
+	assert.Equal(t, book.Sequence+2, update.Sequence)
+	assert.Equal(t, []controllers.LevelChangeResponse{{IsBid: false, Price: dec(100), Volume: entities.ZeroDecimal}}, update.Changes)
+}
+
+func TestControllersL3Book(t *testing.T) {
+	defer setupTest()()
+	e := echo.New()
+	handler := controllers.NewWebServiceHandler(ex)
+	e.GET("/book/:ticker/l3", handler.HandleGetL3Book, handler.RequireKnownTicker)
+	e.GET("/ws", echo.WrapHandler(websocket.Handler(handler.WebSocketHandler)))
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	ex.RegisterUserWithBalance("jane", map[string]entities.Decimal{"ETH": dec(10)})
+	ex.RegisterUserWithBalance("john", map[string]entities.Decimal{"USD": dec(10000)})
+	first := entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(100))
+	ex.PlaceLimitOrderAndPersist(first)
+	second := entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, dec(2), dec(100))
+	ex.PlaceLimitOrderAndPersist(second)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/book/DOGEUSD/l3", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/book/ETHUSD/l3", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	// no user ids
+	assert.NotContains(t, rec.Body.String(), "jane")
+	var book controllers.L3BookResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &book))
+	assert.Equal(t, int64(2), book.Sequence)
+	assert.Equal(t, 0, len(book.Bids))
+	// in time priority
+	if assert.Equal(t, 2, len(book.Asks)) {
+		assert.Equal(t, first.GetId(), book.Asks[0].OrderId)
+		assert.Equal(t, second.GetId(), book.Asks[1].OrderId)
+		assert.Equal(t, dec(2), book.Asks[1].Size)
+	}
+
+	ws, err := websocket.Dial("ws"+server.URL[len("http"):]+"/ws", "", server.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ws.Close()
+	assert.NoError(t, websocket.Message.Send(ws, `{"Op": "subscribe", "Id": 1, "Channels": ["l3:ETHUSD"]}`))
+	type l3Message struct {
+		Type     string
+		Snapshot bool
+		Data     json.RawMessage
+	}
+	receive := func() l3Message {
+		for {
+			var msg l3Message
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if !assert.NoError(t, websocket.JSON.Receive(ws, &msg)) || msg.Type != "heartbeat" {
+				return msg
+			}
+		}
+	}
+	assert.Equal(t, "ack", receive().Type)
+	msg := receive()
+	assert.True(t, msg.Snapshot)
+	var snapshot controllers.L3BookResponse
+	assert.NoError(t, json.Unmarshal(msg.Data, &snapshot))
+	assert.Equal(t, book, snapshot)
+
+	// the first order is executed and gone, the second one is executed in part
+	trades, _ := ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", true, entities.LimitOrderType, dec(1.5), dec(100)))
+	msg = receive()
+	assert.False(t, msg.Snapshot)
+	var update controllers.L3UpdateResponse
+	assert.NoError(t, json.Unmarshal(msg.Data, &update))
+	if assert.Equal(t, 2, len(update.Events)) {
+		assert.Equal(t, book.Sequence+1, update.Events[0].Sequence)
+		assert.Equal(t, entities.OrderExecuted, update.Events[0].Type)
+		assert.Equal(t, first.GetId(), update.Events[0].OrderId)
+		assert.Equal(t, trades[0].GetId(), update.Events[0].TradeId)
+		assert.True(t, update.Events[0].RemainingSize.IsZero())
+		assert.Equal(t, book.Sequence+2, update.Events[1].Sequence)
+		assert.Equal(t, second.GetId(), update.Events[1].OrderId)
+		assert.Equal(t, dec(0.5), update.Events[1].Size)
+		assert.Equal(t, dec(1.5), update.Events[1].RemainingSize)
+	}
+
+	ex.CancelOrder(second.GetId(), "ETHUSD")
+	msg = receive()
+	assert.NoError(t, json.Unmarshal(msg.Data, &update))
+	if assert.Equal(t, 1, len(update.Events)) {
+		assert.Equal(t, book.Sequence+3, update.Events[0].Sequence)
+		assert.Equal(t, entities.OrderRemoved, update.Events[0].Type)
+		assert.Equal(t, dec(1.5), update.Events[0].Size)
+	}
+}
+
+func TestControllersCandles(t *testing.T) {
+	defer setupTest()()
+	e := echo.New()
+	handler := controllers.NewWebServiceHandler(ex)
+	e.GET("/candles/:ticker", handler.HandleGetCandles, handler.RequireKnownTicker)
+	e.GET("/ws", echo.WrapHandler(websocket.Handler(handler.WebSocketHandler)))
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	ex.RegisterUserWithBalance("jane", map[string]entities.Decimal{"ETH": dec(10)})
+	ex.RegisterUserWithBalance("john", map[string]entities.Decimal{"USD": dec(10000)})
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, dec(2), dec(100)))
+
+	ws, err := websocket.Dial("ws"+server.URL[len("http"):]+"/ws", "", server.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ws.Close()
+	type candleMessage struct {
+		Type     string
+		Channel  string
+		Snapshot bool
+		Data     *controllers.CandleResponse
+	}
+	receive := func() candleMessage {
+		for {
+			var msg candleMessage
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if !assert.NoError(t, websocket.JSON.Receive(ws, &msg)) || msg.Type != "heartbeat" {
+				return msg
+			}
+		}
+	}
+	assert.NoError(t, websocket.Message.Send(ws, `{"Op": "subscribe", "Id": 1, "Channels": ["candles:ETHUSD:2m"]}`))
+	assert.Equal(t, "error", receive().Type)
+	assert.NoError(t, websocket.Message.Send(ws, `{"Op": "subscribe", "Id": 2, "Channels": ["candles:ETHUSD:1h"]}`))
+	assert.Equal(t, "ack", receive().Type)
+	// no trade yet
+	msg := receive()
+	assert.True(t, msg.Snapshot)
+	assert.Nil(t, msg.Data)
+
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", true, entities.LimitOrderType, dec(0.5), dec(100)))
+	msg = receive()
+	if assert.NotNil(t, msg.Data) {
+		assert.Equal(t, entities.OneHour, msg.Data.Interval)
+		assert.Equal(t, dec(0.5), msg.Data.Volume)
+		assert.Equal(t, msg.Data.OpenTime+entities.OneHour.Duration(), msg.Data.CloseTime)
+	}
+	// the candle in progress
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", true, entities.LimitOrderType, dec(1), dec(100)))
+	msg = receive()
+	if assert.NotNil(t, msg.Data) {
+		assert.Equal(t, dec(1.5), msg.Data.Volume)
+		assert.Equal(t, int64(2), msg.Data.Trades)
+	}
+
+	get := func(target string) (int, controllers.CandlesResponse) {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		var response controllers.CandlesResponse
+		if rec.Code == http.StatusOK {
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		}
+		return rec.Code, response
+	}
+	code, response := get("/candles/ETHUSD?interval=1h")
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Equal(t, 1, len(response.Candles)) {
+		assert.Equal(t, *msg.Data, response.Candles[0])
+	}
+	// 1m if omitted
+	_, response = get("/candles/ETHUSD?limit=1")
+	if assert.Equal(t, 1, len(response.Candles)) {
+		assert.Equal(t, entities.OneMinute, response.Candles[0].Interval)
+	}
+	_, response = get(fmt.Sprintf("/candles/ETHUSD?interval=1d&from=%d", response.Candles[0].OpenTime+entities.OneDay.Duration()))
+	assert.Equal(t, 0, len(response.Candles))
+	code, _ = get("/candles/ETHUSD?interval=2m")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = get("/candles/ETHUSD?to=-1")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = get("/candles/DOGEUSD")
+	assert.Equal(t, http.StatusNotFound, code)
+}
@@ -2,18 +2,40 @@ package controllers
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
+	"github.com/sirupsen/logrus"
 	"github.com/trandinhkhoa/crypto-exchange/entities"
+	"github.com/trandinhkhoa/crypto-exchange/usecases"
 )
 
+// the SQL databases the repositories run on
+type Dialect string
+
+const (
+	SqliteDialect   Dialect = "sqlite"
+	PostgresDialect Dialect = "postgres"
+)
+
+// the statements are written once for every Dialect: ? placeholders, no quoted identifiers
+// the values go in args, bound to the ? of the statement, never formatted into it
 type SqlDbHandler interface {
-	Exec(string) error
+	Exec(statement string, args ...interface{}) error
 	Close()
-	Query(string) Row
+	Query(statement string, args ...interface{}) Row
+	Dialect() Dialect
+	// until Commit, Exec and Query run in a transaction
+	Begin() error
+	// rolls back instead if a statement of the transaction failed
+	Commit() error
+	Rollback() error
 }
 type Row interface {
-	Scan(dest ...interface{})
+	Scan(dest ...interface{}) error
 	Next() bool
+	// once Next returned false, nil if every row was read
+	Err() error
 }
 
 type OrdersRepoImpl struct {
@@ -27,61 +49,84 @@ func NewOrdersRepoImpl(sqlDbHandler SqlDbHandler) *OrdersRepoImpl {
 }
 
 const (
-	id        = "id"
-	userid    = "userid"
-	size      = "size"
-	price     = "price"
-	timestamp = "timestamp"
+	id          = "id"
+	userid      = "userid"
+	size        = "size"
+	price       = "price"
+	timestamp   = "timestamp"
+	ticker      = "ticker"
+	timeInForce = "timeInForce"
+	expiresAt   = "expiresAt"
+	isBid       = "isBid"
+	orderType   = "orderType"
+	stopPrice   = "stopPrice"
+	// users table
+	selfTradePrevention = "selfTradePrevention"
+	// balances table
+	asset     = "asset"
+	available = "available"
+	locked    = "locked"
 )
 
 // TODO: dont use Fatal
 
-func (ordersRepoImpl OrdersRepoImpl) Create(order entities.Order) {
-	var tableName string
+// prices, sizes and balances are stored as INTEGER number of 10^-8 units (entities.Decimal.Units()) so nothing is rounded on the way in or out
+
+// resting limit orders are in buyOrders/sellOrders, stop orders waiting to be triggered in stopOrders
+func ordersTableName(order entities.Order) string {
+	if order.GetOrderType().IsStop() {
+		return "stopOrders"
+	}
 	if order.GetIsBid() {
-		tableName = "buyOrders"
-	} else {
-		tableName = "sellOrders"
+		return "buyOrders"
 	}
-	queryStr := fmt.Sprintf("INSERT INTO %s (%s, %s, %s, %s, %s) VALUES (%d,'%s',%f,%f,%d)",
-		tableName,
-		id, userid, size, price, timestamp,
-		order.GetId(), order.GetUserId(), order.GetSize(), order.GetLimitPrice(), order.GetTimeStamp(),
-	)
+	return "sellOrders"
+}
 
-	ordersRepoImpl.sqlDbHandler.Exec(queryStr)
+func (ordersRepoImpl OrdersRepoImpl) Create(order entities.Order) {
+	tableName := ordersTableName(order)
+	if order.GetOrderType().IsStop() {
+		queryStr := fmt.Sprintf("INSERT INTO %s (%s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s) VALUES (?,?,?,?,?,?,?,?,?,?,?)",
+			tableName,
+			id, userid, size, price, timestamp, ticker, timeInForce, expiresAt, isBid, orderType, stopPrice)
+		ordersRepoImpl.sqlDbHandler.Exec(queryStr,
+			order.GetId(), order.GetUserId(), order.GetSize().Units(), order.GetLimitPrice().Units(), order.GetTimeStamp(), order.GetTicker(),
+			string(order.GetTimeInForce()), order.GetExpiresAt(), order.GetIsBid(), string(order.GetOrderType()), order.GetStopPrice().Units())
+		return
+	}
+	queryStr := fmt.Sprintf("INSERT INTO %s (%s, %s, %s, %s, %s, %s, %s, %s) VALUES (?,?,?,?,?,?,?,?)",
+		tableName,
+		id, userid, size, price, timestamp, ticker, timeInForce, expiresAt)
+	ordersRepoImpl.sqlDbHandler.Exec(queryStr,
+		order.GetId(), order.GetUserId(), order.GetSize().Units(), order.GetLimitPrice().Units(), order.GetTimeStamp(), order.GetTicker(),
+		string(order.GetTimeInForce()), order.GetExpiresAt())
 }
 
 func (ordersRepoImpl OrdersRepoImpl) Update(order entities.Order) {
-	var tableName string
-	if order.GetIsBid() {
-		tableName = "buyOrders"
-	} else {
-		tableName = "sellOrders"
-	}
-	queryStr := fmt.Sprintf("UPDATE %s SET %s = %f WHERE %s = %d",
+	tableName := ordersTableName(order)
+	// price and timestamp change when the order is amended
+	queryStr := fmt.Sprintf("UPDATE %s SET %s = ?, %s = ?, %s = ? WHERE %s = ?",
 		tableName,
-		size, order.GetSize(),
-		id, order.GetId())
+		size, price, timestamp, id)
 
-	ordersRepoImpl.sqlDbHandler.Exec(queryStr)
+	ordersRepoImpl.sqlDbHandler.Exec(queryStr,
+		order.GetSize().Units(), order.GetLimitPrice().Units(), order.GetTimeStamp(), order.GetId())
 }
 
 func (ordersRepoImpl OrdersRepoImpl) Delete(order entities.Order) {
-	var tableName string
-	if order.GetIsBid() {
-		tableName = "buyOrders"
-	} else {
-		tableName = "sellOrders"
-	}
-	queryStr := fmt.Sprintf("DELETE FROM %s WHERE %s = %d",
+	tableName := ordersTableName(order)
+	queryStr := fmt.Sprintf("DELETE FROM %s WHERE %s = ?",
 		tableName,
-		id, order.GetId())
+		id)
 
-	ordersRepoImpl.sqlDbHandler.Exec(queryStr)
+	ordersRepoImpl.sqlDbHandler.Exec(queryStr, order.GetId())
 }
 
+// side is "buy", "sell" or "stop"
 func (ordersRepoImpl OrdersRepoImpl) ReadAll(side string) []entities.Order {
+	if side == "stop" {
+		return ordersRepoImpl.readAllStopOrders()
+	}
 	var tableName string
 	var isBid bool
 	if side == "buy" {
@@ -92,9 +137,10 @@ func (ordersRepoImpl OrdersRepoImpl) ReadAll(side string) []entities.Order {
 		isBid = false
 	}
 
-	queryStr := fmt.Sprintf("SELECT * FROM %s", tableName)
+	queryStr := fmt.Sprintf("SELECT %s, %s, %s, %s, %s, %s, %s, %s FROM %s",
+		id, userid, size, price, timestamp, ticker, timeInForce, expiresAt,
+		tableName)
 
-	ordersRepoImpl.sqlDbHandler.Exec(queryStr)
 	rows := ordersRepoImpl.sqlDbHandler.Query(queryStr)
 
 	buyOrders := make([]entities.Order, 0)
@@ -102,17 +148,67 @@ func (ordersRepoImpl OrdersRepoImpl) ReadAll(side string) []entities.Order {
 		// TODO: put this somewhere else ??
 		var id int64
 		var userId string
-		var size float64
-		var price float64
+		var size int64
+		var price int64
 		var timestamp int64
-		rows.Scan(&id, &userId, &size, &price, &timestamp)
-		order := entities.NewOrder(userId, "ETHUSD", isBid, entities.LimitOrderType, size, price)
+		var ticker string
+		var timeInForce string
+		var expiresAt int64
+		if err := rows.Scan(&id, &userId, &size, &price, &timestamp, &ticker, &timeInForce, &expiresAt); err != nil {
+			logrus.Errorf("Skipping unreadable order of %s: %s", tableName, err)
+			continue
+		}
+		order := entities.NewOrderWithIdAndTimeStamp(id, userId, ticker, isBid, entities.LimitOrderType,
+			entities.NewDecimalFromUnits(size), entities.NewDecimalFromUnits(price), timestamp)
+		order.SetTimeInForce(entities.TimeInForce(timeInForce), expiresAt)
 		buyOrders = append(buyOrders, *order)
 	}
+	if err := rows.Err(); err != nil {
+		logrus.Errorf("Unable to read %s: %s", tableName, err)
+	}
 
 	return buyOrders
 }
 
+func (ordersRepoImpl OrdersRepoImpl) readAllStopOrders() []entities.Order {
+	tableName := "stopOrders"
+
+	queryStr := fmt.Sprintf("SELECT %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s FROM %s",
+		id, userid, size, price, timestamp, ticker, timeInForce, expiresAt, isBid, orderType, stopPrice,
+		tableName)
+
+	rows := ordersRepoImpl.sqlDbHandler.Query(queryStr)
+
+	stopOrders := make([]entities.Order, 0)
+	for rows.Next() {
+		var id int64
+		var userId string
+		var size int64
+		var price int64
+		var timestamp int64
+		var ticker string
+		var timeInForce string
+		var expiresAt int64
+		var isBid bool
+		var orderType string
+		var stopPrice int64
+		if err := rows.Scan(&id, &userId, &size, &price, &timestamp, &ticker, &timeInForce, &expiresAt, &isBid, &orderType, &stopPrice); err != nil {
+			logrus.Errorf("Skipping unreadable order of %s: %s", tableName, err)
+			continue
+		}
+		order := entities.NewOrderWithIdAndTimeStamp(id, userId, ticker, isBid, entities.OrderType(orderType),
+			entities.NewDecimalFromUnits(size), entities.NewDecimalFromUnits(price), timestamp)
+		order.SetTimeInForce(entities.TimeInForce(timeInForce), expiresAt)
+		order.SetStopPrice(entities.NewDecimalFromUnits(stopPrice))
+		stopOrders = append(stopOrders, *order)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.Errorf("Unable to read %s: %s", tableName, err)
+	}
+
+	return stopOrders
+}
+
 type UsersRepoImpl struct {
 	sqlDbHandler SqlDbHandler
 }
@@ -123,52 +219,117 @@ func NewUsersRepoImpl(sqlDbHandler SqlDbHandler) *UsersRepoImpl {
 	}
 }
 
+// the balances are in their own table, one row per asset of the user
 func (usersRepoImpl UsersRepoImpl) Create(user entities.User) {
 	tableName := "users"
-	queryStr := fmt.Sprintf("INSERT INTO %s (%s, %s, %s) VALUES ('%s',%f,%f)",
+	queryStr := fmt.Sprintf("INSERT INTO %s (%s, %s) VALUES (?,?)",
 		tableName,
-		userid, "ETH", "USD",
-		user.GetUserId(), user.Balance["ETH"], user.Balance["USD"])
+		userid, selfTradePrevention)
 
-	usersRepoImpl.sqlDbHandler.Exec(queryStr)
+	usersRepoImpl.sqlDbHandler.Exec(queryStr, user.GetUserId(), string(user.GetSelfTradePrevention()))
+	usersRepoImpl.saveBalances(user)
 }
 
 func (usersRepoImpl UsersRepoImpl) Update(user entities.User) {
 	tableName := "users"
-	queryStr := fmt.Sprintf("UPDATE %s SET %s = %f, %s = %f WHERE %s = '%s'",
+	queryStr := fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s = ?",
+		tableName,
+		selfTradePrevention, userid)
+
+	usersRepoImpl.sqlDbHandler.Exec(queryStr, string(user.GetSelfTradePrevention()), user.GetUserId())
+	usersRepoImpl.saveBalances(user)
+}
+
+func (usersRepoImpl UsersRepoImpl) saveBalances(user entities.User) {
+	tableName := "balances"
+	queryStr := fmt.Sprintf("INSERT INTO %s (%s, %s, %s, %s) VALUES (?,?,?,?) ON CONFLICT(%s, %s) DO UPDATE SET %s = excluded.%s, %s = excluded.%s",
 		tableName,
-		"ETH", user.Balance["ETH"],
-		"USD", user.Balance["USD"],
-		userid, user.GetUserId())
+		userid, asset, available, locked,
+		userid, asset,
+		available, available, locked, locked)
 
-	usersRepoImpl.sqlDbHandler.Exec(queryStr)
+	assets := make([]string, 0, len(user.Balance))
+	for asset := range user.Balance {
+		assets = append(assets, asset)
+	}
+	// same order every time, the statements of a transaction are easier to follow
+	sort.Strings(assets)
+	for _, asset := range assets {
+		usersRepoImpl.sqlDbHandler.Exec(queryStr,
+			user.GetUserId(), asset, user.GetAvailable(asset).Units(), user.GetLocked(asset).Units())
+	}
 }
 
 func (userRepoImpl UsersRepoImpl) ReadAll() []entities.User {
 	tableName := "users"
 
-	queryStr := fmt.Sprintf("SELECT * FROM %s", tableName)
+	queryStr := fmt.Sprintf("SELECT %s, %s FROM %s",
+		userid, selfTradePrevention,
+		tableName)
 
-	userRepoImpl.sqlDbHandler.Exec(queryStr)
 	rows := userRepoImpl.sqlDbHandler.Query(queryStr)
 
 	usersList := make([]entities.User, 0)
 	for rows.Next() {
-		// TODO: put this somewhere else ??
 		var userId string
-		var ethBalance float64
-		var usdBalance float64
-		rows.Scan(&userId, &ethBalance, &usdBalance)
-		user := entities.NewUser(userId, map[string]float64{
-			"ETH": ethBalance,
-			"USD": usdBalance,
-		})
+		var selfTradePrevention string
+		if err := rows.Scan(&userId, &selfTradePrevention); err != nil {
+			logrus.Errorf("Skipping unreadable user: %s", err)
+			continue
+		}
+		user := entities.NewUser(userId, make(map[string]entities.Balance, 0))
+		user.SetSelfTradePrevention(entities.SelfTradePrevention(selfTradePrevention))
 		usersList = append(usersList, *user)
 	}
+	if err := rows.Err(); err != nil {
+		logrus.Errorf("Unable to read %s: %s", tableName, err)
+	}
+
+	balances := userRepoImpl.readAllBalances()
+	for i := range usersList {
+		if userBalances, ok := balances[usersList[i].GetUserId()]; ok {
+			usersList[i].Balance = userBalances
+		}
+	}
 
 	return usersList
 }
 
+// by user id then asset
+func (userRepoImpl UsersRepoImpl) readAllBalances() map[string]map[string]entities.Balance {
+	tableName := "balances"
+
+	queryStr := fmt.Sprintf("SELECT %s, %s, %s, %s FROM %s",
+		userid, asset, available, locked,
+		tableName)
+
+	rows := userRepoImpl.sqlDbHandler.Query(queryStr)
+
+	balances := make(map[string]map[string]entities.Balance, 0)
+	for rows.Next() {
+		var userId string
+		var asset string
+		var available int64
+		var locked int64
+		if err := rows.Scan(&userId, &asset, &available, &locked); err != nil {
+			logrus.Errorf("Skipping unreadable balance: %s", err)
+			continue
+		}
+		if _, ok := balances[userId]; !ok {
+			balances[userId] = make(map[string]entities.Balance, 0)
+		}
+		balances[userId][asset] = entities.Balance{
+			Available: entities.NewDecimalFromUnits(available),
+			Locked:    entities.NewDecimalFromUnits(locked),
+		}
+	}
+	if err := rows.Err(); err != nil {
+		logrus.Errorf("Unable to read %s: %s", tableName, err)
+	}
+
+	return balances
+}
+
 type LastTradesRepoImpl struct {
 	sqlDbHandler SqlDbHandler
 }
@@ -179,42 +340,251 @@ func NewLastTradesRepoImpl(sqlDbHandler SqlDbHandler) *LastTradesRepoImpl {
 	}
 }
 
-func boolToInt(b bool) int {
-	if b {
-		return 1
-	}
-	return 0
-}
-
 func (tradeRepoImpl LastTradesRepoImpl) Create(trade entities.Trade) {
 	tableName := "lastTrades"
-	queryStr := fmt.Sprintf("INSERT INTO %s (price, size, isBuyerMaker, timestamp) VALUES ('%f',%f,%d,%d)",
-		tableName,
-		trade.GetPrice(), trade.GetSize(), boolToInt(trade.GetIsBuyerMaker()), trade.GetTimeStamp())
+	queryStr := fmt.Sprintf("INSERT INTO %s (id, ticker, price, size, isBuyerMaker, timestamp, buyerFee, sellerFee, buyerOrderId, buyerUserId, sellerOrderId, sellerUserId) VALUES (?,?,?,?,?,?,?,?,?,?,?,?)",
+		tableName)
+
+	tradeRepoImpl.sqlDbHandler.Exec(queryStr,
+		trade.GetId(), trade.GetTicker(), trade.GetPrice().Units(), trade.GetSize().Units(), trade.GetIsBuyerMaker(), trade.GetTimeStamp(),
+		trade.GetBuyerFee().Units(), trade.GetSellerFee().Units(),
+		trade.GetBuyerOrderId(), trade.GetBuyerUserId(), trade.GetSellerOrderId(), trade.GetSellerUserId())
+}
 
-	tradeRepoImpl.sqlDbHandler.Exec(queryStr)
+func (tradeRepoImpl LastTradesRepoImpl) ReadAfter(id int64) []entities.Trade {
+	return tradeRepoImpl.read("WHERE id > ? ORDER BY id", []interface{}{id})
 }
 
-func (tradeRepoImpl LastTradesRepoImpl) ReadAll() []entities.Trade {
+func (tradeRepoImpl LastTradesRepoImpl) ReadForTicker(ticker string, query usecases.TradeHistoryQuery) []entities.Trade {
+	conditions, args := tradeHistoryConditions(query)
+	conditions = append([]string{"ticker = ?"}, conditions...)
+	args = append([]interface{}{ticker}, args...)
+	return tradeRepoImpl.read(tradeHistoryClause(conditions, query), args)
+}
+
+func (tradeRepoImpl LastTradesRepoImpl) ReadForUser(userId string, query usecases.TradeHistoryQuery) []entities.Trade {
+	conditions, args := tradeHistoryConditions(query)
+	conditions = append([]string{"(buyerUserId = ? OR sellerUserId = ?)"}, conditions...)
+	args = append([]interface{}{userId, userId}, args...)
+	return tradeRepoImpl.read(tradeHistoryClause(conditions, query), args)
+}
+
+// the conditions of the query but the ticker or the user, to be joined with AND
+func tradeHistoryConditions(query usecases.TradeHistoryQuery) ([]string, []interface{}) {
+	conditions := make([]string, 0)
+	args := make([]interface{}, 0)
+	if query.From != 0 {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, query.From)
+	}
+	if query.To != 0 {
+		conditions = append(conditions, "timestamp < ?")
+		args = append(args, query.To)
+	}
+	if query.Before != 0 {
+		conditions = append(conditions, "id < ?")
+		args = append(args, query.Before)
+	}
+	return conditions, args
+}
+
+func tradeHistoryClause(conditions []string, query usecases.TradeHistoryQuery) string {
+	// the limit is an int of our own, not a value from the request
+	return fmt.Sprintf("WHERE %s ORDER BY id DESC LIMIT %d", strings.Join(conditions, " AND "), query.Limit)
+}
+
+// clause .e.g. WHERE ... ORDER BY ..., its values bound to args
+func (tradeRepoImpl LastTradesRepoImpl) read(clause string, args []interface{}) []entities.Trade {
 	tableName := "lastTrades"
 
-	queryStr := fmt.Sprintf("SELECT * FROM %s", tableName)
+	queryStr := fmt.Sprintf("SELECT id, ticker, price, size, isBuyerMaker, timestamp, buyerFee, sellerFee, buyerOrderId, buyerUserId, sellerOrderId, sellerUserId FROM %s %s",
+		tableName, clause)
 
-	tradeRepoImpl.sqlDbHandler.Exec(queryStr)
-	rows := tradeRepoImpl.sqlDbHandler.Query(queryStr)
+	rows := tradeRepoImpl.sqlDbHandler.Query(queryStr, args...)
 
 	tradesList := make([]entities.Trade, 0)
 	for rows.Next() {
 		// TODO: put this somewhere else ??
 		var id int64
-		var price float64
-		var size float64
+		var ticker string
+		var price int64
+		var size int64
 		var isBuyerMaker bool
 		var timestamp int64
-		rows.Scan(&id, &price, &size, &isBuyerMaker, &timestamp)
-		user := entities.NewTradeWithTimeStamp(nil, nil, price, size, isBuyerMaker, timestamp)
-		tradesList = append(tradesList, *user)
+		var buyerFee int64
+		var sellerFee int64
+		var buyerOrderId int64
+		var buyerUserId string
+		var sellerOrderId int64
+		var sellerUserId string
+		if err := rows.Scan(&id, &ticker, &price, &size, &isBuyerMaker, &timestamp, &buyerFee, &sellerFee,
+			&buyerOrderId, &buyerUserId, &sellerOrderId, &sellerUserId); err != nil {
+			logrus.Errorf("Skipping unreadable trade: %s", err)
+			continue
+		}
+		trade := entities.NewTradeRecord(id, ticker, buyerOrderId, buyerUserId, sellerOrderId, sellerUserId,
+			entities.NewDecimalFromUnits(price), entities.NewDecimalFromUnits(size), isBuyerMaker, timestamp)
+		trade.SetFees(entities.NewDecimalFromUnits(buyerFee), entities.NewDecimalFromUnits(sellerFee))
+		tradesList = append(tradesList, *trade)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.Errorf("Unable to read %s: %s", tableName, err)
 	}
 
 	return tradesList
 }
+
+type SequencesRepoImpl struct {
+	sqlDbHandler SqlDbHandler
+}
+
+func NewSequencesRepoImpl(sqlDbHandler SqlDbHandler) *SequencesRepoImpl {
+	return &SequencesRepoImpl{
+		sqlDbHandler: sqlDbHandler,
+	}
+}
+
+// 0 if the sequence was never saved
+func (sequencesRepoImpl SequencesRepoImpl) Read(name string) int64 {
+	tableName := "sequences"
+
+	queryStr := fmt.Sprintf("SELECT last FROM %s WHERE name = ?", tableName)
+
+	rows := sequencesRepoImpl.sqlDbHandler.Query(queryStr, name)
+
+	var last int64
+	for rows.Next() {
+		if err := rows.Scan(&last); err != nil {
+			logrus.Errorf("Unable to read sequence %s: %s", name, err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		logrus.Errorf("Unable to read sequence %s: %s", name, err)
+	}
+	return last
+}
+
+func (sequencesRepoImpl SequencesRepoImpl) Update(name string, last int64) {
+	tableName := "sequences"
+	queryStr := fmt.Sprintf("INSERT INTO %s (name, last) VALUES (?,?) ON CONFLICT(name) DO UPDATE SET last = excluded.last",
+		tableName)
+
+	sequencesRepoImpl.sqlDbHandler.Exec(queryStr, name, last)
+}
+
+type FeesRepoImpl struct {
+	sqlDbHandler SqlDbHandler
+}
+
+func NewFeesRepoImpl(sqlDbHandler SqlDbHandler) *FeesRepoImpl {
+	return &FeesRepoImpl{
+		sqlDbHandler: sqlDbHandler,
+	}
+}
+
+func (feesRepoImpl FeesRepoImpl) Create(entry entities.FeeLedgerEntry) {
+	tableName := "fees"
+	queryStr := fmt.Sprintf("INSERT INTO %s (tradeId, userId, ticker, asset, fee, notional, isMaker, timestamp) VALUES (?,?,?,?,?,?,?,?)",
+		tableName)
+
+	feesRepoImpl.sqlDbHandler.Exec(queryStr,
+		entry.TradeId, entry.UserId, entry.Ticker, entry.Asset, entry.Fee.Units(), entry.Notional.Units(), entry.IsMaker, entry.Timestamp)
+}
+
+func (feesRepoImpl FeesRepoImpl) ReadSince(timestamp int64) []entities.FeeLedgerEntry {
+	tableName := "fees"
+
+	queryStr := fmt.Sprintf("SELECT tradeId, userId, ticker, asset, fee, notional, isMaker, timestamp FROM %s WHERE timestamp > ? ORDER BY timestamp, id",
+		tableName)
+
+	rows := feesRepoImpl.sqlDbHandler.Query(queryStr, timestamp)
+
+	entries := make([]entities.FeeLedgerEntry, 0)
+	for rows.Next() {
+		var entry entities.FeeLedgerEntry
+		var fee int64
+		var notional int64
+		if err := rows.Scan(&entry.TradeId, &entry.UserId, &entry.Ticker, &entry.Asset, &fee, &notional, &entry.IsMaker, &entry.Timestamp); err != nil {
+			logrus.Errorf("Skipping unreadable fee: %s", err)
+			continue
+		}
+		entry.Fee = entities.NewDecimalFromUnits(fee)
+		entry.Notional = entities.NewDecimalFromUnits(notional)
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.Errorf("Unable to read %s: %s", tableName, err)
+	}
+
+	return entries
+}
+
+type CandlesRepoImpl struct {
+	sqlDbHandler SqlDbHandler
+}
+
+func NewCandlesRepoImpl(sqlDbHandler SqlDbHandler) *CandlesRepoImpl {
+	return &CandlesRepoImpl{
+		sqlDbHandler: sqlDbHandler,
+	}
+}
+
+func (candlesRepoImpl CandlesRepoImpl) Save(candle entities.Candle) {
+	tableName := "candles"
+	queryStr := fmt.Sprintf("INSERT INTO %s (ticker, candleInterval, openTime, open, high, low, close, volume, quoteVolume, trades) VALUES (?,?,?,?,?,?,?,?,?,?) "+
+		"ON CONFLICT(ticker, candleInterval, openTime) DO UPDATE SET open = excluded.open, high = excluded.high, low = excluded.low, close = excluded.close, "+
+		"volume = excluded.volume, quoteVolume = excluded.quoteVolume, trades = excluded.trades",
+		tableName)
+
+	candlesRepoImpl.sqlDbHandler.Exec(queryStr,
+		candle.Ticker, string(candle.Interval), candle.OpenTime, candle.Open.Units(), candle.High.Units(), candle.Low.Units(), candle.Close.Units(),
+		candle.Volume.Units(), candle.QuoteVolume.Units(), candle.Trades)
+}
+
+func (candlesRepoImpl CandlesRepoImpl) Read(ticker string, interval entities.CandleInterval, query usecases.CandleQuery) []entities.Candle {
+	tableName := "candles"
+
+	conditions := []string{"ticker = ?", "candleInterval = ?"}
+	args := []interface{}{ticker, string(interval)}
+	if query.From != 0 {
+		conditions = append(conditions, "openTime >= ?")
+		args = append(args, query.From)
+	}
+	if query.To != 0 {
+		conditions = append(conditions, "openTime < ?")
+		args = append(args, query.To)
+	}
+	// the latest ones, the limit is an int of our own, not a value from the request
+	queryStr := fmt.Sprintf("SELECT ticker, candleInterval, openTime, open, high, low, close, volume, quoteVolume, trades FROM %s WHERE %s ORDER BY openTime DESC LIMIT %d",
+		tableName, strings.Join(conditions, " AND "), query.Limit)
+
+	rows := candlesRepoImpl.sqlDbHandler.Query(queryStr, args...)
+
+	candles := make([]entities.Candle, 0)
+	for rows.Next() {
+		var candle entities.Candle
+		var candleInterval string
+		var open, high, low, closePrice, volume, quoteVolume int64
+		if err := rows.Scan(&candle.Ticker, &candleInterval, &candle.OpenTime, &open, &high, &low, &closePrice, &volume, &quoteVolume, &candle.Trades); err != nil {
+			logrus.Errorf("Skipping unreadable candle: %s", err)
+			continue
+		}
+		candle.Interval = entities.CandleInterval(candleInterval)
+		candle.Open = entities.NewDecimalFromUnits(open)
+		candle.High = entities.NewDecimalFromUnits(high)
+		candle.Low = entities.NewDecimalFromUnits(low)
+		candle.Close = entities.NewDecimalFromUnits(closePrice)
+		candle.Volume = entities.NewDecimalFromUnits(volume)
+		candle.QuoteVolume = entities.NewDecimalFromUnits(quoteVolume)
+		candles = append(candles, candle)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.Errorf("Unable to read %s: %s", tableName, err)
+	}
+
+	// oldest first
+	for i, j := 0, len(candles)-1; i < j; i, j = i+1, j-1 {
+		candles[i], candles[j] = candles[j], candles[i]
+	}
+	return candles
+}
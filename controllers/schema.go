@@ -0,0 +1,422 @@
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// one step of the schema, applied once in its own transaction
+// the database files written before the migrations existed have no version: every step keeps what is already there
+type migration struct {
+	version     int
+	description string
+	up          func(db SqlDbHandler) error
+}
+
+// in order, append only: a step that was released is never changed
+var migrations = []migration{
+	{1, "tables of the first version", createFirstTables},
+	{2, "locked balances and tickers", addLockedBalancesAndTickers},
+	{3, "amounts as integer number of 10^-8 units", convertAmountsToUnits},
+	{4, "id sequences, time in force and stop orders", addSequencesAndOrderTypes},
+	{5, "self-trade prevention and fees", addSelfTradePreventionAndFees},
+	{6, "balances of any asset in their own table", moveBalancesToTheirTable},
+	{7, "orders and users of the trades", addTradeCounterparties},
+	{8, "candles", createCandles},
+}
+
+// the tables of version 6 for PostgreSQL, where amounts need BIGINT
+var postgresTables = migration{6, "tables of version 6", createPostgresTables}
+
+// bring the database to the latest version of the schema, a new database gets all the tables
+// the versions applied are in schemaMigrations
+func Migrate(db SqlDbHandler) error {
+	createTableSQL := `CREATE TABLE IF NOT EXISTS schemaMigrations (
+		version INTEGER PRIMARY KEY,
+		description TEXT,
+		appliedAt BIGINT
+	);`
+	if err := db.Exec(createTableSQL); err != nil {
+		return fmt.Errorf("unable to create table schemaMigrations: %w", err)
+	}
+
+	currentVersion, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	// the steps before were only ever run on SQLite: a new PostgreSQL database gets their result at once
+	if currentVersion == 0 && db.Dialect() == PostgresDialect {
+		if err := applyMigration(db, postgresTables); err != nil {
+			return fmt.Errorf("unable to create the tables: %w", err)
+		}
+		currentVersion = postgresTables.version
+		logrus.Infof("Database created at version %d", currentVersion)
+	}
+	for _, m := range migrations {
+		if m.version <= currentVersion {
+			continue
+		}
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("unable to migrate the database to version %d (%s): %w", m.version, m.description, err)
+		}
+		logrus.Infof("Database migrated to version %d: %s", m.version, m.description)
+	}
+	return nil
+}
+
+// the tables of the exchange emptied, the schema is kept
+var exchangeTables = []string{"users", "balances", "buyOrders", "sellOrders", "stopOrders", "lastTrades", "sequences", "fees", "candles"}
+
+// forget every user, order and trade, .e.g. on a fresh start. The database must be migrated
+func ResetDatabase(db SqlDbHandler) error {
+	if err := db.Begin(); err != nil {
+		return err
+	}
+	for _, table := range exchangeTables {
+		if err := db.Exec(fmt.Sprintf(`DELETE FROM %s`, table)); err != nil {
+			db.Rollback()
+			return fmt.Errorf("unable to empty table %s: %w", table, err)
+		}
+	}
+	return db.Commit()
+}
+
+func schemaVersion(db SqlDbHandler) (int, error) {
+	rows := db.Query(`SELECT COALESCE(MAX(version), 0) FROM schemaMigrations`)
+	var version int
+	for rows.Next() {
+		if err := rows.Scan(&version); err != nil {
+			return 0, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("unable to read the schema version: %w", err)
+	}
+	return version, nil
+}
+
+func applyMigration(db SqlDbHandler, m migration) error {
+	if err := db.Begin(); err != nil {
+		return err
+	}
+	err := m.up(db)
+	if err == nil {
+		err = db.Exec(`INSERT INTO schemaMigrations (version, description, appliedAt) VALUES (?,?,?)`,
+			m.version, m.description, time.Now().UnixNano())
+	}
+	if err != nil {
+		db.Rollback()
+		return err
+	}
+	return db.Commit()
+}
+
+// the declared type of the column, "" if the table has no such column
+func columnType(db SqlDbHandler, table string, column string) (string, error) {
+	rows := db.Query(`SELECT type FROM pragma_table_info(?) WHERE name = ?`, table, column)
+	var declaredType string
+	for rows.Next() {
+		if err := rows.Scan(&declaredType); err != nil {
+			return "", err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("unable to read the columns of %s: %w", table, err)
+	}
+	return declaredType, nil
+}
+
+func addColumnIfMissing(db SqlDbHandler, table string, column string, definition string) error {
+	declaredType, err := columnType(db, table, column)
+	if err != nil || declaredType != "" {
+		return err
+	}
+	if err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN "%s" %s`, table, column, definition)); err != nil {
+		return fmt.Errorf("unable to add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+func execAll(db SqlDbHandler, statements ...string) error {
+	for _, statement := range statements {
+		if err := db.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createFirstTables(db SqlDbHandler) error {
+	return execAll(db,
+		`CREATE TABLE IF NOT EXISTS users (
+			"userid" TEXT PRIMARY KEY,
+			"ETH" FLOAT,
+			"USD" FLOAT
+		);`,
+		`CREATE TABLE IF NOT EXISTS buyOrders (
+			"id" INTEGER PRIMARY KEY,
+			"userid" TEXT,
+			"size" INTEGER,
+			"price" INTEGER,
+			"timestamp" INTEGER
+		);`,
+		`CREATE TABLE IF NOT EXISTS sellOrders (
+			"id" INTEGER PRIMARY KEY,
+			"userid" TEXT,
+			"size" INTEGER,
+			"price" INTEGER,
+			"timestamp" INTEGER
+		);`,
+		`CREATE TABLE IF NOT EXISTS lastTrades (
+			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+			"price" FLOAT,
+			"size" FLOAT,
+			"isBuyerMaker" BOOLEAN,
+			"timestamp" INTEGER
+		);`,
+	)
+}
+
+// ETHUSD was the only ticker before the instruments
+func addLockedBalancesAndTickers(db SqlDbHandler) error {
+	for _, column := range []string{"ETHLocked", "USDLocked"} {
+		if err := addColumnIfMissing(db, "users", column, "FLOAT DEFAULT 0"); err != nil {
+			return err
+		}
+	}
+	for _, table := range []string{"buyOrders", "sellOrders", "lastTrades"} {
+		if err := addColumnIfMissing(db, table, "ticker", "TEXT DEFAULT 'ETHUSD'"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the amounts used to be floats, a FLOAT balance column tells the database is from then
+// prices and sizes are stored as INTEGER number of 10^-8 units (entities.Decimal.Units()) so nothing is rounded on the way in or out
+func convertAmountsToUnits(db SqlDbHandler) error {
+	declaredType, err := columnType(db, "users", "ETH")
+	if err != nil || declaredType != "FLOAT" {
+		return err
+	}
+	toUnits := func(column string) string {
+		return fmt.Sprintf(`CAST(ROUND("%s" * 100000000) AS INTEGER)`, column)
+	}
+	return execAll(db,
+		`ALTER TABLE users RENAME TO usersFloat`,
+		`CREATE TABLE users (
+			"userid" TEXT PRIMARY KEY,
+			"ETH" INTEGER,
+			"USD" INTEGER,
+			"ETHLocked" INTEGER,
+			"USDLocked" INTEGER
+		);`,
+		fmt.Sprintf(`INSERT INTO users (userid, ETH, USD, ETHLocked, USDLocked) SELECT userid, %s, %s, %s, %s FROM usersFloat`,
+			toUnits("ETH"), toUnits("USD"), toUnits("ETHLocked"), toUnits("USDLocked")),
+		`DROP TABLE usersFloat`,
+		fmt.Sprintf(`UPDATE buyOrders SET size = %s, price = %s`, toUnits("size"), toUnits("price")),
+		fmt.Sprintf(`UPDATE sellOrders SET size = %s, price = %s`, toUnits("size"), toUnits("price")),
+		`ALTER TABLE lastTrades RENAME TO lastTradesFloat`,
+		`CREATE TABLE lastTrades (
+			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+			"ticker" TEXT,
+			"price" INTEGER,
+			"size" INTEGER,
+			"isBuyerMaker" BOOLEAN,
+			"timestamp" INTEGER
+		);`,
+		fmt.Sprintf(`INSERT INTO lastTrades (id, ticker, price, size, isBuyerMaker, timestamp) SELECT id, ticker, %s, %s, isBuyerMaker, timestamp FROM lastTradesFloat`,
+			toUnits("price"), toUnits("size")),
+		`DROP TABLE lastTradesFloat`,
+	)
+}
+
+func addSequencesAndOrderTypes(db SqlDbHandler) error {
+	// last order id and trade id handed out, so they keep increasing after a restart
+	err := execAll(db,
+		`CREATE TABLE IF NOT EXISTS sequences (
+			"name" TEXT PRIMARY KEY,
+			"last" INTEGER
+		);`,
+		`CREATE TABLE IF NOT EXISTS stopOrders (
+			"id" INTEGER PRIMARY KEY,
+			"userid" TEXT,
+			"size" INTEGER,
+			"price" INTEGER,
+			"timestamp" INTEGER,
+			"ticker" TEXT,
+			"timeInForce" TEXT,
+			"expiresAt" INTEGER,
+			"isBid" BOOLEAN,
+			"orderType" TEXT,
+			"stopPrice" INTEGER
+		);`,
+	)
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"buyOrders", "sellOrders"} {
+		if err := addColumnIfMissing(db, table, "timeInForce", "TEXT DEFAULT 'GTC'"); err != nil {
+			return err
+		}
+		if err := addColumnIfMissing(db, table, "expiresAt", "INTEGER DEFAULT 0"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addSelfTradePreventionAndFees(db SqlDbHandler) error {
+	if err := addColumnIfMissing(db, "users", "selfTradePrevention", "TEXT DEFAULT 'NONE'"); err != nil {
+		return err
+	}
+	for _, column := range []string{"buyerFee", "sellerFee"} {
+		if err := addColumnIfMissing(db, "lastTrades", column, "INTEGER DEFAULT 0"); err != nil {
+			return err
+		}
+	}
+	// fee ledger, one row per side of each trade
+	return db.Exec(`CREATE TABLE IF NOT EXISTS fees (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"tradeId" INTEGER,
+		"userId" TEXT,
+		"ticker" TEXT,
+		"asset" TEXT,
+		"fee" INTEGER,
+		"notional" INTEGER,
+		"isMaker" BOOLEAN,
+		"timestamp" INTEGER
+	);`)
+}
+
+// the users table had one column per asset, only ETH and USD
+func moveBalancesToTheirTable(db SqlDbHandler) error {
+	return execAll(db,
+		`CREATE TABLE balances (
+			"userid" TEXT,
+			"asset" TEXT,
+			"available" INTEGER,
+			"locked" INTEGER,
+			PRIMARY KEY ("userid", "asset")
+		);`,
+		`INSERT INTO balances (userid, asset, available, locked) SELECT userid, 'ETH', COALESCE(ETH, 0), COALESCE(ETHLocked, 0) FROM users`,
+		`INSERT INTO balances (userid, asset, available, locked) SELECT userid, 'USD', COALESCE(USD, 0), COALESCE(USDLocked, 0) FROM users`,
+		`ALTER TABLE users RENAME TO usersWithAssets`,
+		`CREATE TABLE users (
+			"userid" TEXT PRIMARY KEY,
+			"selfTradePrevention" TEXT
+		);`,
+		`INSERT INTO users (userid, selfTradePrevention) SELECT userid, selfTradePrevention FROM usersWithAssets`,
+		`DROP TABLE usersWithAssets`,
+	)
+}
+
+// from here on the steps run on SQLite and PostgreSQL alike
+// the trades saved before have no orders nor users: 0 and ”
+func addTradeCounterparties(db SqlDbHandler) error {
+	return execAll(db,
+		`ALTER TABLE lastTrades ADD COLUMN buyerOrderId BIGINT NOT NULL DEFAULT 0;`,
+		`ALTER TABLE lastTrades ADD COLUMN buyerUserId TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE lastTrades ADD COLUMN sellerOrderId BIGINT NOT NULL DEFAULT 0;`,
+		`ALTER TABLE lastTrades ADD COLUMN sellerUserId TEXT NOT NULL DEFAULT '';`,
+		// the history is read newest first, by ticker or by user
+		`CREATE INDEX lastTradesByTicker ON lastTrades (ticker, id);`,
+		`CREATE INDEX lastTradesByBuyer ON lastTrades (buyerUserId, id);`,
+		`CREATE INDEX lastTradesBySeller ON lastTrades (sellerUserId, id);`,
+	)
+}
+
+// interval is a keyword of PostgreSQL
+func createCandles(db SqlDbHandler) error {
+	return execAll(db,
+		`CREATE TABLE candles (
+			ticker TEXT,
+			candleInterval TEXT,
+			openTime BIGINT,
+			open BIGINT,
+			high BIGINT,
+			low BIGINT,
+			close BIGINT,
+			volume BIGINT,
+			quoteVolume BIGINT,
+			trades BIGINT,
+			PRIMARY KEY (ticker, candleInterval, openTime)
+		);`,
+	)
+}
+
+func createPostgresTables(db SqlDbHandler) error {
+	return execAll(db,
+		`CREATE TABLE users (
+			userid TEXT PRIMARY KEY,
+			selfTradePrevention TEXT
+		);`,
+		`CREATE TABLE balances (
+			userid TEXT,
+			asset TEXT,
+			available BIGINT,
+			locked BIGINT,
+			PRIMARY KEY (userid, asset)
+		);`,
+		`CREATE TABLE buyOrders (
+			id BIGINT PRIMARY KEY,
+			userid TEXT,
+			size BIGINT,
+			price BIGINT,
+			timestamp BIGINT,
+			ticker TEXT,
+			timeInForce TEXT,
+			expiresAt BIGINT
+		);`,
+		`CREATE TABLE sellOrders (
+			id BIGINT PRIMARY KEY,
+			userid TEXT,
+			size BIGINT,
+			price BIGINT,
+			timestamp BIGINT,
+			ticker TEXT,
+			timeInForce TEXT,
+			expiresAt BIGINT
+		);`,
+		`CREATE TABLE stopOrders (
+			id BIGINT PRIMARY KEY,
+			userid TEXT,
+			size BIGINT,
+			price BIGINT,
+			timestamp BIGINT,
+			ticker TEXT,
+			timeInForce TEXT,
+			expiresAt BIGINT,
+			isBid BOOLEAN,
+			orderType TEXT,
+			stopPrice BIGINT
+		);`,
+		`CREATE TABLE lastTrades (
+			id BIGINT PRIMARY KEY,
+			ticker TEXT,
+			price BIGINT,
+			size BIGINT,
+			isBuyerMaker BOOLEAN,
+			timestamp BIGINT,
+			buyerFee BIGINT,
+			sellerFee BIGINT
+		);`,
+		`CREATE TABLE fees (
+			id BIGSERIAL PRIMARY KEY,
+			tradeId BIGINT,
+			userId TEXT,
+			ticker TEXT,
+			asset TEXT,
+			fee BIGINT,
+			notional BIGINT,
+			isMaker BOOLEAN,
+			timestamp BIGINT
+		);`,
+		`CREATE TABLE sequences (
+			name TEXT PRIMARY KEY,
+			last BIGINT
+		);`,
+	)
+}
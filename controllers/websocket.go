@@ -0,0 +1,552 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trandinhkhoa/crypto-exchange/entities"
+	"github.com/trandinhkhoa/crypto-exchange/usecases"
+	"golang.org/x/net/websocket"
+)
+
+// what a client sends on /ws .e.g. {"Op": "subscribe", "Id": 1, "Channels": ["trades:ETHUSD", "book:ETHUSD:depth20"]}
+type WsRequest struct {
+	// subscribe, unsubscribe or ping
+	Op string
+	// given back in the answer to the request
+	Id       int64
+	Channels []string
+	// the user of the user channel
+	UserId string
+}
+
+// what the server sends on /ws, Type says which fields are set
+type WsMessage struct {
+	Type string
+	// ack, error and pong: the request answered
+	Id       int64    `json:",omitempty"`
+	Op       string   `json:",omitempty"`
+	Channels []string `json:",omitempty"`
+	// error only
+	Msg string `json:",omitempty"`
+	// update only
+	Channel string `json:",omitempty"`
+	// one sequence per channel, from 1: a gap means updates were lost
+	Seq int64 `json:",omitempty"`
+	// the first update of a channel is the whole state, the next ones what changed
+	Snapshot bool        `json:",omitempty"`
+	Data     interface{} `json:",omitempty"`
+	// heartbeat only, unix nano
+	Timestamp int64 `json:",omitempty"`
+}
+
+const (
+	ackMessage       = "ack"
+	errorMessage     = "error"
+	pongMessage      = "pong"
+	heartbeatMessage = "heartbeat"
+	updateMessage    = "update"
+)
+
+const (
+	subscribeOp   = "subscribe"
+	unsubscribeOp = "unsubscribe"
+	pingOp        = "ping"
+)
+
+// the channels of /ws
+const (
+	// trades:ETHUSD, the new trades oldest first
+	tradesChannel = "trades"
+	// book:ETHUSD:depth20, both sides of the book every time they change, 20 levels if the depth is omitted
+	bookChannel = "book"
+	// l2:ETHUSD, every price level then the levels that changed, see L2UpdateResponse
+	l2Channel = "l2"
+	// l3:ETHUSD, every order then the order events, see L3UpdateResponse
+	l3Channel = "l3"
+	// candles:ETHUSD:5m, the latest candle of the interval every time a trade changes it, 1m if the interval is omitted
+	candlesChannel = "candles"
+	// ticker:ETHUSD or ticker:* for every ticker, the last price and the best prices
+	tickerChannel = "ticker"
+	// user, the balance and the orders of the UserId of the request
+	userChannel = "user"
+)
+
+const defaultBookDepth = 20
+
+// number of messages a client can be behind before it is disconnected
+const wsClientBuffer = 256
+
+type BookUpdateResponse struct {
+	Bids []LimitResponse
+	Asks []LimitResponse
+}
+
+// the price levels that changed, Volume is 0 when the level is gone
+// Sequence follows the one before by 1, else changes were lost: resync with GET /book/:ticker/l2
+type L2UpdateResponse struct {
+	Sequence int64
+	Changes  []LevelChangeResponse
+}
+
+type LevelChangeResponse struct {
+	IsBid  bool
+	Price  entities.Decimal
+	Volume entities.Decimal
+}
+
+// the order events, oldest first. The Sequence of each one follows the one before by 1,
+// else events were lost: resync with GET /book/:ticker/l3
+type L3UpdateResponse struct {
+	Events []OrderEventResponse
+}
+
+type OrderEventResponse struct {
+	Sequence int64
+	// ADDED, REDUCED, EXECUTED or REMOVED
+	Type    entities.OrderEventType
+	OrderId int64
+	IsBid   bool
+	Price   entities.Decimal
+	// what the event added to or took from the order
+	Size          entities.Decimal
+	RemainingSize entities.Decimal
+	// EXECUTED only
+	TradeId   int64 `json:",omitempty"`
+	Timestamp int64
+}
+
+type TickerResponse struct {
+	Ticker    string
+	LastPrice entities.Decimal
+	// 0 when that side is empty
+	BestBid entities.Decimal
+	BestAsk entities.Decimal
+}
+
+type wsChannel struct {
+	kind string
+	// every ticker for ticker:*
+	tickers  []string
+	depth    int
+	interval entities.CandleInterval
+}
+
+// .e.g. trades:ETHUSD, book:ETHUSD:depth20, l2:ETHUSD, l3:ETHUSD, candles:ETHUSD:5m, ticker:*, user
+func (handler WebServiceHandler) parseChannel(name string) (wsChannel, error) {
+	parts := strings.Split(name, ":")
+	channel := wsChannel{kind: parts[0]}
+	switch {
+	case channel.kind == userChannel && len(parts) == 1:
+		return channel, nil
+	case channel.kind == tickerChannel && len(parts) == 2 && parts[1] == "*":
+		for _, instrument := range handler.Ex.GetInstruments() {
+			channel.tickers = append(channel.tickers, instrument.Ticker)
+		}
+		return channel, nil
+	case channel.kind == tradesChannel && len(parts) == 2,
+		channel.kind == l2Channel && len(parts) == 2,
+		channel.kind == l3Channel && len(parts) == 2,
+		channel.kind == tickerChannel && len(parts) == 2,
+		channel.kind == bookChannel && (len(parts) == 2 || len(parts) == 3),
+		channel.kind == candlesChannel && (len(parts) == 2 || len(parts) == 3):
+		if _, err := handler.Ex.GetInstrument(parts[1]); err != nil {
+			return channel, err
+		}
+		channel.tickers = []string{parts[1]}
+	default:
+		return channel, fmt.Errorf("unknown channel %s", name)
+	}
+	if channel.kind == bookChannel {
+		channel.depth = defaultBookDepth
+		if len(parts) == 3 {
+			depth, err := strconv.Atoi(strings.TrimPrefix(parts[2], "depth"))
+			if !strings.HasPrefix(parts[2], "depth") || err != nil || depth < 1 || depth > usecases.MarketDataDepth {
+				return channel, fmt.Errorf("the depth of %s must be depth1 to depth%d", name, usecases.MarketDataDepth)
+			}
+			channel.depth = depth
+		}
+	}
+	if channel.kind == candlesChannel {
+		channel.interval = entities.OneMinute
+		if len(parts) == 3 {
+			interval, err := entities.ParseCandleInterval(parts[2])
+			if err != nil {
+				return channel, err
+			}
+			channel.interval = interval
+		}
+	}
+	return channel, nil
+}
+
+// one connection to /ws
+type wsClient struct {
+	ws  *websocket.Conn
+	out chan WsMessage
+	// closed with the connection
+	done      chan struct{}
+	closeOnce sync.Once
+	// by name, only used by the goroutine reading the requests
+	subscriptions map[string]*wsSubscription
+}
+
+func newWsClient(ws *websocket.Conn) *wsClient {
+	return &wsClient{
+		ws:            ws,
+		out:           make(chan WsMessage, wsClientBuffer),
+		done:          make(chan struct{}),
+		subscriptions: make(map[string]*wsSubscription, 0),
+	}
+}
+
+// never waits: a client too slow to read what it is sent is disconnected
+func (client *wsClient) push(msg WsMessage) {
+	select {
+	case <-client.done:
+	case client.out <- msg:
+	default:
+		logrus.Warnf("Websocket client %s too slow, disconnected", client.ws.Request().RemoteAddr)
+		client.close()
+	}
+}
+
+func (client *wsClient) close() {
+	client.closeOnce.Do(func() {
+		close(client.done)
+		client.ws.Close()
+	})
+}
+
+// send what is pushed, and a heartbeat every interval
+func (client *wsClient) write(heartbeatInterval time.Duration) {
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		var msg WsMessage
+		select {
+		case <-client.done:
+			return
+		case msg = <-client.out:
+		case now := <-heartbeat.C:
+			msg = WsMessage{Type: heartbeatMessage, Timestamp: now.UnixNano()}
+		}
+		jsonMsg, _ := json.Marshal(msg)
+		if err := websocket.Message.Send(client.ws, string(jsonMsg)); err != nil {
+			client.close()
+			return
+		}
+	}
+}
+
+type wsSubscription struct {
+	client *wsClient
+	name   string
+	// the user channel
+	userId     string
+	marketData []*usecases.MarketDataSubscription
+	// the updates are pushed in the order of their seq, none once closed
+	mu     sync.Mutex
+	seq    int64
+	closed bool
+}
+
+func (sub *wsSubscription) update(data interface{}, snapshot bool) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return
+	}
+	sub.seq += 1
+	sub.client.push(WsMessage{Type: updateMessage, Channel: sub.name, Seq: sub.seq, Snapshot: snapshot, Data: data})
+}
+
+// the user channels of every client, by user id
+type userStreams struct {
+	mu            sync.Mutex
+	subscriptions map[string]map[*wsSubscription]bool
+}
+
+func newUserStreams() *userStreams {
+	return &userStreams{
+		subscriptions: make(map[string]map[*wsSubscription]bool, 0),
+	}
+}
+
+// the user as it is comes first
+func (streams *userStreams) add(sub *wsSubscription, user *UserResponse) {
+	streams.mu.Lock()
+	defer streams.mu.Unlock()
+	if streams.subscriptions[sub.userId] == nil {
+		streams.subscriptions[sub.userId] = make(map[*wsSubscription]bool, 0)
+	}
+	streams.subscriptions[sub.userId][sub] = true
+	sub.update(user, true)
+}
+
+func (streams *userStreams) remove(sub *wsSubscription) {
+	streams.mu.Lock()
+	defer streams.mu.Unlock()
+	delete(streams.subscriptions[sub.userId], sub)
+}
+
+func (streams *userStreams) publish(userId string, user *UserResponse) {
+	streams.mu.Lock()
+	defer streams.mu.Unlock()
+	for sub := range streams.subscriptions[userId] {
+		sub.update(user, false)
+	}
+}
+
+// one websocket for everything, see WsRequest and WsMessage
+func (handler WebServiceHandler) WebSocketHandler(ws *websocket.Conn) {
+	client := newWsClient(ws)
+	go client.write(handler.HeartbeatInterval)
+	defer handler.unsubscribeAll(client)
+	defer client.close()
+
+	for {
+		var raw string
+		if err := websocket.Message.Receive(ws, &raw); err != nil {
+			return
+		}
+		var request WsRequest
+		if err := json.Unmarshal([]byte(raw), &request); err != nil {
+			client.push(WsMessage{Type: errorMessage, Msg: fmt.Sprintf("invalid request: %s", err)})
+			continue
+		}
+		var err error
+		switch request.Op {
+		case subscribeOp:
+			err = handler.subscribe(client, request)
+		case unsubscribeOp:
+			err = handler.unsubscribe(client, request)
+		case pingOp:
+			client.push(WsMessage{Type: pongMessage, Id: request.Id, Op: request.Op})
+			continue
+		default:
+			err = fmt.Errorf("unknown op %s", request.Op)
+		}
+		if err != nil {
+			client.push(WsMessage{Type: errorMessage, Id: request.Id, Op: request.Op, Msg: err.Error()})
+		}
+	}
+}
+
+// all the channels or none, the ones already subscribed to are kept as they are
+func (handler WebServiceHandler) subscribe(client *wsClient, request WsRequest) error {
+	if len(request.Channels) == 0 {
+		return fmt.Errorf("no channel")
+	}
+	channels := make(map[string]wsChannel, 0)
+	for _, name := range request.Channels {
+		channel, err := handler.parseChannel(name)
+		if err != nil {
+			return err
+		}
+		if channel.kind == userChannel {
+			if _, ok := handler.Ex.GetUser(request.UserId); !ok {
+				return fmt.Errorf("userId %s does not exist", request.UserId)
+			}
+			if sub, ok := client.subscriptions[name]; ok && sub.userId != request.UserId {
+				return fmt.Errorf("already subscribed to the user channel of %s", sub.userId)
+			}
+		}
+		channels[name] = channel
+	}
+
+	// kept only once every channel is subscribed to
+	subscribed := make(map[string]*wsSubscription, 0)
+	started := make([]func(), 0)
+	for _, name := range request.Channels {
+		if _, ok := client.subscriptions[name]; ok {
+			continue
+		}
+		if _, ok := subscribed[name]; ok {
+			continue
+		}
+		channel := channels[name]
+		sub := &wsSubscription{client: client, name: name}
+		subscribed[name] = sub
+		if channel.kind == userChannel {
+			sub.userId = request.UserId
+			started = append(started, func() {
+				user, _ := handler.Ex.GetUser(sub.userId)
+				handler.userStreams.add(sub, toUserResponse(user))
+			})
+			continue
+		}
+		for _, ticker := range channel.tickers {
+			// subscribed to before the ack, so nothing happens in between
+			marketData, err := handler.Ex.SubscribeMarketData(ticker, marketDataBuffer)
+			if err != nil {
+				for _, sub := range subscribed {
+					handler.closeSubscription(sub)
+				}
+				return err
+			}
+			sub.marketData = append(sub.marketData, marketData)
+			toData := marketDataToData(channel, ticker)
+			started = append(started, func() {
+				go forwardMarketData(sub, marketData, toData)
+			})
+		}
+	}
+	for name, sub := range subscribed {
+		client.subscriptions[name] = sub
+	}
+	client.push(WsMessage{Type: ackMessage, Id: request.Id, Op: request.Op, Channels: request.Channels})
+	for _, start := range started {
+		start()
+	}
+	return nil
+}
+
+// the channels not subscribed to are ignored
+func (handler WebServiceHandler) unsubscribe(client *wsClient, request WsRequest) error {
+	if len(request.Channels) == 0 {
+		return fmt.Errorf("no channel")
+	}
+	for _, name := range request.Channels {
+		if sub, ok := client.subscriptions[name]; ok {
+			handler.closeSubscription(sub)
+			delete(client.subscriptions, name)
+		}
+	}
+	client.push(WsMessage{Type: ackMessage, Id: request.Id, Op: request.Op, Channels: request.Channels})
+	return nil
+}
+
+func (handler WebServiceHandler) unsubscribeAll(client *wsClient) {
+	for name, sub := range client.subscriptions {
+		handler.closeSubscription(sub)
+		delete(client.subscriptions, name)
+	}
+}
+
+func (handler WebServiceHandler) closeSubscription(sub *wsSubscription) {
+	sub.mu.Lock()
+	sub.closed = true
+	sub.mu.Unlock()
+	if sub.userId != "" {
+		handler.userStreams.remove(sub)
+	}
+	for _, marketData := range sub.marketData {
+		marketData.Close()
+	}
+}
+
+// the first event makes the snapshot
+func forwardMarketData(sub *wsSubscription, marketData *usecases.MarketDataSubscription, toData func(usecases.MarketDataEvent, bool) (interface{}, bool)) {
+	first := true
+	for event := range marketData.Events() {
+		if data, ok := toData(event, first); ok {
+			sub.update(data, first)
+		}
+		first = false
+	}
+	if marketData.Dropped() {
+		logrus.Warnf("Websocket client %s too slow for %s, disconnected", sub.client.ws.Request().RemoteAddr, sub.name)
+		sub.client.close()
+	}
+}
+
+// what a channel makes of the market data events of one ticker, false if there is nothing to send
+func marketDataToData(channel wsChannel, ticker string) func(usecases.MarketDataEvent, bool) (interface{}, bool) {
+	switch channel.kind {
+	case tradesChannel:
+		return func(event usecases.MarketDataEvent, first bool) (interface{}, bool) {
+			return toTradeResponses(event.Trades), first || len(event.Trades) > 0
+		}
+	case bookChannel:
+		var bids []usecases.PriceLevel
+		var asks []usecases.PriceLevel
+		return func(event usecases.MarketDataEvent, first bool) (interface{}, bool) {
+			changed := first
+			if event.BuysChanged {
+				newBids := topPriceLevels(event.BestBuys, channel.depth)
+				changed = changed || !usecases.SamePriceLevels(newBids, bids)
+				bids = newBids
+			}
+			if event.SellsChanged {
+				newAsks := topPriceLevels(event.BestSells, channel.depth)
+				changed = changed || !usecases.SamePriceLevels(newAsks, asks)
+				asks = newAsks
+			}
+			return BookUpdateResponse{Bids: toLimitResponses(bids), Asks: toLimitResponses(asks)}, changed
+		}
+	case l2Channel:
+		return func(event usecases.MarketDataEvent, first bool) (interface{}, bool) {
+			if first {
+				return toL2BookResponse(*event.Book), true
+			}
+			changes := make([]LevelChangeResponse, 0, len(event.LevelChanges))
+			for _, change := range event.LevelChanges {
+				changes = append(changes, LevelChangeResponse{IsBid: change.IsBid, Price: change.Price, Volume: change.Volume})
+			}
+			return L2UpdateResponse{Sequence: event.BookSequence, Changes: changes}, len(changes) > 0
+		}
+	case candlesChannel:
+		return func(event usecases.MarketDataEvent, first bool) (interface{}, bool) {
+			for _, candle := range event.Candles {
+				if candle.Interval == channel.interval {
+					response := toCandleResponse(candle)
+					return &response, true
+				}
+			}
+			// null before the first trade of the ticker
+			var none *CandleResponse
+			return none, first
+		}
+	case l3Channel:
+		return func(event usecases.MarketDataEvent, first bool) (interface{}, bool) {
+			if first {
+				return toL3BookResponse(*event.Orders), true
+			}
+			events := make([]OrderEventResponse, 0, len(event.OrderEvents))
+			for _, orderEvent := range event.OrderEvents {
+				events = append(events, OrderEventResponse{
+					Sequence:      orderEvent.Sequence,
+					Type:          orderEvent.Type,
+					OrderId:       orderEvent.OrderId,
+					IsBid:         orderEvent.IsBid,
+					Price:         orderEvent.Price,
+					Size:          orderEvent.Size,
+					RemainingSize: orderEvent.RemainingSize,
+					TradeId:       orderEvent.TradeId,
+					Timestamp:     orderEvent.Timestamp,
+				})
+			}
+			return L3UpdateResponse{Events: events}, len(events) > 0
+		}
+	default:
+		last := TickerResponse{Ticker: ticker}
+		return func(event usecases.MarketDataEvent, first bool) (interface{}, bool) {
+			current := last
+			if len(event.Trades) > 0 {
+				current.LastPrice = event.Trades[len(event.Trades)-1].GetPrice()
+			}
+			if event.BuysChanged {
+				current.BestBid = bestPrice(event.BestBuys)
+			}
+			if event.SellsChanged {
+				current.BestAsk = bestPrice(event.BestSells)
+			}
+			changed := first || current != last
+			last = current
+			return current, changed
+		}
+	}
+}
+
+func bestPrice(levels []usecases.PriceLevel) entities.Decimal {
+	if len(levels) == 0 {
+		return entities.ZeroDecimal
+	}
+	return levels[0].Price
+}
@@ -0,0 +1,101 @@
+package entities
+
+import "fmt"
+
+// the time a candle covers .e.g. 1m, 1d
+type CandleInterval string
+
+const (
+	OneMinute      CandleInterval = "1m"
+	FiveMinutes    CandleInterval = "5m"
+	FifteenMinutes CandleInterval = "15m"
+	OneHour        CandleInterval = "1h"
+	OneDay         CandleInterval = "1d"
+)
+
+// the candles of every ticker are built at each of these intervals
+var CandleIntervals = []CandleInterval{OneMinute, FiveMinutes, FifteenMinutes, OneHour, OneDay}
+
+var candleIntervalDurations = map[CandleInterval]int64{
+	OneMinute:      60 * 1e9,
+	FiveMinutes:    5 * 60 * 1e9,
+	FifteenMinutes: 15 * 60 * 1e9,
+	OneHour:        60 * 60 * 1e9,
+	OneDay:         24 * 60 * 60 * 1e9,
+}
+
+func ParseCandleInterval(s string) (CandleInterval, error) {
+	interval := CandleInterval(s)
+	if _, ok := candleIntervalDurations[interval]; !ok {
+		return "", fmt.Errorf("unknown candle interval %s, must be one of %v", s, CandleIntervals)
+	}
+	return interval, nil
+}
+
+// in nanoseconds
+func (interval CandleInterval) Duration() int64 {
+	return candleIntervalDurations[interval]
+}
+
+// the start of the candle the time falls in, both unix nano
+// the candles are aligned on the unix epoch: a day starts at midnight UTC
+func (interval CandleInterval) OpenTime(timestamp int64) int64 {
+	return timestamp - timestamp%interval.Duration()
+}
+
+// the trades of a ticker during an interval, a candle without trades does not exist
+type Candle struct {
+	Ticker   string
+	Interval CandleInterval
+	// unix nano, the candle covers OpenTime included to OpenTime + the interval excluded
+	OpenTime int64
+	Open     Decimal
+	High     Decimal
+	Low      Decimal
+	Close    Decimal
+	// in the base asset
+	Volume Decimal
+	// in the quote asset
+	QuoteVolume Decimal
+	Trades      int64
+}
+
+// the candle the trade opens
+func NewCandle(interval CandleInterval, trade Trade) Candle {
+	return Candle{
+		Ticker:      trade.GetTicker(),
+		Interval:    interval,
+		OpenTime:    interval.OpenTime(trade.GetTimeStamp()),
+		Open:        trade.GetPrice(),
+		High:        trade.GetPrice(),
+		Low:         trade.GetPrice(),
+		Close:       trade.GetPrice(),
+		Volume:      trade.GetSize(),
+		QuoteVolume: trade.GetSize().Mul(trade.GetPrice()),
+		Trades:      1,
+	}
+}
+
+// the unix nano the candle ends at, excluded
+func (c Candle) CloseTime() int64 {
+	return c.OpenTime + c.Interval.Duration()
+}
+
+// false if the trade belongs to a later candle
+func (c Candle) Covers(trade Trade) bool {
+	return trade.GetTimeStamp() < c.CloseTime()
+}
+
+// the trades come in the order they were matched
+func (c *Candle) AddTrade(trade Trade) {
+	if trade.GetPrice().GreaterThan(c.High) {
+		c.High = trade.GetPrice()
+	}
+	if trade.GetPrice().LessThan(c.Low) {
+		c.Low = trade.GetPrice()
+	}
+	c.Close = trade.GetPrice()
+	c.Volume = c.Volume.Add(trade.GetSize())
+	c.QuoteVolume = c.QuoteVolume.Add(trade.GetSize().Mul(trade.GetPrice()))
+	c.Trades += 1
+}
@@ -0,0 +1,48 @@
+package entities_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trandinhkhoa/crypto-exchange/entities"
+)
+
+func TestCandle(t *testing.T) {
+	minute := int64(60 * 1e9)
+	// 2023-10-03 22:00:30 UTC
+	timestamp := int64(1696370430) * 1e9
+	trade := func(id int64, price float64, size float64, timestamp int64) entities.Trade {
+		return *entities.NewTradeRecord(id, "ETHUSD", 1, "john", 2, "jane", dec(price), dec(size), true, timestamp)
+	}
+
+	interval, err := entities.ParseCandleInterval("5m")
+	assert.NoError(t, err)
+	assert.Equal(t, entities.FiveMinutes, interval)
+	_, err = entities.ParseCandleInterval("2m")
+	assert.Error(t, err)
+	// on the unix epoch: a day starts at midnight UTC
+	assert.Equal(t, int64(1696370400)*1e9, entities.OneMinute.OpenTime(timestamp))
+	assert.Equal(t, int64(1696291200)*1e9, entities.OneDay.OpenTime(timestamp))
+
+	candle := entities.NewCandle(entities.OneMinute, trade(1, 100, 1, timestamp))
+	for i, price := range []float64{104, 98, 101} {
+		next := trade(int64(i+2), price, 0.5, timestamp+int64(i+1)*1e9)
+		assert.True(t, candle.Covers(next))
+		candle.AddTrade(next)
+	}
+	assert.Equal(t, entities.Candle{
+		Ticker:      "ETHUSD",
+		Interval:    entities.OneMinute,
+		OpenTime:    int64(1696370400) * 1e9,
+		Open:        dec(100),
+		High:        dec(104),
+		Low:         dec(98),
+		Close:       dec(101),
+		Volume:      dec(2.5),
+		QuoteVolume: dec(251.5),
+		Trades:      4,
+	}, candle)
+	assert.Equal(t, candle.OpenTime+minute, candle.CloseTime())
+	// the next minute is the next candle
+	assert.False(t, candle.Covers(trade(5, 100, 1, candle.CloseTime())))
+}
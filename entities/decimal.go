@@ -0,0 +1,217 @@
+package entities
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// number of digits after the decimal point, enough for satoshis
+const decimalPlaces = 8
+
+const decimalScale int64 = 100000000
+
+// fixed-point number used for every price, size and balance.
+// stored as an integer number of 10^-8 units so additions and subtractions are exact (no dust left behind like float64)
+// a struct and not `type Decimal int64` so that a*b can't be written by mistake, use Mul
+type Decimal struct {
+	units int64
+}
+
+var ZeroDecimal = Decimal{}
+
+func NewDecimalFromInt(i int64) Decimal {
+	return Decimal{units: i * decimalScale}
+}
+
+// the raw number of 10^-8 units .e.g. what is stored in the database
+func NewDecimalFromUnits(units int64) Decimal {
+	return Decimal{units: units}
+}
+
+// rounded to 8 decimals
+func NewDecimalFromFloat(f float64) Decimal {
+	d, err := ParseDecimal(strconv.FormatFloat(f, 'f', decimalPlaces, 64))
+	if err != nil {
+		panic(fmt.Sprintf("can't convert %f to decimal: %s", f, err))
+	}
+	return d
+}
+
+// parse "1", "-0.5", "1999.12345678", "1e-3". More than 8 decimals is an error, nothing is rounded
+func ParseDecimal(s string) (Decimal, error) {
+	str := strings.TrimSpace(s)
+	// big.Rat also accepts fractions .e.g. "1/3"
+	if str == "" || strings.Contains(str, "/") {
+		return ZeroDecimal, fmt.Errorf("invalid decimal %q", s)
+	}
+	r, ok := new(big.Rat).SetString(str)
+	if !ok {
+		return ZeroDecimal, fmt.Errorf("invalid decimal %q", s)
+	}
+	r.Mul(r, new(big.Rat).SetInt64(decimalScale))
+	if !r.IsInt() {
+		return ZeroDecimal, fmt.Errorf("decimal %q has more than %d decimals", s, decimalPlaces)
+	}
+	if !r.Num().IsInt64() {
+		return ZeroDecimal, fmt.Errorf("decimal %q out of range", s)
+	}
+	return Decimal{units: r.Num().Int64()}, nil
+}
+
+func MustParseDecimal(s string) Decimal {
+	d, err := ParseDecimal(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func (d Decimal) Units() int64 {
+	return d.units
+}
+
+func (d Decimal) Add(other Decimal) Decimal {
+	return Decimal{units: d.units + other.units}
+}
+
+func (d Decimal) Sub(other Decimal) Decimal {
+	return Decimal{units: d.units - other.units}
+}
+
+func (d Decimal) Neg() Decimal {
+	return Decimal{units: -d.units}
+}
+
+// rounded half away from zero to 8 decimals
+func (d Decimal) Mul(other Decimal) Decimal {
+	product := new(big.Int).Mul(big.NewInt(d.units), big.NewInt(other.units))
+	return Decimal{units: divRound(product, big.NewInt(decimalScale))}
+}
+
+// rounded half away from zero to 8 decimals
+func (d Decimal) Div(other Decimal) Decimal {
+	if other.units == 0 {
+		panic("decimal division by zero")
+	}
+	numerator := new(big.Int).Mul(big.NewInt(d.units), big.NewInt(decimalScale))
+	return Decimal{units: divRound(numerator, big.NewInt(other.units))}
+}
+
+// false if d * other needs more than 8 decimals
+func (d Decimal) isExactMul(other Decimal) bool {
+	product := new(big.Int).Mul(big.NewInt(d.units), big.NewInt(other.units))
+	return new(big.Int).Rem(product, big.NewInt(decimalScale)).Sign() == 0
+}
+
+func divRound(numerator *big.Int, denominator *big.Int) int64 {
+	quotient, remainder := new(big.Int).QuoRem(numerator, denominator, new(big.Int))
+	// |remainder| * 2 >= |denominator| -> round away from zero
+	if new(big.Int).Mul(new(big.Int).Abs(remainder), big.NewInt(2)).Cmp(new(big.Int).Abs(denominator)) >= 0 {
+		if numerator.Sign()*denominator.Sign() < 0 {
+			quotient.Sub(quotient, big.NewInt(1))
+		} else {
+			quotient.Add(quotient, big.NewInt(1))
+		}
+	}
+	if !quotient.IsInt64() {
+		panic("decimal overflow")
+	}
+	return quotient.Int64()
+}
+
+// -1 if d < other, 0 if d == other, +1 if d > other
+func (d Decimal) Cmp(other Decimal) int {
+	switch {
+	case d.units < other.units:
+		return -1
+	case d.units > other.units:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func (d Decimal) LessThan(other Decimal) bool {
+	return d.units < other.units
+}
+
+func (d Decimal) GreaterThan(other Decimal) bool {
+	return d.units > other.units
+}
+
+func (d Decimal) IsZero() bool {
+	return d.units == 0
+}
+
+func (d Decimal) IsPositive() bool {
+	return d.units > 0
+}
+
+func (d Decimal) IsNegative() bool {
+	return d.units < 0
+}
+
+// true if d is a whole number of steps .e.g. a price and the tick size
+func (d Decimal) IsMultipleOf(step Decimal) bool {
+	if step.units == 0 {
+		return false
+	}
+	return d.units%step.units == 0
+}
+
+func MinDecimal(a Decimal, b Decimal) Decimal {
+	if a.LessThan(b) {
+		return a
+	}
+	return b
+}
+
+// only for display/logging, not for computations
+func (d Decimal) Float64() float64 {
+	f, _ := strconv.ParseFloat(d.String(), 64)
+	return f
+}
+
+// shortest representation .e.g. "1999.5", "0.001", "-3"
+func (d Decimal) String() string {
+	units := d.units
+	sign := ""
+	if units < 0 {
+		sign = "-"
+	}
+	absUnits := uint64(units)
+	if units < 0 {
+		absUnits = uint64(-(units + 1)) + 1
+	}
+	integerPart := absUnits / uint64(decimalScale)
+	fractionalPart := absUnits % uint64(decimalScale)
+	if fractionalPart == 0 {
+		return fmt.Sprintf("%s%d", sign, integerPart)
+	}
+	fractionalStr := strings.TrimRight(fmt.Sprintf("%0*d", decimalPlaces, fractionalPart), "0")
+	return fmt.Sprintf("%s%d.%s", sign, integerPart, fractionalStr)
+}
+
+// always a JSON string so clients parsing JSON numbers as float64 don't lose precision
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(d.String())), nil
+}
+
+// accept both "1.5" and 1.5, a JSON number is parsed from its text so it stays exact
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	str := string(data)
+	if str == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(str); err == nil {
+		str = unquoted
+	}
+	parsed, err := ParseDecimal(str)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
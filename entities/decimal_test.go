@@ -0,0 +1,71 @@
+package entities_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trandinhkhoa/crypto-exchange/entities"
+)
+
+func TestParseDecimal(t *testing.T) {
+	d, err := entities.ParseDecimal("1999.12345678")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(199912345678), d.Units())
+	assert.Equal(t, "1999.12345678", d.String())
+
+	d, err = entities.ParseDecimal("-0.5")
+	assert.NoError(t, err)
+	assert.Equal(t, "-0.5", d.String())
+
+	d, err = entities.ParseDecimal("1e-3")
+	assert.NoError(t, err)
+	assert.Equal(t, "0.001", d.String())
+
+	_, err = entities.ParseDecimal("0.123456789")
+	assert.Error(t, err)
+	_, err = entities.ParseDecimal("1/3")
+	assert.Error(t, err)
+	_, err = entities.ParseDecimal("abc")
+	assert.Error(t, err)
+	_, err = entities.ParseDecimal("")
+	assert.Error(t, err)
+}
+
+func TestDecimalArithmetic(t *testing.T) {
+	// 0.1 + 0.2 == 0.3, unlike float64
+	sum := entities.MustParseDecimal("0.1").Add(entities.MustParseDecimal("0.2"))
+	assert.Equal(t, entities.MustParseDecimal("0.3"), sum)
+
+	// 999.6 - 0.2 == 999.4, not 999.3999999999999
+	assert.Equal(t, "999.4", entities.MustParseDecimal("999.6").Sub(entities.MustParseDecimal("0.2")).String())
+
+	assert.Equal(t, "2.5", entities.MustParseDecimal("0.5").Mul(entities.NewDecimalFromInt(5)).String())
+	// rounded half away from zero
+	assert.Equal(t, "0.00000001", entities.MustParseDecimal("0.00000001").Mul(entities.MustParseDecimal("0.5")).String())
+	assert.Equal(t, "-0.00000001", entities.MustParseDecimal("-0.00000001").Mul(entities.MustParseDecimal("0.5")).String())
+	assert.Equal(t, "0.33333333", entities.NewDecimalFromInt(1).Div(entities.NewDecimalFromInt(3)).String())
+
+	assert.True(t, entities.MustParseDecimal("27000.01").IsMultipleOf(entities.MustParseDecimal("0.01")))
+	assert.False(t, entities.MustParseDecimal("27000.015").IsMultipleOf(entities.MustParseDecimal("0.01")))
+	assert.True(t, entities.MustParseDecimal("1").LessThan(entities.MustParseDecimal("1.00000001")))
+	assert.Equal(t, entities.MustParseDecimal("1"), entities.MinDecimal(entities.MustParseDecimal("1"), entities.MustParseDecimal("2")))
+}
+
+func TestDecimalJSON(t *testing.T) {
+	type payload struct {
+		Size  entities.Decimal
+		Price entities.Decimal
+	}
+	var p payload
+	// both a JSON string and a JSON number are accepted
+	assert.NoError(t, json.Unmarshal([]byte(`{"Size":"0.1","Price":999.4}`), &p))
+	assert.Equal(t, entities.MustParseDecimal("0.1"), p.Size)
+	assert.Equal(t, entities.MustParseDecimal("999.4"), p.Price)
+
+	out, err := json.Marshal(p)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Size":"0.1","Price":"999.4"}`, string(out))
+
+	assert.Error(t, json.Unmarshal([]byte(`{"Size":"0.000000001"}`), &p))
+}
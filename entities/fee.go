@@ -0,0 +1,74 @@
+package entities
+
+import (
+	"fmt"
+	"sort"
+)
+
+// how long the traded volume counts toward the fee tier of a user
+const FeeVolumeWindow int64 = 30 * 24 * 60 * 60 * 1e9
+
+// rates of the users whose traded volume over the last 30 days is at least MinVolume
+// a rate of 0.001 = 0.1% of what the user receives from the trade
+type FeeTier struct {
+	// in the quote asset of the instrument
+	MinVolume Decimal
+	MakerRate Decimal
+	TakerRate Decimal
+}
+
+// empty = no fees
+type FeeSchedule []FeeTier
+
+func (s FeeSchedule) Validate() error {
+	seen := make(map[Decimal]bool, 0)
+	for _, tier := range s {
+		if tier.MinVolume.IsNegative() {
+			return fmt.Errorf("fee tier %s: min volume can't be negative", tier.MinVolume)
+		}
+		if seen[tier.MinVolume] {
+			return fmt.Errorf("fee tier %s is defined twice", tier.MinVolume)
+		}
+		seen[tier.MinVolume] = true
+		if !isValidFeeRate(tier.MakerRate) || !isValidFeeRate(tier.TakerRate) {
+			return fmt.Errorf("fee tier %s: rates must be between 0 and 1", tier.MinVolume)
+		}
+	}
+	return nil
+}
+
+// a fee takes a part of what is received, never all of it
+func isValidFeeRate(rate Decimal) bool {
+	return !rate.IsNegative() && rate.LessThan(NewDecimalFromInt(1))
+}
+
+// rates of the highest tier reached by volume, 0 if none is reached
+func (s FeeSchedule) Rates(volume Decimal) (makerRate Decimal, takerRate Decimal) {
+	tiers := make(FeeSchedule, len(s))
+	copy(tiers, s)
+	sort.Slice(tiers, func(i, j int) bool {
+		return tiers[i].MinVolume.LessThan(tiers[j].MinVolume)
+	})
+	makerRate, takerRate = ZeroDecimal, ZeroDecimal
+	for _, tier := range tiers {
+		if volume.LessThan(tier.MinVolume) {
+			break
+		}
+		makerRate, takerRate = tier.MakerRate, tier.TakerRate
+	}
+	return makerRate, takerRate
+}
+
+// the fee paid by one side of a trade
+// the buyer pays in the base asset, the seller in the quote asset: the fee is taken from what they receive
+type FeeLedgerEntry struct {
+	TradeId int64
+	UserId  string
+	Ticker  string
+	Asset   string
+	Fee     Decimal
+	// size * price of the trade, counts toward the fee tier of the user
+	Notional  Decimal
+	IsMaker   bool
+	Timestamp int64
+}
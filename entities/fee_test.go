@@ -0,0 +1,37 @@
+package entities_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trandinhkhoa/crypto-exchange/entities"
+)
+
+func TestFeeSchedule(t *testing.T) {
+	// not sorted on purpose
+	schedule := entities.FeeSchedule{
+		{MinVolume: dec(1000), MakerRate: dec(0), TakerRate: dec(0.001)},
+		{MinVolume: dec(0), MakerRate: dec(0.001), TakerRate: dec(0.002)},
+	}
+	assert.NoError(t, schedule.Validate())
+
+	makerRate, takerRate := schedule.Rates(dec(999.99))
+	assert.Equal(t, dec(0.001), makerRate)
+	assert.Equal(t, dec(0.002), takerRate)
+	makerRate, takerRate = schedule.Rates(dec(1000))
+	assert.Equal(t, dec(0), makerRate)
+	assert.Equal(t, dec(0.001), takerRate)
+
+	// no tier reached, no fee
+	makerRate, takerRate = entities.FeeSchedule{{MinVolume: dec(10), MakerRate: dec(0.1), TakerRate: dec(0.1)}}.Rates(dec(5))
+	assert.Equal(t, dec(0), makerRate)
+	assert.Equal(t, dec(0), takerRate)
+
+	assert.Error(t, entities.FeeSchedule{{MakerRate: dec(-0.001), TakerRate: dec(0.001)}}.Validate())
+	assert.Error(t, entities.FeeSchedule{{MakerRate: dec(0.001), TakerRate: dec(1)}}.Validate())
+	assert.Error(t, append(schedule, entities.FeeTier{MinVolume: dec(1000)}).Validate())
+
+	instrument := entities.Instrument{Ticker: "ETHUSD", BaseAsset: "ETH", QuoteAsset: "USD", TickSize: dec(0.01), LotSize: dec(0.001)}
+	instrument.FeeSchedule = entities.FeeSchedule{{MinVolume: dec(-1)}}
+	assert.Error(t, instrument.Validate())
+}
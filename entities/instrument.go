@@ -0,0 +1,48 @@
+package entities
+
+import (
+	"fmt"
+)
+
+// a market that can be traded on the exchange .e.g. ETHUSD = ETH (base) priced in USD (quote)
+type Instrument struct {
+	Ticker     string
+	BaseAsset  string
+	QuoteAsset string
+	// smallest price increment
+	TickSize Decimal
+	// smallest size increment
+	LotSize Decimal
+	// smallest size * price accepted for an order
+	MinNotional Decimal
+	// the fee schedule of the exchange is used if empty
+	FeeSchedule FeeSchedule `json:",omitempty"`
+}
+
+func (i Instrument) Validate() error {
+	if i.Ticker == "" || i.BaseAsset == "" || i.QuoteAsset == "" {
+		return fmt.Errorf("instrument %q: ticker, base asset and quote asset are required", i.Ticker)
+	}
+	if i.BaseAsset == i.QuoteAsset {
+		return fmt.Errorf("instrument %q: base asset and quote asset must be different", i.Ticker)
+	}
+	if !i.TickSize.IsPositive() || !i.LotSize.IsPositive() || i.MinNotional.IsNegative() {
+		return fmt.Errorf("instrument %q: tick size and lot size must be positive, min notional can't be negative", i.Ticker)
+	}
+	// every size * price is then a multiple of TickSize * LotSize, no rounding when settling trades
+	if !i.TickSize.isExactMul(i.LotSize) {
+		return fmt.Errorf("instrument %q: tick size * lot size must fit in %d decimals", i.Ticker, decimalPlaces)
+	}
+	if err := i.FeeSchedule.Validate(); err != nil {
+		return fmt.Errorf("instrument %q: %w", i.Ticker, err)
+	}
+	return nil
+}
+
+func (i Instrument) IsValidPrice(price Decimal) bool {
+	return price.IsMultipleOf(i.TickSize)
+}
+
+func (i Instrument) IsValidSize(size Decimal) bool {
+	return size.IsMultipleOf(i.LotSize)
+}
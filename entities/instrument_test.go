@@ -0,0 +1,31 @@
+package entities_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trandinhkhoa/crypto-exchange/entities"
+)
+
+func TestInstrument(t *testing.T) {
+	instrument := entities.Instrument{
+		Ticker:      "BTCUSDT",
+		BaseAsset:   "BTC",
+		QuoteAsset:  "USDT",
+		TickSize:    dec(0.01),
+		LotSize:     dec(0.0001),
+		MinNotional: dec(5),
+	}
+	assert.NoError(t, instrument.Validate())
+
+	assert.True(t, instrument.IsValidPrice(dec(27000.01)))
+	assert.False(t, instrument.IsValidPrice(dec(27000.015)))
+	assert.True(t, instrument.IsValidSize(dec(0.0003)))
+	assert.False(t, instrument.IsValidSize(dec(0.00035)))
+
+	instrument.QuoteAsset = "BTC"
+	assert.Error(t, instrument.Validate())
+	instrument.QuoteAsset = "USDT"
+	instrument.TickSize = entities.ZeroDecimal
+	assert.Error(t, instrument.Validate())
+}
@@ -4,21 +4,18 @@ import "fmt"
 
 // for each price level(limit) we need to know total volume and the corresponding orders
 type Limit struct {
-	limitPrice  float64
-	totalVolume float64
-	parent      *Limit
-	leftChild   *Limit
-	rightChild  *Limit
+	limitPrice  Decimal
+	totalVolume Decimal
 	headOrder   *Order
 	tailOrder   *Order
 }
 
-func (l Limit) GetTotalVolume() float64 {
+func (l Limit) GetTotalVolume() Decimal {
 	return l.totalVolume
 }
 
 func (l Limit) String() string {
-	str := fmt.Sprintf("{\"limitPrice\": %.2f, \"totalVolume\": %.2f, \"orders\":", l.GetLimitPrice(), l.totalVolume)
+	str := fmt.Sprintf("{\"limitPrice\": %s, \"totalVolume\": %s, \"orders\":", l.GetLimitPrice(), l.totalVolume)
 	str += "["
 	iterator := l.headOrder
 	for iterator != nil {
@@ -32,16 +29,28 @@ func (l Limit) String() string {
 	return str
 }
 
-func NewLimit(limitPrice float64) *Limit {
+func NewLimit(limitPrice Decimal) *Limit {
 	return &Limit{
 		limitPrice: limitPrice,
 	}
 }
 
-func (l Limit) GetLimitPrice() float64 {
+func (l Limit) GetLimitPrice() Decimal {
 	return l.limitPrice
 }
 
+// the same orders in the same order, the book can change the limit without changing its copy
+func (l Limit) Copy() *Limit {
+	limit := NewLimit(l.limitPrice)
+	for _, order := range l.GetAllOrders() {
+		order := order
+		order.prevOrder = nil
+		order.nextOrder = nil
+		limit.AddOrder(&order)
+	}
+	return limit
+}
+
 func (l *Limit) AddOrder(newOrder *Order) {
 	if l.tailOrder == nil {
 		// if empty
@@ -53,7 +62,7 @@ func (l *Limit) AddOrder(newOrder *Order) {
 		l.tailOrder = l.tailOrder.nextOrder
 	}
 	newOrder.parentLimit = l
-	l.totalVolume += float64(newOrder.Size)
+	l.totalVolume = l.totalVolume.Add(newOrder.Size)
 	// TODO: throw error if sell limit but o is bid
 }
 
@@ -69,7 +78,7 @@ func (l *Limit) DeleteOrderById(id int64) {
 }
 
 func (l *Limit) deleteOrder(order *Order) {
-	l.totalVolume -= order.Size
+	l.totalVolume = l.totalVolume.Sub(order.Size)
 	if (order.prevOrder == nil) && (order.nextOrder == nil) {
 		// if the only one left
 		l.headOrder = nil
@@ -85,8 +94,19 @@ func (l *Limit) deleteOrder(order *Order) {
 		if nextOrder != nil {
 			// if not the last one
 			nextOrder.prevOrder = prevOrder
+		} else {
+			// if deleting the tail
+			l.tailOrder = prevOrder
 		}
 	}
+	order.prevOrder = nil
+	order.nextOrder = nil
+}
+
+// change the size of an order in place, it keeps its place in the queue
+func (l *Limit) resizeOrder(order *Order, newSize Decimal) {
+	l.totalVolume = l.totalVolume.Sub(order.Size).Add(newSize)
+	order.Size = newSize
 }
 
 func (l Limit) GetAllOrders() []Order {
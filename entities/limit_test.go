@@ -8,46 +8,65 @@ import (
 )
 
 func TestLimit(t *testing.T) {
-	o := entities.NewOrder("john", "ticker", true, "LIMIT", 1, 1000)
-	l := entities.NewLimit(1000)
+	o := newOrder("john", "ticker", true, "LIMIT", dec(1), dec(1000))
+	l := entities.NewLimit(dec(1000))
 	assert.Equal(t, len(l.GetAllOrders()), 0)
-	assert.Equal(t, l.GetTotalVolume(), 0.0)
+	assert.Equal(t, l.GetTotalVolume(), dec(0.0))
 
 	l.AddOrder(o)
 	assert.Equal(t, len(l.GetAllOrders()), 1)
 	assert.Equal(t, l.GetAllOrders()[0].GetUserId(), "john")
-	assert.Equal(t, l.GetTotalVolume(), 1.0)
+	assert.Equal(t, l.GetTotalVolume(), dec(1.0))
 
-	o = entities.NewOrder("jane", "ticker", true, "LIMIT", 1, 1000)
+	o = newOrder("jane", "ticker", true, "LIMIT", dec(1), dec(1000))
 	l.AddOrder(o)
 	assert.Equal(t, len(l.GetAllOrders()), 2)
 	assert.Equal(t, l.GetAllOrders()[0].GetUserId(), "john")
 	assert.Equal(t, l.GetAllOrders()[1].GetUserId(), "jane")
-	assert.Equal(t, l.GetTotalVolume(), 2.0)
+	assert.Equal(t, l.GetTotalVolume(), dec(2.0))
 
-	o = entities.NewOrder("jim", "ticker", true, "LIMIT", 1, 1000)
+	o = newOrder("jim", "ticker", true, "LIMIT", dec(1), dec(1000))
 	l.AddOrder(o)
 	assert.Equal(t, len(l.GetAllOrders()), 3)
 	assert.Equal(t, l.GetAllOrders()[0].GetUserId(), "john")
 	assert.Equal(t, l.GetAllOrders()[1].GetUserId(), "jane")
 	assert.Equal(t, l.GetAllOrders()[2].GetUserId(), "jim")
-	assert.Equal(t, l.GetTotalVolume(), 3.0)
+	assert.Equal(t, l.GetTotalVolume(), dec(3.0))
+
+	// delete tail then add, the new order is the tail
+	l.DeleteOrderById(l.GetAllOrders()[2].GetId())
+	o = newOrder("jim", "ticker", true, "LIMIT", dec(1), dec(1000))
+	l.AddOrder(o)
+	assert.Equal(t, len(l.GetAllOrders()), 3)
+	assert.Equal(t, l.GetAllOrders()[2].GetUserId(), "jim")
+	assert.Equal(t, l.GetTotalVolume(), dec(3.0))
 
 	// delete middle (cancel)
 	l.DeleteOrderById(l.GetAllOrders()[1].GetId())
 	assert.Equal(t, len(l.GetAllOrders()), 2)
 	assert.Equal(t, l.GetAllOrders()[0].GetUserId(), "john")
 	assert.Equal(t, l.GetAllOrders()[1].GetUserId(), "jim")
-	assert.Equal(t, l.GetTotalVolume(), 2.0)
+	assert.Equal(t, l.GetTotalVolume(), dec(2.0))
 
 	// delete head (cancel/match)
 	l.DeleteOrderById(l.GetAllOrders()[0].GetId())
 	assert.Equal(t, len(l.GetAllOrders()), 1)
 	assert.Equal(t, l.GetAllOrders()[0].GetUserId(), "jim")
-	assert.Equal(t, l.GetTotalVolume(), 1.0)
+	assert.Equal(t, l.GetTotalVolume(), dec(1.0))
+
+	// a copy is not changed with the limit
+	copied := l.Copy()
+	l.AddOrder(newOrder("jane", "ticker", true, "LIMIT", dec(2), dec(1000)))
+	assert.Equal(t, len(copied.GetAllOrders()), 1)
+	assert.Equal(t, copied.GetAllOrders()[0].GetUserId(), "jim")
+	assert.Equal(t, copied.GetTotalVolume(), dec(1.0))
+	copied.AddOrder(newOrder("john", "ticker", true, "LIMIT", dec(1), dec(1000)))
+	assert.Equal(t, len(l.GetAllOrders()), 2)
+	assert.Equal(t, l.GetAllOrders()[1].GetUserId(), "jane")
 
 	// delete the rest
 	l.DeleteOrderById(l.GetAllOrders()[0].GetId())
+	l.DeleteOrderById(l.GetAllOrders()[0].GetId())
 	assert.Equal(t, len(l.GetAllOrders()), 0)
-	assert.Equal(t, l.GetTotalVolume(), 0.0)
+	assert.Equal(t, l.GetTotalVolume(), dec(0.0))
 }
@@ -0,0 +1,26 @@
+package entities
+
+// the price levels of one side of the book, sorted from the best price to the worst one
+// the Orderbook only goes through this interface, the data structure behind it can be swapped
+type limitIndex interface {
+	// nil if there is no limit at this price
+	get(price Decimal) *Limit
+	// the price of the limit must not be in the index already
+	insert(limit *Limit)
+	remove(limit *Limit)
+	// nil if empty
+	best() *Limit
+	// visit the limits from the best one to the worst one, stop as soon as visit returns false
+	walk(visit func(*Limit) bool)
+	len() int
+}
+
+// higher price first
+func isBetterBuyPrice(a Decimal, b Decimal) bool {
+	return a.GreaterThan(b)
+}
+
+// lower price first
+func isBetterSellPrice(a Decimal, b Decimal) bool {
+	return a.LessThan(b)
+}
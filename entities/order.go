@@ -2,39 +2,80 @@ package entities
 
 import (
 	"fmt"
-	"math/rand"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
-// TODO: user need crypto wallet
-type User struct {
-	userId  string
-	Balance map[string]float64
-	// TODO: should be *Order to save space and avoid copy?
-	OpenOrders map[int64]Order
-}
+type OrderType string
 
-func (u User) GetUserId() string {
-	return u.userId
+const (
+	MarketOrderType OrderType = "MARKET"
+	LimitOrderType  OrderType = "LIMIT"
+	// wait in the TriggerBook until the last traded price reaches the stop price, then become a MARKET/LIMIT order
+	StopMarketOrderType OrderType = "STOP_MARKET"
+	StopLimitOrderType  OrderType = "STOP_LIMIT"
+)
+
+func (orderType OrderType) IsStop() bool {
+	return orderType == StopMarketOrderType || orderType == StopLimitOrderType
 }
 
-func NewUser(userId string, balance map[string]float64) *User {
-	return &User{
-		userId:     userId,
-		Balance:    balance,
-		OpenOrders: make(map[int64]Order, 0),
+// how long a limit order stays in the book
+type TimeInForce string
+
+const (
+	// good till cancelled, the default
+	GoodTillCancelled TimeInForce = "GTC"
+	// immediate or cancel: match what can be matched, what is left is cancelled
+	ImmediateOrCancel TimeInForce = "IOC"
+	// fill or kill: match the whole size right away or nothing
+	FillOrKill TimeInForce = "FOK"
+	// good till date: rests in the book until expiresAt
+	GoodTillDate TimeInForce = "GTD"
+)
+
+func (tif TimeInForce) IsValid() bool {
+	switch tif {
+	case GoodTillCancelled, ImmediateOrCancel, FillOrKill, GoodTillDate:
+		return true
+	default:
+		return false
 	}
 }
 
-type OrderType string
+// what happens when an order would be matched against a resting order of the same user
+// only the mode of the incoming order counts
+type SelfTradePrevention string
 
 const (
-	MarketOrderType OrderType = "MARKET"
-	LimitOrderType  OrderType = "LIMIT"
+	// not set: the order takes the default of its user, see User.GetSelfTradePrevention
+	SelfTradePreventionUnset SelfTradePrevention = ""
+	// self-trades are matched like any other trade
+	SelfTradeAllowed SelfTradePrevention = "NONE"
+	// what is left of the incoming order is cancelled, the resting order stays
+	CancelNewest SelfTradePrevention = "CANCEL_NEWEST"
+	// the resting order is cancelled, the incoming order goes on matching
+	CancelOldest SelfTradePrevention = "CANCEL_OLDEST"
+	// both are cancelled
+	CancelBoth SelfTradePrevention = "CANCEL_BOTH"
+	// the smaller size is taken from both orders without trading. The one left with nothing is cancelled, the other one goes on
+	DecrementAndCancel SelfTradePrevention = "DECREMENT_AND_CANCEL"
 )
 
+func (stp SelfTradePrevention) IsValid() bool {
+	switch stp {
+	case SelfTradePreventionUnset, SelfTradeAllowed, CancelNewest, CancelOldest, CancelBoth, DecrementAndCancel:
+		return true
+	default:
+		return false
+	}
+}
+
+func (stp SelfTradePrevention) preventsSelfTrade() bool {
+	return stp != SelfTradePreventionUnset && stp != SelfTradeAllowed
+}
+
 // make sure outer packages using &Order{} cant use it
 // hiding the most essential info w/ lowercase
 type Order struct {
@@ -43,8 +84,19 @@ type Order struct {
 	ticker      string
 	isBid       bool
 	orderType   OrderType
-	Size        float64
-	limitPrice  float64
+	timeInForce TimeInForce
+	// unix nano, only for GTD
+	expiresAt int64
+	// maker only: never matched on arrival, see Orderbook.WouldCross
+	postOnly bool
+	// with postOnly, move the price one tick away from the other side instead of rejecting the order
+	postOnlyReprice bool
+	// the exchange falls back to the default of the user if it is not set
+	selfTradePrevention SelfTradePrevention
+	// only for STOP_MARKET/STOP_LIMIT
+	stopPrice   Decimal
+	Size        Decimal
+	limitPrice  Decimal
 	timestamp   int64
 	nextOrder   *Order
 	prevOrder   *Order
@@ -56,24 +108,40 @@ func NewOrder(
 	ticker string,
 	isBid bool,
 	orderType OrderType,
-	size float64,
-	limitPrice float64) *Order {
+	size Decimal,
+	limitPrice Decimal) *Order {
+	// the id is assigned by the exchange when the order is accepted, see SetId
 	return &Order{
-		// TODO: incremental unique id
-		id:         int64(rand.Int31()),
-		ticker:     ticker,
-		userId:     userId,
-		isBid:      isBid,
-		orderType:  orderType,
-		Size:       size,
-		limitPrice: limitPrice,
-		timestamp:  time.Now().UnixNano(),
+		ticker:      ticker,
+		userId:      userId,
+		isBid:       isBid,
+		orderType:   orderType,
+		timeInForce: GoodTillCancelled,
+		Size:        size,
+		limitPrice:  limitPrice,
+		timestamp:   time.Now().UnixNano(),
 	}
 }
 
+// used when reading back an order that already has an id .e.g. from the database
+func NewOrderWithIdAndTimeStamp(
+	id int64,
+	userId string,
+	ticker string,
+	isBid bool,
+	orderType OrderType,
+	size Decimal,
+	limitPrice Decimal,
+	timestamp int64) *Order {
+	order := NewOrder(userId, ticker, isBid, orderType, size, limitPrice)
+	order.id = id
+	order.timestamp = timestamp
+	return order
+}
+
 // implement Stringer interface
 func (o Order) String() string {
-	return fmt.Sprintf("{\"id\": %d, \"userId\": \"%s\", \"isBid\": %t, \"orderType\": \"%s\", \"size\": %.2f, \"limitPrice\": %.2f, \"timestamp\": %d }",
+	return fmt.Sprintf("{\"id\": %d, \"userId\": \"%s\", \"isBid\": %t, \"orderType\": \"%s\", \"size\": %s, \"limitPrice\": %s, \"timestamp\": %d }",
 		o.id,
 		o.userId,
 		o.isBid,
@@ -85,23 +153,118 @@ func (o Order) String() string {
 
 func (o1 Order) IsBetter(o2 Order) bool {
 	if o1.isBid && o2.isBid {
-		return o1.limitPrice > o2.limitPrice
+		return o1.limitPrice.GreaterThan(o2.limitPrice)
 	} else if !o1.isBid && !o2.isBid {
-		return o1.limitPrice < o2.limitPrice
+		return o1.limitPrice.LessThan(o2.limitPrice)
 	} else {
 		logrus.Warn("Cant compare if not bid-bid/ask-ask")
 		return false
 	}
 }
 
+// a market order takes any price
+// a limit order only takes a price that is at least as good as its limit price
+func (o Order) acceptsPrice(price Decimal) bool {
+	if o.orderType == MarketOrderType {
+		return true
+	}
+	if o.isBid {
+		return !price.GreaterThan(o.limitPrice)
+	}
+	return !price.LessThan(o.limitPrice)
+}
+
+// only GTC and GTD orders are added to the book
+func (o Order) restsInBook() bool {
+	return o.timeInForce == GoodTillCancelled || o.timeInForce == GoodTillDate
+}
+
+func (o Order) IsExpired(now int64) bool {
+	return o.timeInForce == GoodTillDate && o.expiresAt <= now
+}
+
+// a buy stop is triggered when the price goes up to its stop price, a sell stop when it goes down to it
+func (o Order) IsTriggeredBy(lastTradedPrice Decimal) bool {
+	if o.isBid {
+		return !lastTradedPrice.LessThan(o.stopPrice)
+	}
+	return !lastTradedPrice.GreaterThan(o.stopPrice)
+}
+
+// the MARKET/LIMIT order a stop order turns into once triggered. Same id, same timestamp
+func (o Order) Trigger() Order {
+	triggeredOrder := o
+	if o.orderType == StopMarketOrderType {
+		triggeredOrder.orderType = MarketOrderType
+	} else if o.orderType == StopLimitOrderType {
+		triggeredOrder.orderType = LimitOrderType
+	}
+	return triggeredOrder
+}
+
 func (o Order) IsFilled() bool {
-	return o.Size == float64(0)
+	return o.Size.IsZero()
 }
 
 func (o Order) GetId() int64 {
 	return o.id
 }
 
+func (o *Order) SetId(id int64) {
+	o.id = id
+}
+
+func (o Order) GetTimeInForce() TimeInForce {
+	return o.timeInForce
+}
+
+func (o Order) GetExpiresAt() int64 {
+	return o.expiresAt
+}
+
+func (o Order) GetPostOnly() bool {
+	return o.postOnly
+}
+
+func (o Order) GetPostOnlyReprice() bool {
+	return o.postOnlyReprice
+}
+
+func (o *Order) SetPostOnly(postOnly bool, reprice bool) {
+	o.postOnly = postOnly
+	o.postOnlyReprice = postOnly && reprice
+}
+
+func (o Order) GetStopPrice() Decimal {
+	return o.stopPrice
+}
+
+func (o *Order) SetStopPrice(stopPrice Decimal) {
+	o.stopPrice = stopPrice
+}
+
+func (o Order) GetSelfTradePrevention() SelfTradePrevention {
+	return o.selfTradePrevention
+}
+
+func (o *Order) SetSelfTradePrevention(selfTradePrevention SelfTradePrevention) {
+	o.selfTradePrevention = selfTradePrevention
+}
+
+func (o *Order) SetLimitPrice(limitPrice Decimal) {
+	o.limitPrice = limitPrice
+}
+
+// expiresAt is ignored unless timeInForce is GTD
+func (o *Order) SetTimeInForce(timeInForce TimeInForce, expiresAt int64) {
+	o.timeInForce = timeInForce
+	if timeInForce == GoodTillDate {
+		o.expiresAt = expiresAt
+	} else {
+		o.expiresAt = 0
+	}
+}
+
 func (o Order) GetUserId() string {
 	return o.userId
 }
@@ -114,12 +277,12 @@ func (o Order) GetIsBid() bool {
 func (o Order) GetOrderType() OrderType {
 	return o.orderType
 }
-func (o Order) GetLimitPrice() float64 {
+func (o Order) GetLimitPrice() Decimal {
 	return o.limitPrice
 }
 func (o Order) GetTimeStamp() int64 {
 	return o.timestamp
 }
-func (o Order) GetSize() float64 {
+func (o Order) GetSize() Decimal {
 	return o.Size
 }
@@ -2,7 +2,8 @@ package entities
 
 import (
 	"errors"
-	"fmt"
+	"sort"
+	"time"
 )
 
 type NoLiquidityError struct {
@@ -13,58 +14,232 @@ func (e NoLiquidityError) Error() string {
 	return e.msg
 }
 
+// one side of the book
+type bookSide struct {
+	limits limitIndex
+	// sum of the volumes of all the limits, kept up to date on every change instead of walking the limits
+	totalVolume Decimal
+	// the prices of the limits whose total volume changed since PopLevelChanges
+	changedPrices map[Decimal]bool
+}
+
+func newBookSide(isBetter func(a Decimal, b Decimal) bool) *bookSide {
+	return &bookSide{
+		limits:        newRBTree(isBetter),
+		changedPrices: make(map[Decimal]bool),
+	}
+}
+
+// MUST be called every time the total volume of a limit changes
+func (side *bookSide) volumeChanged(price Decimal) {
+	side.changedPrices[price] = true
+}
+
+// a price level as it is after a change, Volume is 0 if the level is gone
+type LevelChange struct {
+	IsBid  bool
+	Price  Decimal
+	Volume Decimal
+}
+
+// the k best limits, best first
+func (side bookSide) getBestLimits(k int) []*Limit {
+	array := make([]*Limit, 0)
+	if k <= 0 {
+		return array
+	}
+	side.limits.walk(func(limit *Limit) bool {
+		array = append(array, limit)
+		return len(array) < k
+	})
+	return array
+}
+
 type Orderbook struct {
-	// TODO: limitation: this way the "interface" of Orderbook is tied to its implementation
-	// e.g. switch from BST to heap will be costly
-	// entities.Limit has the same issue
-	BuyTree         *Limit
-	SellTree        *Limit
-	LowestSell      *Limit
-	HighestBuy      *Limit
+	// the price levels are only reached through limitIndex
+	// TODO: entities.Limit still exposes the orders as a linked list
+	buys            *bookSide
+	sells           *bookSide
 	lastTrades      []Trade
 	idToOrderMap    map[int64]*Order
-	lastTradedPrice float64
+	lastTradedPrice Decimal
+	tradeIds        *Sequence
+	// subset of idToOrderMap, the GTD orders to expire. Filled/cancelled ones are cleaned up by ExpireOrders
+	gtdOrders map[int64]*Order
+	// waiting for PopSelfTradeCancels
+	selfTradeCancels []SelfTradeCancel
+	// unix nano, the time of the trades and of the amended orders
+	clock func() int64
+	// number of PopLevelChanges that returned changes
+	bookSequence int64
+	// waiting for PopOrderEvents
+	orderEvents   []OrderEvent
+	orderSequence int64
 }
 
 // TODO: hide all the pointers, make sure if &Orderbook{} is used it would be useless
 func NewOrderbook() *Orderbook {
+	return NewOrderbookWithSequence(NewSequence(0))
+}
+
+// trade ids come from tradeIds, the exchange shares one sequence between all its orderbooks
+func NewOrderbookWithSequence(tradeIds *Sequence) *Orderbook {
 	return &Orderbook{
-		idToOrderMap: make(map[int64]*Order),
+		buys:             newBookSide(isBetterBuyPrice),
+		sells:            newBookSide(isBetterSellPrice),
+		idToOrderMap:     make(map[int64]*Order),
+		tradeIds:         tradeIds,
+		gtdOrders:        make(map[int64]*Order),
+		selfTradeCancels: make([]SelfTradeCancel, 0),
+		orderEvents:      make([]OrderEvent, 0),
+		clock: func() int64 {
+			return time.Now().UnixNano()
+		},
 	}
 }
 
-func (ob *Orderbook) PlaceLimitOrder(incomingOrder Order) {
-	// check if price level is in buyTree/sellTree
-	if incomingOrder.GetIsBid() {
-		if ob.BuyTree == nil {
-			// if empty tree
-			newLimit := setupNewLimit(&incomingOrder)
-			ob.BuyTree = newLimit
-			ob.HighestBuy = newLimit
-		} else {
-			limit := travelLimitTreeAndAddOrderToLimit(ob.BuyTree, &incomingOrder)
-			if limit != nil && limit.GetLimitPrice() > ob.HighestBuy.GetLimitPrice() {
-				ob.HighestBuy = limit
-			}
+// the exchange replaying its journal needs the time the orders were matched at, not the time of the replay
+func (ob *Orderbook) SetClock(clock func() int64) {
+	ob.clock = clock
+}
+
+func (ob *Orderbook) PlaceLimitOrder(incomingOrder Order) []Trade {
+	// FOK: nothing is matched unless the whole size can be
+	if incomingOrder.timeInForce == FillOrKill && ob.getFillableSize(incomingOrder).LessThan(incomingOrder.Size) {
+		return make([]Trade, 0)
+	}
+
+	// match against the other side first as long as the price is acceptable
+	tradesArray := ob.matchIncomingOrder(&incomingOrder)
+	// IOC/FOK: what is left is cancelled
+	if incomingOrder.IsFilled() || !incomingOrder.restsInBook() {
+		return tradesArray
+	}
+
+	// the rest of the order goes to the book
+	ob.addToLimit(&incomingOrder)
+	ob.idToOrderMap[incomingOrder.GetId()] = &incomingOrder
+	if incomingOrder.timeInForce == GoodTillDate {
+		ob.gtdOrders[incomingOrder.GetId()] = &incomingOrder
+	}
+	return tradesArray
+}
+
+// add the order at the tail of its price level, the price level is created if needed
+func (ob *Orderbook) addToLimit(order *Order) {
+	side := ob.side(order.GetIsBid())
+	limit := side.limits.get(order.GetLimitPrice())
+	if limit == nil {
+		limit = NewLimit(order.GetLimitPrice())
+		side.limits.insert(limit)
+	}
+	limit.AddOrder(order)
+	side.totalVolume = side.totalVolume.Add(order.Size)
+	side.volumeChanged(limit.limitPrice)
+	ob.recordOrderEvent(OrderAdded, order, order.Size, order.Size, 0)
+}
+
+// remove the order from its price level, the price level is removed if it is empty
+func (ob *Orderbook) removeFromLimit(order *Order) {
+	side := ob.side(order.GetIsBid())
+	limit := order.parentLimit
+	limit.deleteOrder(order)
+	side.totalVolume = side.totalVolume.Sub(order.Size)
+	side.volumeChanged(limit.limitPrice)
+	if limit.headOrder == nil {
+		side.limits.remove(limit)
+	}
+	ob.recordOrderEvent(OrderRemoved, order, order.Size, ZeroDecimal, 0)
+}
+
+func (ob Orderbook) side(isBid bool) *bookSide {
+	if isBid {
+		return ob.buys
+	}
+	return ob.sells
+}
+
+// true if the limit order would be matched, at least partially, if placed now
+func (ob Orderbook) WouldCross(o Order) bool {
+	if o.GetIsBid() {
+		return ob.GetLowestSell() != nil && o.acceptsPrice(ob.GetLowestSell().GetLimitPrice())
+	}
+	return ob.GetHighestBuy() != nil && o.acceptsPrice(ob.GetHighestBuy().GetLimitPrice())
+}
+
+// the most aggressive price the order can have without crossing: one tick behind the best price of the other side
+// the price of the order if it does not cross
+func (ob Orderbook) GetPassivePrice(o Order, tickSize Decimal) Decimal {
+	if !ob.WouldCross(o) {
+		return o.GetLimitPrice()
+	}
+	if o.GetIsBid() {
+		return ob.GetLowestSell().GetLimitPrice().Sub(tickSize)
+	}
+	return ob.GetHighestBuy().GetLimitPrice().Add(tickSize)
+}
+
+// how much of the order could be matched right now at its limit price
+func (ob Orderbook) getFillableSize(incomingOrder Order) Decimal {
+	fillable := ZeroDecimal
+	ob.side(!incomingOrder.GetIsBid()).limits.walk(func(limit *Limit) bool {
+		if !incomingOrder.acceptsPrice(limit.GetLimitPrice()) {
+			return false
 		}
-	} else {
-		if ob.SellTree == nil {
-			// if empty tree
-			newLimit := setupNewLimit(&incomingOrder)
-			ob.SellTree = newLimit
-			ob.LowestSell = newLimit
-		} else {
-			limit := travelLimitTreeAndAddOrderToLimit(ob.SellTree, &incomingOrder)
-			if limit != nil && limit.GetLimitPrice() < ob.LowestSell.GetLimitPrice() {
-				ob.LowestSell = limit
+		if !incomingOrder.selfTradePrevention.preventsSelfTrade() {
+			fillable = fillable.Add(limit.GetTotalVolume())
+			return fillable.LessThan(incomingOrder.Size)
+		}
+		// the orders of the same user are not filled: skipped with CANCEL_OLDEST, the matching stops there otherwise
+		for order := limit.headOrder; order != nil; order = order.nextOrder {
+			if order.GetUserId() == incomingOrder.GetUserId() {
+				if incomingOrder.selfTradePrevention == CancelOldest {
+					continue
+				}
+				return false
+			}
+			fillable = fillable.Add(order.Size)
+			if !fillable.LessThan(incomingOrder.Size) {
+				return false
 			}
 		}
+		return true
+	})
+	return fillable
+}
+
+// remove the GTD orders whose expiry is at or before now, returns them as they were in the book
+func (ob *Orderbook) ExpireOrders(now int64) []Order {
+	expiredOrders := make([]Order, 0)
+	for orderId, order := range ob.gtdOrders {
+		if _, ok := ob.idToOrderMap[orderId]; !ok {
+			// filled or cancelled already
+			delete(ob.gtdOrders, orderId)
+			continue
+		}
+		if order.IsExpired(now) {
+			expiredOrders = append(expiredOrders, *order)
+			ob.CancelOrder(orderId)
+			delete(ob.gtdOrders, orderId)
+		}
 	}
-	ob.idToOrderMap[incomingOrder.GetId()] = &incomingOrder
+	// oldest first, map iteration order is random
+	sortByTimePriority(expiredOrders)
+	return expiredOrders
+}
+
+// true if ExpireOrders(now) would remove an order
+func (ob Orderbook) HasExpiredOrders(now int64) bool {
+	for orderId, order := range ob.gtdOrders {
+		if _, ok := ob.idToOrderMap[orderId]; ok && order.IsExpired(now) {
+			return true
+		}
+	}
+	return false
 }
 
 func (ob *Orderbook) PlaceMarketOrder(incomingOrder Order) ([]Trade, error) {
-	if (incomingOrder.GetIsBid() && ob.GetTotalVolumeAllSells() < incomingOrder.Size) || (!incomingOrder.GetIsBid() && ob.GetTotalVolumeAllBuys() < incomingOrder.Size) {
+	if (incomingOrder.GetIsBid() && ob.GetTotalVolumeAllSells().LessThan(incomingOrder.Size)) || (!incomingOrder.GetIsBid() && ob.GetTotalVolumeAllBuys().LessThan(incomingOrder.Size)) {
 		var msg string
 		if incomingOrder.GetIsBid() {
 			msg = "Out of sell liquidity"
@@ -75,109 +250,133 @@ func (ob *Orderbook) PlaceMarketOrder(incomingOrder Order) ([]Trade, error) {
 			msg: msg,
 		}
 	}
-	// check if price level is in buyTree/sellTree
+
+	return ob.matchIncomingOrder(&incomingOrder), nil
+}
+
+// fill the incoming order against the best limits of the other side (price-time priority)
+// until it is filled or the best limit left is worse than what the incoming order accepts
+func (ob *Orderbook) matchIncomingOrder(incomingOrder *Order) []Trade {
 	tradesArray := make([]Trade, 0)
 
 	var smallerOrder *Order
 	var biggerOrder *Order
 
-	var makerTree *Limit
-	var bestLimit *Limit
+	makerSide := ob.side(!incomingOrder.GetIsBid())
+	bestLimit := makerSide.limits.best()
 
-	if incomingOrder.GetIsBid() {
-		makerTree = ob.SellTree
-		bestLimit = ob.LowestSell
-	} else {
-		makerTree = ob.BuyTree
-		bestLimit = ob.HighestBuy
-	}
-
-	for incomingOrder.Size > 0 {
+	for incomingOrder.Size.IsPositive() && bestLimit != nil && incomingOrder.acceptsPrice(bestLimit.GetLimitPrice()) {
 		existingOrder := bestLimit.headOrder
-		// TODO: remove these println
-		if existingOrder == nil {
-			fmt.Println("HELLO  existingOrder == nil")
-		}
-		if bestLimit == nil {
-			fmt.Println("HELLO  bestLimit == nil")
+		if existingOrder.GetUserId() == incomingOrder.GetUserId() && incomingOrder.selfTradePrevention.preventsSelfTrade() {
+			if !ob.preventSelfTrade(incomingOrder, existingOrder) {
+				break
+			}
+			// the resting order might be gone, and its price level with it
+			bestLimit = makerSide.limits.best()
+			continue
 		}
-		if existingOrder.Size < incomingOrder.Size {
+		if existingOrder.Size.LessThan(incomingOrder.Size) {
 			smallerOrder = existingOrder
-			biggerOrder = &incomingOrder
+			biggerOrder = incomingOrder
 		} else {
-			smallerOrder = &incomingOrder
+			smallerOrder = incomingOrder
 			biggerOrder = existingOrder
 		}
 
 		sizeFilled := smallerOrder.Size
-		biggerOrder.Size = biggerOrder.Size - sizeFilled
-		smallerOrder.Size = 0
-		if existingOrder.Size == 0 {
+		biggerOrder.Size = biggerOrder.Size.Sub(sizeFilled)
+		smallerOrder.Size = ZeroDecimal
+		if existingOrder.Size.IsZero() {
 			bestLimit.deleteOrder(existingOrder)
+			delete(ob.idToOrderMap, existingOrder.GetId())
 		}
 
 		var buy *Order
 		var sell *Order
 		// update trades and ob volume
 		if incomingOrder.GetIsBid() {
-			buy = &incomingOrder
+			buy = incomingOrder
 			sell = existingOrder
 		} else {
 			buy = existingOrder
-			sell = &incomingOrder
+			sell = incomingOrder
 		}
-		tradesArray = append(tradesArray, *NewTrade(
+		tradesArray = append(tradesArray, *NewTradeWithTimeStamp(
+			ob.tradeIds.Next(),
 			buy,
 			sell,
+			buy.ticker,
 			existingOrder.GetLimitPrice(),
 			sizeFilled,
-			existingOrder.isBid))
+			existingOrder.isBid,
+			ob.clock()))
 
-		bestLimit.totalVolume -= sizeFilled
+		bestLimit.totalVolume = bestLimit.totalVolume.Sub(sizeFilled)
+		makerSide.totalVolume = makerSide.totalVolume.Sub(sizeFilled)
+		makerSide.volumeChanged(bestLimit.limitPrice)
+		ob.recordOrderEvent(OrderExecuted, existingOrder, sizeFilled, existingOrder.Size, tradesArray[len(tradesArray)-1].GetId())
 
 		// if current limit is out of liquidity, remove it and move on to next limit
-		// this check for empty limit, YIKES
-		// if bestLimit.TotalVolume == 0 {
 		if bestLimit.headOrder == nil {
-			if bestLimit.parent == nil && bestLimit.rightChild == nil {
-				bestLimit = nil
-				makerTree = nil
-				break
-			}
-			if bestLimit.parent != nil {
-				parent := bestLimit.parent
-				newChild := bestLimit.rightChild
-				// cut link parent to current lowest sell both ways
-				// link parent - child both ways
-				// current lowest has to be the left child of its parent
-				parent.leftChild = newChild
-				if newChild != nil {
-					newChild.parent = parent
-				}
-				bestLimit.parent = nil
-
-				bestLimit = findLeftMost(parent)
-			} else {
-				// if root
-				makerTree = bestLimit.rightChild
-				makerTree.parent = nil
-				bestLimit = findLeftMost(makerTree)
-			}
+			makerSide.limits.remove(bestLimit)
+			bestLimit = makerSide.limits.best()
 		}
 	}
 
-	// TODO: how to check all deleted nodes has references to them all removed ?
-	//  so that the garbage collector can do its thing ??
+	if len(tradesArray) > 0 {
+		ob.lastTrades = append(ob.lastTrades, tradesArray...)
+		ob.lastTradedPrice = tradesArray[len(tradesArray)-1].GetPrice()
+	}
+	return tradesArray
+}
+
+// how much it would cost to fill the market order against the other side of the book right now
+// walking the price levels from the best one, the orders of the same user as matching would, see preventSelfTrade
+func (ob Orderbook) GetCostToFill(incomingOrder Order) (Decimal, error) {
+	var msg string
 	if incomingOrder.GetIsBid() {
-		ob.SellTree = makerTree
-		ob.LowestSell = bestLimit
+		msg = "Out of sell liquidity"
 	} else {
-		ob.BuyTree = makerTree
-		ob.HighestBuy = bestLimit
+		msg = "Out of buy liquidity"
+	}
+
+	cost := ZeroDecimal
+	remaining := incomingOrder.Size
+	// the rest of the order is cancelled, not filled deeper in the book
+	stopped := false
+	ob.side(!incomingOrder.GetIsBid()).limits.walk(func(limit *Limit) bool {
+		if !incomingOrder.selfTradePrevention.preventsSelfTrade() {
+			sizeFilled := MinDecimal(remaining, limit.GetTotalVolume())
+			cost = cost.Add(sizeFilled.Mul(limit.GetLimitPrice()))
+			remaining = remaining.Sub(sizeFilled)
+			return remaining.IsPositive()
+		}
+		for order := limit.headOrder; order != nil && remaining.IsPositive(); order = order.nextOrder {
+			if order.GetUserId() != incomingOrder.GetUserId() {
+				sizeFilled := MinDecimal(remaining, order.Size)
+				cost = cost.Add(sizeFilled.Mul(limit.GetLimitPrice()))
+				remaining = remaining.Sub(sizeFilled)
+				continue
+			}
+			switch incomingOrder.selfTradePrevention {
+			case CancelOldest:
+				// cancelled, the matching goes on with the next order
+			case DecrementAndCancel:
+				// taken from both without trading
+				remaining = remaining.Sub(MinDecimal(remaining, order.Size))
+			default:
+				stopped = true
+				return false
+			}
+		}
+		return remaining.IsPositive()
+	})
+	if remaining.IsPositive() && !stopped {
+		return ZeroDecimal, &NoLiquidityError{
+			msg: msg,
+		}
 	}
-	ob.lastTrades = append(ob.lastTrades, tradesArray...)
-	ob.lastTradedPrice = tradesArray[len(tradesArray)-1].GetPrice()
-	return tradesArray, nil
+	return cost, nil
 }
 
 func (ob *Orderbook) AddLastTrade(trade Trade) {
@@ -185,201 +384,134 @@ func (ob *Orderbook) AddLastTrade(trade Trade) {
 	ob.lastTradedPrice = trade.GetPrice()
 }
 
-func (ob Orderbook) GetTotalVolumeAllSells() float64 {
-	return sumTree(ob.SellTree)
+// the trades are added to the last trades when matched, before the exchange knows their fees
+func (ob *Orderbook) SetLastTradeFees(trade Trade) {
+	for i := len(ob.lastTrades) - 1; i >= 0; i-- {
+		if ob.lastTrades[i].id == trade.id {
+			ob.lastTrades[i].SetFees(trade.buyerFee, trade.sellerFee)
+			return
+		}
+	}
 }
 
-func (ob Orderbook) GetTotalVolumeAllBuys() float64 {
-	return sumTree(ob.BuyTree)
+func (ob Orderbook) GetTotalVolumeAllSells() Decimal {
+	return ob.sells.totalVolume
 }
 
-func (ob Orderbook) GetLastTrades() []Trade {
-	return ob.lastTrades
+func (ob Orderbook) GetTotalVolumeAllBuys() Decimal {
+	return ob.buys.totalVolume
 }
 
-func (ob Orderbook) GetLastTradedPrice() float64 {
-	return ob.lastTradedPrice
+// nil if there is no buy order
+func (ob Orderbook) GetHighestBuy() *Limit {
+	return ob.buys.limits.best()
 }
 
-func (ob *Orderbook) CancelOrder(orderId int64) (string, bool, float64, float64) {
-	order, ok := ob.idToOrderMap[orderId]
-	if !ok {
-		return "", false, 0, 0
-	}
-
-	limit := order.parentLimit
-	limit.deleteOrder(order)
-	if limit.headOrder == nil {
-		ob.clearLimit(limit, order.GetIsBid())
-		if limit == ob.HighestBuy {
-			ob.HighestBuy = findLeftMost(ob.BuyTree)
-		} else if limit == ob.LowestSell {
-			ob.LowestSell = findLeftMost(ob.SellTree)
-		}
-	}
-	// TODO: remove order from map
-	delete(ob.idToOrderMap, order.GetId())
-
-	return order.GetUserId(), order.GetIsBid(), order.GetLimitPrice(), order.Size
+// nil if there is no sell order
+func (ob Orderbook) GetLowestSell() *Limit {
+	return ob.sells.limits.best()
 }
 
-func (ob Orderbook) GetBestLimits(tree *Limit, k int) []*Limit {
-	array := make([]*Limit, 0)
-	ob.dfTraversal(tree, k, &array)
-	return array
+// all the buy limits, highest price first
+func (ob Orderbook) GetBuyLimits() []*Limit {
+	return ob.buys.getBestLimits(ob.buys.limits.len())
 }
 
-func (ob *Orderbook) clearLimit(limit *Limit, isBid bool) {
-
-	parent := limit.parent
-	rightChild := limit.rightChild
-	leftMostOfRightSide := findLeftMost(rightChild)
+// all the sell limits, lowest price first
+func (ob Orderbook) GetSellLimits() []*Limit {
+	return ob.sells.getBestLimits(ob.sells.limits.len())
+}
 
-	// replace current node with leftMostOfRightSide
-	if leftMostOfRightSide != nil {
-		// detach leftMostOfRightSide from its parent
-		// leftMostOfRightSide.Parent == nil ?? -> leftMostOfRightSide == root
-		// ; but leftMostleftMostOfRightSide == current.Child -> impossible
-		if leftMostOfRightSide == leftMostOfRightSide.parent.leftChild {
-			leftMostOfRightSide.parent.leftChild = nil
-		}
-		if leftMostOfRightSide == leftMostOfRightSide.parent.rightChild {
-			leftMostOfRightSide.parent.rightChild = nil
-		}
-		leftMostOfRightSide.parent = nil
+func (ob Orderbook) GetBestBuyLimits(k int) []*Limit {
+	return ob.buys.getBestLimits(k)
+}
 
-		// connect current parent to leftMostOfRightSide
-		if parent != nil && parent.leftChild == limit {
-			parent.leftChild = leftMostOfRightSide
-		} else if parent != nil && parent.rightChild == limit {
-			parent.rightChild = leftMostOfRightSide
-		}
-		leftMostOfRightSide.parent = parent
+func (ob Orderbook) GetBestSellLimits(k int) []*Limit {
+	return ob.sells.getBestLimits(k)
+}
 
-		// connect leftMostOfRightSide to current node's childs
-		leftMostOfRightSide.leftChild = limit.leftChild
-		if leftMostOfRightSide != limit.rightChild {
-			leftMostOfRightSide.rightChild = limit.rightChild
-		}
-		if limit.leftChild != nil {
-			limit.leftChild.parent = leftMostOfRightSide
-		}
-		if limit.rightChild != nil {
-			limit.rightChild.parent = leftMostOfRightSide
-		}
+func (ob Orderbook) GetLastTrades() []Trade {
+	return ob.lastTrades
+}
 
-		// detach current node
-		limit.parent = nil
-		limit.leftChild = nil
-		limit.rightChild = nil
-	} else {
-		// if right side empty, just move up left side
-		if parent != nil {
-			// if not root
-			if parent.leftChild == limit {
-				parent.leftChild = limit.leftChild
-			} else {
-				parent.rightChild = limit.leftChild
-			}
-		} else {
-			if isBid {
-				ob.BuyTree = limit.leftChild
-			} else {
-				ob.SellTree = limit.leftChild
+// the price levels whose volume changed since the call before, bids then asks, best price first
+// the book sequence is incremented when there is any
+func (ob *Orderbook) PopLevelChanges() []LevelChange {
+	changes := make([]LevelChange, 0)
+	for _, side := range []*bookSide{ob.buys, ob.sells} {
+		sideChanges := make([]LevelChange, 0, len(side.changedPrices))
+		for price := range side.changedPrices {
+			change := LevelChange{IsBid: side == ob.buys, Price: price, Volume: ZeroDecimal}
+			if limit := side.limits.get(price); limit != nil {
+				change.Volume = limit.totalVolume
 			}
+			sideChanges = append(sideChanges, change)
 		}
+		sort.Slice(sideChanges, func(i, j int) bool {
+			if side == ob.buys {
+				return sideChanges[i].Price.GreaterThan(sideChanges[j].Price)
+			}
+			return sideChanges[i].Price.LessThan(sideChanges[j].Price)
+		})
+		changes = append(changes, sideChanges...)
+		side.changedPrices = make(map[Decimal]bool)
 	}
-}
-func sumTree(node *Limit) float64 {
-	if node == nil {
-		return 0
-	}
-	if node.leftChild == nil && node.rightChild == nil {
-		return node.totalVolume
+	if len(changes) > 0 {
+		ob.bookSequence += 1
 	}
-	sum := 0.0
-	sum += sumTree(node.leftChild)
-	sum += node.totalVolume
-	sum += sumTree(node.rightChild)
-	return sum
+	return changes
 }
 
-func (ob *Orderbook) dfTraversal(node *Limit, k int, arr *[]*Limit) {
-	if node == nil {
-		return
-	}
-	ob.dfTraversal(node.leftChild, k, arr)
-	if len(*arr) < k {
-		*arr = append(*arr, node)
-	}
-	if len(*arr) >= k {
-		return
-	}
-	ob.dfTraversal(node.rightChild, k, arr)
+// the book as it is is the one after the changes of that many PopLevelChanges
+func (ob Orderbook) GetBookSequence() int64 {
+	return ob.bookSequence
 }
-func findLeftMost(node *Limit) *Limit {
-	if node != nil && node.leftChild != nil {
-		return findLeftMost(node.leftChild)
-	} else {
-		return node
-	}
-}
-func setupNewLimit(incomingOrder *Order) *Limit {
-	newLimit := NewLimit(incomingOrder.GetLimitPrice())
-	newLimit.parent = nil
-	newLimit.leftChild = nil
-	newLimit.rightChild = nil
-	newLimit.AddOrder(incomingOrder)
-	return newLimit
+
+func (ob Orderbook) GetLastTradedPrice() Decimal {
+	return ob.lastTradedPrice
 }
 
-func treeToArrayHelper(node *Limit, array *[]*Limit) {
-	if node == nil {
-		return
-	}
-	if node.leftChild == nil && node.rightChild == nil {
-		*array = append(*array, node)
-		return
-	}
-	if node.leftChild != nil {
-		treeToArrayHelper(node.leftChild, array)
-	}
-	*array = append(*array, node)
-	if node.rightChild != nil {
-		treeToArrayHelper(node.rightChild, array)
+func (ob *Orderbook) CancelOrder(orderId int64) (string, bool, Decimal, Decimal) {
+	order, ok := ob.idToOrderMap[orderId]
+	if !ok {
+		return "", false, ZeroDecimal, ZeroDecimal
 	}
-}
 
-// TODO: dont expose the pointer
-func TreeToArray(node *Limit) []*Limit {
-	array := make([]*Limit, 0)
-	treeToArrayHelper(node, &array)
-	return array
+	ob.removeFromLimit(order)
+	// TODO: remove order from map
+	delete(ob.idToOrderMap, order.GetId())
+
+	return order.GetUserId(), order.GetIsBid(), order.GetLimitPrice(), order.Size
 }
 
-func travelLimitTreeAndAddOrderToLimit(node *Limit, incomingOrder *Order) *Limit {
-	if incomingOrder.GetLimitPrice() == node.headOrder.GetLimitPrice() {
-		node.AddOrder(incomingOrder)
-		return nil
-	} else if incomingOrder.IsBetter(*node.headOrder) {
-		if node.leftChild != nil {
-			return travelLimitTreeAndAddOrderToLimit(node.leftChild, incomingOrder)
-		} else {
-			newLimit := setupNewLimit(incomingOrder)
-			node.leftChild = newLimit
-			newLimit.parent = node
-			return newLimit
-		}
-	} else {
-		if node.rightChild != nil {
-			return travelLimitTreeAndAddOrderToLimit(node.rightChild, incomingOrder)
-		} else {
-			newLimit := setupNewLimit(incomingOrder)
-			node.rightChild = newLimit
-			newLimit.parent = node
-			return newLimit
+// a size decrease at the same price keeps the time priority of the order.
+// a price change or a size increase loses it: the order goes to the tail of its price level,
+// after being matched against the other side if the new price crosses
+func (ob *Orderbook) AmendOrder(orderId int64, newSize Decimal, newPrice Decimal) ([]Trade, error) {
+	order, ok := ob.idToOrderMap[orderId]
+	if !ok {
+		return nil, errors.New("Order does not exist")
+	}
+	if newPrice == order.GetLimitPrice() && !newSize.GreaterThan(order.Size) {
+		side := ob.side(order.GetIsBid())
+		side.totalVolume = side.totalVolume.Sub(order.Size).Add(newSize)
+		side.volumeChanged(order.GetLimitPrice())
+		reducedBy := order.Size.Sub(newSize)
+		order.parentLimit.resizeOrder(order, newSize)
+		if reducedBy.IsPositive() {
+			ob.recordOrderEvent(OrderReduced, order, reducedBy, newSize, 0)
 		}
+		return make([]Trade, 0), nil
 	}
+
+	ob.CancelOrder(orderId)
+	// copied once out of its limit, so it does not carry the links to its old neighbours
+	amendedOrder := *order
+	amendedOrder.parentLimit = nil
+	amendedOrder.Size = newSize
+	amendedOrder.limitPrice = newPrice
+	amendedOrder.timestamp = ob.clock()
+	return ob.PlaceLimitOrder(amendedOrder), nil
 }
 
 func (ob Orderbook) GetOrderbyId(id int64) (Order, error) {
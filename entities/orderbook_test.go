@@ -1,6 +1,7 @@
 package entities_test
 
 import (
+	"math/rand"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -19,6 +20,20 @@ func limitArrToJson(ll []*entities.Limit) string {
 	return str
 }
 
+// shorthand for the literals in the tests
+func dec(f float64) entities.Decimal {
+	return entities.NewDecimalFromFloat(f)
+}
+
+// the exchange gives the ids in the real world
+var orderIds = entities.NewSequence(0)
+
+func newOrder(userId string, ticker string, isBid bool, orderType entities.OrderType, size entities.Decimal, limitPrice entities.Decimal) *entities.Order {
+	order := entities.NewOrder(userId, ticker, isBid, orderType, size, limitPrice)
+	order.SetId(orderIds.Next())
+	return order
+}
+
 func TestPlaceLimitOrder(t *testing.T) {
 	ob := entities.NewOrderbook()
 
@@ -26,28 +41,28 @@ func TestPlaceLimitOrder(t *testing.T) {
 	// L--- 1005
 	//     L--- 1100
 	// R--- 900
-	incomingOrder := entities.NewOrder("john", "ticker", true, entities.LimitOrderType, 1, 1000)
+	incomingOrder := newOrder("john", "ticker", true, entities.LimitOrderType, dec(1), dec(1000))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jim", "ticker", true, entities.LimitOrderType, 1, 900)
+	incomingOrder = newOrder("jim", "ticker", true, entities.LimitOrderType, dec(1), dec(900))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jane", "ticker", true, entities.LimitOrderType, 4, 1100)
+	incomingOrder = newOrder("jane", "ticker", true, entities.LimitOrderType, dec(4), dec(1100))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jun", "ticker", true, entities.LimitOrderType, 9, 1005)
+	incomingOrder = newOrder("jun", "ticker", true, entities.LimitOrderType, dec(9), dec(1005))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jack", "ticker", true, entities.LimitOrderType, 9, 1005)
+	incomingOrder = newOrder("jack", "ticker", true, entities.LimitOrderType, dec(9), dec(1005))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	assert.Equal(t, ob.HighestBuy.GetTotalVolume(), 4.0)
-	assert.Equal(t, ob.HighestBuy.GetLimitPrice(), 1100.0)
+	assert.Equal(t, ob.GetHighestBuy().GetTotalVolume(), dec(4.0))
+	assert.Equal(t, ob.GetHighestBuy().GetLimitPrice(), dec(1100.0))
 
-	arr := entities.TreeToArray(ob.BuyTree)
+	arr := ob.GetBuyLimits()
 	orderList := make([]entities.Order, 0)
 	for index := 0; index < len(arr); index++ {
-		if (index < len(arr)-1) && (arr[index].GetLimitPrice() <= arr[index+1].GetLimitPrice()) {
+		if (index < len(arr)-1) && !arr[index].GetLimitPrice().GreaterThan(arr[index+1].GetLimitPrice()) {
 			t.Errorf("Buy Limits not sorted in descending order ")
 			break
 		}
@@ -69,25 +84,25 @@ func TestPlaceLimitOrderSell(t *testing.T) {
 	// R--- 1005
 	//     R--- 1100
 
-	incomingOrder := entities.NewOrder("john", "ticker", false, entities.LimitOrderType, 1, 1000)
+	incomingOrder := newOrder("john", "ticker", false, entities.LimitOrderType, dec(1), dec(1000))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jim", "ticker", false, entities.LimitOrderType, 1, 900)
+	incomingOrder = newOrder("jim", "ticker", false, entities.LimitOrderType, dec(1), dec(900))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jane", "ticker", false, entities.LimitOrderType, 4, 1100)
+	incomingOrder = newOrder("jane", "ticker", false, entities.LimitOrderType, dec(4), dec(1100))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jun", "ticker", false, entities.LimitOrderType, 9, 1005)
+	incomingOrder = newOrder("jun", "ticker", false, entities.LimitOrderType, dec(9), dec(1005))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jack", "ticker", false, entities.LimitOrderType, 9, 1005)
+	incomingOrder = newOrder("jack", "ticker", false, entities.LimitOrderType, dec(9), dec(1005))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	arr := entities.TreeToArray(ob.SellTree)
+	arr := ob.GetSellLimits()
 	orderList := make([]entities.Order, 0)
 	for index := 0; index < len(arr); index++ {
-		if (index < len(arr)-1) && (arr[index].GetLimitPrice() >= arr[index+1].GetLimitPrice()) {
+		if (index < len(arr)-1) && !arr[index].GetLimitPrice().LessThan(arr[index+1].GetLimitPrice()) {
 			t.Errorf("Sell Limits not sorted in ascending order ")
 			break
 		}
@@ -107,38 +122,38 @@ func TestPlaceMarketOrderBuyOneFill(t *testing.T) {
 	//     R--- 1100
 	ob := entities.NewOrderbook()
 
-	incomingOrder := entities.NewOrder("john", "ticker", false, entities.LimitOrderType, 1, 1000)
+	incomingOrder := newOrder("john", "ticker", false, entities.LimitOrderType, dec(1), dec(1000))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jim", "ticker", false, entities.LimitOrderType, 1, 900)
+	incomingOrder = newOrder("jim", "ticker", false, entities.LimitOrderType, dec(1), dec(900))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jane", "ticker", false, entities.LimitOrderType, 4, 1100)
+	incomingOrder = newOrder("jane", "ticker", false, entities.LimitOrderType, dec(4), dec(1100))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jun", "ticker", false, entities.LimitOrderType, 9, 1005)
+	incomingOrder = newOrder("jun", "ticker", false, entities.LimitOrderType, dec(9), dec(1005))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jack", "ticker", false, entities.LimitOrderType, 9, 1005)
+	incomingOrder = newOrder("jack", "ticker", false, entities.LimitOrderType, dec(9), dec(1005))
 	ob.PlaceLimitOrder(*incomingOrder)
-	assert.Equal(t, ob.GetTotalVolumeAllSells(), 24.0)
+	assert.Equal(t, ob.GetTotalVolumeAllSells(), dec(24.0))
 
-	incomingOrder = entities.NewOrder("lily", "ticker", true, entities.MarketOrderType, 1, 0)
+	incomingOrder = newOrder("lily", "ticker", true, entities.MarketOrderType, dec(1), dec(0))
 	tradesArray, err := ob.PlaceMarketOrder(*incomingOrder)
 
 	assert.NoError(t, err)
-	assert.Equal(t, ob.GetTotalVolumeAllSells(), 23.0)
-	assert.Equal(t, ob.LowestSell.GetLimitPrice(), 1000.0)
+	assert.Equal(t, ob.GetTotalVolumeAllSells(), dec(23.0))
+	assert.Equal(t, ob.GetLowestSell().GetLimitPrice(), dec(1000.0))
 
 	assert.Equal(t, tradesArray[0].GetBuyer().GetUserId(), "lily")
 	assert.Equal(t, tradesArray[0].GetSeller().GetUserId(), "jim")
-	assert.Equal(t, tradesArray[0].GetPrice(), 900.0)
-	assert.Equal(t, tradesArray[0].GetSize(), 1.0)
+	assert.Equal(t, tradesArray[0].GetPrice(), dec(900.0))
+	assert.Equal(t, tradesArray[0].GetSize(), dec(1.0))
 
-	arr := entities.TreeToArray(ob.SellTree)
+	arr := ob.GetSellLimits()
 	orderList := make([]entities.Order, 0)
 	for index := 0; index < len(arr); index++ {
-		if (index < len(arr)-1) && (arr[index].GetLimitPrice() >= arr[index+1].GetLimitPrice()) {
+		if (index < len(arr)-1) && !arr[index].GetLimitPrice().LessThan(arr[index+1].GetLimitPrice()) {
 			t.Errorf("Sell Limits not sorted in ascending order ")
 			break
 		}
@@ -158,33 +173,33 @@ func TestPlaceMarketOrderBuyOnePartialFill(t *testing.T) {
 	// L--- 900
 	// R--- 1005
 	//     R--- 1100
-	incomingOrder := entities.NewOrder("john", "ticker", false, entities.LimitOrderType, 1, 1000)
+	incomingOrder := newOrder("john", "ticker", false, entities.LimitOrderType, dec(1), dec(1000))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jim", "ticker", false, entities.LimitOrderType, 1, 900)
+	incomingOrder = newOrder("jim", "ticker", false, entities.LimitOrderType, dec(1), dec(900))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jane", "ticker", false, entities.LimitOrderType, 4, 1100)
+	incomingOrder = newOrder("jane", "ticker", false, entities.LimitOrderType, dec(4), dec(1100))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jun", "ticker", false, entities.LimitOrderType, 9, 1005)
+	incomingOrder = newOrder("jun", "ticker", false, entities.LimitOrderType, dec(9), dec(1005))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jack", "ticker", false, entities.LimitOrderType, 9, 1005)
+	incomingOrder = newOrder("jack", "ticker", false, entities.LimitOrderType, dec(9), dec(1005))
 	ob.PlaceLimitOrder(*incomingOrder)
-	assert.Equal(t, ob.GetTotalVolumeAllSells(), 24.0)
+	assert.Equal(t, ob.GetTotalVolumeAllSells(), dec(24.0))
 
-	incomingOrder = entities.NewOrder("lily", "ticker", true, entities.MarketOrderType, 0.5, 0)
+	incomingOrder = newOrder("lily", "ticker", true, entities.MarketOrderType, dec(0.5), dec(0))
 	tradesArray, err := ob.PlaceMarketOrder(*incomingOrder)
 
 	assert.NoError(t, err)
-	assert.Equal(t, ob.GetTotalVolumeAllSells(), 23.5)
-	assert.Equal(t, ob.LowestSell.GetLimitPrice(), 900.0)
+	assert.Equal(t, ob.GetTotalVolumeAllSells(), dec(23.5))
+	assert.Equal(t, ob.GetLowestSell().GetLimitPrice(), dec(900.0))
 
 	assert.Equal(t, tradesArray[0].GetBuyer().GetUserId(), "lily")
 	assert.Equal(t, tradesArray[0].GetSeller().GetUserId(), "jim")
-	assert.Equal(t, tradesArray[0].GetPrice(), 900.0)
-	assert.Equal(t, tradesArray[0].GetSize(), 0.5)
+	assert.Equal(t, tradesArray[0].GetPrice(), dec(900.0))
+	assert.Equal(t, tradesArray[0].GetSize(), dec(0.5))
 }
 
 func TestPlaceMarketOrderBuyMultiFill(t *testing.T) {
@@ -195,28 +210,28 @@ func TestPlaceMarketOrderBuyMultiFill(t *testing.T) {
 	// R--- 1005
 	//     R--- 1100
 
-	incomingOrder := entities.NewOrder("john", "ticker", false, entities.LimitOrderType, 1, 1000)
+	incomingOrder := newOrder("john", "ticker", false, entities.LimitOrderType, dec(1), dec(1000))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jim", "ticker", false, entities.LimitOrderType, 1, 900)
+	incomingOrder = newOrder("jim", "ticker", false, entities.LimitOrderType, dec(1), dec(900))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jane", "ticker", false, entities.LimitOrderType, 4, 1100)
+	incomingOrder = newOrder("jane", "ticker", false, entities.LimitOrderType, dec(4), dec(1100))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jun", "ticker", false, entities.LimitOrderType, 9, 1005)
+	incomingOrder = newOrder("jun", "ticker", false, entities.LimitOrderType, dec(9), dec(1005))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jack", "ticker", false, entities.LimitOrderType, 9, 1005)
+	incomingOrder = newOrder("jack", "ticker", false, entities.LimitOrderType, dec(9), dec(1005))
 	ob.PlaceLimitOrder(*incomingOrder)
-	assert.Equal(t, ob.GetTotalVolumeAllSells(), 24.0)
+	assert.Equal(t, ob.GetTotalVolumeAllSells(), dec(24.0))
 
-	incomingOrder = entities.NewOrder("lily", "ticker", true, entities.MarketOrderType, 23.5, 0)
+	incomingOrder = newOrder("lily", "ticker", true, entities.MarketOrderType, dec(23.5), dec(0))
 	tradesArray, err := ob.PlaceMarketOrder(*incomingOrder)
 
 	assert.NoError(t, err)
-	assert.Equal(t, ob.GetTotalVolumeAllSells(), 0.5)
-	assert.Equal(t, ob.LowestSell.GetLimitPrice(), 1100.0)
+	assert.Equal(t, ob.GetTotalVolumeAllSells(), dec(0.5))
+	assert.Equal(t, ob.GetLowestSell().GetLimitPrice(), dec(1100.0))
 
 	// check price priority
 	assert.Equal(t, tradesArray[0].GetSeller().GetUserId(), "jim")
@@ -226,15 +241,15 @@ func TestPlaceMarketOrderBuyMultiFill(t *testing.T) {
 	assert.Equal(t, tradesArray[3].GetSeller().GetUserId(), "jack")
 	assert.Equal(t, tradesArray[4].GetSeller().GetUserId(), "jane")
 
-	incomingOrder = entities.NewOrder("lily", "ticker", true, entities.MarketOrderType, 0.5, 0)
+	incomingOrder = newOrder("lily", "ticker", true, entities.MarketOrderType, dec(0.5), dec(0))
 	tradesArray, err = ob.PlaceMarketOrder(*incomingOrder)
 
 	assert.NoError(t, err)
-	assert.Equal(t, ob.GetTotalVolumeAllSells(), 0.0)
+	assert.Equal(t, ob.GetTotalVolumeAllSells(), dec(0.0))
 	// check returned trades array
 	assert.Equal(t, tradesArray[0].GetSeller().GetUserId(), "jane")
-	assert.Equal(t, tradesArray[0].GetSize(), 0.5)
-	assert.Equal(t, tradesArray[0].GetPrice(), 1100.0)
+	assert.Equal(t, tradesArray[0].GetSize(), dec(0.5))
+	assert.Equal(t, tradesArray[0].GetPrice(), dec(1100.0))
 
 	// check if orderbook recorded all trades across all placed market order
 	assert.Equal(t, ob.GetLastTrades()[0].GetSeller().GetUserId(), "jim")
@@ -244,10 +259,10 @@ func TestPlaceMarketOrderBuyMultiFill(t *testing.T) {
 	assert.Equal(t, ob.GetLastTrades()[4].GetSeller().GetUserId(), "jane")
 	assert.Equal(t, ob.GetLastTrades()[5].GetSeller().GetUserId(), "jane")
 
-	arr := entities.TreeToArray(ob.SellTree)
+	arr := ob.GetSellLimits()
 	assert.Equal(t, len(arr) == 0, true)
 
-	assert.Equal(t, ob.LowestSell == nil, true)
+	assert.Equal(t, ob.GetLowestSell() == nil, true)
 }
 
 func TestPlaceMarketOrderSellMultiFill(t *testing.T) {
@@ -257,28 +272,28 @@ func TestPlaceMarketOrderSellMultiFill(t *testing.T) {
 	// R--- 900
 	ob := entities.NewOrderbook()
 
-	incomingOrder := entities.NewOrder("john", "ticker", true, entities.LimitOrderType, 1, 1000)
+	incomingOrder := newOrder("john", "ticker", true, entities.LimitOrderType, dec(1), dec(1000))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jim", "ticker", true, entities.LimitOrderType, 1, 900)
+	incomingOrder = newOrder("jim", "ticker", true, entities.LimitOrderType, dec(1), dec(900))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jane", "ticker", true, entities.LimitOrderType, 4, 1100)
+	incomingOrder = newOrder("jane", "ticker", true, entities.LimitOrderType, dec(4), dec(1100))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jun", "ticker", true, entities.LimitOrderType, 9, 1005)
+	incomingOrder = newOrder("jun", "ticker", true, entities.LimitOrderType, dec(9), dec(1005))
 	ob.PlaceLimitOrder(*incomingOrder)
 
-	incomingOrder = entities.NewOrder("jack", "ticker", true, entities.LimitOrderType, 9, 1005)
+	incomingOrder = newOrder("jack", "ticker", true, entities.LimitOrderType, dec(9), dec(1005))
 	ob.PlaceLimitOrder(*incomingOrder)
-	assert.Equal(t, ob.GetTotalVolumeAllBuys(), 24.0)
+	assert.Equal(t, ob.GetTotalVolumeAllBuys(), dec(24.0))
 
-	incomingOrder = entities.NewOrder("lily", "ticker", false, entities.MarketOrderType, 23.5, 0)
+	incomingOrder = newOrder("lily", "ticker", false, entities.MarketOrderType, dec(23.5), dec(0))
 	tradesArray, err := ob.PlaceMarketOrder(*incomingOrder)
 
 	assert.NoError(t, err)
-	assert.Equal(t, ob.GetTotalVolumeAllBuys(), 0.5)
-	assert.Equal(t, ob.HighestBuy.GetLimitPrice(), 900.0)
+	assert.Equal(t, ob.GetTotalVolumeAllBuys(), dec(0.5))
+	assert.Equal(t, ob.GetHighestBuy().GetLimitPrice(), dec(900.0))
 
 	// check price priority
 	assert.Equal(t, tradesArray[0].GetBuyer().GetUserId(), "jane")
@@ -288,16 +303,16 @@ func TestPlaceMarketOrderSellMultiFill(t *testing.T) {
 	assert.Equal(t, tradesArray[3].GetBuyer().GetUserId(), "john")
 	assert.Equal(t, tradesArray[4].GetBuyer().GetUserId(), "jim")
 
-	incomingOrder = entities.NewOrder("lily", "ticker", false, entities.MarketOrderType, 0.5, 0)
+	incomingOrder = newOrder("lily", "ticker", false, entities.MarketOrderType, dec(0.5), dec(0))
 	tradesArray, err = ob.PlaceMarketOrder(*incomingOrder)
 
 	assert.NoError(t, err)
-	assert.Equal(t, ob.GetTotalVolumeAllBuys(), 0.0)
+	assert.Equal(t, ob.GetTotalVolumeAllBuys(), dec(0.0))
 
 	// check returned trades array
 	assert.Equal(t, tradesArray[0].GetBuyer().GetUserId(), "jim")
-	assert.Equal(t, tradesArray[0].GetSize(), 0.5)
-	assert.Equal(t, tradesArray[0].GetPrice(), 900.0)
+	assert.Equal(t, tradesArray[0].GetSize(), dec(0.5))
+	assert.Equal(t, tradesArray[0].GetPrice(), dec(900.0))
 
 	// check if orderbook recorded all trades across all placed market order
 	assert.Equal(t, ob.GetLastTrades()[0].GetBuyer().GetUserId(), "jane")
@@ -307,10 +322,10 @@ func TestPlaceMarketOrderSellMultiFill(t *testing.T) {
 	assert.Equal(t, ob.GetLastTrades()[4].GetBuyer().GetUserId(), "jim")
 	assert.Equal(t, ob.GetLastTrades()[5].GetBuyer().GetUserId(), "jim")
 
-	arr := entities.TreeToArray(ob.BuyTree)
+	arr := ob.GetBuyLimits()
 	assert.Equal(t, len(arr) == 0, true)
 
-	assert.Equal(t, ob.HighestBuy == nil, true)
+	assert.Equal(t, ob.GetHighestBuy() == nil, true)
 }
 
 func TestCancelOrderSimple(t *testing.T) {
@@ -318,7 +333,7 @@ func TestCancelOrderSimple(t *testing.T) {
 
 	// Root: 1000
 
-	incomingOrder := entities.NewOrder("john", "ticker", true, entities.LimitOrderType, 1, 1000)
+	incomingOrder := newOrder("john", "ticker", true, entities.LimitOrderType, dec(1), dec(1000))
 	ob.PlaceLimitOrder(*incomingOrder)
 
 	order, err := ob.GetOrderbyId(incomingOrder.GetId())
@@ -330,16 +345,16 @@ func TestCancelOrderSimple(t *testing.T) {
 		assert.Equal(t, incomingOrder.GetUserId(), order.GetUserId())
 		assert.Equal(t, incomingOrder.GetOrderType(), order.GetOrderType())
 	}
-	assert.Equal(t, 1.0, ob.GetTotalVolumeAllBuys(), 1.0)
-	assert.Equal(t, 1000.0, ob.HighestBuy.GetLimitPrice())
+	assert.Equal(t, dec(1.0), ob.GetTotalVolumeAllBuys(), dec(1.0))
+	assert.Equal(t, dec(1000.0), ob.GetHighestBuy().GetLimitPrice())
 
 	ob.CancelOrder(incomingOrder.GetId())
 
 	_, err = ob.GetOrderbyId(incomingOrder.GetId())
 	assert.Error(t, err)
 
-	assert.Equal(t, 0.0, ob.GetTotalVolumeAllBuys())
-	assert.True(t, ob.HighestBuy == nil)
+	assert.Equal(t, dec(0.0), ob.GetTotalVolumeAllBuys())
+	assert.True(t, ob.GetHighestBuy() == nil)
 }
 
 func TestCancelOrderBigTree(t *testing.T) {
@@ -361,85 +376,85 @@ func TestCancelOrderBigTree(t *testing.T) {
 	//         R--- 14
 
 	// Adding orders with limit prices from 1 to 14 (from the BST)
-	johnOrder := entities.NewOrder("john", "ticker", false, entities.LimitOrderType, 1, 7)
+	johnOrder := newOrder("john", "ticker", false, entities.LimitOrderType, dec(1), dec(7))
 	ob.PlaceLimitOrder(*johnOrder)
 
-	jimOrder := entities.NewOrder("jim", "ticker", false, entities.LimitOrderType, 1, 3)
+	jimOrder := newOrder("jim", "ticker", false, entities.LimitOrderType, dec(1), dec(3))
 	ob.PlaceLimitOrder(*jimOrder)
 
-	janeOrder := entities.NewOrder("jane", "ticker", false, entities.LimitOrderType, 4, 11)
+	janeOrder := newOrder("jane", "ticker", false, entities.LimitOrderType, dec(4), dec(11))
 	ob.PlaceLimitOrder(*janeOrder)
 
-	junOrder := entities.NewOrder("jun", "ticker", false, entities.LimitOrderType, 9, 9)
+	junOrder := newOrder("jun", "ticker", false, entities.LimitOrderType, dec(9), dec(9))
 	ob.PlaceLimitOrder(*junOrder)
 
-	jackOrder := entities.NewOrder("jack", "ticker", false, entities.LimitOrderType, 9, 9)
+	jackOrder := newOrder("jack", "ticker", false, entities.LimitOrderType, dec(9), dec(9))
 	ob.PlaceLimitOrder(*jackOrder)
 
-	jerryOrder := entities.NewOrder("jerry", "ticker", false, entities.LimitOrderType, 2, 1)
+	jerryOrder := newOrder("jerry", "ticker", false, entities.LimitOrderType, dec(2), dec(1))
 	ob.PlaceLimitOrder(*jerryOrder)
 
-	jessicaOrder := entities.NewOrder("jessica", "ticker", false, entities.LimitOrderType, 2, 2)
+	jessicaOrder := newOrder("jessica", "ticker", false, entities.LimitOrderType, dec(2), dec(2))
 	ob.PlaceLimitOrder(*jessicaOrder)
 
-	jessicaTwinOrder := entities.NewOrder("jessicaTwin", "ticker", false, entities.LimitOrderType, 3, 2)
+	jessicaTwinOrder := newOrder("jessicaTwin", "ticker", false, entities.LimitOrderType, dec(3), dec(2))
 	ob.PlaceLimitOrder(*jessicaTwinOrder)
 
-	jillOrder := entities.NewOrder("jill", "ticker", false, entities.LimitOrderType, 3, 4)
+	jillOrder := newOrder("jill", "ticker", false, entities.LimitOrderType, dec(3), dec(4))
 	ob.PlaceLimitOrder(*jillOrder)
 
-	jeffOrder := entities.NewOrder("jeff", "ticker", false, entities.LimitOrderType, 3, 5)
+	jeffOrder := newOrder("jeff", "ticker", false, entities.LimitOrderType, dec(3), dec(5))
 	ob.PlaceLimitOrder(*jeffOrder)
 
-	jacobOrder := entities.NewOrder("jacob", "ticker", false, entities.LimitOrderType, 4, 6)
+	jacobOrder := newOrder("jacob", "ticker", false, entities.LimitOrderType, dec(4), dec(6))
 	ob.PlaceLimitOrder(*jacobOrder)
 
-	julieOrder := entities.NewOrder("julie", "ticker", false, entities.LimitOrderType, 4, 8)
+	julieOrder := newOrder("julie", "ticker", false, entities.LimitOrderType, dec(4), dec(8))
 	ob.PlaceLimitOrder(*julieOrder)
 
-	jamesOrder := entities.NewOrder("james", "ticker", false, entities.LimitOrderType, 5, 10)
+	jamesOrder := newOrder("james", "ticker", false, entities.LimitOrderType, dec(5), dec(10))
 	ob.PlaceLimitOrder(*jamesOrder)
 
-	joanOrder := entities.NewOrder("joan", "ticker", false, entities.LimitOrderType, 5, 12)
+	joanOrder := newOrder("joan", "ticker", false, entities.LimitOrderType, dec(5), dec(12))
 	ob.PlaceLimitOrder(*joanOrder)
 
-	jamieOrder := entities.NewOrder("jamie", "ticker", false, entities.LimitOrderType, 6, 13)
+	jamieOrder := newOrder("jamie", "ticker", false, entities.LimitOrderType, dec(6), dec(13))
 	ob.PlaceLimitOrder(*jamieOrder)
 
-	jodieOrder := entities.NewOrder("jodie", "ticker", false, entities.LimitOrderType, 6, 14)
+	jodieOrder := newOrder("jodie", "ticker", false, entities.LimitOrderType, dec(6), dec(14))
 	ob.PlaceLimitOrder(*jodieOrder)
 
-	assert.Equal(t, 67.0, ob.GetTotalVolumeAllSells())
+	assert.Equal(t, dec(67.0), ob.GetTotalVolumeAllSells())
 
-	assert.Equal(t, 1.0, ob.LowestSell.GetLimitPrice())
+	assert.Equal(t, dec(1.0), ob.GetLowestSell().GetLimitPrice())
 
 	ob.CancelOrder(jerryOrder.GetId())
-	assert.Equal(t, 2.0, ob.LowestSell.GetLimitPrice())
-	assert.Equal(t, 65.0, ob.GetTotalVolumeAllSells())
+	assert.Equal(t, dec(2.0), ob.GetLowestSell().GetLimitPrice())
+	assert.Equal(t, dec(65.0), ob.GetTotalVolumeAllSells())
 
 	ob.CancelOrder(jessicaOrder.GetId())
-	assert.Equal(t, 2.0, ob.LowestSell.GetLimitPrice())
-	assert.Equal(t, 63.0, ob.GetTotalVolumeAllSells())
+	assert.Equal(t, dec(2.0), ob.GetLowestSell().GetLimitPrice())
+	assert.Equal(t, dec(63.0), ob.GetTotalVolumeAllSells())
 
 	ob.CancelOrder(jessicaTwinOrder.GetId())
-	assert.Equal(t, 3.0, ob.LowestSell.GetLimitPrice())
-	assert.Equal(t, 60.0, ob.GetTotalVolumeAllSells())
+	assert.Equal(t, dec(3.0), ob.GetLowestSell().GetLimitPrice())
+	assert.Equal(t, dec(60.0), ob.GetTotalVolumeAllSells())
 
 	ob.CancelOrder(jodieOrder.GetId())
-	assert.Equal(t, 3.0, ob.LowestSell.GetLimitPrice())
-	assert.Equal(t, 54.0, ob.GetTotalVolumeAllSells())
+	assert.Equal(t, dec(3.0), ob.GetLowestSell().GetLimitPrice())
+	assert.Equal(t, dec(54.0), ob.GetTotalVolumeAllSells())
 
 	ob.CancelOrder(julieOrder.GetId())
-	assert.Equal(t, 3.0, ob.LowestSell.GetLimitPrice())
-	assert.Equal(t, 50.0, ob.GetTotalVolumeAllSells())
+	assert.Equal(t, dec(3.0), ob.GetLowestSell().GetLimitPrice())
+	assert.Equal(t, dec(50.0), ob.GetTotalVolumeAllSells())
 
 	ob.CancelOrder(jamesOrder.GetId())
-	assert.Equal(t, 3.0, ob.LowestSell.GetLimitPrice())
-	assert.Equal(t, 45.0, ob.GetTotalVolumeAllSells())
+	assert.Equal(t, dec(3.0), ob.GetLowestSell().GetLimitPrice())
+	assert.Equal(t, dec(45.0), ob.GetTotalVolumeAllSells())
 
-	arr := entities.TreeToArray(ob.SellTree)
+	arr := ob.GetSellLimits()
 	for index := 0; index < len(arr)-1; index++ {
-		if arr[index].GetLimitPrice() >= arr[index+1].GetLimitPrice() {
+		if !arr[index].GetLimitPrice().LessThan(arr[index+1].GetLimitPrice()) {
 			t.Errorf("Sell Limit not sorted in ascending order ")
 			break
 		}
@@ -465,58 +480,632 @@ func TestGetKBestBuys(t *testing.T) {
 	//         R--- 14
 
 	// Adding orders with limit prices from 1 to 14 (from the BST)
-	johnOrder := entities.NewOrder("john", "ticker", false, entities.LimitOrderType, 1, 7)
+	johnOrder := newOrder("john", "ticker", false, entities.LimitOrderType, dec(1), dec(7))
 	ob.PlaceLimitOrder(*johnOrder)
 
-	jimOrder := entities.NewOrder("jim", "ticker", false, entities.LimitOrderType, 1, 3)
+	jimOrder := newOrder("jim", "ticker", false, entities.LimitOrderType, dec(1), dec(3))
 	ob.PlaceLimitOrder(*jimOrder)
 
-	janeOrder := entities.NewOrder("jane", "ticker", false, entities.LimitOrderType, 4, 11)
+	janeOrder := newOrder("jane", "ticker", false, entities.LimitOrderType, dec(4), dec(11))
 	ob.PlaceLimitOrder(*janeOrder)
 
-	junOrder := entities.NewOrder("jun", "ticker", false, entities.LimitOrderType, 9, 9)
+	junOrder := newOrder("jun", "ticker", false, entities.LimitOrderType, dec(9), dec(9))
 	ob.PlaceLimitOrder(*junOrder)
 
-	jackOrder := entities.NewOrder("jack", "ticker", false, entities.LimitOrderType, 9, 9)
+	jackOrder := newOrder("jack", "ticker", false, entities.LimitOrderType, dec(9), dec(9))
 	ob.PlaceLimitOrder(*jackOrder)
 
-	jerryOrder := entities.NewOrder("jerry", "ticker", false, entities.LimitOrderType, 2, 1)
+	jerryOrder := newOrder("jerry", "ticker", false, entities.LimitOrderType, dec(2), dec(1))
 	ob.PlaceLimitOrder(*jerryOrder)
 
-	jessicaOrder := entities.NewOrder("jessica", "ticker", false, entities.LimitOrderType, 2, 2)
+	jessicaOrder := newOrder("jessica", "ticker", false, entities.LimitOrderType, dec(2), dec(2))
 	ob.PlaceLimitOrder(*jessicaOrder)
 
-	jillOrder := entities.NewOrder("jill", "ticker", false, entities.LimitOrderType, 3, 4)
+	jillOrder := newOrder("jill", "ticker", false, entities.LimitOrderType, dec(3), dec(4))
 	ob.PlaceLimitOrder(*jillOrder)
 
-	jeffOrder := entities.NewOrder("jeff", "ticker", false, entities.LimitOrderType, 3, 5)
+	jeffOrder := newOrder("jeff", "ticker", false, entities.LimitOrderType, dec(3), dec(5))
 	ob.PlaceLimitOrder(*jeffOrder)
 
-	jacobOrder := entities.NewOrder("jacob", "ticker", false, entities.LimitOrderType, 4, 6)
+	jacobOrder := newOrder("jacob", "ticker", false, entities.LimitOrderType, dec(4), dec(6))
 	ob.PlaceLimitOrder(*jacobOrder)
 
-	julieOrder := entities.NewOrder("julie", "ticker", false, entities.LimitOrderType, 4, 8)
+	julieOrder := newOrder("julie", "ticker", false, entities.LimitOrderType, dec(4), dec(8))
 	ob.PlaceLimitOrder(*julieOrder)
 
-	jamesOrder := entities.NewOrder("james", "ticker", false, entities.LimitOrderType, 5, 10)
+	jamesOrder := newOrder("james", "ticker", false, entities.LimitOrderType, dec(5), dec(10))
 	ob.PlaceLimitOrder(*jamesOrder)
 
-	joanOrder := entities.NewOrder("joan", "ticker", false, entities.LimitOrderType, 5, 12)
+	joanOrder := newOrder("joan", "ticker", false, entities.LimitOrderType, dec(5), dec(12))
 	ob.PlaceLimitOrder(*joanOrder)
 
-	jamieOrder := entities.NewOrder("jamie", "ticker", false, entities.LimitOrderType, 6, 13)
+	jamieOrder := newOrder("jamie", "ticker", false, entities.LimitOrderType, dec(6), dec(13))
 	ob.PlaceLimitOrder(*jamieOrder)
 
-	jodieOrder := entities.NewOrder("jodie", "ticker", false, entities.LimitOrderType, 6, 14)
+	jodieOrder := newOrder("jodie", "ticker", false, entities.LimitOrderType, dec(6), dec(14))
 	ob.PlaceLimitOrder(*jodieOrder)
 
-	assert.Equal(t, 64.0, ob.GetTotalVolumeAllSells())
+	assert.Equal(t, dec(64.0), ob.GetTotalVolumeAllSells())
 
-	assert.Equal(t, 1.0, ob.LowestSell.GetLimitPrice())
+	assert.Equal(t, dec(1.0), ob.GetLowestSell().GetLimitPrice())
 
-	arr := ob.GetBestLimits(ob.SellTree, 3)
+	arr := ob.GetBestSellLimits(3)
 	assert.Equal(t, 3, len(arr))
-	assert.Equal(t, 1.0, arr[0].GetLimitPrice())
-	assert.Equal(t, 2.0, arr[1].GetLimitPrice())
-	assert.Equal(t, 3.0, arr[2].GetLimitPrice())
+	assert.Equal(t, dec(1.0), arr[0].GetLimitPrice())
+	assert.Equal(t, dec(2.0), arr[1].GetLimitPrice())
+	assert.Equal(t, dec(3.0), arr[2].GetLimitPrice())
+}
+
+func TestPlaceLimitOrderBuyCrossing(t *testing.T) {
+	ob := entities.NewOrderbook()
+
+	// Root: 1000
+	// L--- 900
+	// R--- 1005
+	//     R--- 1100
+	incomingOrder := newOrder("john", "ticker", false, entities.LimitOrderType, dec(1), dec(1000))
+	ob.PlaceLimitOrder(*incomingOrder)
+
+	incomingOrder = newOrder("jim", "ticker", false, entities.LimitOrderType, dec(1), dec(900))
+	ob.PlaceLimitOrder(*incomingOrder)
+
+	incomingOrder = newOrder("jane", "ticker", false, entities.LimitOrderType, dec(4), dec(1100))
+	ob.PlaceLimitOrder(*incomingOrder)
+
+	incomingOrder = newOrder("jun", "ticker", false, entities.LimitOrderType, dec(9), dec(1005))
+	ob.PlaceLimitOrder(*incomingOrder)
+
+	incomingOrder = newOrder("jack", "ticker", false, entities.LimitOrderType, dec(9), dec(1005))
+	ob.PlaceLimitOrder(*incomingOrder)
+	assert.Equal(t, dec(24.0), ob.GetTotalVolumeAllSells())
+
+	// takes everything up to 1005, the rest stays in the book at 1005
+	lilyOrder := newOrder("lily", "ticker", true, entities.LimitOrderType, dec(22), dec(1005))
+	tradesArray := ob.PlaceLimitOrder(*lilyOrder)
+
+	assert.Equal(t, 4, len(tradesArray))
+	// check price priority
+	assert.Equal(t, "jim", tradesArray[0].GetSeller().GetUserId())
+	assert.Equal(t, dec(900.0), tradesArray[0].GetPrice())
+	assert.Equal(t, "john", tradesArray[1].GetSeller().GetUserId())
+	assert.Equal(t, dec(1000.0), tradesArray[1].GetPrice())
+	// check time priority jun > jack
+	assert.Equal(t, "jun", tradesArray[2].GetSeller().GetUserId())
+	assert.Equal(t, "jack", tradesArray[3].GetSeller().GetUserId())
+	assert.Equal(t, dec(1005.0), tradesArray[3].GetPrice())
+	assert.False(t, tradesArray[3].GetIsBuyerMaker())
+
+	assert.Equal(t, dec(4.0), ob.GetTotalVolumeAllSells())
+	assert.Equal(t, dec(1100.0), ob.GetLowestSell().GetLimitPrice())
+	assert.Equal(t, dec(2.0), ob.GetTotalVolumeAllBuys())
+	assert.Equal(t, dec(1005.0), ob.GetHighestBuy().GetLimitPrice())
+
+	restingOrder, err := ob.GetOrderbyId(lilyOrder.GetId())
+	if assert.NoError(t, err) {
+		assert.Equal(t, dec(2.0), restingOrder.GetSize())
+	}
+	assert.Equal(t, dec(1005.0), ob.GetLastTradedPrice())
+}
+
+func TestPlaceLimitOrderSellNotCrossing(t *testing.T) {
+	ob := entities.NewOrderbook()
+
+	incomingOrder := newOrder("john", "ticker", true, entities.LimitOrderType, dec(1), dec(1000))
+	ob.PlaceLimitOrder(*incomingOrder)
+
+	incomingOrder = newOrder("jim", "ticker", true, entities.LimitOrderType, dec(1), dec(900))
+	ob.PlaceLimitOrder(*incomingOrder)
+
+	// only john's bid is good enough
+	incomingOrder = newOrder("lily", "ticker", false, entities.LimitOrderType, dec(3), dec(950))
+	tradesArray := ob.PlaceLimitOrder(*incomingOrder)
+
+	assert.Equal(t, 1, len(tradesArray))
+	assert.Equal(t, "john", tradesArray[0].GetBuyer().GetUserId())
+	assert.Equal(t, dec(1000.0), tradesArray[0].GetPrice())
+	assert.True(t, tradesArray[0].GetIsBuyerMaker())
+
+	assert.Equal(t, dec(900.0), ob.GetHighestBuy().GetLimitPrice())
+	assert.Equal(t, dec(950.0), ob.GetLowestSell().GetLimitPrice())
+	assert.Equal(t, dec(2.0), ob.GetTotalVolumeAllSells())
+}
+
+func TestPlaceLimitOrderTimeInForce(t *testing.T) {
+	ob := entities.NewOrderbook()
+
+	ob.PlaceLimitOrder(*newOrder("john", "ticker", false, entities.LimitOrderType, dec(1), dec(1000)))
+	ob.PlaceLimitOrder(*newOrder("jim", "ticker", false, entities.LimitOrderType, dec(2), dec(1005)))
+
+	// IOC: takes john's 1 at 1000, jim's 1005 is too expensive, the rest is not added to the book
+	iocOrder := newOrder("lily", "ticker", true, entities.LimitOrderType, dec(2), dec(1000))
+	iocOrder.SetTimeInForce(entities.ImmediateOrCancel, 0)
+	tradesArray := ob.PlaceLimitOrder(*iocOrder)
+	assert.Equal(t, 1, len(tradesArray))
+	assert.Nil(t, ob.GetHighestBuy())
+	_, err := ob.GetOrderbyId(iocOrder.GetId())
+	assert.Error(t, err)
+
+	// FOK: only 2 available at 1005, nothing happens
+	fokOrder := newOrder("lily", "ticker", true, entities.LimitOrderType, dec(3), dec(1005))
+	fokOrder.SetTimeInForce(entities.FillOrKill, 0)
+	tradesArray = ob.PlaceLimitOrder(*fokOrder)
+	assert.Equal(t, 0, len(tradesArray))
+	assert.Equal(t, dec(2), ob.GetTotalVolumeAllSells())
+	assert.Nil(t, ob.GetHighestBuy())
+
+	// FOK: the whole size is available
+	fokOrder = newOrder("lily", "ticker", true, entities.LimitOrderType, dec(2), dec(1005))
+	fokOrder.SetTimeInForce(entities.FillOrKill, 0)
+	tradesArray = ob.PlaceLimitOrder(*fokOrder)
+	assert.Equal(t, 1, len(tradesArray))
+	assert.Equal(t, dec(2), tradesArray[0].GetSize())
+	assert.Equal(t, dec(0), ob.GetTotalVolumeAllSells())
+}
+
+func TestExpireOrders(t *testing.T) {
+	ob := entities.NewOrderbook()
+
+	gtdOrder := newOrder("john", "ticker", true, entities.LimitOrderType, dec(1), dec(1000))
+	gtdOrder.SetTimeInForce(entities.GoodTillDate, 100)
+	ob.PlaceLimitOrder(*gtdOrder)
+	laterGtdOrder := newOrder("jim", "ticker", true, entities.LimitOrderType, dec(1), dec(900))
+	laterGtdOrder.SetTimeInForce(entities.GoodTillDate, 200)
+	ob.PlaceLimitOrder(*laterGtdOrder)
+	gtcOrder := newOrder("jane", "ticker", true, entities.LimitOrderType, dec(1), dec(800))
+	ob.PlaceLimitOrder(*gtcOrder)
+
+	assert.Equal(t, 0, len(ob.ExpireOrders(99)))
+
+	expiredOrders := ob.ExpireOrders(100)
+	assert.Equal(t, 1, len(expiredOrders))
+	assert.Equal(t, gtdOrder.GetId(), expiredOrders[0].GetId())
+	assert.Equal(t, dec(900), ob.GetHighestBuy().GetLimitPrice())
+
+	// jim's order is filled before it expires
+	ob.PlaceLimitOrder(*newOrder("lily", "ticker", false, entities.LimitOrderType, dec(1), dec(900)))
+	assert.Equal(t, 0, len(ob.ExpireOrders(1000)))
+	assert.Equal(t, dec(800), ob.GetHighestBuy().GetLimitPrice())
+	assert.Equal(t, dec(1), ob.GetTotalVolumeAllBuys())
+}
+
+func TestWouldCross(t *testing.T) {
+	ob := entities.NewOrderbook()
+	tickSize := dec(0.01)
+
+	bid := newOrder("lily", "ticker", true, entities.LimitOrderType, dec(1), dec(1000))
+	assert.False(t, ob.WouldCross(*bid))
+	assert.Equal(t, dec(1000), ob.GetPassivePrice(*bid, tickSize))
+
+	ob.PlaceLimitOrder(*newOrder("john", "ticker", false, entities.LimitOrderType, dec(1), dec(1000)))
+	ob.PlaceLimitOrder(*newOrder("jim", "ticker", true, entities.LimitOrderType, dec(1), dec(990)))
+
+	assert.True(t, ob.WouldCross(*bid))
+	assert.Equal(t, dec(999.99), ob.GetPassivePrice(*bid, tickSize))
+
+	ask := newOrder("lily", "ticker", false, entities.LimitOrderType, dec(1), dec(989))
+	assert.True(t, ob.WouldCross(*ask))
+	assert.Equal(t, dec(990.01), ob.GetPassivePrice(*ask, tickSize))
+	ask = newOrder("lily", "ticker", false, entities.LimitOrderType, dec(1), dec(995))
+	assert.False(t, ob.WouldCross(*ask))
+}
+
+func TestAmendOrder(t *testing.T) {
+	ob := entities.NewOrderbook()
+
+	john := newOrder("john", "ticker", true, entities.LimitOrderType, dec(2), dec(1000))
+	ob.PlaceLimitOrder(*john)
+	jane := newOrder("jane", "ticker", true, entities.LimitOrderType, dec(1), dec(1000))
+	ob.PlaceLimitOrder(*jane)
+	jim := newOrder("jim", "ticker", true, entities.LimitOrderType, dec(1), dec(1000))
+	ob.PlaceLimitOrder(*jim)
+
+	// size decrease: john stays first
+	trades, err := ob.AmendOrder(john.GetId(), dec(1.5), dec(1000))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(trades))
+	orders := ob.GetHighestBuy().GetAllOrders()
+	assert.Equal(t, "john", orders[0].GetUserId())
+	assert.Equal(t, dec(1.5), orders[0].GetSize())
+	assert.Equal(t, dec(3.5), ob.GetHighestBuy().GetTotalVolume())
+
+	// size increase: john goes to the back
+	_, err = ob.AmendOrder(john.GetId(), dec(3), dec(1000))
+	assert.NoError(t, err)
+	orders = ob.GetHighestBuy().GetAllOrders()
+	assert.Equal(t, "jane", orders[0].GetUserId())
+	assert.Equal(t, "jim", orders[1].GetUserId())
+	assert.Equal(t, "john", orders[2].GetUserId())
+	assert.Equal(t, dec(5), ob.GetHighestBuy().GetTotalVolume())
+
+	// price change: jane gets a price level of her own
+	_, err = ob.AmendOrder(jane.GetId(), dec(1), dec(1010))
+	assert.NoError(t, err)
+	assert.Equal(t, dec(1010), ob.GetHighestBuy().GetLimitPrice())
+	assert.Equal(t, "jane", ob.GetHighestBuy().GetAllOrders()[0].GetUserId())
+	assert.Equal(t, 2, len(ob.GetBuyLimits()))
+	assert.Equal(t, dec(5), ob.GetTotalVolumeAllBuys())
+
+	// back to 1000: behind john, the 1010 level is gone
+	_, err = ob.AmendOrder(jane.GetId(), dec(1), dec(1000))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ob.GetBuyLimits()))
+	orders = ob.GetHighestBuy().GetAllOrders()
+	assert.Equal(t, "jim", orders[0].GetUserId())
+	assert.Equal(t, "john", orders[1].GetUserId())
+	assert.Equal(t, "jane", orders[2].GetUserId())
+
+	// a new price that crosses is matched first
+	ob.PlaceLimitOrder(*newOrder("lily", "ticker", false, entities.LimitOrderType, dec(1), dec(1020)))
+	trades, err = ob.AmendOrder(jim.GetId(), dec(1), dec(1020))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(trades))
+	assert.Equal(t, dec(1020), trades[0].GetPrice())
+	_, err = ob.GetOrderbyId(jim.GetId())
+	assert.Error(t, err)
+	assert.Nil(t, ob.GetLowestSell())
+
+	_, err = ob.AmendOrder(jim.GetId(), dec(1), dec(1000))
+	assert.Error(t, err)
+}
+
+func TestPriceLevelsRandomized(t *testing.T) {
+	ob := entities.NewOrderbook()
+	rng := rand.New(rand.NewSource(42))
+	openIds := make([]int64, 0)
+	for i := 0; i < 5000; i++ {
+		if len(openIds) > 0 && rng.Intn(3) == 0 {
+			// cancel a random order
+			index := rng.Intn(len(openIds))
+			ob.CancelOrder(openIds[index])
+			openIds = append(openIds[:index], openIds[index+1:]...)
+			continue
+		}
+		// bids below 1000, asks above, nothing crosses
+		isBid := rng.Intn(2) == 0
+		price := int64(1000 + 1 + rng.Intn(200))
+		if isBid {
+			price = int64(1000 - rng.Intn(200))
+		}
+		order := newOrder("john", "ticker", isBid, entities.LimitOrderType, dec(1), entities.NewDecimalFromInt(price))
+		ob.PlaceLimitOrder(*order)
+		openIds = append(openIds, order.GetId())
+	}
+
+	buyVolume := entities.ZeroDecimal
+	buys := ob.GetBuyLimits()
+	for i, limit := range buys {
+		if i > 0 {
+			assert.True(t, limit.GetLimitPrice().LessThan(buys[i-1].GetLimitPrice()))
+		}
+		buyVolume = buyVolume.Add(limit.GetTotalVolume())
+	}
+	sellVolume := entities.ZeroDecimal
+	sells := ob.GetSellLimits()
+	for i, limit := range sells {
+		if i > 0 {
+			assert.True(t, limit.GetLimitPrice().GreaterThan(sells[i-1].GetLimitPrice()))
+		}
+		sellVolume = sellVolume.Add(limit.GetTotalVolume())
+	}
+	assert.Equal(t, buys[0], ob.GetHighestBuy())
+	assert.Equal(t, sells[0], ob.GetLowestSell())
+	assert.Equal(t, buyVolume, ob.GetTotalVolumeAllBuys())
+	assert.Equal(t, sellVolume, ob.GetTotalVolumeAllSells())
+	assert.Equal(t, entities.NewDecimalFromInt(int64(len(openIds))), buyVolume.Add(sellVolume))
+
+	// a market order sweeping all the sells empties the side
+	_, err := ob.PlaceMarketOrder(*newOrder("jane", "ticker", true, entities.MarketOrderType, sellVolume, entities.ZeroDecimal))
+	assert.NoError(t, err)
+	assert.Nil(t, ob.GetLowestSell())
+	assert.Equal(t, 0, len(ob.GetSellLimits()))
+	assert.Equal(t, entities.ZeroDecimal, ob.GetTotalVolumeAllSells())
+}
+
+// a market maker quoting further and further away: the prices come in increasing order
+func BenchmarkPlaceLimitOrderIncreasingPrices(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		ob := entities.NewOrderbook()
+		for price := int64(1); price <= 2000; price++ {
+			ob.PlaceLimitOrder(*newOrder("maker", "ticker", false, entities.LimitOrderType, dec(1), entities.NewDecimalFromInt(price)))
+		}
+	}
+}
+
+// every market order takes the best price level, a new one is quoted at the back
+func BenchmarkPlaceMarketOrderDeepBook(b *testing.B) {
+	ob := entities.NewOrderbook()
+	price := int64(1)
+	for ; price <= 10000; price++ {
+		ob.PlaceLimitOrder(*newOrder("maker", "ticker", false, entities.LimitOrderType, dec(1), entities.NewDecimalFromInt(price)))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ob.PlaceMarketOrder(*newOrder("taker", "ticker", true, entities.MarketOrderType, dec(1), entities.ZeroDecimal))
+		ob.PlaceLimitOrder(*newOrder("maker", "ticker", false, entities.LimitOrderType, dec(1), entities.NewDecimalFromInt(price)))
+		price++
+	}
+}
+
+func TestGetCostToFillSelfTrade(t *testing.T) {
+	// john rests 1 @ 100, jane 1 @ 200
+	ob := entities.NewOrderbook()
+	ob.PlaceLimitOrder(*newOrder("john", "ticker", false, entities.LimitOrderType, dec(1), dec(100)))
+	ob.PlaceLimitOrder(*newOrder("jane", "ticker", false, entities.LimitOrderType, dec(1), dec(200)))
+	costToFill := func(size float64, stp entities.SelfTradePrevention) (entities.Decimal, error) {
+		order := newOrder("john", "ticker", true, entities.MarketOrderType, dec(size), dec(0))
+		order.SetSelfTradePrevention(stp)
+		return ob.GetCostToFill(*order)
+	}
+
+	cost, err := costToFill(1.5, entities.SelfTradeAllowed)
+	assert.NoError(t, err)
+	assert.Equal(t, dec(200), cost)
+	// his ask is cancelled, the whole size is filled by jane
+	cost, err = costToFill(1, entities.CancelOldest)
+	assert.NoError(t, err)
+	assert.Equal(t, dec(200), cost)
+	_, err = costToFill(1.5, entities.CancelOldest)
+	assert.Error(t, err)
+	// the matching stops at his ask
+	for _, stp := range []entities.SelfTradePrevention{entities.CancelNewest, entities.CancelBoth} {
+		cost, err = costToFill(1.5, stp)
+		assert.NoError(t, err)
+		assert.Equal(t, dec(0), cost)
+	}
+	// 1 taken from both, 0.5 filled by jane
+	cost, err = costToFill(1.5, entities.DecrementAndCancel)
+	assert.NoError(t, err)
+	assert.Equal(t, dec(100), cost)
+}
+
+func TestSelfTradePrevention(t *testing.T) {
+	// john rests 1 @ 1000 then jane 1 @ 1000, john comes back with a buy of 1.5
+	placeBook := func() (*entities.Orderbook, *entities.Order, *entities.Order) {
+		ob := entities.NewOrderbook()
+		johnAsk := newOrder("john", "ticker", false, entities.LimitOrderType, dec(1), dec(1000))
+		ob.PlaceLimitOrder(*johnAsk)
+		janeAsk := newOrder("jane", "ticker", false, entities.LimitOrderType, dec(1), dec(1000))
+		ob.PlaceLimitOrder(*janeAsk)
+		return ob, johnAsk, janeAsk
+	}
+	johnBid := func(stp entities.SelfTradePrevention) entities.Order {
+		bid := newOrder("john", "ticker", true, entities.LimitOrderType, dec(1.5), dec(1000))
+		bid.SetSelfTradePrevention(stp)
+		return *bid
+	}
+
+	// allowed: john trades with himself first
+	ob, _, _ := placeBook()
+	trades := ob.PlaceLimitOrder(johnBid(entities.SelfTradeAllowed))
+	assert.Equal(t, 2, len(trades))
+	assert.Equal(t, "john", trades[0].GetSeller().GetUserId())
+	assert.Equal(t, 0, len(ob.PopSelfTradeCancels()))
+
+	// cancel newest: nothing traded, the bid is gone, john's ask stays
+	ob, johnAsk, _ := placeBook()
+	bid := johnBid(entities.CancelNewest)
+	trades = ob.PlaceLimitOrder(bid)
+	assert.Equal(t, 0, len(trades))
+	_, err := ob.GetOrderbyId(bid.GetId())
+	assert.Error(t, err)
+	_, err = ob.GetOrderbyId(johnAsk.GetId())
+	assert.NoError(t, err)
+	cancels := ob.PopSelfTradeCancels()
+	assert.Equal(t, 1, len(cancels))
+	assert.False(t, cancels[0].IsResting)
+	assert.Equal(t, dec(1.5), cancels[0].Size)
+	assert.Equal(t, dec(2), ob.GetTotalVolumeAllSells())
+	assert.Equal(t, 0, len(ob.PopSelfTradeCancels()))
+
+	// cancel oldest: john's ask is gone, jane's is matched, 0.5 rests
+	ob, johnAsk, _ = placeBook()
+	bid = johnBid(entities.CancelOldest)
+	trades = ob.PlaceLimitOrder(bid)
+	assert.Equal(t, 1, len(trades))
+	assert.Equal(t, "jane", trades[0].GetSeller().GetUserId())
+	_, err = ob.GetOrderbyId(johnAsk.GetId())
+	assert.Error(t, err)
+	restingBid, err := ob.GetOrderbyId(bid.GetId())
+	assert.NoError(t, err)
+	assert.Equal(t, dec(0.5), restingBid.GetSize())
+	cancels = ob.PopSelfTradeCancels()
+	assert.Equal(t, 1, len(cancels))
+	assert.True(t, cancels[0].IsResting)
+	assert.Equal(t, johnAsk.GetId(), cancels[0].Order.GetId())
+	assert.Equal(t, dec(1), cancels[0].Size)
+	assert.Nil(t, ob.GetLowestSell())
+	assert.Equal(t, dec(0), ob.GetTotalVolumeAllSells())
+
+	// cancel both
+	ob, johnAsk, _ = placeBook()
+	bid = johnBid(entities.CancelBoth)
+	trades = ob.PlaceLimitOrder(bid)
+	assert.Equal(t, 0, len(trades))
+	_, err = ob.GetOrderbyId(bid.GetId())
+	assert.Error(t, err)
+	_, err = ob.GetOrderbyId(johnAsk.GetId())
+	assert.Error(t, err)
+	assert.Equal(t, 2, len(ob.PopSelfTradeCancels()))
+	assert.Equal(t, dec(1), ob.GetTotalVolumeAllSells())
+	assert.Equal(t, dec(0), ob.GetTotalVolumeAllBuys())
+
+	// decrement and cancel: 1 is taken from both, john's ask is gone, 0.5 goes on and trades with jane
+	ob, johnAsk, _ = placeBook()
+	bid = johnBid(entities.DecrementAndCancel)
+	trades = ob.PlaceLimitOrder(bid)
+	assert.Equal(t, 1, len(trades))
+	assert.Equal(t, dec(0.5), trades[0].GetSize())
+	assert.Equal(t, "jane", trades[0].GetSeller().GetUserId())
+	_, err = ob.GetOrderbyId(bid.GetId())
+	assert.Error(t, err)
+	cancels = ob.PopSelfTradeCancels()
+	assert.Equal(t, 2, len(cancels))
+	assert.Equal(t, dec(1), cancels[0].Size)
+	assert.Equal(t, dec(1), cancels[1].Size)
+	assert.Equal(t, dec(0.5), ob.GetTotalVolumeAllSells())
+
+	// decrement and cancel, the resting order is bigger: it stays with what is left
+	ob, johnAsk, _ = placeBook()
+	smallBid := newOrder("john", "ticker", true, entities.MarketOrderType, dec(0.25), dec(0))
+	smallBid.SetSelfTradePrevention(entities.DecrementAndCancel)
+	trades, err = ob.PlaceMarketOrder(*smallBid)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(trades))
+	restingAsk, err := ob.GetOrderbyId(johnAsk.GetId())
+	assert.NoError(t, err)
+	assert.Equal(t, dec(0.75), restingAsk.GetSize())
+	assert.Equal(t, dec(1.75), ob.GetLowestSell().GetTotalVolume())
+	assert.Equal(t, dec(1.75), ob.GetTotalVolumeAllSells())
+
+	// FOK: john's own ask does not count as liquidity
+	ob, _, _ = placeBook()
+	fokBid := newOrder("john", "ticker", true, entities.LimitOrderType, dec(1.5), dec(1000))
+	fokBid.SetTimeInForce(entities.FillOrKill, 0)
+	fokBid.SetSelfTradePrevention(entities.CancelOldest)
+	trades = ob.PlaceLimitOrder(*fokBid)
+	assert.Equal(t, 0, len(trades))
+	assert.Equal(t, 0, len(ob.PopSelfTradeCancels()))
+	assert.Equal(t, dec(2), ob.GetTotalVolumeAllSells())
+}
+
+// a copy of the book kept up to date with the level changes only is the book
+func TestLevelChangesRandomized(t *testing.T) {
+	ob := entities.NewOrderbook()
+	rng := rand.New(rand.NewSource(7))
+	replica := map[bool]map[entities.Decimal]entities.Decimal{true: {}, false: {}}
+	openIds := make([]int64, 0)
+	for i := 0; i < 2000; i++ {
+		switch {
+		case len(openIds) > 0 && rng.Intn(4) == 0:
+			index := rng.Intn(len(openIds))
+			ob.CancelOrder(openIds[index])
+			openIds = append(openIds[:index], openIds[index+1:]...)
+		case len(openIds) > 0 && rng.Intn(4) == 0:
+			// smaller keeps its place, bigger or elsewhere goes to the tail
+			index := rng.Intn(len(openIds))
+			ob.AmendOrder(openIds[index], dec(float64(1+rng.Intn(3))), entities.NewDecimalFromInt(int64(990+rng.Intn(20))))
+		default:
+			// both sides around 1000: some orders cross
+			isBid := rng.Intn(2) == 0
+			order := newOrder("john", "ticker", isBid, entities.LimitOrderType, dec(float64(1+rng.Intn(3))), entities.NewDecimalFromInt(int64(990+rng.Intn(20))))
+			ob.PlaceLimitOrder(*order)
+			openIds = append(openIds, order.GetId())
+		}
+
+		sequence := ob.GetBookSequence()
+		changes := ob.PopLevelChanges()
+		if len(changes) > 0 {
+			assert.Equal(t, sequence+1, ob.GetBookSequence())
+		} else {
+			assert.Equal(t, sequence, ob.GetBookSequence())
+		}
+		for _, change := range changes {
+			if change.Volume.IsZero() {
+				delete(replica[change.IsBid], change.Price)
+			} else {
+				replica[change.IsBid][change.Price] = change.Volume
+			}
+		}
+		for _, isBid := range []bool{true, false} {
+			limits := ob.GetSellLimits()
+			if isBid {
+				limits = ob.GetBuyLimits()
+			}
+			book := make(map[entities.Decimal]entities.Decimal, 0)
+			for _, limit := range limits {
+				book[limit.GetLimitPrice()] = limit.GetTotalVolume()
+			}
+			assert.Equal(t, book, replica[isBid])
+		}
+	}
+	assert.Equal(t, 0, len(ob.PopLevelChanges()))
+}
+
+// a copy of the book kept up to date with the order events only is the book, order by order
+func TestOrderEventsRandomized(t *testing.T) {
+	ob := entities.NewOrderbook()
+	rng := rand.New(rand.NewSource(11))
+	type restingOrder struct {
+		id   int64
+		size entities.Decimal
+	}
+	// by side then price, in time priority
+	replica := map[bool]map[entities.Decimal][]restingOrder{true: {}, false: {}}
+	find := func(event entities.OrderEvent) int {
+		for i, order := range replica[event.IsBid][event.Price] {
+			if order.id == event.OrderId {
+				return i
+			}
+		}
+		t.Fatalf("order event %+v of an order not in the book", event)
+		return -1
+	}
+	remove := func(event entities.OrderEvent, i int) {
+		queue := replica[event.IsBid][event.Price]
+		replica[event.IsBid][event.Price] = append(queue[:i], queue[i+1:]...)
+		if len(replica[event.IsBid][event.Price]) == 0 {
+			delete(replica[event.IsBid], event.Price)
+		}
+	}
+	stps := []entities.SelfTradePrevention{entities.SelfTradeAllowed, entities.CancelNewest, entities.CancelOldest, entities.CancelBoth, entities.DecrementAndCancel}
+	openIds := make([]int64, 0)
+	lastSequence := int64(0)
+	for i := 0; i < 2000; i++ {
+		switch {
+		case len(openIds) > 0 && rng.Intn(4) == 0:
+			index := rng.Intn(len(openIds))
+			ob.CancelOrder(openIds[index])
+			openIds = append(openIds[:index], openIds[index+1:]...)
+		case len(openIds) > 0 && rng.Intn(4) == 0:
+			index := rng.Intn(len(openIds))
+			ob.AmendOrder(openIds[index], dec(float64(1+rng.Intn(3))), entities.NewDecimalFromInt(int64(990+rng.Intn(20))))
+		default:
+			userId := []string{"john", "jane"}[rng.Intn(2)]
+			order := newOrder(userId, "ticker", rng.Intn(2) == 0, entities.LimitOrderType, dec(float64(1+rng.Intn(3))), entities.NewDecimalFromInt(int64(990+rng.Intn(20))))
+			order.SetSelfTradePrevention(stps[rng.Intn(len(stps))])
+			ob.PlaceLimitOrder(*order)
+			openIds = append(openIds, order.GetId())
+		}
+
+		for _, event := range ob.PopOrderEvents() {
+			assert.Equal(t, lastSequence+1, event.Sequence)
+			lastSequence = event.Sequence
+			switch event.Type {
+			case entities.OrderAdded:
+				assert.Equal(t, event.Size, event.RemainingSize)
+				queue := replica[event.IsBid][event.Price]
+				replica[event.IsBid][event.Price] = append(queue, restingOrder{event.OrderId, event.RemainingSize})
+			case entities.OrderReduced:
+				j := find(event)
+				assert.Equal(t, replica[event.IsBid][event.Price][j].size.Sub(event.Size), event.RemainingSize)
+				replica[event.IsBid][event.Price][j].size = event.RemainingSize
+			case entities.OrderExecuted:
+				// the head of the best level only
+				assert.Equal(t, 0, find(event))
+				assert.NotEqual(t, int64(0), event.TradeId)
+				replica[event.IsBid][event.Price][0].size = event.RemainingSize
+				if event.RemainingSize.IsZero() {
+					remove(event, 0)
+				}
+			case entities.OrderRemoved:
+				assert.True(t, event.RemainingSize.IsZero())
+				remove(event, find(event))
+			}
+		}
+		assert.Equal(t, lastSequence, ob.GetOrderSequence())
+
+		for _, isBid := range []bool{true, false} {
+			limits := ob.GetSellLimits()
+			if isBid {
+				limits = ob.GetBuyLimits()
+			}
+			book := make(map[entities.Decimal][]restingOrder, 0)
+			for _, limit := range limits {
+				for _, order := range limit.GetAllOrders() {
+					book[limit.GetLimitPrice()] = append(book[limit.GetLimitPrice()], restingOrder{order.GetId(), order.Size})
+				}
+			}
+			assert.Equal(t, book, replica[isBid])
+		}
+	}
 }
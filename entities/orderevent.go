@@ -0,0 +1,60 @@
+package entities
+
+// what happened to an order resting in the book
+type OrderEventType string
+
+const (
+	// the order, or the rest of it, goes to the tail of its price level
+	OrderAdded OrderEventType = "ADDED"
+	// smaller in place, it keeps its time priority .e.g. amended down, self-trade prevention
+	OrderReduced OrderEventType = "REDUCED"
+	// matched as the maker of TradeId, gone from the book once RemainingSize is 0
+	OrderExecuted OrderEventType = "EXECUTED"
+	// cancelled, expired, or moved by an amend: an ADDED follows then
+	OrderRemoved OrderEventType = "REMOVED"
+)
+
+// one change of the book, order by order
+type OrderEvent struct {
+	// one sequence per orderbook, from 1, without gaps
+	Sequence int64
+	Type     OrderEventType
+	OrderId  int64
+	IsBid    bool
+	Price    Decimal
+	// what the event added to or took from the order
+	Size Decimal
+	// what is left of the order in the book, 0 once it is gone
+	RemainingSize Decimal
+	// EXECUTED only
+	TradeId   int64
+	Timestamp int64
+}
+
+// MUST be called every time an order of the book is added, resized or removed, after the change
+func (ob *Orderbook) recordOrderEvent(eventType OrderEventType, order *Order, size Decimal, remainingSize Decimal, tradeId int64) {
+	ob.orderSequence += 1
+	ob.orderEvents = append(ob.orderEvents, OrderEvent{
+		Sequence:      ob.orderSequence,
+		Type:          eventType,
+		OrderId:       order.GetId(),
+		IsBid:         order.GetIsBid(),
+		Price:         order.GetLimitPrice(),
+		Size:          size,
+		RemainingSize: remainingSize,
+		TradeId:       tradeId,
+		Timestamp:     ob.clock(),
+	})
+}
+
+// remove and return the order events since the last call, in the order they happened
+func (ob *Orderbook) PopOrderEvents() []OrderEvent {
+	orderEvents := ob.orderEvents
+	ob.orderEvents = make([]OrderEvent, 0)
+	return orderEvents
+}
+
+// the sequence of the last order event: the book as it is is the one after it
+func (ob Orderbook) GetOrderSequence() int64 {
+	return ob.orderSequence
+}
@@ -0,0 +1,303 @@
+package entities
+
+type rbColor bool
+
+const (
+	red   rbColor = true
+	black rbColor = false
+)
+
+type rbNode struct {
+	limit  *Limit
+	color  rbColor
+	parent *rbNode
+	left   *rbNode
+	right  *rbNode
+}
+
+// red-black tree of limits, the better price on the left
+// insert and remove are O(log n) whatever the order the prices come in,
+// a plain BST turns into a linked list when a market maker quotes increasing prices
+// the price to node map finds an existing price level without walking the tree
+type rbTree struct {
+	root *rbNode
+	// sentinel for all the leaves and the parent of the root, always black
+	leaf  *rbNode
+	nodes map[Decimal]*rbNode
+	// leftmost node, leaf if empty
+	bestNode *rbNode
+	isBetter func(a Decimal, b Decimal) bool
+}
+
+func newRBTree(isBetter func(a Decimal, b Decimal) bool) *rbTree {
+	leaf := &rbNode{color: black}
+	return &rbTree{
+		root:     leaf,
+		leaf:     leaf,
+		nodes:    make(map[Decimal]*rbNode),
+		bestNode: leaf,
+		isBetter: isBetter,
+	}
+}
+
+func (t *rbTree) get(price Decimal) *Limit {
+	node, ok := t.nodes[price]
+	if !ok {
+		return nil
+	}
+	return node.limit
+}
+
+func (t *rbTree) best() *Limit {
+	return t.bestNode.limit
+}
+
+func (t *rbTree) len() int {
+	return len(t.nodes)
+}
+
+func (t *rbTree) walk(visit func(*Limit) bool) {
+	t.walkFrom(t.root, visit)
+}
+
+func (t *rbTree) walkFrom(node *rbNode, visit func(*Limit) bool) bool {
+	if node == t.leaf {
+		return true
+	}
+	return t.walkFrom(node.left, visit) && visit(node.limit) && t.walkFrom(node.right, visit)
+}
+
+func (t *rbTree) insert(limit *Limit) {
+	node := &rbNode{
+		limit:  limit,
+		color:  red,
+		parent: t.leaf,
+		left:   t.leaf,
+		right:  t.leaf,
+	}
+	parent := t.leaf
+	current := t.root
+	for current != t.leaf {
+		parent = current
+		if t.isBetter(limit.limitPrice, current.limit.limitPrice) {
+			current = current.left
+		} else {
+			current = current.right
+		}
+	}
+	node.parent = parent
+	if parent == t.leaf {
+		t.root = node
+	} else if t.isBetter(limit.limitPrice, parent.limit.limitPrice) {
+		parent.left = node
+	} else {
+		parent.right = node
+	}
+
+	t.nodes[limit.limitPrice] = node
+	if t.bestNode == t.leaf || t.isBetter(limit.limitPrice, t.bestNode.limit.limitPrice) {
+		t.bestNode = node
+	}
+	t.insertFixup(node)
+}
+
+// restore the red-black properties: a red node has no red child, all the paths to the leaves have the same number of black nodes
+func (t *rbTree) insertFixup(node *rbNode) {
+	for node.parent.color == red {
+		grandParent := node.parent.parent
+		if node.parent == grandParent.left {
+			uncle := grandParent.right
+			if uncle.color == red {
+				node.parent.color = black
+				uncle.color = black
+				grandParent.color = red
+				node = grandParent
+			} else {
+				if node == node.parent.right {
+					node = node.parent
+					t.rotateLeft(node)
+				}
+				node.parent.color = black
+				node.parent.parent.color = red
+				t.rotateRight(node.parent.parent)
+			}
+		} else {
+			uncle := grandParent.left
+			if uncle.color == red {
+				node.parent.color = black
+				uncle.color = black
+				grandParent.color = red
+				node = grandParent
+			} else {
+				if node == node.parent.left {
+					node = node.parent
+					t.rotateRight(node)
+				}
+				node.parent.color = black
+				node.parent.parent.color = red
+				t.rotateLeft(node.parent.parent)
+			}
+		}
+	}
+	t.root.color = black
+}
+
+func (t *rbTree) remove(limit *Limit) {
+	node, ok := t.nodes[limit.limitPrice]
+	if !ok || node.limit != limit {
+		return
+	}
+	delete(t.nodes, limit.limitPrice)
+
+	// the node taking the place of the removed one, may be the leaf
+	var replacement *rbNode
+	removedColor := node.color
+	if node.left == t.leaf {
+		replacement = node.right
+		t.transplant(node, node.right)
+	} else if node.right == t.leaf {
+		replacement = node.left
+		t.transplant(node, node.left)
+	} else {
+		// 2 children: the successor takes the place of the node
+		successor := t.leftMost(node.right)
+		removedColor = successor.color
+		replacement = successor.right
+		if successor.parent == node {
+			replacement.parent = successor
+		} else {
+			t.transplant(successor, successor.right)
+			successor.right = node.right
+			successor.right.parent = successor
+		}
+		t.transplant(node, successor)
+		successor.left = node.left
+		successor.left.parent = successor
+		successor.color = node.color
+	}
+	if removedColor == black {
+		t.removeFixup(replacement)
+	}
+	if node == t.bestNode {
+		t.bestNode = t.leftMost(t.root)
+	}
+
+	// detach the removed node
+	node.parent = nil
+	node.left = nil
+	node.right = nil
+}
+
+// node has an extra black to push up the tree, or to get rid of with rotations
+func (t *rbTree) removeFixup(node *rbNode) {
+	for node != t.root && node.color == black {
+		if node == node.parent.left {
+			sibling := node.parent.right
+			if sibling.color == red {
+				sibling.color = black
+				node.parent.color = red
+				t.rotateLeft(node.parent)
+				sibling = node.parent.right
+			}
+			if sibling.left.color == black && sibling.right.color == black {
+				sibling.color = red
+				node = node.parent
+			} else {
+				if sibling.right.color == black {
+					sibling.left.color = black
+					sibling.color = red
+					t.rotateRight(sibling)
+					sibling = node.parent.right
+				}
+				sibling.color = node.parent.color
+				node.parent.color = black
+				sibling.right.color = black
+				t.rotateLeft(node.parent)
+				node = t.root
+			}
+		} else {
+			sibling := node.parent.left
+			if sibling.color == red {
+				sibling.color = black
+				node.parent.color = red
+				t.rotateRight(node.parent)
+				sibling = node.parent.left
+			}
+			if sibling.right.color == black && sibling.left.color == black {
+				sibling.color = red
+				node = node.parent
+			} else {
+				if sibling.left.color == black {
+					sibling.right.color = black
+					sibling.color = red
+					t.rotateLeft(sibling)
+					sibling = node.parent.left
+				}
+				sibling.color = node.parent.color
+				node.parent.color = black
+				sibling.left.color = black
+				t.rotateRight(node.parent)
+				node = t.root
+			}
+		}
+	}
+	node.color = black
+}
+
+// replace the subtree rooted at old by the one rooted at newNode
+func (t *rbTree) transplant(old *rbNode, newNode *rbNode) {
+	if old.parent == t.leaf {
+		t.root = newNode
+	} else if old == old.parent.left {
+		old.parent.left = newNode
+	} else {
+		old.parent.right = newNode
+	}
+	newNode.parent = old.parent
+}
+
+func (t *rbTree) rotateLeft(node *rbNode) {
+	rightChild := node.right
+	node.right = rightChild.left
+	if rightChild.left != t.leaf {
+		rightChild.left.parent = node
+	}
+	rightChild.parent = node.parent
+	if node.parent == t.leaf {
+		t.root = rightChild
+	} else if node == node.parent.left {
+		node.parent.left = rightChild
+	} else {
+		node.parent.right = rightChild
+	}
+	rightChild.left = node
+	node.parent = rightChild
+}
+
+func (t *rbTree) rotateRight(node *rbNode) {
+	leftChild := node.left
+	node.left = leftChild.right
+	if leftChild.right != t.leaf {
+		leftChild.right.parent = node
+	}
+	leftChild.parent = node.parent
+	if node.parent == t.leaf {
+		t.root = leftChild
+	} else if node == node.parent.right {
+		node.parent.right = leftChild
+	} else {
+		node.parent.left = leftChild
+	}
+	leftChild.right = node
+	node.parent = leftChild
+}
+
+func (t *rbTree) leftMost(node *rbNode) *rbNode {
+	if node == t.leaf {
+		return node
+	}
+	for node.left != t.leaf {
+		node = node.left
+	}
+	return node
+}
@@ -0,0 +1,70 @@
+package entities
+
+// an order, or part of it, cancelled by self-trade prevention instead of being matched
+type SelfTradeCancel struct {
+	// the order as it was just before
+	Order Order
+	// how much of the order was cancelled
+	Size Decimal
+	// false if it is the incoming order
+	IsResting bool
+}
+
+// the incoming order meets a resting order of the same user, see SelfTradePrevention
+// returns false if the incoming order is done matching
+func (ob *Orderbook) preventSelfTrade(incomingOrder *Order, restingOrder *Order) bool {
+	switch incomingOrder.selfTradePrevention {
+	case CancelNewest:
+		ob.cancelIncomingSize(incomingOrder, incomingOrder.Size)
+		return false
+	case CancelOldest:
+		ob.cancelRestingSize(restingOrder, restingOrder.Size)
+		return true
+	case CancelBoth:
+		ob.cancelRestingSize(restingOrder, restingOrder.Size)
+		ob.cancelIncomingSize(incomingOrder, incomingOrder.Size)
+		return false
+	case DecrementAndCancel:
+		size := MinDecimal(incomingOrder.Size, restingOrder.Size)
+		ob.cancelRestingSize(restingOrder, size)
+		ob.cancelIncomingSize(incomingOrder, size)
+		return incomingOrder.Size.IsPositive()
+	default:
+		return true
+	}
+}
+
+// what is cancelled of the incoming order never rests in the book
+func (ob *Orderbook) cancelIncomingSize(incomingOrder *Order, size Decimal) {
+	ob.selfTradeCancels = append(ob.selfTradeCancels, SelfTradeCancel{
+		Order: *incomingOrder,
+		Size:  size,
+	})
+	incomingOrder.Size = incomingOrder.Size.Sub(size)
+}
+
+// the resting order is removed from the book if nothing is left of it
+func (ob *Orderbook) cancelRestingSize(restingOrder *Order, size Decimal) {
+	ob.selfTradeCancels = append(ob.selfTradeCancels, SelfTradeCancel{
+		Order:     *restingOrder,
+		Size:      size,
+		IsResting: true,
+	})
+	if size == restingOrder.Size {
+		ob.removeFromLimit(restingOrder)
+		delete(ob.idToOrderMap, restingOrder.GetId())
+		return
+	}
+	side := ob.side(restingOrder.GetIsBid())
+	side.totalVolume = side.totalVolume.Sub(size)
+	side.volumeChanged(restingOrder.GetLimitPrice())
+	restingOrder.parentLimit.resizeOrder(restingOrder, restingOrder.Size.Sub(size))
+	ob.recordOrderEvent(OrderReduced, restingOrder, size, restingOrder.Size, 0)
+}
+
+// remove and return what self-trade prevention cancelled since the last call, in the order it happened
+func (ob *Orderbook) PopSelfTradeCancels() []SelfTradeCancel {
+	selfTradeCancels := ob.selfTradeCancels
+	ob.selfTradeCancels = make([]SelfTradeCancel, 0)
+	return selfTradeCancels
+}
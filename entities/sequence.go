@@ -0,0 +1,36 @@
+package entities
+
+import "sync"
+
+// hands out strictly increasing ids, shared by every orderbook of the exchange
+// the first id is 1, 0 means "no id assigned yet"
+type Sequence struct {
+	mu   sync.Mutex
+	last int64
+}
+
+func NewSequence(last int64) *Sequence {
+	return &Sequence{last: last}
+}
+
+func (s *Sequence) Next() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last += 1
+	return s.last
+}
+
+func (s *Sequence) Last() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// used when recovering: never hand out an id that was already used
+func (s *Sequence) AdvanceTo(id int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id > s.last {
+		s.last = id
+	}
+}
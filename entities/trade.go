@@ -6,17 +6,32 @@ import (
 )
 
 type Trade struct {
-	buyer        *Order
-	seller       *Order
-	price        float64
-	size         float64
-	isBuyerMaker bool
-	timestamp    int64
+	id     int64
+	buyer  *Order
+	seller *Order
+	// kept when the trade is read back without its orders
+	buyerOrderId  int64
+	buyerUserId   string
+	sellerOrderId int64
+	sellerUserId  string
+	ticker        string
+	price         Decimal
+	size          Decimal
+	isBuyerMaker  bool
+	timestamp     int64
+	// set by the exchange when the trade is settled
+	// in the base asset for the buyer, in the quote asset for the seller
+	buyerFee  Decimal
+	sellerFee Decimal
 }
 
 // TODO: the comment below is not really an issue since the return value is a dereference pointer, essentially a copy
 // dont return order as it contains pointer, as w/ the pointer, the content of h field can be modified
 // defeat the point of encapsulation
+func (t Trade) GetId() int64 {
+	return t.id
+}
+
 func (t Trade) GetBuyer() Order {
 	return *t.buyer
 }
@@ -25,11 +40,31 @@ func (t Trade) GetSeller() Order {
 	return *t.seller
 }
 
-func (t Trade) GetPrice() float64 {
+func (t Trade) GetBuyerOrderId() int64 {
+	return t.buyerOrderId
+}
+
+func (t Trade) GetBuyerUserId() string {
+	return t.buyerUserId
+}
+
+func (t Trade) GetSellerOrderId() int64 {
+	return t.sellerOrderId
+}
+
+func (t Trade) GetSellerUserId() string {
+	return t.sellerUserId
+}
+
+func (t Trade) GetTicker() string {
+	return t.ticker
+}
+
+func (t Trade) GetPrice() Decimal {
 	return t.price
 }
 
-func (t Trade) GetSize() float64 {
+func (t Trade) GetSize() Decimal {
 	return t.size
 }
 
@@ -41,47 +76,85 @@ func (t Trade) GetTimeStamp() int64 {
 	return t.timestamp
 }
 
+func (t Trade) GetBuyerFee() Decimal {
+	return t.buyerFee
+}
+
+func (t Trade) GetSellerFee() Decimal {
+	return t.sellerFee
+}
+
+func (t *Trade) SetFees(buyerFee Decimal, sellerFee Decimal) {
+	t.buyerFee = buyerFee
+	t.sellerFee = sellerFee
+}
+
 func NewTrade(
+	id int64,
 	buyer *Order,
 	seller *Order,
-	price float64,
-	size float64,
+	price Decimal,
+	size Decimal,
 	isBuyerMaker bool,
 ) *Trade {
-	return &Trade{
-		buyer:        buyer,
-		seller:       seller,
-		price:        price,
-		size:         size,
-		isBuyerMaker: isBuyerMaker,
-		timestamp:    time.Now().UnixNano(),
-	}
+	return NewTradeWithTimeStamp(id, buyer, seller, buyer.ticker, price, size, isBuyerMaker, time.Now().UnixNano())
 }
 
 func NewTradeWithTimeStamp(
+	id int64,
 	buyer *Order,
 	seller *Order,
-	price float64,
-	size float64,
+	ticker string,
+	price Decimal,
+	size Decimal,
 	isBuyerMaker bool,
 	timestamp int64,
 ) *Trade {
-	return &Trade{
+	trade := &Trade{
+		id:           id,
 		buyer:        buyer,
 		seller:       seller,
+		ticker:       ticker,
 		price:        price,
 		size:         size,
 		isBuyerMaker: isBuyerMaker,
 		timestamp:    timestamp,
 	}
+	if buyer != nil {
+		trade.buyerOrderId, trade.buyerUserId = buyer.id, buyer.userId
+	}
+	if seller != nil {
+		trade.sellerOrderId, trade.sellerUserId = seller.id, seller.userId
+	}
+	return trade
+}
+
+// a trade read back from the history, without its orders: GetBuyer and GetSeller must not be called
+func NewTradeRecord(
+	id int64,
+	ticker string,
+	buyerOrderId int64,
+	buyerUserId string,
+	sellerOrderId int64,
+	sellerUserId string,
+	price Decimal,
+	size Decimal,
+	isBuyerMaker bool,
+	timestamp int64,
+) *Trade {
+	trade := NewTradeWithTimeStamp(id, nil, nil, ticker, price, size, isBuyerMaker, timestamp)
+	trade.buyerOrderId, trade.buyerUserId = buyerOrderId, buyerUserId
+	trade.sellerOrderId, trade.sellerUserId = sellerOrderId, sellerUserId
+	return trade
 }
 
 func (t Trade) String() string {
-	str := fmt.Sprintf("{\"buyerOrderId\": %d, \"buyerUserId\": \"%s\", \"sellerOrderId\": %d, \"sellerUserId\": \"%s\", \"price\": %.2f, \"size\": %.2f}",
-		t.buyer.id,
-		t.buyer.userId,
-		t.seller.id,
-		t.seller.userId,
+	str := fmt.Sprintf("{\"id\": %d, \"buyerOrderId\": %d, \"buyerUserId\": \"%s\", \"sellerOrderId\": %d, \"sellerUserId\": \"%s\", \"price\": %s, \"size\": %s}",
+		t.id,
+		t.buyerOrderId,
+		t.buyerUserId,
+		t.sellerOrderId,
+		t.sellerUserId,
 		t.price,
 		t.size)
 	return str
@@ -0,0 +1,71 @@
+package entities
+
+import (
+	"errors"
+	"sort"
+)
+
+// the stop orders of one ticker, waiting for the last traded price to reach their stop price
+// they are not in the Orderbook, nobody can match against them
+type TriggerBook struct {
+	idToOrderMap map[int64]*Order
+}
+
+func NewTriggerBook() *TriggerBook {
+	return &TriggerBook{
+		idToOrderMap: make(map[int64]*Order),
+	}
+}
+
+func (tb *TriggerBook) AddOrder(o Order) {
+	tb.idToOrderMap[o.GetId()] = &o
+}
+
+func (tb TriggerBook) GetOrderbyId(orderId int64) (Order, error) {
+	order, ok := tb.idToOrderMap[orderId]
+	if !ok {
+		return Order{}, errors.New("Order does not exist")
+	}
+	return *order, nil
+}
+
+// false if the order is not in the trigger book
+func (tb *TriggerBook) CancelOrder(orderId int64) (Order, bool) {
+	order, ok := tb.idToOrderMap[orderId]
+	if !ok {
+		return Order{}, false
+	}
+	delete(tb.idToOrderMap, orderId)
+	return *order, true
+}
+
+// remove and return the stop orders triggered by lastTradedPrice, oldest first
+// they are still stop orders, see Order.Trigger
+func (tb *TriggerBook) PopTriggeredOrders(lastTradedPrice Decimal) []Order {
+	triggeredOrders := make([]Order, 0)
+	for orderId, order := range tb.idToOrderMap {
+		if order.IsTriggeredBy(lastTradedPrice) {
+			triggeredOrders = append(triggeredOrders, *order)
+			delete(tb.idToOrderMap, orderId)
+		}
+	}
+	sortByTimePriority(triggeredOrders)
+	return triggeredOrders
+}
+
+// oldest first
+func (tb TriggerBook) GetAllOrders() []Order {
+	orders := make([]Order, 0)
+	for _, order := range tb.idToOrderMap {
+		orders = append(orders, *order)
+	}
+	sortByTimePriority(orders)
+	return orders
+}
+
+// ids are increasing so the smallest id came first
+func sortByTimePriority(orders []Order) {
+	sort.Slice(orders, func(i, j int) bool {
+		return orders[i].GetId() < orders[j].GetId()
+	})
+}
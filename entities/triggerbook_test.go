@@ -0,0 +1,44 @@
+package entities_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trandinhkhoa/crypto-exchange/entities"
+)
+
+func TestTriggerBook(t *testing.T) {
+	tb := entities.NewTriggerBook()
+
+	sellStop := newOrder("john", "ticker", false, entities.StopMarketOrderType, dec(1), dec(0))
+	sellStop.SetStopPrice(dec(950))
+	tb.AddOrder(*sellStop)
+	buyStop := newOrder("jim", "ticker", true, entities.StopLimitOrderType, dec(1), dec(1060))
+	buyStop.SetStopPrice(dec(1050))
+	tb.AddOrder(*buyStop)
+	otherSellStop := newOrder("jane", "ticker", false, entities.StopMarketOrderType, dec(1), dec(0))
+	otherSellStop.SetStopPrice(dec(960))
+	tb.AddOrder(*otherSellStop)
+
+	assert.Equal(t, 0, len(tb.PopTriggeredOrders(dec(1000))))
+
+	// oldest first
+	triggeredOrders := tb.PopTriggeredOrders(dec(950))
+	assert.Equal(t, 2, len(triggeredOrders))
+	assert.Equal(t, "john", triggeredOrders[0].GetUserId())
+	assert.Equal(t, "jane", triggeredOrders[1].GetUserId())
+	assert.Equal(t, entities.MarketOrderType, triggeredOrders[0].Trigger().GetOrderType())
+
+	triggeredOrders = tb.PopTriggeredOrders(dec(1050))
+	assert.Equal(t, 1, len(triggeredOrders))
+	assert.Equal(t, entities.LimitOrderType, triggeredOrders[0].Trigger().GetOrderType())
+	assert.Equal(t, dec(1060), triggeredOrders[0].Trigger().GetLimitPrice())
+	assert.Equal(t, buyStop.GetId(), triggeredOrders[0].Trigger().GetId())
+
+	tb.AddOrder(*buyStop)
+	_, ok := tb.CancelOrder(buyStop.GetId())
+	assert.True(t, ok)
+	_, ok = tb.CancelOrder(buyStop.GetId())
+	assert.False(t, ok)
+	assert.Equal(t, 0, len(tb.GetAllOrders()))
+}
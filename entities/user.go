@@ -0,0 +1,105 @@
+package entities
+
+// available is what the user can spend, locked is what is held by the user's open orders
+type Balance struct {
+	Available Decimal
+	Locked    Decimal
+}
+
+func (b Balance) Total() Decimal {
+	return b.Available.Add(b.Locked)
+}
+
+// TODO: user need crypto wallet
+type User struct {
+	userId  string
+	Balance map[string]Balance
+	// TODO: should be *Order to save space and avoid copy?
+	OpenOrders map[int64]Order
+	// used by the orders of the user that do not set their own
+	selfTradePrevention SelfTradePrevention
+}
+
+func (u User) GetUserId() string {
+	return u.userId
+}
+
+func NewUser(userId string, balance map[string]Balance) *User {
+	return &User{
+		userId:     userId,
+		Balance:    balance,
+		OpenOrders: make(map[int64]Order, 0),
+	}
+}
+
+// its balances and open orders are not shared with the user
+func (u User) Copy() User {
+	balance := make(map[string]Balance, len(u.Balance))
+	for asset, assetBalance := range u.Balance {
+		balance[asset] = assetBalance
+	}
+	openOrders := make(map[int64]Order, len(u.OpenOrders))
+	for orderId, order := range u.OpenOrders {
+		openOrders[orderId] = order
+	}
+	u.Balance = balance
+	u.OpenOrders = openOrders
+	return u
+}
+
+// self-trades are allowed if not set
+func (u User) GetSelfTradePrevention() SelfTradePrevention {
+	if u.selfTradePrevention == SelfTradePreventionUnset {
+		return SelfTradeAllowed
+	}
+	return u.selfTradePrevention
+}
+
+func (u *User) SetSelfTradePrevention(selfTradePrevention SelfTradePrevention) {
+	u.selfTradePrevention = selfTradePrevention
+}
+
+func (u User) GetAvailable(asset string) Decimal {
+	return u.Balance[asset].Available
+}
+
+func (u User) GetLocked(asset string) Decimal {
+	return u.Balance[asset].Locked
+}
+
+// add to the available balance .e.g. deposit or proceeds of a trade
+func (u *User) Credit(asset string, amount Decimal) {
+	balance := u.Balance[asset]
+	balance.Available = balance.Available.Add(amount)
+	u.Balance[asset] = balance
+}
+
+// take from the available balance .e.g. a market order paying right away
+func (u *User) Debit(asset string, amount Decimal) {
+	balance := u.Balance[asset]
+	balance.Available = balance.Available.Sub(amount)
+	u.Balance[asset] = balance
+}
+
+// move funds from available to locked when an order is placed
+func (u *User) Lock(asset string, amount Decimal) {
+	balance := u.Balance[asset]
+	balance.Available = balance.Available.Sub(amount)
+	balance.Locked = balance.Locked.Add(amount)
+	u.Balance[asset] = balance
+}
+
+// move funds from locked back to available .e.g. order cancelled
+func (u *User) Unlock(asset string, amount Decimal) {
+	balance := u.Balance[asset]
+	balance.Locked = balance.Locked.Sub(amount)
+	balance.Available = balance.Available.Add(amount)
+	u.Balance[asset] = balance
+}
+
+// take from the locked balance when an order holding those funds is filled
+func (u *User) DebitLocked(asset string, amount Decimal) {
+	balance := u.Balance[asset]
+	balance.Locked = balance.Locked.Sub(amount)
+	u.Balance[asset] = balance
+}
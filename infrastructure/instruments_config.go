@@ -0,0 +1,38 @@
+package infrastructure
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/trandinhkhoa/crypto-exchange/entities"
+)
+
+// read the list of tradable instruments from a JSON file .e.g.
+// [{"Ticker": "ETHUSD", "BaseAsset": "ETH", "QuoteAsset": "USD", "TickSize": 0.01, "LotSize": 0.001, "MinNotional": 1}]
+func LoadInstrumentsFromFile(fileName string) ([]entities.Instrument, error) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read instruments config %s: %w", fileName, err)
+	}
+
+	instruments := make([]entities.Instrument, 0)
+	if err := json.Unmarshal(content, &instruments); err != nil {
+		return nil, fmt.Errorf("unable to parse instruments config %s: %w", fileName, err)
+	}
+	if len(instruments) == 0 {
+		return nil, fmt.Errorf("no instrument in config %s", fileName)
+	}
+
+	seen := make(map[string]bool, 0)
+	for _, instrument := range instruments {
+		if err := instrument.Validate(); err != nil {
+			return nil, err
+		}
+		if seen[instrument.Ticker] {
+			return nil, fmt.Errorf("instrument %q is defined twice in %s", instrument.Ticker, fileName)
+		}
+		seen[instrument.Ticker] = true
+	}
+	return instruments, nil
+}
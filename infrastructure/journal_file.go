@@ -0,0 +1,80 @@
+package infrastructure
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trandinhkhoa/crypto-exchange/usecases"
+)
+
+// one JSON command per line, each line is on disk before Append returns
+type FileJournal struct {
+	file *os.File
+}
+
+// a line cut short by a crash while it was written is dropped, the command was never applied
+func NewFileJournal(fileName string) (*FileJournal, error) {
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open journal %s: %w", fileName, err)
+	}
+	if err := dropTornLine(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("unable to repair journal %s: %w", fileName, err)
+	}
+	return &FileJournal{file: file}, nil
+}
+
+// truncate the file after its last newline
+func dropTornLine(file *os.File) error {
+	content, err := io.ReadAll(io.NewSectionReader(file, 0, 1<<62))
+	if err != nil {
+		return err
+	}
+	if len(content) == 0 || content[len(content)-1] == '\n' {
+		return nil
+	}
+	end := bytes.LastIndexByte(content, '\n') + 1
+	logrus.Warnf("Dropping the last %d bytes of the journal, cut short", len(content)-end)
+	return file.Truncate(int64(end))
+}
+
+// MUST NOT be called concurrently, the exchange appends with its lock held
+func (journal *FileJournal) Append(command usecases.Command) error {
+	line, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+	if _, err := journal.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return journal.file.Sync()
+}
+
+func (journal *FileJournal) ReadAll() ([]usecases.Command, error) {
+	scanner := bufio.NewScanner(io.NewSectionReader(journal.file, 0, 1<<62))
+	// a command is one line however long it is
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	commands := make([]usecases.Command, 0)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		var command usecases.Command
+		if err := json.Unmarshal(scanner.Bytes(), &command); err != nil {
+			return nil, fmt.Errorf("journal line %d: %w", lineNumber, err)
+		}
+		commands = append(commands, command)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return commands, nil
+}
+
+func (journal *FileJournal) Close() {
+	journal.file.Close()
+}
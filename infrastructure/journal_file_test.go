@@ -0,0 +1,73 @@
+package infrastructure_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trandinhkhoa/crypto-exchange/infrastructure"
+	"github.com/trandinhkhoa/crypto-exchange/usecases"
+)
+
+func TestFileJournal(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "journal.log")
+	journal, err := infrastructure.NewFileJournal(fileName)
+	assert.NoError(t, err)
+	assert.NoError(t, journal.Append(usecases.Command{Sequence: 1, Type: usecases.RegisterUserCommand, UserId: "john"}))
+	assert.NoError(t, journal.Append(usecases.Command{Sequence: 2, Type: usecases.DepositCommand, UserId: "john", Asset: "USD", Amount: dec(10)}))
+	journal.Close()
+
+	// opened again, the commands are still there in the same order
+	journal, err = infrastructure.NewFileJournal(fileName)
+	assert.NoError(t, err)
+	defer journal.Close()
+	commands, err := journal.ReadAll()
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(commands)) {
+		assert.Equal(t, int64(1), commands[0].Sequence)
+		assert.Equal(t, usecases.RegisterUserCommand, commands[0].Type)
+		assert.Equal(t, dec(10), commands[1].Amount)
+	}
+}
+
+func TestFileJournalTruncatedLine(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "journal.log")
+	journal, err := infrastructure.NewFileJournal(fileName)
+	assert.NoError(t, err)
+	assert.NoError(t, journal.Append(usecases.Command{Sequence: 1, Type: usecases.RegisterUserCommand, UserId: "john"}))
+	journal.Close()
+
+	// crash while the second command was written
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	_, err = file.WriteString(`{"Sequence":2,"Type":"DEP`)
+	assert.NoError(t, err)
+	file.Close()
+
+	journal, err = infrastructure.NewFileJournal(fileName)
+	assert.NoError(t, err)
+	defer journal.Close()
+	commands, err := journal.ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(commands))
+	// the next command starts on its own line
+	assert.NoError(t, journal.Append(usecases.Command{Sequence: 2, Type: usecases.DepositCommand, UserId: "john", Asset: "USD", Amount: dec(10)}))
+	commands, err = journal.ReadAll()
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(commands)) {
+		assert.Equal(t, int64(2), commands[1].Sequence)
+		assert.Equal(t, usecases.DepositCommand, commands[1].Type)
+	}
+}
+
+func TestFileJournalCorruptedLine(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "journal.log")
+	// a whole line that is not a command is not a crash while writing, it is not dropped
+	assert.NoError(t, os.WriteFile(fileName, []byte("{\"Sequence\":1,\"Type\":\"REGISTER_USER\"}\n{\"Sequence\":2,\"Type\n{\"Sequence\":3}\n"), 0644))
+	journal, err := infrastructure.NewFileJournal(fileName)
+	assert.NoError(t, err)
+	defer journal.Close()
+	_, err = journal.ReadAll()
+	assert.ErrorContains(t, err, "journal line 2")
+}
@@ -0,0 +1,22 @@
+package infrastructure
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToNumberedPlaceholders(t *testing.T) {
+	for statement, expected := range map[string]string{
+		"SELECT 1": "SELECT 1",
+		"INSERT INTO users (id, name) VALUES (?,?)":    "INSERT INTO users (id, name) VALUES ($1,$2)",
+		"UPDATE t SET a = ? WHERE b = ? AND c = ?":     "UPDATE t SET a = $1 WHERE b = $2 AND c = $3",
+		"SELECT * FROM t WHERE a = '?' AND b = ?":      "SELECT * FROM t WHERE a = '?' AND b = $1",
+		`SELECT "what?" FROM t WHERE a = ?`:            `SELECT "what?" FROM t WHERE a = $1`,
+		"SELECT 'it''s ?' FROM t WHERE a = ?":          "SELECT 'it''s ?' FROM t WHERE a = $1",
+		`SELECT 'say "hi?"' FROM t WHERE a = ?`:        `SELECT 'say "hi?"' FROM t WHERE a = $1`,
+		`SELECT "it's" FROM t WHERE a = ? AND b = '?'`: `SELECT "it's" FROM t WHERE a = $1 AND b = '?'`,
+	} {
+		assert.Equal(t, expected, toNumberedPlaceholders(statement), statement)
+	}
+}
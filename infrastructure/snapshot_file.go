@@ -0,0 +1,147 @@
+package infrastructure
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trandinhkhoa/crypto-exchange/usecases"
+)
+
+const snapshotFilePrefix = "snapshot-"
+const snapshotFileSuffix = ".json"
+
+// one file per snapshot in dir: the sha256 of the snapshot on the first line, the snapshot in JSON after it
+// only the latest snapshots are kept
+type FileSnapshotStore struct {
+	dir  string
+	keep int
+	// the snapshots are written in the background, maybe 2 at a time
+	mu sync.Mutex
+}
+
+// keep is the number of snapshots kept, at least 2 so there is one to fall back to
+func NewFileSnapshotStore(dir string, keep int) (*FileSnapshotStore, error) {
+	if keep < 2 {
+		return nil, fmt.Errorf("must keep at least 2 snapshots, got %d", keep)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create snapshot directory %s: %w", dir, err)
+	}
+	return &FileSnapshotStore{dir: dir, keep: keep}, nil
+}
+
+func (store *FileSnapshotStore) fileName(sequence int64) string {
+	return filepath.Join(store.dir, fmt.Sprintf("%s%020d%s", snapshotFilePrefix, sequence, snapshotFileSuffix))
+}
+
+// written to a temporary file first: a crash while writing leaves no snapshot rather than half of one
+func (store *FileSnapshotStore) Save(snapshot usecases.Snapshot) error {
+	content, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	checksum := sha256.Sum256(content)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	tmpFile, err := os.CreateTemp(store.dir, "tmp-"+snapshotFilePrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.WriteString(hex.EncodeToString(checksum[:]) + "\n")
+	if err == nil {
+		_, err = tmpFile.Write(content)
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), store.fileName(snapshot.Sequence)); err != nil {
+		return err
+	}
+	logrus.Infof("Snapshot %d saved", snapshot.Sequence)
+	store.prune()
+	return nil
+}
+
+// MUST be called with store.mu held
+func (store *FileSnapshotStore) prune() {
+	sequences, err := store.List()
+	if err != nil {
+		logrus.Errorf("Unable to prune snapshots: %s", err)
+		return
+	}
+	for i := store.keep; i < len(sequences); i++ {
+		if err := os.Remove(store.fileName(sequences[i])); err != nil {
+			logrus.Errorf("Unable to remove snapshot %d: %s", sequences[i], err)
+		}
+	}
+}
+
+func (store *FileSnapshotStore) Delete(sequence int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return os.Remove(store.fileName(sequence))
+}
+
+func (store *FileSnapshotStore) List() ([]int64, error) {
+	entries, err := os.ReadDir(store.dir)
+	if err != nil {
+		return nil, err
+	}
+	sequences := make([]int64, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, snapshotFilePrefix) || !strings.HasSuffix(name, snapshotFileSuffix) {
+			continue
+		}
+		sequence, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, snapshotFilePrefix), snapshotFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		sequences = append(sequences, sequence)
+	}
+	sort.Slice(sequences, func(i, j int) bool {
+		return sequences[i] > sequences[j]
+	})
+	return sequences, nil
+}
+
+func (store *FileSnapshotStore) Read(sequence int64) (usecases.Snapshot, error) {
+	var snapshot usecases.Snapshot
+	content, err := os.ReadFile(store.fileName(sequence))
+	if err != nil {
+		return snapshot, err
+	}
+	checksumLine, content, found := bytes.Cut(content, []byte("\n"))
+	if !found {
+		return snapshot, fmt.Errorf("snapshot %d has no checksum", sequence)
+	}
+	checksum := sha256.Sum256(content)
+	if hex.EncodeToString(checksum[:]) != string(checksumLine) {
+		return snapshot, fmt.Errorf("snapshot %d does not match its checksum", sequence)
+	}
+	if err := json.Unmarshal(content, &snapshot); err != nil {
+		return snapshot, fmt.Errorf("snapshot %d: %w", sequence, err)
+	}
+	if snapshot.Sequence != sequence {
+		return snapshot, fmt.Errorf("snapshot %d holds sequence %d", sequence, snapshot.Sequence)
+	}
+	return snapshot, nil
+}
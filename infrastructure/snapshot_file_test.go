@@ -0,0 +1,154 @@
+package infrastructure_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/trandinhkhoa/crypto-exchange/controllers"
+	"github.com/trandinhkhoa/crypto-exchange/entities"
+	"github.com/trandinhkhoa/crypto-exchange/infrastructure"
+	"github.com/trandinhkhoa/crypto-exchange/usecases"
+)
+
+func dec(f float64) entities.Decimal {
+	return entities.NewDecimalFromFloat(f)
+}
+
+func snapshotFile(t *testing.T, dir string) string {
+	snapshotFiles, err := filepath.Glob(filepath.Join(dir, "snapshot-*"))
+	assert.NoError(t, err)
+	if !assert.Equal(t, 1, len(snapshotFiles)) {
+		t.FailNow()
+	}
+	return snapshotFiles[0]
+}
+
+func TestFileSnapshotStoreChecksum(t *testing.T) {
+	dir := t.TempDir()
+	store, err := infrastructure.NewFileSnapshotStore(dir, 2)
+	assert.NoError(t, err)
+	snapshot := usecases.Snapshot{
+		Sequence:    3,
+		LastOrderId: 7,
+		Users: []usecases.SnapshotUser{{
+			UserId:  "john",
+			Balance: map[string]entities.Balance{"USD": {Available: dec(100), Locked: dec(0)}},
+		}},
+	}
+	assert.NoError(t, store.Save(snapshot))
+	read, err := store.Read(3)
+	assert.NoError(t, err)
+	assert.Equal(t, "john", read.Users[0].UserId)
+	assert.Equal(t, dec(100), read.Users[0].Balance["USD"].Available)
+
+	// one byte of the snapshot, the checksum line is left as it is
+	fileName := snapshotFile(t, dir)
+	content, err := os.ReadFile(fileName)
+	assert.NoError(t, err)
+	flipped := bytes.Replace(content, []byte(`"john"`), []byte(`"jahn"`), 1)
+	assert.NotEqual(t, content, flipped)
+	assert.NoError(t, os.WriteFile(fileName, flipped, 0644))
+	_, err = store.Read(3)
+	assert.ErrorContains(t, err, "snapshot 3 does not match its checksum")
+
+	// no checksum line at all
+	assert.NoError(t, os.WriteFile(fileName, bytes.ReplaceAll(content, []byte("\n"), nil), 0644))
+	_, err = store.Read(3)
+	assert.ErrorContains(t, err, "snapshot 3 has no checksum")
+}
+
+func TestFileSnapshotStorePrune(t *testing.T) {
+	store, err := infrastructure.NewFileSnapshotStore(t.TempDir(), 2)
+	assert.NoError(t, err)
+	for _, sequence := range []int64{4, 8, 12} {
+		assert.NoError(t, store.Save(usecases.Snapshot{Sequence: sequence}))
+	}
+	sequences, err := store.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{12, 8}, sequences)
+
+	_, err = infrastructure.NewFileSnapshotStore(t.TempDir(), 1)
+	assert.Error(t, err)
+}
+
+// an exchange over the files of dir, as main.go puts it together
+func newFileExchange(t *testing.T, dir string) (*usecases.Exchange, func()) {
+	logrus.SetOutput(io.Discard)
+	dbHandler := infrastructure.NewSqliteDbHandler(filepath.Join(dir, "exchange.db"))
+	if err := controllers.Migrate(dbHandler); err != nil {
+		t.Fatal(err)
+	}
+	journal, err := infrastructure.NewFileJournal(filepath.Join(dir, "journal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := infrastructure.NewFileSnapshotStore(filepath.Join(dir, "snapshots"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ex := usecases.NewExchange()
+	ex.OrdersRepo = controllers.NewOrdersRepoImpl(dbHandler)
+	ex.UsersRepo = controllers.NewUsersRepoImpl(dbHandler)
+	ex.SequencesRepo = controllers.NewSequencesRepoImpl(dbHandler)
+	ex.LastTradesRepo = controllers.NewLastTradesRepoImpl(dbHandler)
+	ex.FeesRepo = controllers.NewFeesRepoImpl(dbHandler)
+	ex.CandlesRepo = controllers.NewCandlesRepoImpl(dbHandler)
+	ex.TransactionManager = dbHandler
+	ex.Journal = journal
+	ex.SnapshotStore = store
+	ex.Recover()
+	return ex, func() {
+		journal.Close()
+		dbHandler.Close()
+	}
+}
+
+func TestRecoverFromPreviousSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	ex, closeExchange := newFileExchange(t, dir)
+	assert.NoError(t, ex.RegisterUserWithBalance("john", map[string]entities.Decimal{"USD": dec(100)}))
+	assert.NoError(t, ex.SaveSnapshot())
+	assert.NoError(t, ex.Deposit("john", "USD", dec(10)))
+	assert.NoError(t, ex.SaveSnapshot())
+	assert.NoError(t, ex.Deposit("john", "USD", dec(1)))
+	closeExchange()
+
+	// the latest snapshot is corrupted
+	store, err := infrastructure.NewFileSnapshotStore(filepath.Join(dir, "snapshots"), 2)
+	assert.NoError(t, err)
+	sequences, err := store.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{2, 1}, sequences)
+	_, err = store.Read(1)
+	assert.NoError(t, err)
+	latest := filepath.Join(dir, "snapshots", "snapshot-00000000000000000002.json")
+	content, err := os.ReadFile(latest)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(latest, bytes.Replace(content, []byte(`"john"`), []byte(`"jahn"`), 1), 0644))
+	_, err = store.Read(2)
+	assert.Error(t, err)
+
+	// the commands up to snapshot 1 are not needed anymore, the ones after it are replayed on it
+	journalFile := filepath.Join(dir, "journal.log")
+	content, err = os.ReadFile(journalFile)
+	assert.NoError(t, err)
+	_, rest, _ := bytes.Cut(content, []byte("\n"))
+	assert.NoError(t, os.WriteFile(journalFile, rest, 0644))
+	recovered, closeRecovered := newFileExchange(t, dir)
+	defer closeRecovered()
+	john, ok := recovered.GetUser("john")
+	assert.True(t, ok)
+	assert.Equal(t, dec(111), john.GetAvailable("USD"))
+	_, ok = recovered.GetUser("jahn")
+	assert.False(t, ok)
+	// and the commands go on after the last one
+	assert.NoError(t, recovered.Deposit("john", "USD", dec(1)))
+	john, _ = recovered.GetUser("john")
+	assert.Equal(t, dec(112), john.GetAvailable("USD"))
+}
@@ -0,0 +1,194 @@
+package infrastructure
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trandinhkhoa/crypto-exchange/controllers"
+)
+
+// what the handlers of the databases reached through database/sql have in common
+type sqlHandler struct {
+	dbConn *sql.DB
+	// the statements are written with ?, turned into what the database expects
+	rebind func(statement string) string
+	// held from Begin to Commit, one transaction at a time
+	txLock sync.Mutex
+	// guards tx, txGoroutine and txErr
+	mu sync.Mutex
+	// while it is not nil the statements of the goroutine that began it run in it.
+	// the ones of other goroutines .e.g. a request for the trade history, run outside and see only what is committed
+	tx          *sql.Tx
+	txGoroutine uint64
+	// the first statement of the transaction that failed
+	txErr error
+}
+
+func newSqlHandler(dbConn *sql.DB, rebind func(statement string) string) *sqlHandler {
+	return &sqlHandler{
+		dbConn: dbConn,
+		rebind: rebind,
+	}
+}
+
+// statements written for SQLite need no change
+func keepPlaceholders(statement string) string {
+	return statement
+}
+
+// the args are bound to the ? of the statement, never written into it
+func (sqlDbHandler *sqlHandler) Exec(statement string, args ...interface{}) error {
+	statement = sqlDbHandler.rebind(statement)
+	retryCount := 4
+	var err error
+	if _, err = sqlDbHandler.execer().Exec(statement, args...); err != nil {
+		logrus.Error(fmt.Sprintf("Unable to exec statement. Error: %s. Retrying... Statement: %s %v", err.Error(), statement, args))
+		for retryCount > 0 {
+			_, err = sqlDbHandler.execer().Exec(statement, args...)
+			if err == nil {
+				logrus.Info(fmt.Sprintf("Retry OK. Statement: %s %v", statement, args))
+				break
+			}
+			retryCount -= 1
+		}
+	}
+	if err != nil {
+		logrus.Error(fmt.Sprintf("Unable to exec statement. Error: %s. Statement: %s %v", err.Error(), statement, args))
+		sqlDbHandler.mu.Lock()
+		if sqlDbHandler.tx != nil && sqlDbHandler.txErr == nil && sqlDbHandler.txGoroutine == goroutineId() {
+			sqlDbHandler.txErr = err
+		}
+		sqlDbHandler.mu.Unlock()
+		return err
+	} else {
+		return nil
+	}
+}
+
+// *sql.DB and *sql.Tx
+type execQueryer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// the transaction in progress if the goroutine began it, so its statements see what it already wrote
+func (sqlDbHandler *sqlHandler) execer() execQueryer {
+	sqlDbHandler.mu.Lock()
+	defer sqlDbHandler.mu.Unlock()
+	if sqlDbHandler.tx != nil && sqlDbHandler.txGoroutine == goroutineId() {
+		return sqlDbHandler.tx
+	}
+	return sqlDbHandler.dbConn
+}
+
+// the id in the first line of the stack of the current goroutine: "goroutine 42 [running]:"
+func goroutineId() uint64 {
+	var buf [64]byte
+	stack := buf[:runtime.Stack(buf[:], false)]
+	stack = bytes.TrimPrefix(stack, []byte("goroutine "))
+	id, _, _ := bytes.Cut(stack, []byte(" "))
+	goroutine, err := strconv.ParseUint(string(id), 10, 64)
+	if err != nil {
+		panic(fmt.Sprintf("Unable to read the id of the goroutine: %s", err))
+	}
+	return goroutine
+}
+
+// until Commit, the statements run in a transaction. Waits for the transaction in progress if any
+func (sqlDbHandler *sqlHandler) Begin() error {
+	sqlDbHandler.txLock.Lock()
+	tx, err := sqlDbHandler.dbConn.Begin()
+	if err != nil {
+		sqlDbHandler.txLock.Unlock()
+		logrus.Error(fmt.Sprintf("Unable to begin transaction. Error: %s", err.Error()))
+		return err
+	}
+	sqlDbHandler.mu.Lock()
+	sqlDbHandler.tx = tx
+	sqlDbHandler.txGoroutine = goroutineId()
+	sqlDbHandler.txErr = nil
+	sqlDbHandler.mu.Unlock()
+	return nil
+}
+
+// all the statements since Begin are saved, or none of them if one failed
+func (sqlDbHandler *sqlHandler) Commit() error {
+	sqlDbHandler.mu.Lock()
+	tx, txErr := sqlDbHandler.tx, sqlDbHandler.txErr
+	sqlDbHandler.tx, sqlDbHandler.txErr = nil, nil
+	sqlDbHandler.mu.Unlock()
+	if tx == nil {
+		return errors.New("no transaction in progress")
+	}
+	defer sqlDbHandler.txLock.Unlock()
+
+	if txErr != nil {
+		if err := tx.Rollback(); err != nil {
+			logrus.Error(fmt.Sprintf("Unable to rollback transaction. Error: %s", err.Error()))
+		}
+		return fmt.Errorf("transaction rolled back: %w", txErr)
+	}
+	return tx.Commit()
+}
+
+// none of the statements since Begin are saved
+func (sqlDbHandler *sqlHandler) Rollback() error {
+	sqlDbHandler.mu.Lock()
+	tx := sqlDbHandler.tx
+	sqlDbHandler.tx, sqlDbHandler.txErr = nil, nil
+	sqlDbHandler.mu.Unlock()
+	if tx == nil {
+		return errors.New("no transaction in progress")
+	}
+	defer sqlDbHandler.txLock.Unlock()
+	return tx.Rollback()
+}
+
+func (sqlDbHandler *sqlHandler) Close() {
+	sqlDbHandler.dbConn.Close()
+}
+
+type SqlRow struct {
+	Rows *sql.Rows
+	// the query failed, there is no row
+	err error
+}
+
+func (r SqlRow) Scan(dest ...interface{}) error {
+	if r.Rows == nil {
+		return fmt.Errorf("no row to scan: %w", r.err)
+	}
+	return r.Rows.Scan(dest...)
+}
+
+func (r SqlRow) Next() bool {
+	// the query failed .e.g. the table does not exist
+	if r.Rows == nil {
+		return false
+	}
+	return r.Rows.Next()
+}
+
+// once Next returned false: why the query failed or stopped early, nil if every row was read
+func (r SqlRow) Err() error {
+	if r.Rows == nil {
+		return r.err
+	}
+	return r.Rows.Err()
+}
+
+// the args are bound to the ? of the statement, never written into it
+func (sqlDbHandler *sqlHandler) Query(statement string, args ...interface{}) controllers.Row {
+	rows, err := sqlDbHandler.execer().Query(sqlDbHandler.rebind(statement), args...)
+	if err != nil {
+		logrus.Error(err)
+		return &SqlRow{err: err}
+	}
+	return &SqlRow{Rows: rows}
+}
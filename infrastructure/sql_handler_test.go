@@ -0,0 +1,57 @@
+package infrastructure_test
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/trandinhkhoa/crypto-exchange/controllers"
+	"github.com/trandinhkhoa/crypto-exchange/infrastructure"
+)
+
+func countUsers(t *testing.T, dbHandler controllers.SqlDbHandler) int {
+	rows := dbHandler.Query(`SELECT COUNT(*) FROM users`)
+	count := 0
+	for rows.Next() {
+		assert.NoError(t, rows.Scan(&count))
+	}
+	assert.NoError(t, rows.Err())
+	return count
+}
+
+// what another goroutine reads, without waiting for the transaction
+func countUsersElsewhere(t *testing.T, dbHandler controllers.SqlDbHandler) int {
+	count := make(chan int)
+	go func() {
+		count <- countUsers(t, dbHandler)
+	}()
+	return <-count
+}
+
+func TestTransactionOfItsGoroutine(t *testing.T) {
+	logrus.SetOutput(io.Discard)
+	dbHandler := infrastructure.NewSqliteDbHandler(filepath.Join(t.TempDir(), "exchange.db"))
+	defer dbHandler.Close()
+	assert.NoError(t, controllers.Migrate(dbHandler))
+
+	assert.NoError(t, dbHandler.Begin())
+	assert.NoError(t, dbHandler.Exec(`INSERT INTO users (userId) VALUES (?)`, "john"))
+	// the goroutine of the transaction sees what it wrote, the others only what is committed
+	assert.Equal(t, 1, countUsers(t, dbHandler))
+	assert.Equal(t, 0, countUsersElsewhere(t, dbHandler))
+	// a statement of another goroutine that fails does not roll the transaction back
+	failed := make(chan error)
+	go func() {
+		failed <- dbHandler.Exec(`INSERT INTO noSuchTable (userId) VALUES (?)`, "jane")
+	}()
+	assert.Error(t, <-failed)
+	assert.NoError(t, dbHandler.Commit())
+	assert.Equal(t, 1, countUsersElsewhere(t, dbHandler))
+
+	assert.NoError(t, dbHandler.Begin())
+	assert.NoError(t, dbHandler.Exec(`INSERT INTO users (userId) VALUES (?)`, "jane"))
+	assert.NoError(t, dbHandler.Rollback())
+	assert.Equal(t, 1, countUsers(t, dbHandler))
+}
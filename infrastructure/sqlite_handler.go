@@ -10,7 +10,7 @@ import (
 )
 
 type SqliteDbHandler struct {
-	dbConn *sql.DB
+	*sqlHandler
 }
 
 func NewSqliteDbHandler(dbFileName string) *SqliteDbHandler {
@@ -21,7 +21,7 @@ func NewSqliteDbHandler(dbFileName string) *SqliteDbHandler {
 	}
 
 	sqliteDbHandler := &SqliteDbHandler{
-		dbConn: db,
+		sqlHandler: newSqlHandler(db, keepPlaceholders),
 	}
 
 	logrus.Info("Connected to the database")
@@ -29,54 +29,6 @@ func NewSqliteDbHandler(dbFileName string) *SqliteDbHandler {
 	return sqliteDbHandler
 }
 
-func (sqlDbHandler *SqliteDbHandler) Exec(statement string) error {
-	retryCount := 4
-	var err error
-	if _, err = sqlDbHandler.dbConn.Exec(statement); err != nil {
-		logrus.Error(fmt.Sprintf("Unable to exec statement. Error: %s. Retrying... Statement: %s", err.Error(), statement))
-		for retryCount > 0 {
-			_, err := sqlDbHandler.dbConn.Exec(statement)
-			if err == nil {
-				logrus.Info(fmt.Sprintf("Retry OK. Statement: %s", statement))
-				break
-			}
-			retryCount -= 1
-		}
-	}
-	if err != nil {
-		logrus.Error(fmt.Sprintf("Unable to exec statement. Error: %s. Statement: %s", err.Error(), statement))
-		return err
-	} else {
-		return nil
-	}
-}
-
-func (sqlDbHandler *SqliteDbHandler) Close() {
-	sqlDbHandler.dbConn.Close()
-}
-
-type SqliteRow struct {
-	Rows *sql.Rows
-}
-
-func (r SqliteRow) Scan(dest ...interface{}) {
-	if err := r.Rows.Scan(dest...); err != nil {
-		logrus.Error(err)
-	}
-}
-
-func (r SqliteRow) Next() bool {
-	return r.Rows.Next()
-}
-
-func (sqlDbHandler *SqliteDbHandler) Query(statement string) controllers.Row {
-	// Step 2: Execute SQL SELECT query
-	rows, err := sqlDbHandler.dbConn.Query(statement)
-	if err != nil {
-		logrus.Error(err)
-		return new(SqliteRow)
-	}
-	row := new(SqliteRow)
-	row.Rows = rows
-	return row
+func (sqlDbHandler *SqliteDbHandler) Dialect() controllers.Dialect {
+	return controllers.SqliteDialect
 }
@@ -3,12 +3,15 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/sirupsen/logrus"
 	"github.com/trandinhkhoa/crypto-exchange/client"
 	"github.com/trandinhkhoa/crypto-exchange/controllers"
+	"github.com/trandinhkhoa/crypto-exchange/entities"
 	"github.com/trandinhkhoa/crypto-exchange/infrastructure"
 	"github.com/trandinhkhoa/crypto-exchange/usecases"
 	"golang.org/x/net/websocket"
@@ -24,76 +27,36 @@ func init() {
 	logrus.SetLevel(logrus.DebugLevel)
 }
 
-func initialTablesSetup(db controllers.SqlDbHandler) {
-	// TODO: avoid hardcoding all currencies
-	createTableSQL := `CREATE TABLE IF NOT EXISTS users (
-		"userid" TEXT PRIMARY KEY,
-		"ETH" FLOAT,
-		"USD" FLOAT
-	);`
-	if err := db.Exec(createTableSQL); err != nil {
-		panic("Unable to create table users")
-	}
-
-	createTableSQL = `CREATE TABLE IF NOT EXISTS buyOrders (
-		"id" INTEGER PRIMARY KEY,
-		"userid" TEXT,
-		"size" INTEGER,
-		"price" INTEGER,
-		"timestamp" INTEGER
-	);`
-
-	if err := db.Exec(createTableSQL); err != nil {
-		panic("Unable to create table buyOrders")
-	}
-
-	createTableSQL = `CREATE TABLE IF NOT EXISTS sellOrders (
-		"id" INTEGER PRIMARY KEY,
-		"userid" TEXT,
-		"size" INTEGER,
-		"price" INTEGER,
-		"timestamp" INTEGER
-	);`
-
-	if err := db.Exec(createTableSQL); err != nil {
-		panic("Unable to create table sellOrders")
+func createSomeUsers(apiHandler *controllers.WebServiceHandler) error {
+	if err := apiHandler.Ex.RegisterUserWithBalance("maker123",
+		map[string]entities.Decimal{
+			"ETH": entities.NewDecimalFromInt(10000),
+			"USD": entities.NewDecimalFromInt(1000000),
+		},
+	); err != nil {
+		return err
 	}
-
-	createTableSQL = `CREATE TABLE IF NOT EXISTS lastTrades (
-		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
-		"price" FLOAT,
-		"size" FLOAT,
-		"isBuyerMaker" BOOLEAN,
-		"timestamp" INTEGER
-	);`
-	if err := db.Exec(createTableSQL); err != nil {
-		panic("Unable to create table lastTrades")
+	// the market maker must not trade with itself, its stale quotes are cancelled instead
+	if err := apiHandler.Ex.SetSelfTradePrevention("maker123", entities.CancelOldest); err != nil {
+		return err
 	}
-}
-
-func createSomeUsers(apiHandler *controllers.WebServiceHandler) {
-	apiHandler.Ex.RegisterUserWithBalance("maker123",
-		map[string]float64{
-			"ETH": 10000.0,
-			"USD": 1000000.0,
-		},
-	)
-	apiHandler.Ex.RegisterUserWithBalance("traderJoe123",
-		map[string]float64{
-			"ETH": 10.0,
-			"USD": 1000.0,
+	if err := apiHandler.Ex.RegisterUserWithBalance("traderJoe123",
+		map[string]entities.Decimal{
+			"ETH": entities.NewDecimalFromInt(10),
+			"USD": entities.NewDecimalFromInt(1000),
 		},
-	)
-	apiHandler.Ex.RegisterUserWithBalance("me",
-		map[string]float64{
-			"ETH": 0.0,
-			"USD": 1000.0,
+	); err != nil {
+		return err
+	}
+	return apiHandler.Ex.RegisterUserWithBalance("me",
+		map[string]entities.Decimal{
+			"ETH": entities.NewDecimalFromInt(0),
+			"USD": entities.NewDecimalFromInt(1000),
 		},
 	)
-
 }
 
-func StartServer(freshstart bool, port int, serverStarted chan bool) {
+func StartServer(freshstart bool, port int, instrumentsFile string, journalFile string, snapshotDir string, dbDsn string, dbPool infrastructure.PostgresPoolConfig, serverStarted chan bool) {
 	e := echo.New()
 	// allow all origins just for testing
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
@@ -103,10 +66,18 @@ func StartServer(freshstart bool, port int, serverStarted chan bool) {
 
 	// client, err := ethclient.Dial("http://localhost:8545")
 
+	instruments, err := infrastructure.LoadInstrumentsFromFile(instrumentsFile)
+	if err != nil {
+		panic(err)
+	}
+
 	// injections of implementations
-	ex := usecases.NewExchange()
+	ex := usecases.NewExchangeWithInstruments(instruments)
 
-	dbHandler := infrastructure.NewSqliteDbHandler("./real.db")
+	dbHandler, err := infrastructure.OpenDbHandler(dbDsn, dbPool)
+	if err != nil {
+		panic(err)
+	}
 	defer dbHandler.Close()
 
 	ordersRepoImpl := controllers.NewOrdersRepoImpl(dbHandler)
@@ -115,37 +86,91 @@ func StartServer(freshstart bool, port int, serverStarted chan bool) {
 	ex.UsersRepo = usersRepoImpl
 	lastTradeRepoImpl := controllers.NewLastTradesRepoImpl(dbHandler)
 	ex.LastTradesRepo = lastTradeRepoImpl
+	sequencesRepoImpl := controllers.NewSequencesRepoImpl(dbHandler)
+	ex.SequencesRepo = sequencesRepoImpl
+	feesRepoImpl := controllers.NewFeesRepoImpl(dbHandler)
+	ex.FeesRepo = feesRepoImpl
+	candlesRepoImpl := controllers.NewCandlesRepoImpl(dbHandler)
+	ex.CandlesRepo = candlesRepoImpl
+	ex.TransactionManager = dbHandler
+
+	// a fresh start forgets what was journaled before, and the database it was applied to
+	if freshstart {
+		os.Remove(journalFile)
+		os.RemoveAll(snapshotDir)
+	}
+	journal, err := infrastructure.NewFileJournal(journalFile)
+	if err != nil {
+		panic(err)
+	}
+	defer journal.Close()
+	ex.Journal = journal
+	snapshotStore, err := infrastructure.NewFileSnapshotStore(snapshotDir, 3)
+	if err != nil {
+		panic(err)
+	}
+	ex.SnapshotStore = snapshotStore
+	ex.SnapshotEveryCommands = 10000
+	// 0.1% for the takers, 0.05% for the makers, less above 1M traded in 30 days
+	ex.FeeSchedule = entities.FeeSchedule{
+		{MinVolume: entities.ZeroDecimal, MakerRate: entities.MustParseDecimal("0.0005"), TakerRate: entities.MustParseDecimal("0.001")},
+		{MinVolume: entities.NewDecimalFromInt(1000000), MakerRate: entities.ZeroDecimal, TakerRate: entities.MustParseDecimal("0.0005")},
+	}
 
 	apiHandler := controllers.NewWebServiceHandler(ex)
+	ex.OnStopOrderTriggered = apiHandler.HandleStopOrderTriggered
+	ex.OnSelfTradePrevented = apiHandler.HandleSelfTradePrevented
 
-	// initial database setup
+	// a database written by an older version is upgraded in place
+	if err := controllers.Migrate(dbHandler); err != nil {
+		panic(err)
+	}
 	if freshstart {
-		initialTablesSetup(dbHandler)
-		createSomeUsers(apiHandler)
-	} else {
-		ex.Recover()
+		if err := controllers.ResetDatabase(dbHandler); err != nil {
+			panic(err)
+		}
+	}
+	// even on a fresh start: the state the journal starts from is saved
+	ex.Recover()
+	if freshstart {
+		if err := createSomeUsers(apiHandler); err != nil {
+			panic(err)
+		}
 	}
 	close(serverStarted)
 
+	go apiHandler.ExpireOrdersEvery(time.Second)
+	go ex.SaveSnapshotEvery(time.Minute)
+
 	e.POST("/order", apiHandler.HandlePlaceOrder)
 
 	e.GET("/users", apiHandler.HandleGetUsers)
 	e.GET("/users/:userId", apiHandler.HandleGetUser)
-	e.GET("/book/:ticker", apiHandler.HandleGetBook)
-	// TODO: handle error when ticker does not exist
-	e.GET("/book/:ticker/currentPrice", apiHandler.HandleGetCurrentPrice)
+	e.POST("/users/:userId/deposit", apiHandler.HandleDeposit)
+	e.PUT("/users/:userId/selfTradePrevention", apiHandler.HandleSetSelfTradePrevention)
+	e.GET("/users/:userId/trades", apiHandler.HandleGetUserTrades)
+	e.GET("/instruments", apiHandler.HandleGetInstruments)
+	e.GET("/book/:ticker", apiHandler.HandleGetBook, apiHandler.RequireKnownTicker)
+	e.GET("/book/:ticker/l2", apiHandler.HandleGetL2Book, apiHandler.RequireKnownTicker)
+	e.GET("/book/:ticker/l3", apiHandler.HandleGetL3Book, apiHandler.RequireKnownTicker)
+	e.GET("/book/:ticker/currentPrice", apiHandler.HandleGetCurrentPrice, apiHandler.RequireKnownTicker)
 	// TODO: handle error when this is called while no bid/ask is in the book
-	e.GET("/book/:ticker/bestAsk", apiHandler.HandleGetBestAsk)
-	e.GET("/book/:ticker/bestBid", apiHandler.HandleGetBestBid)
-
-	e.DELETE("/order/:ticker/:id", apiHandler.HandleCancelOrder)
-
-	// in practice, you would have 1 websocket URL.
-	// each usecase below would be represented by  an event specified in the payload
-	e.GET("/ws/currentPrice", echo.WrapHandler(websocket.Handler(apiHandler.WebSocketHandlerCurrentPrice)))
-	e.GET("/ws/lastTrades", echo.WrapHandler(websocket.Handler(apiHandler.WebSocketHandlerLastTrade)))
-	e.GET("/ws/bestSells", echo.WrapHandler(websocket.Handler(apiHandler.WebSocketHandlerBestSells)))
-	e.GET("/ws/bestBuys", echo.WrapHandler(websocket.Handler(apiHandler.WebSocketHandlerBestBuys)))
+	e.GET("/book/:ticker/bestAsk", apiHandler.HandleGetBestAsk, apiHandler.RequireKnownTicker)
+	e.GET("/book/:ticker/bestBid", apiHandler.HandleGetBestBid, apiHandler.RequireKnownTicker)
+	e.GET("/trades/:ticker", apiHandler.HandleGetTradeHistory, apiHandler.RequireKnownTicker)
+	e.GET("/candles/:ticker", apiHandler.HandleGetCandles, apiHandler.RequireKnownTicker)
+
+	e.DELETE("/order/:ticker/:id", apiHandler.HandleCancelOrder, apiHandler.RequireKnownTicker)
+	e.PATCH("/order/:ticker/:id", apiHandler.HandleAmendOrder, apiHandler.RequireKnownTicker)
+
+	// one websocket for every channel, subscribed to in the payload
+	e.GET("/ws", echo.WrapHandler(websocket.Handler(apiHandler.WebSocketHandler)))
+	// one websocket per channel, kept for the clients written before /ws
+	// the ticker is passed as a query parameter .e.g. /ws/lastTrades?ticker=ETHUSD
+	e.GET("/ws/currentPrice", echo.WrapHandler(websocket.Handler(apiHandler.WebSocketHandlerCurrentPrice)), apiHandler.RequireKnownTicker)
+	e.GET("/ws/lastTrades", echo.WrapHandler(websocket.Handler(apiHandler.WebSocketHandlerLastTrade)), apiHandler.RequireKnownTicker)
+	e.GET("/ws/bestSells", echo.WrapHandler(websocket.Handler(apiHandler.WebSocketHandlerBestSells)), apiHandler.RequireKnownTicker)
+	e.GET("/ws/bestBuys", echo.WrapHandler(websocket.Handler(apiHandler.WebSocketHandlerBestBuys)), apiHandler.RequireKnownTicker)
 	e.GET("/ws/userInfo", echo.WrapHandler(websocket.Handler(apiHandler.WebSocketHandlerUserInfo)))
 
 	e.Start(fmt.Sprintf(":%d", port))
@@ -155,15 +180,31 @@ func main() {
 	// Define flags
 	var freshstart bool
 	var port int
+	var instrumentsFile string
+	var journalFile string
+	var snapshotDir string
+	var dbDsn string
+	dbPool := infrastructure.DefaultPostgresPoolConfig
 
 	flag.BoolVar(&freshstart, "freshstart", true, "Indicate whether it's a fresh start or not")
 	flag.IntVar(&port, "port", 3000, "Port to run the application on")
+	flag.StringVar(&instrumentsFile, "instruments", "./instruments.json", "JSON file listing the instruments to trade")
+	flag.StringVar(&journalFile, "journal", "./journal.log", "File the commands are journaled to, replayed when it's not a fresh start")
+	flag.StringVar(&snapshotDir, "snapshots", "./snapshots", "Directory the snapshots are saved to, the journal is replayed from the latest one")
+
+	defaultDbDsn := os.Getenv("EXCHANGE_DB_DSN")
+	if defaultDbDsn == "" {
+		defaultDbDsn = "./real.db"
+	}
+	flag.StringVar(&dbDsn, "db", defaultDbDsn, "Database to store to: the path of an SQLite file or a postgres:// URL, $EXCHANGE_DB_DSN by default")
+	flag.IntVar(&dbPool.MaxOpenConns, "db-max-conns", dbPool.MaxOpenConns, "Maximum number of connections to PostgreSQL")
+	flag.IntVar(&dbPool.MaxIdleConns, "db-max-idle-conns", dbPool.MaxIdleConns, "Maximum number of idle connections to PostgreSQL")
 
 	// Parse the flags
 	flag.Parse()
 
 	serverStarted := make(chan bool)
-	go StartServer(freshstart, port, serverStarted)
+	go StartServer(freshstart, port, instrumentsFile, journalFile, snapshotDir, dbDsn, dbPool, serverStarted)
 
 	<-serverStarted
 
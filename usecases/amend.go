@@ -0,0 +1,126 @@
+package usecases
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trandinhkhoa/crypto-exchange/entities"
+)
+
+type OrderNotFoundError struct {
+	OrderId int64
+}
+
+func (e OrderNotFoundError) Error() string {
+	return fmt.Sprintf("order %d does not exist", e.OrderId)
+}
+
+// the order is someone else's
+type OrderNotOwnedError struct {
+	OrderId int64
+	UserId  string
+}
+
+func (e OrderNotOwnedError) Error() string {
+	return fmt.Sprintf("order %d is not an order of %s", e.OrderId, e.UserId)
+}
+
+// change the size and/or the price of a resting limit order in one step.
+// a size decrease keeps the order's place in the queue, a price change or a size increase sends it to the back,
+// matched first if the new price crosses. The locked funds follow the new size and price.
+// a zero newSize or newPrice keeps the current one.
+// returns the order as amended: what is left of it in the book, or the whole amended order if it was filled
+// the amendment of an order of userId in the book is journaled before its checks, it is rejected again when replayed
+func (ex *Exchange) AmendOrder(orderId int64, ticker string, userId string, newSize entities.Decimal, newPrice entities.Decimal) (entities.Order, []entities.Trade, error) {
+	ex.mu.Lock()
+	ex.tick()
+	if orderbook, ok := ex.orderbooksMap[Ticker(ticker)]; ok {
+		if order, err := orderbook.GetOrderbyId(orderId); err == nil {
+			if order.GetUserId() != userId {
+				ex.mu.Unlock()
+				return entities.Order{}, nil, &OrderNotOwnedError{OrderId: orderId, UserId: userId}
+			}
+			if err := ex.journal(Command{Type: AmendOrderCommand, Ticker: ticker, OrderId: orderId, Size: newSize, Price: newPrice}); err != nil {
+				ex.mu.Unlock()
+				return entities.Order{}, nil, err
+			}
+		}
+	}
+	ex.beginTransaction()
+	amendedOrder, tradesArray, err := ex.amendOrder(orderId, Ticker(ticker), newSize, newPrice)
+	var triggeredStopOrders []StopOrderTriggered
+	if err == nil {
+		triggeredStopOrders = ex.triggerStopOrders(Ticker(ticker))
+	}
+	ex.commitTransaction()
+	ex.publishMarketData()
+	selfTradesPrevented := ex.popSelfTradesPrevented()
+	ex.mu.Unlock()
+
+	ex.notifySelfTradesPrevented(selfTradesPrevented)
+	ex.notifyStopOrdersTriggered(triggeredStopOrders)
+	return amendedOrder, tradesArray, err
+}
+
+// MUST be called with ex.mu held
+func (ex *Exchange) amendOrder(orderId int64, ticker Ticker, newSize entities.Decimal, newPrice entities.Decimal) (entities.Order, []entities.Trade, error) {
+	orderbook, ok := ex.orderbooksMap[ticker]
+	if !ok {
+		return entities.Order{}, nil, &UnknownTickerError{Ticker: string(ticker)}
+	}
+	order, err := orderbook.GetOrderbyId(orderId)
+	if err != nil {
+		return entities.Order{}, nil, &OrderNotFoundError{OrderId: orderId}
+	}
+	instrument := ex.instruments[ticker]
+	user := ex.usersMap[order.GetUserId()]
+
+	amendedOrder := order
+	if !newSize.IsZero() {
+		amendedOrder.Size = newSize
+	}
+	if !newPrice.IsZero() {
+		amendedOrder.SetLimitPrice(newPrice)
+	}
+
+	// the funds held by the order count as available for the checks of the amended order
+	ex.releaseFunds(user, instrument, order.GetIsBid(), order.GetLimitPrice(), order.GetSize())
+	err = ex.checkRisk(amendedOrder)
+	if err == nil {
+		err = ex.checkPostOnly(&amendedOrder)
+	}
+	if err != nil {
+		ex.lockFunds(user, instrument, order.GetIsBid(), order.GetLimitPrice(), order.GetSize())
+		return entities.Order{}, nil, err
+	}
+	ex.lockFunds(user, instrument, amendedOrder.GetIsBid(), amendedOrder.GetLimitPrice(), amendedOrder.GetSize())
+
+	tradesArray, err := orderbook.AmendOrder(orderId, amendedOrder.GetSize(), amendedOrder.GetLimitPrice())
+	if err != nil {
+		logrus.Errorf("Unexpected error amending order id: %d, error: %s \n", orderId, err)
+		ex.releaseFunds(user, instrument, amendedOrder.GetIsBid(), amendedOrder.GetLimitPrice(), amendedOrder.GetSize())
+		ex.lockFunds(user, instrument, order.GetIsBid(), order.GetLimitPrice(), order.GetSize())
+		return entities.Order{}, nil, err
+	}
+	ex.executeTrades(ticker, tradesArray)
+	ex.settleSelfTradeCancels(ticker)
+	ex.releaseCancelledRest(user, instrument, amendedOrder, tradesArray)
+	ex.refreshOpenOrder(user, ticker, orderId)
+
+	// TODO: persist should be async
+	ex.persistTrades(tradesArray)
+	ex.UsersRepo.Update(*user)
+	restingOrder, err := orderbook.GetOrderbyId(orderId)
+	if err == nil {
+		ex.OrdersRepo.Update(restingOrder)
+		amendedOrder = restingOrder
+	} else {
+		ex.OrdersRepo.Delete(order)
+	}
+	ex.persistSequences()
+
+	logrus.WithFields(logrus.Fields{
+		"order": amendedOrder,
+	}).Info("Order Amended")
+	return amendedOrder, tradesArray, nil
+}
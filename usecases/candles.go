@@ -0,0 +1,90 @@
+package usecases
+
+import (
+	"github.com/trandinhkhoa/crypto-exchange/entities"
+)
+
+// when the query does not say, and at most
+const DefaultCandlesLimit = 500
+const MaxCandlesLimit = 1000
+
+// the latest candles of the ticker opened in the range, oldest first
+func (ex *Exchange) GetCandles(ticker string, interval entities.CandleInterval, query CandleQuery) []entities.Candle {
+	if query.Limit <= 0 {
+		query.Limit = DefaultCandlesLimit
+	}
+	if query.Limit > MaxCandlesLimit {
+		query.Limit = MaxCandlesLimit
+	}
+	// no ex.mu: the candles of the command in progress are not committed yet, they are not read
+	return ex.CandlesRepo.Read(ticker, interval, query)
+}
+
+// in the order of entities.CandleIntervals
+// MUST be called with ex.mu held
+func (ex *Exchange) latestCandles(ticker Ticker) []entities.Candle {
+	candles := make([]entities.Candle, 0)
+	for _, interval := range entities.CandleIntervals {
+		if candle, ok := ex.candles[ticker][interval]; ok {
+			candles = append(candles, *candle)
+		}
+	}
+	return candles
+}
+
+// a trade timestamped before the latest candle .e.g. the clock went back, counts in it
+// MUST be called with ex.mu held, for every trade in the order they were matched
+func (ex *Exchange) addToCandles(ticker Ticker, trade entities.Trade) {
+	for _, interval := range entities.CandleIntervals {
+		if candle, ok := ex.candles[ticker][interval]; ok && candle.Covers(trade) {
+			candle.AddTrade(trade)
+			continue
+		}
+		candle := entities.NewCandle(interval, trade)
+		ex.candles[ticker][interval] = &candle
+	}
+}
+
+// the candle a trade closes was saved with the trade before it
+// MUST be called with ex.mu held, in the transaction of the trades
+func (ex *Exchange) persistCandles(ticker Ticker) {
+	for _, candle := range ex.latestCandles(ticker) {
+		ex.CandlesRepo.Save(candle)
+	}
+}
+
+// read back the latest candle of each interval, the next trades go on in them
+// MUST be called with ex.mu held
+func (ex *Exchange) loadCandles() {
+	for ticker, orderbook := range ex.orderbooksMap {
+		ex.candles[ticker] = make(map[entities.CandleInterval]*entities.Candle, 0)
+		for _, interval := range entities.CandleIntervals {
+			for _, candle := range ex.CandlesRepo.Read(string(ticker), interval, CandleQuery{Limit: 1}) {
+				candle := candle
+				ex.candles[ticker][interval] = &candle
+			}
+		}
+		// trades from before the candles existed
+		if len(ex.candles[ticker]) == 0 && len(orderbook.GetLastTrades()) > 0 {
+			ex.rebuildCandles(ticker)
+		}
+	}
+}
+
+// build the candles of the ticker again from the trades in memory, in the order they were matched
+// MUST be called with ex.mu held
+func (ex *Exchange) rebuildCandles(ticker Ticker) {
+	ex.beginTransaction()
+	defer ex.commitTransaction()
+
+	ex.candles[ticker] = make(map[entities.CandleInterval]*entities.Candle, 0)
+	for _, trade := range ex.orderbooksMap[ticker].GetLastTrades() {
+		for _, candle := range ex.candles[ticker] {
+			if !candle.Covers(trade) {
+				ex.CandlesRepo.Save(*candle)
+			}
+		}
+		ex.addToCandles(ticker, trade)
+	}
+	ex.persistCandles(ticker)
+}
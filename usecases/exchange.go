@@ -1,8 +1,10 @@
 package usecases
 
 import (
-	"errors"
+	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/trandinhkhoa/crypto-exchange/entities"
@@ -14,12 +16,59 @@ const (
 	ETHUSD Ticker = "ETHUSD"
 )
 
-var TickerList = [...]Ticker{ETHUSD}
+// used when no instrument registry is given to the exchange
+var DefaultInstruments = []entities.Instrument{
+	{
+		Ticker:      string(ETHUSD),
+		BaseAsset:   "ETH",
+		QuoteAsset:  "USD",
+		TickSize:    entities.MustParseDecimal("0.01"),
+		LotSize:     entities.MustParseDecimal("0.001"),
+		MinNotional: entities.ZeroDecimal,
+	},
+}
+
+// names of the id sequences in SequencesRepo
+const (
+	ordersSequence = "orders"
+	tradesSequence = "trades"
+)
+
+type UnknownTickerError struct {
+	Ticker string
+}
+
+func (e UnknownTickerError) Error() string {
+	return fmt.Sprintf("ticker %s does not exist", e.Ticker)
+}
 
 type Exchange struct {
 	usersMap      map[string]*entities.User
+	instruments   map[Ticker]entities.Instrument
 	orderbooksMap map[Ticker]*entities.Orderbook
-	mu            sync.Mutex
+	// stop orders waiting to be triggered, one per orderbook
+	triggerBooksMap map[Ticker]*entities.TriggerBook
+	mu              sync.Mutex
+	// ids are unique across all the orderbooks
+	orderIds *entities.Sequence
+	tradeIds *entities.Sequence
+	// waiting to be notified once ex.mu is released
+	selfTradesPrevented []SelfTradePrevented
+	// fees of the last 30 days by user id, oldest first
+	feeLedger map[string][]entities.FeeLedgerEntry
+	// size * price of the entries of the ledger by user id then ticker, kept along with it
+	tradedVolumes map[string]map[Ticker]entities.Decimal
+	// sequence of the last journaled command
+	commandIds *entities.Sequence
+	// unix nano, see tick
+	now int64
+	// sequence of the last command in a snapshot
+	lastSnapshotSequence int64
+	// see SubscribeMarketData
+	marketData          *marketDataBus
+	publishedMarketData map[Ticker]*publishedMarketData
+	// the latest candle of each ticker and interval, none before the first trade of the ticker
+	candles map[Ticker]map[entities.CandleInterval]*entities.Candle
 
 	// uppercase for now for quick injection
 	// TODO: pass these as constructor args ??
@@ -27,47 +76,143 @@ type Exchange struct {
 	// TODO: OrdersRepo and LastsTradesRepo belong to /entities
 	OrdersRepo     OrdersRepository
 	LastTradesRepo LastTradesRepository
+	SequencesRepo  SequencesRepository
+	FeesRepo       FeesRepository
+	CandlesRepo    CandlesRepository
+	// the writes of each order event are committed together
+	TransactionManager TransactionManager
+	// optional, every command is appended to it before it is applied, see Recover
+	Journal Journal
+	// optional, needs a Journal. Recover starts from the latest snapshot instead of the beginning of the journal
+	SnapshotStore SnapshotStore
+	// a snapshot is written in the background every SnapshotEveryCommands journaled commands, never if 0
+	SnapshotEveryCommands int64
+	// the latest trades of each ticker kept in a snapshot and read back by Recover, DefaultRecentTrades if 0
+	// the ones before are only in LastTradesRepo
+	RecentTrades int
+
+	// optional, used by the instruments without their own fee schedule
+	FeeSchedule entities.FeeSchedule
+	// optional
+	OnStopOrderTriggered StopOrderTriggeredListener
+	OnSelfTradePrevented SelfTradePreventedListener
 }
 
 func NewExchange() *Exchange {
+	return NewExchangeWithInstruments(DefaultInstruments)
+}
+
+// one orderbook per instrument
+func NewExchangeWithInstruments(instruments []entities.Instrument) *Exchange {
 	newExchange := &Exchange{}
 	newExchange.usersMap = make(map[string]*entities.User, 0)
-	ethusdOrderbook := entities.NewOrderbook()
-	newExchange.orderbooksMap = map[Ticker]*entities.Orderbook{}
-	newExchange.orderbooksMap[ETHUSD] = ethusdOrderbook
+	newExchange.instruments = make(map[Ticker]entities.Instrument, 0)
+	newExchange.orderbooksMap = make(map[Ticker]*entities.Orderbook, 0)
+	newExchange.triggerBooksMap = make(map[Ticker]*entities.TriggerBook, 0)
+	newExchange.orderIds = entities.NewSequence(0)
+	newExchange.tradeIds = entities.NewSequence(0)
+	newExchange.selfTradesPrevented = make([]SelfTradePrevented, 0)
+	newExchange.feeLedger = make(map[string][]entities.FeeLedgerEntry, 0)
+	newExchange.tradedVolumes = make(map[string]map[Ticker]entities.Decimal, 0)
+	newExchange.commandIds = entities.NewSequence(0)
+	newExchange.marketData = newMarketDataBus()
+	newExchange.publishedMarketData = make(map[Ticker]*publishedMarketData, 0)
+	newExchange.candles = make(map[Ticker]map[entities.CandleInterval]*entities.Candle, 0)
+	for _, instrument := range instruments {
+		newExchange.instruments[Ticker(instrument.Ticker)] = instrument
+		orderbook := entities.NewOrderbookWithSequence(newExchange.tradeIds)
+		orderbook.SetClock(newExchange.clock)
+		newExchange.orderbooksMap[Ticker(instrument.Ticker)] = orderbook
+		newExchange.triggerBooksMap[Ticker(instrument.Ticker)] = entities.NewTriggerBook()
+		newExchange.publishedMarketData[Ticker(instrument.Ticker)] = &publishedMarketData{}
+		newExchange.candles[Ticker(instrument.Ticker)] = make(map[entities.CandleInterval]*entities.Candle, 0)
+	}
 
 	return newExchange
 }
 
+func (ex *Exchange) GetInstrument(ticker string) (entities.Instrument, error) {
+	instrument, ok := ex.instruments[Ticker(ticker)]
+	if !ok {
+		return entities.Instrument{}, &UnknownTickerError{Ticker: ticker}
+	}
+	return instrument, nil
+}
+
+// sorted by ticker
+func (ex *Exchange) GetInstruments() []entities.Instrument {
+	instruments := make([]entities.Instrument, 0)
+	for _, instrument := range ex.instruments {
+		instruments = append(instruments, instrument)
+	}
+	sort.Slice(instruments, func(i, j int) bool {
+		return instruments[i].Ticker < instruments[j].Ticker
+	})
+	return instruments
+}
+
 // there is a lock inside Exchange so the pointer is the receiver
+// copies of the users, matching goes on changing the ones of the exchange
 func (ex *Exchange) GetUsersMap() map[string]entities.User {
-	usersMap := make(map[string]entities.User, 0)
-
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	usersMap := make(map[string]entities.User, len(ex.usersMap))
 	for k, v := range ex.usersMap {
-		usersMap[k] = *v
+		usersMap[k] = v.Copy()
 	}
 	return usersMap
 }
 
+// a copy of the user, false if there is no such user
+func (ex *Exchange) GetUser(userId string) (entities.User, bool) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	user, ok := ex.usersMap[userId]
+	if !ok {
+		return entities.User{}, false
+	}
+	return user.Copy(), true
+}
+
+// the k latest, oldest first
 func (ex *Exchange) GetLastTrades(ticker string, k int) []entities.Trade {
-	length := len(ex.orderbooksMap[Ticker(ticker)].GetLastTrades())
-	if k > length {
-		return ex.orderbooksMap[Ticker(ticker)].GetLastTrades()
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	lastTrades := ex.orderbooksMap[Ticker(ticker)].GetLastTrades()
+	if k > len(lastTrades) {
+		k = len(lastTrades)
 	}
-	return ex.orderbooksMap[Ticker(ticker)].GetLastTrades()[length-k:]
+	trades := make([]entities.Trade, k)
+	copy(trades, lastTrades[len(lastTrades)-k:])
+	return trades
 }
 
+// copies of the limits, see copyLimits
 func (ex *Exchange) GetBestBuys(ticker string, k int) []*entities.Limit {
-	book := ex.orderbooksMap[Ticker(ticker)]
-	return book.GetBestLimits(book.BuyTree, k)
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	return copyLimits(ex.orderbooksMap[Ticker(ticker)].GetBestBuyLimits(k))
 }
 
 func (ex *Exchange) GetBestSells(ticker string, k int) []*entities.Limit {
-	book := ex.orderbooksMap[Ticker(ticker)]
-	return book.GetBestLimits(book.SellTree, k)
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	return copyLimits(ex.orderbooksMap[Ticker(ticker)].GetBestSellLimits(k))
+}
+
+// the limits of the book change with matching, their copies do not
+// MUST be called with ex.mu held
+func copyLimits(limits []*entities.Limit) []*entities.Limit {
+	copies := make([]*entities.Limit, 0, len(limits))
+	for _, limit := range limits {
+		copies = append(copies, limit.Copy())
+	}
+	return copies
 }
 
-func (ex *Exchange) GetLastPrice(ticker string) float64 {
+func (ex *Exchange) GetLastPrice(ticker string) entities.Decimal {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
 	return ex.orderbooksMap[Ticker(ticker)].GetLastTradedPrice()
 }
 
@@ -77,6 +222,8 @@ func (ex *Exchange) ReplayPlaceLimitOrder(o entities.Order) {
 	// TODO: check user's balance
 	ex.mu.Lock()
 	defer ex.mu.Unlock()
+	// the mode of the order is not persisted
+	ex.resolveSelfTradePrevention(&o)
 	ex.orderbooksMap[ticker].PlaceLimitOrder(o)
 
 	userId := o.GetUserId()
@@ -84,165 +231,458 @@ func (ex *Exchange) ReplayPlaceLimitOrder(o entities.Order) {
 	user.OpenOrders[o.GetId()] = o
 }
 
-func (ex *Exchange) PlaceLimitOrderAndPersist(o entities.Order) {
-	ticker := Ticker(o.GetTicker())
-	userId := o.GetUserId()
-	user := ex.usersMap[userId]
-	// TODO: check ticker values is valid ?? asset's name (part of ticker) should be an enum too ??
-	ticker1 := string(ticker[:3])
-	ticker2 := string(ticker[3:])
+// the id of the order is set once it passes the risk checks
+func (ex *Exchange) PlaceLimitOrderAndPersist(o *entities.Order) ([]entities.Trade, error) {
+	ex.mu.Lock()
+	ex.tick()
+	if err := ex.checkRisk(*o); err != nil {
+		ex.mu.Unlock()
+		return nil, err
+	}
+	// a repriced post only order is journaled with its new price
+	if err := ex.checkPostOnly(o); err != nil {
+		ex.mu.Unlock()
+		return nil, err
+	}
+	if err := ex.journal(Command{Type: PlaceOrderCommand, UserId: o.GetUserId(), Ticker: o.GetTicker(), Order: toJournaledOrder(*o)}); err != nil {
+		ex.mu.Unlock()
+		return nil, err
+	}
+	ex.beginTransaction()
+	tradesArray := ex.placeLimitOrder(o)
+	triggeredStopOrders := ex.triggerStopOrders(Ticker(o.GetTicker()))
+	ex.commitTransaction()
+	ex.publishMarketData()
+	selfTradesPrevented := ex.popSelfTradesPrevented()
+	ex.mu.Unlock()
+
+	ex.notifySelfTradesPrevented(selfTradesPrevented)
+	ex.notifyStopOrdersTriggered(triggeredStopOrders)
+	return tradesArray, nil
+}
 
-	// block user balance
-	// TODO: check user's balance
+// the id of the order is set once it passes the risk checks
+func (ex *Exchange) PlaceMarketOrder(o *entities.Order) ([]entities.Trade, error) {
 	ex.mu.Lock()
-	defer ex.mu.Unlock()
-	if o.GetIsBid() {
-		user.Balance[ticker2] -= o.Size * o.GetLimitPrice()
-	} else {
-		user.Balance[ticker1] -= o.Size
+	ex.tick()
+	// balance and volume check, nothing is modified if the order is rejected
+	if err := ex.checkRisk(*o); err != nil {
+		ex.mu.Unlock()
+		return nil, err
 	}
-	user.OpenOrders[o.GetId()] = o
+	if err := ex.journal(Command{Type: PlaceOrderCommand, UserId: o.GetUserId(), Ticker: o.GetTicker(), Order: toJournaledOrder(*o)}); err != nil {
+		ex.mu.Unlock()
+		return nil, err
+	}
+	ex.beginTransaction()
+	tradesArray, err := ex.placeMarketOrder(o)
+	triggeredStopOrders := ex.triggerStopOrders(Ticker(o.GetTicker()))
+	ex.commitTransaction()
+	ex.publishMarketData()
+	selfTradesPrevented := ex.popSelfTradesPrevented()
+	ex.mu.Unlock()
+
+	ex.notifySelfTradesPrevented(selfTradesPrevented)
+	ex.notifyStopOrdersTriggered(triggeredStopOrders)
+	return tradesArray, err
+}
 
-	ex.orderbooksMap[ticker].PlaceLimitOrder(o)
+// the order already passed the checks
+// MUST be called with ex.mu held
+func (ex *Exchange) placeLimitOrder(o *entities.Order) []entities.Trade {
+	o.SetId(ex.orderIds.Next())
+	tradesArray := ex.executeLimitOrder(*o)
+	ex.persistSequences()
+	return tradesArray
+}
+
+// the order already passed the checks
+// MUST be called with ex.mu held
+func (ex *Exchange) placeMarketOrder(o *entities.Order) ([]entities.Trade, error) {
+	o.SetId(ex.orderIds.Next())
+	tradesArray, err := ex.executeMarketOrder(*o)
+	if err != nil {
+		return nil, err
+	}
+	ex.persistSequences()
+	return tradesArray, nil
+}
+
+// lock the funds, match, add what is left to the book and persist. The order already passed the risk checks and has an id
+func (ex *Exchange) executeLimitOrder(o entities.Order) []entities.Trade {
+	ticker := Ticker(o.GetTicker())
+	instrument := ex.instruments[ticker]
+
+	// block user balance
+	user := ex.usersMap[o.GetUserId()]
+	ex.lockFunds(user, instrument, o.GetIsBid(), o.GetLimitPrice(), o.Size)
+
+	// match first, the rest of the order (if any) is added to the book
+	ex.resolveSelfTradePrevention(&o)
+	tradesArray := ex.orderbooksMap[ticker].PlaceLimitOrder(o)
+	ex.executeTrades(ticker, tradesArray)
+	ex.settleSelfTradeCancels(ticker)
+
+	restingOrder, err := ex.orderbooksMap[ticker].GetOrderbyId(o.GetId())
+	if err == nil {
+		user.OpenOrders[o.GetId()] = restingOrder
+	}
+	ex.releaseCancelledRest(user, instrument, o, tradesArray)
 
 	// TODO: persist should be async
-	// go ex.persistAfterLimitOrder(o)
-	ex.persistAfterLimitOrder(o)
+	// go ex.persistAfterLimitOrder(o, tradesArray)
+	ex.persistAfterLimitOrder(o, tradesArray)
+
+	return tradesArray
 }
 
-func (ex *Exchange) PlaceMarketOrder(o entities.Order) []entities.Trade {
-	// TODO: volume check
+// match and persist. The order already passed the risk checks and has an id
+func (ex *Exchange) executeMarketOrder(o entities.Order) ([]entities.Trade, error) {
 	ticker := Ticker(o.GetTicker())
-	ticker1 := string(ticker[:3])
-	ticker2 := string(ticker[3:])
 
-	ex.mu.Lock()
-	defer ex.mu.Unlock()
 	// match
-	// TODO: PlaceMarketOrder() should not modify the orderbook.
-	// Market Buyer/Seller might not have sufficient balance and there is no way to check it before calling PlaceMarketOrder
-
-	// TODO: bubble up the error
+	ex.resolveSelfTradePrevention(&o)
 	tradesArray, err := ex.orderbooksMap[ticker].PlaceMarketOrder(o)
 	if err != nil {
-		var noLiquidError *entities.NoLiquidityError
-		switch {
-		case errors.As(err, &noLiquidError):
-			logrus.Error(noLiquidError.Error())
-		default:
-			logrus.Errorf("Unexpected error placing market order id: %d, error: %s \n", o.GetId(), err)
-		}
-		return nil
+		logrus.Errorf("Unexpected error placing market order id: %d, error: %s \n", o.GetId(), err)
+		return nil, err
 	}
 
-	//execute
-	for _, trade := range tradesArray {
-		buyer := ex.usersMap[trade.GetBuyer().GetUserId()]
-		seller := ex.usersMap[trade.GetSeller().GetUserId()]
+	ex.executeTrades(ticker, tradesArray)
+	// nothing was locked for what self-trade prevention cancelled of the market order
+	ex.settleSelfTradeCancels(ticker)
 
-		buyer.Balance[ticker1] += trade.GetSize()
-		if trade.GetBuyer().GetOrderType() == entities.MarketOrderType {
-			// taker is buyer
-			buyer.Balance[ticker2] -= trade.GetSize() * trade.GetPrice()
-			delete(seller.OpenOrders, trade.GetSeller().GetId())
-		}
+	// TODO: persist should be async
+	// go ex.persistTrades(tradesArray)
+	ex.persistTrades(tradesArray)
+
+	return tradesArray, nil
+}
 
-		if trade.GetSeller().GetOrderType() == entities.MarketOrderType {
+// release the funds of what the limit order o neither traded nor left in the book:
+// IOC/FOK leftovers, or what self-trade prevention cancelled
+func (ex *Exchange) releaseCancelledRest(user *entities.User, instrument entities.Instrument, o entities.Order, tradesArray []entities.Trade) {
+	cancelled := o.Size
+	for _, trade := range tradesArray {
+		cancelled = cancelled.Sub(trade.GetSize())
+	}
+	if restingOrder, err := ex.orderbooksMap[Ticker(o.GetTicker())].GetOrderbyId(o.GetId()); err == nil {
+		cancelled = cancelled.Sub(restingOrder.GetSize())
+	}
+	if cancelled.IsPositive() {
+		ex.releaseFunds(user, instrument, o.GetIsBid(), o.GetLimitPrice(), cancelled)
+	}
+}
+
+// settle the balances of both sides of each trade
+// the maker pays with the funds locked when its limit order was placed.
+// the taker pays with its available funds, unless it is a limit order, in which case its funds were locked at its limit price
+// the fees are set on the trades
+func (ex *Exchange) executeTrades(ticker Ticker, tradesArray []entities.Trade) {
+	ticker1 := ex.instruments[ticker].BaseAsset
+	ticker2 := ex.instruments[ticker].QuoteAsset
+
+	for i := range tradesArray {
+		ex.chargeFees(ticker, &tradesArray[i])
+		trade := tradesArray[i]
+		ex.addToCandles(ticker, trade)
+		buyOrder := trade.GetBuyer()
+		sellOrder := trade.GetSeller()
+		buyer := ex.usersMap[buyOrder.GetUserId()]
+		seller := ex.usersMap[sellOrder.GetUserId()]
+		cost := trade.GetSize().Mul(trade.GetPrice())
+
+		if trade.GetIsBuyerMaker() {
 			// taker is seller
-			seller.Balance[ticker1] -= trade.GetSize()
-			delete(buyer.OpenOrders, trade.GetBuyer().GetId())
+			buyer.DebitLocked(ticker2, cost)
+			if sellOrder.GetOrderType() == entities.MarketOrderType {
+				seller.Debit(ticker1, trade.GetSize())
+			} else {
+				seller.DebitLocked(ticker1, trade.GetSize())
+			}
+			ex.refreshOpenOrder(buyer, ticker, buyOrder.GetId())
+		} else {
+			// taker is buyer
+			seller.DebitLocked(ticker1, trade.GetSize())
+			if buyOrder.GetOrderType() == entities.MarketOrderType {
+				buyer.Debit(ticker2, cost)
+			} else {
+				buyer.DebitLocked(ticker2, cost)
+				// the buyer locked size * limitPrice but might get a better price
+				buyer.Unlock(ticker2, trade.GetSize().Mul(buyOrder.GetLimitPrice()).Sub(cost))
+			}
+			ex.refreshOpenOrder(seller, ticker, sellOrder.GetId())
 		}
 		// TODO: john's limit order might be filled (here) at the same time as he is placing a new limit order
 		// -> concurrent write
-		seller.Balance[ticker2] += trade.GetSize() * trade.GetPrice()
+		buyer.Credit(ticker1, trade.GetSize().Sub(trade.GetBuyerFee()))
+		seller.Credit(ticker2, cost.Sub(trade.GetSellerFee()))
 		logrus.WithFields(logrus.Fields{
 			"trade": trade,
 		}).Info("Order Executed")
 	}
+}
 
-	// TODO: persist should be async
-	// go ex.persistAfterMarketOrder(tradesArray)
-	ex.persistAfterMarketOrder(tradesArray)
-
-	return tradesArray
+// keep the user's copy of a resting order in sync with the book: partially filled or gone
+func (ex *Exchange) refreshOpenOrder(user *entities.User, ticker Ticker, orderId int64) {
+	order, err := ex.orderbooksMap[ticker].GetOrderbyId(orderId)
+	if err != nil {
+		delete(user.OpenOrders, orderId)
+	} else {
+		user.OpenOrders[orderId] = order
+	}
 }
 
-func (ex *Exchange) RegisterUser(userId string) {
-	// TODO: should have an array of tickers, iterate it and set their balances to zeros
-	newUser := entities.NewUser(userId, make(map[string]float64))
-	newUser.Balance[string(ETHUSD)[:3]] = 0
-	newUser.Balance[string(ETHUSD)[3:]] = 0
-	ex.usersMap[userId] = newUser
+func (ex *Exchange) RegisterUser(userId string) error {
+	return ex.RegisterUserWithBalance(userId, nil)
+}
 
-	//persist the creation
-	ex.UsersRepo.Create(*newUser)
+func (ex *Exchange) RegisterUserWithBalance(userId string, balance map[string]entities.Decimal) error {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	ex.tick()
+	if err := ex.journal(Command{Type: RegisterUserCommand, UserId: userId, Balance: balance}); err != nil {
+		return err
+	}
+	ex.registerUser(userId, balance)
+	return nil
 }
 
-func (ex *Exchange) RegisterUserWithBalance(userId string, balance map[string]float64) {
-	// TODO: should have an array of tickers, iterate it and set their balances to zeros
-	newUser := entities.NewUser(userId, balance)
+// MUST be called with ex.mu held
+func (ex *Exchange) registerUser(userId string, balance map[string]entities.Decimal) {
+	newUser := entities.NewUser(userId, make(map[string]entities.Balance))
+	for _, instrument := range ex.instruments {
+		newUser.Balance[instrument.BaseAsset] = entities.Balance{}
+		newUser.Balance[instrument.QuoteAsset] = entities.Balance{}
+	}
+	for asset, amount := range balance {
+		newUser.Credit(asset, amount)
+	}
 	ex.usersMap[userId] = newUser
 
 	//persist the creation
 	ex.UsersRepo.Create(*newUser)
 }
 
-func (ex *Exchange) GetBook(ticker string) ([]*entities.Limit, float64, []*entities.Limit, float64) {
-	buybook := entities.TreeToArray(ex.orderbooksMap[Ticker(ticker)].BuyTree)
+func (ex *Exchange) GetBook(ticker string) ([]*entities.Limit, entities.Decimal, []*entities.Limit, entities.Decimal) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	buybook := copyLimits(ex.orderbooksMap[Ticker(ticker)].GetBuyLimits())
 	buyVolume := ex.orderbooksMap[Ticker(ticker)].GetTotalVolumeAllBuys()
-	sellbook := entities.TreeToArray(ex.orderbooksMap[Ticker(ticker)].SellTree)
+	sellbook := copyLimits(ex.orderbooksMap[Ticker(ticker)].GetSellLimits())
 	sellVolume := ex.orderbooksMap[Ticker(ticker)].GetTotalVolumeAllSells()
 	return buybook, buyVolume, sellbook, sellVolume
 }
 
-func (ex *Exchange) GetBestBuy(ticker string) float64 {
-	if ex.orderbooksMap[Ticker(ticker)].HighestBuy == nil {
+func (ex *Exchange) GetBestBuy(ticker string) entities.Decimal {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	if ex.orderbooksMap[Ticker(ticker)].GetHighestBuy() == nil {
 		// TODO: return error instead
-		return 0
+		return entities.ZeroDecimal
 	}
-	return ex.orderbooksMap[Ticker(ticker)].HighestBuy.GetLimitPrice()
+	return ex.orderbooksMap[Ticker(ticker)].GetHighestBuy().GetLimitPrice()
 }
 
-func (ex *Exchange) GetBestSell(ticker string) float64 {
-	if ex.orderbooksMap[Ticker(ticker)].LowestSell == nil {
+func (ex *Exchange) GetBestSell(ticker string) entities.Decimal {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	if ex.orderbooksMap[Ticker(ticker)].GetLowestSell() == nil {
 		// TODO: return error instead
-		return 0
+		return entities.ZeroDecimal
 	}
-	return ex.orderbooksMap[Ticker(ticker)].LowestSell.GetLimitPrice()
+	return ex.orderbooksMap[Ticker(ticker)].GetLowestSell().GetLimitPrice()
 }
 
+// add to the available balance of the user
+func (ex *Exchange) Deposit(userId string, asset string, amount entities.Decimal) error {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	ex.tick()
+	if _, ok := ex.usersMap[userId]; !ok {
+		return newOrderRejectedError(UnknownUserReason, "userId %s does not exist", userId)
+	}
+	if !ex.isKnownAsset(asset) {
+		return newOrderRejectedError(InvalidDepositReason, "asset %s is not traded on the exchange", asset)
+	}
+	if !amount.IsPositive() {
+		return newOrderRejectedError(InvalidDepositReason, "amount must be positive, got %s", amount)
+	}
+	if err := ex.journal(Command{Type: DepositCommand, UserId: userId, Asset: asset, Amount: amount}); err != nil {
+		return err
+	}
+	ex.deposit(userId, asset, amount)
+	return nil
+}
+
+// MUST be called with ex.mu held
+func (ex *Exchange) deposit(userId string, asset string, amount entities.Decimal) {
+	user := ex.usersMap[userId]
+	user.Credit(asset, amount)
+	ex.UsersRepo.Update(*user)
+}
+
+func (ex *Exchange) isKnownAsset(asset string) bool {
+	for _, instrument := range ex.instruments {
+		if instrument.BaseAsset == asset || instrument.QuoteAsset == asset {
+			return true
+		}
+	}
+	return false
+}
+
+// returns nil if the order is not in the book, or if the cancel could not be journaled
 func (ex *Exchange) CancelOrder(orderId int64, ticker string) *entities.User {
-	orderbook := ex.orderbooksMap[Ticker(ticker)]
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	ex.tick()
+	orderbook, ok := ex.orderbooksMap[Ticker(ticker)]
+	if !ok {
+		return nil
+	}
+	if _, err := ex.triggerBooksMap[Ticker(ticker)].GetOrderbyId(orderId); err != nil {
+		if _, err := orderbook.GetOrderbyId(orderId); err != nil {
+			return nil
+		}
+	}
+	if err := ex.journal(Command{Type: CancelOrderCommand, Ticker: ticker, OrderId: orderId}); err != nil {
+		return nil
+	}
+	ex.beginTransaction()
+	defer ex.publishMarketData()
+	defer ex.commitTransaction()
+	return ex.cancelOrder(orderId, Ticker(ticker))
+}
+
+// the order is in the book or in the trigger book of ticker
+// MUST be called with ex.mu held
+func (ex *Exchange) cancelOrder(orderId int64, ticker Ticker) *entities.User {
+	orderbook := ex.orderbooksMap[ticker]
+	// stop orders did not lock anything
+	if stopOrder, ok := ex.triggerBooksMap[ticker].CancelOrder(orderId); ok {
+		user := ex.usersMap[stopOrder.GetUserId()]
+		delete(user.OpenOrders, orderId)
+		ex.OrdersRepo.Delete(stopOrder)
+		return user
+	}
+	order, err := orderbook.GetOrderbyId(orderId)
+	if err != nil {
+		return nil
+	}
 	userId, isBid, price, size := orderbook.CancelOrder(orderId)
 	user := ex.usersMap[userId]
 
-	ticker1 := string(ticker[:3])
-	ticker2 := string(ticker[3:])
+	// release what the order was still holding
+	ex.releaseFunds(user, ex.instruments[ticker], isBid, price, size)
+	delete(user.OpenOrders, orderId)
+
+	ex.UsersRepo.Update(*user)
+	ex.OrdersRepo.Delete(order)
+
+	return user
+}
+
+// lock what a buy (size * price of quote asset) or a sell (size of base asset) needs
+func (ex *Exchange) lockFunds(user *entities.User, instrument entities.Instrument, isBid bool, price entities.Decimal, size entities.Decimal) {
 	if isBid {
-		user.Balance[ticker2] += size * price
+		user.Lock(instrument.QuoteAsset, size.Mul(price))
 	} else {
-		user.Balance[ticker1] += size
+		user.Lock(instrument.BaseAsset, size)
 	}
-	delete(user.OpenOrders, orderId)
+}
 
-	return user
+// unlock what a buy (size * price of quote asset) or a sell (size of base asset) was holding
+func (ex *Exchange) releaseFunds(user *entities.User, instrument entities.Instrument, isBid bool, price entities.Decimal, size entities.Decimal) {
+	if isBid {
+		user.Unlock(instrument.QuoteAsset, size.Mul(price))
+	} else {
+		user.Unlock(instrument.BaseAsset, size)
+	}
 }
 
-func (ex *Exchange) persistAfterLimitOrder(order entities.Order) {
+// remove the GTD orders that expired at or before now from every orderbook and release their funds
+// returns the users whose orders expired
+func (ex *Exchange) ExpireOrders(now int64) []entities.User {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	ex.now = now
+	// called every second, only journaled when there is something to expire
+	hasExpiredOrders := false
+	for _, orderbook := range ex.orderbooksMap {
+		hasExpiredOrders = hasExpiredOrders || orderbook.HasExpiredOrders(now)
+	}
+	if !hasExpiredOrders {
+		return make([]entities.User, 0)
+	}
+	if err := ex.journal(Command{Type: ExpireOrdersCommand}); err != nil {
+		return make([]entities.User, 0)
+	}
+	ex.beginTransaction()
+	defer ex.publishMarketData()
+	defer ex.commitTransaction()
+	return ex.expireOrders(now)
+}
+
+// MUST be called with ex.mu held
+func (ex *Exchange) expireOrders(now int64) []entities.User {
+	tickers := make([]Ticker, 0)
+	for ticker := range ex.orderbooksMap {
+		tickers = append(tickers, ticker)
+	}
+	sort.Slice(tickers, func(i, j int) bool {
+		return tickers[i] < tickers[j]
+	})
+
+	affectedUsers := make(map[string]*entities.User, 0)
+	for _, ticker := range tickers {
+		for _, order := range ex.orderbooksMap[ticker].ExpireOrders(now) {
+			user := ex.usersMap[order.GetUserId()]
+			ex.releaseFunds(user, ex.instruments[ticker], order.GetIsBid(), order.GetLimitPrice(), order.GetSize())
+			delete(user.OpenOrders, order.GetId())
+			ex.OrdersRepo.Delete(order)
+			affectedUsers[user.GetUserId()] = user
+			logrus.WithFields(logrus.Fields{
+				"order": order,
+			}).Info("Order Expired")
+		}
+	}
+
+	usersList := make([]entities.User, 0)
+	for _, user := range affectedUsers {
+		ex.UsersRepo.Update(*user)
+		usersList = append(usersList, *user)
+	}
+	return usersList
+}
+
+func (ex *Exchange) persistAfterLimitOrder(order entities.Order, tradesArray []entities.Trade) {
+	ex.persistTrades(tradesArray)
 	// persist users balance
-	ex.UsersRepo.Update(ex.GetUsersMap()[order.GetUserId()])
-	// PlaceLimitOrder only adds for now so persist the creation
-	ex.OrdersRepo.Create(order)
+	ex.persistUser(order.GetUserId())
+	// persist the creation of what is left of the order in the book
+	restingOrder, err := ex.orderbooksMap[Ticker(order.GetTicker())].GetOrderbyId(order.GetId())
+	if err == nil {
+		ex.OrdersRepo.Create(restingOrder)
+	}
+}
+
+// MUST be called with ex.mu held
+func (ex *Exchange) persistUser(userId string) {
+	if user, ok := ex.usersMap[userId]; ok {
+		ex.UsersRepo.Update(*user)
+	}
 }
 
-func (ex *Exchange) persistAfterMarketOrder(tradesArray []entities.Trade) {
+func (ex *Exchange) persistTrades(tradesArray []entities.Trade) {
 	for _, trade := range tradesArray {
 		buyer := trade.GetBuyer()
 		seller := trade.GetSeller()
 
+		ex.LastTradesRepo.Create(trade)
 		// persist users balance
-		ex.UsersRepo.Update(ex.GetUsersMap()[buyer.GetUserId()])
-		ex.UsersRepo.Update(ex.GetUsersMap()[seller.GetUserId()])
+		ex.persistUser(buyer.GetUserId())
+		ex.persistUser(seller.GetUserId())
+		ex.persistUser(FeeAccountId)
 
 		ticker := Ticker(trade.GetBuyer().GetTicker())
 		// order does not exist == deleted => persist the deletion else persist current state
@@ -260,10 +700,64 @@ func (ex *Exchange) persistAfterMarketOrder(tradesArray []entities.Trade) {
 			ex.OrdersRepo.Update(trade.GetSeller())
 		}
 	}
+	if len(tradesArray) > 0 {
+		ex.persistCandles(Ticker(tradesArray[0].GetTicker()))
+	}
+}
+
+// see tick
+func (ex *Exchange) clock() int64 {
+	return ex.now
+}
+
+func (ex *Exchange) persistSequences() {
+	ex.SequencesRepo.Update(ordersSequence, ex.orderIds.Last())
+	ex.SequencesRepo.Update(tradesSequence, ex.tradeIds.Last())
+}
+
+// balances, orders, trades and fees of an order event are written together, a crash in between leaves the database as it was
+// MUST be called with ex.mu held, followed by commitTransaction
+func (ex *Exchange) beginTransaction() {
+	if err := ex.TransactionManager.Begin(); err != nil {
+		logrus.Errorf("Unable to begin transaction, writing without it: %s", err)
+	}
 }
 
+// the state in memory is kept even if nothing could be written, it is what the exchange goes on with
+// MUST be called with ex.mu held
+func (ex *Exchange) commitTransaction() {
+	if err := ex.TransactionManager.Commit(); err != nil {
+		logrus.Errorf("Unable to commit transaction, the database is behind: %s", err)
+	}
+}
+
+// with a journal that is not empty, the latest snapshot is loaded and the commands after it are applied again, see replayJournal
+// otherwise the state is read back from the repositories
 // TODO: test for this
 func (ex *Exchange) Recover() {
+	if ex.Journal != nil {
+		commands, err := ex.Journal.ReadAll()
+		if err != nil {
+			panic(fmt.Sprintf("Unable to read the journal: %s", err))
+		}
+		if len(commands) > 0 {
+			ex.mu.Lock()
+			snapshotSequence := ex.loadLatestSnapshot()
+			tail := commands
+			for len(tail) > 0 && tail[0].Sequence <= snapshotSequence {
+				tail = tail[1:]
+			}
+			// the commands before would be missing .e.g. a journal opened over a database without its baseline snapshot
+			if len(tail) > 0 && tail[0].Sequence != snapshotSequence+1 {
+				ex.mu.Unlock()
+				panic(fmt.Sprintf("The journal goes on from command %d but the state before it is in no snapshot", tail[0].Sequence))
+			}
+			ex.replayJournal(tail)
+			ex.mu.Unlock()
+			logrus.Infof("Exchange state replayed from %d journaled commands after snapshot %d", len(tail), snapshotSequence)
+			return
+		}
+	}
 	// TODO: right now this Users MUST be recovered first. Remove MUST
 	usersList := ex.UsersRepo.ReadAll()
 	for _, user := range usersList {
@@ -272,28 +766,51 @@ func (ex *Exchange) Recover() {
 	}
 
 	buyOrders := ex.OrdersRepo.ReadAll("buy")
-	for _, order := range buyOrders {
-		ex.ReplayPlaceLimitOrder(order)
-	}
 	sellOrders := ex.OrdersRepo.ReadAll("sell")
-	for _, order := range sellOrders {
+	restingOrders := append(buyOrders, sellOrders...)
+	// replayed oldest first so each price level gets its time priority back, an amended order might have lost its place
+	sort.SliceStable(restingOrders, func(i, j int) bool {
+		return restingOrders[i].GetTimeStamp() < restingOrders[j].GetTimeStamp()
+	})
+	for _, order := range restingOrders {
+		ex.orderIds.AdvanceTo(order.GetId())
+		if _, ok := ex.orderbooksMap[Ticker(order.GetTicker())]; !ok {
+			logrus.Warnf("Skipping order %d of unknown ticker %s", order.GetId(), order.GetTicker())
+			continue
+		}
 		ex.ReplayPlaceLimitOrder(order)
 	}
 
-	lastTradesList := ex.LastTradesRepo.ReadAll()
-	// TODO: OrdersRepo and LastsTradesRepo belong to /entities
-	for _, trade := range lastTradesList {
-		ex.orderbooksMap["ETHUSD"].AddLastTrade(trade)
+	for _, order := range ex.OrdersRepo.ReadAll("stop") {
+		ex.orderIds.AdvanceTo(order.GetId())
+		triggerBook, ok := ex.triggerBooksMap[Ticker(order.GetTicker())]
+		if !ok {
+			logrus.Warnf("Skipping stop order %d of unknown ticker %s", order.GetId(), order.GetTicker())
+			continue
+		}
+		triggerBook.AddOrder(order)
+		ex.usersMap[order.GetUserId()].OpenOrders[order.GetId()] = order
 	}
-	logrus.Info("Orderbook state recovered from shutdown")
-}
 
-// TODO: very inefficient ??
-func (ex *Exchange) RetrieveOpenOrdersForUsers(userId string) map[int64]entities.Order {
-
-	user, ok := ex.usersMap[userId]
-	if !ok {
-		return nil
+	// TODO: OrdersRepo and LastsTradesRepo belong to /entities
+	for ticker, orderbook := range ex.orderbooksMap {
+		recentTrades := ex.LastTradesRepo.ReadForTicker(string(ticker), TradeHistoryQuery{Limit: ex.recentTrades()})
+		// newest first
+		for i := len(recentTrades) - 1; i >= 0; i-- {
+			ex.tradeIds.AdvanceTo(recentTrades[i].GetId())
+			orderbook.AddLastTrade(recentTrades[i])
+		}
 	}
-	return user.OpenOrders
+	// only the last 30 days count toward the fee tiers
+	for _, entry := range ex.FeesRepo.ReadSince(time.Now().UnixNano() - entities.FeeVolumeWindow) {
+		ex.addToFeeLedger(entry)
+	}
+	// filled and cancelled orders are not in the database anymore, the sequences remember their ids
+	ex.orderIds.AdvanceTo(ex.SequencesRepo.Read(ordersSequence))
+	ex.tradeIds.AdvanceTo(ex.SequencesRepo.Read(tradesSequence))
+	ex.mu.Lock()
+	ex.loadCandles()
+	ex.saveBaselineSnapshot()
+	ex.mu.Unlock()
+	logrus.Info("Orderbook state recovered from shutdown")
 }
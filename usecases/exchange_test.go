@@ -1,9 +1,14 @@
 package usecases_test
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -15,6 +20,11 @@ import (
 
 var ex *usecases.Exchange
 
+// shorthand for the literals in the tests
+func dec(f float64) entities.Decimal {
+	return entities.NewDecimalFromFloat(f)
+}
+
 func deleteDb(filePath string) {
 	if _, err := os.Stat(filePath); err == nil {
 		err := os.Remove(filePath)
@@ -44,7 +54,16 @@ func setup() (string, controllers.SqlDbHandler) {
 	ex.OrdersRepo = ordersRepoImpl
 	usersRepoImpl := controllers.NewUsersRepoImpl(dbHandler)
 	ex.UsersRepo = usersRepoImpl
+	sequencesRepoImpl := controllers.NewSequencesRepoImpl(dbHandler)
+	ex.SequencesRepo = sequencesRepoImpl
+	ex.LastTradesRepo = controllers.NewLastTradesRepoImpl(dbHandler)
+	ex.FeesRepo = controllers.NewFeesRepoImpl(dbHandler)
+	ex.CandlesRepo = controllers.NewCandlesRepoImpl(dbHandler)
+	ex.TransactionManager = dbHandler
 	logrus.SetOutput(io.Discard)
+	if err := controllers.Migrate(dbHandler); err != nil {
+		panic(err)
+	}
 
 	return filePath, dbHandler
 }
@@ -67,155 +86,1558 @@ func TestPlaceLimitOrderExchange(t *testing.T) {
 	defer setupTest()()
 
 	ex.RegisterUserWithBalance("john",
-		map[string]float64{
-			"ETH": 2000.0,
-			"USD": 2000.0,
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
 		})
 	ex.RegisterUserWithBalance("jim",
-		map[string]float64{
-			"ETH": 2000.0,
-			"USD": 2000.0,
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
 		})
 	ex.RegisterUserWithBalance("jane",
-		map[string]float64{
-			"ETH": 2000.0,
-			"USD": 2000.0,
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
 		})
 	ex.RegisterUserWithBalance("jun",
-		map[string]float64{
-			"ETH": 2000.0,
-			"USD": 2000.0,
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
 		})
 	ex.RegisterUserWithBalance("jack",
-		map[string]float64{
-			"ETH": 2000.0,
-			"USD": 2000.0,
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
 		})
 	ex.RegisterUserWithBalance("lily",
-		map[string]float64{
-			"ETH": 2000.0,
-			"USD": 2000.0,
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
 		})
 
 	// 1000(*)
-	incomingOrder := entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, 1, 100)
-	ex.PlaceLimitOrderAndPersist(*incomingOrder)
+	incomingOrder := entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(100))
+	ex.PlaceLimitOrderAndPersist(incomingOrder)
 
 	// 900 < 1000(*)
-	incomingOrder = entities.NewOrder("jim", "ETHUSD", false, entities.LimitOrderType, 1, 90)
-	ex.PlaceLimitOrderAndPersist(*incomingOrder)
+	incomingOrder = entities.NewOrder("jim", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(90))
+	ex.PlaceLimitOrderAndPersist(incomingOrder)
 
 	// 900 < 1000(*) < 1100
-	incomingOrder = entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, 4, 110)
-	ex.PlaceLimitOrderAndPersist(*incomingOrder)
+	incomingOrder = entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, dec(4), dec(110))
+	ex.PlaceLimitOrderAndPersist(incomingOrder)
 
 	// 900 < 1000(*) < 1005 < 1100
-	incomingOrder = entities.NewOrder("jun", "ETHUSD", false, entities.LimitOrderType, 9, 105)
-	ex.PlaceLimitOrderAndPersist(*incomingOrder)
+	incomingOrder = entities.NewOrder("jun", "ETHUSD", false, entities.LimitOrderType, dec(9), dec(105))
+	ex.PlaceLimitOrderAndPersist(incomingOrder)
 
 	// 900 < 1000(*) < 1005[2] < 1100
-	incomingOrder = entities.NewOrder("jack", "ETHUSD", false, entities.LimitOrderType, 9, 105)
-	ex.PlaceLimitOrderAndPersist(*incomingOrder)
+	incomingOrder = entities.NewOrder("jack", "ETHUSD", false, entities.LimitOrderType, dec(9), dec(105))
+	ex.PlaceLimitOrderAndPersist(incomingOrder)
 
-	incomingOrder = entities.NewOrder("lily", "ETHUSD", true, entities.MarketOrderType, 1, 0)
-	ex.PlaceMarketOrder(*incomingOrder)
+	incomingOrder = entities.NewOrder("lily", "ETHUSD", true, entities.MarketOrderType, dec(1), dec(0))
+	ex.PlaceMarketOrder(incomingOrder)
 
-	assert.Equal(t, ex.GetUsersMap()["john"].Balance["ETH"], 1999.0)
-	assert.Equal(t, ex.GetUsersMap()["john"].Balance["USD"], 2000.0)
+	assert.Equal(t, ex.GetUsersMap()["john"].GetAvailable("ETH"), dec(1999.0))
+	assert.Equal(t, ex.GetUsersMap()["john"].GetAvailable("USD"), dec(2000.0))
 
-	assert.Equal(t, ex.GetUsersMap()["jim"].Balance["ETH"], 1999.0)
-	assert.Equal(t, ex.GetUsersMap()["jim"].Balance["USD"], 2090.0)
+	assert.Equal(t, ex.GetUsersMap()["jim"].GetAvailable("ETH"), dec(1999.0))
+	assert.Equal(t, ex.GetUsersMap()["jim"].GetAvailable("USD"), dec(2090.0))
 
-	assert.Equal(t, ex.GetUsersMap()["jane"].Balance["ETH"], 1996.0)
-	assert.Equal(t, ex.GetUsersMap()["jane"].Balance["USD"], 2000.0)
+	assert.Equal(t, ex.GetUsersMap()["jane"].GetAvailable("ETH"), dec(1996.0))
+	assert.Equal(t, ex.GetUsersMap()["jane"].GetAvailable("USD"), dec(2000.0))
 
-	assert.Equal(t, ex.GetUsersMap()["jun"].Balance["ETH"], 1991.0)
-	assert.Equal(t, ex.GetUsersMap()["jun"].Balance["USD"], 2000.0)
+	assert.Equal(t, ex.GetUsersMap()["jun"].GetAvailable("ETH"), dec(1991.0))
+	assert.Equal(t, ex.GetUsersMap()["jun"].GetAvailable("USD"), dec(2000.0))
 
-	assert.Equal(t, ex.GetUsersMap()["jack"].Balance["ETH"], 1991.0)
-	assert.Equal(t, ex.GetUsersMap()["jack"].Balance["USD"], 2000.0)
+	assert.Equal(t, ex.GetUsersMap()["jack"].GetAvailable("ETH"), dec(1991.0))
+	assert.Equal(t, ex.GetUsersMap()["jack"].GetAvailable("USD"), dec(2000.0))
 
 	// TODO: assert.Equal should not hide the line with the error
-	assert.Equal(t, ex.GetUsersMap()["lily"].Balance["ETH"], 2001.0)
-	assert.Equal(t, ex.GetUsersMap()["lily"].Balance["USD"], 1910.0)
+	assert.Equal(t, ex.GetUsersMap()["lily"].GetAvailable("ETH"), dec(2001.0))
+	assert.Equal(t, ex.GetUsersMap()["lily"].GetAvailable("USD"), dec(1910.0))
 }
 
 func TestCancelOrderExchange(t *testing.T) {
 	defer setupTest()()
 
 	ex.RegisterUserWithBalance("john",
-		map[string]float64{
-			"ETH": 2000.0,
-			"USD": 2000.0,
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
 		})
 	ex.RegisterUserWithBalance("jim",
-		map[string]float64{
-			"ETH": 2000.0,
-			"USD": 2000.0,
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
 		})
 	ex.RegisterUserWithBalance("jane",
-		map[string]float64{
-			"ETH": 2000.0,
-			"USD": 2000.0,
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
 		})
 	ex.RegisterUserWithBalance("jun",
-		map[string]float64{
-			"ETH": 2000.0,
-			"USD": 2000.0,
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
 		})
 	ex.RegisterUserWithBalance("jack",
-		map[string]float64{
-			"ETH": 2000.0,
-			"USD": 2000.0,
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
 		})
 	ex.RegisterUserWithBalance("lily",
-		map[string]float64{
-			"ETH": 2000.0,
-			"USD": 2000.0,
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
 		})
 
 	// Root: 1000
 	// L--- 900
 	// R--- 1005
 	//     R--- 1100
-	johnOrder := entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, 1, 100)
-	ex.PlaceLimitOrderAndPersist(*johnOrder)
+	johnOrder := entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(100))
+	ex.PlaceLimitOrderAndPersist(johnOrder)
 
-	jimOrder := entities.NewOrder("jim", "ETHUSD", false, entities.LimitOrderType, 1, 90)
-	ex.PlaceLimitOrderAndPersist(*jimOrder)
+	jimOrder := entities.NewOrder("jim", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(90))
+	ex.PlaceLimitOrderAndPersist(jimOrder)
 
-	janeOrder := entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, 4, 110)
-	ex.PlaceLimitOrderAndPersist(*janeOrder)
+	janeOrder := entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, dec(4), dec(110))
+	ex.PlaceLimitOrderAndPersist(janeOrder)
 
-	junOrder := entities.NewOrder("jun", "ETHUSD", false, entities.LimitOrderType, 9, 105)
-	ex.PlaceLimitOrderAndPersist(*junOrder)
+	junOrder := entities.NewOrder("jun", "ETHUSD", false, entities.LimitOrderType, dec(9), dec(105))
+	ex.PlaceLimitOrderAndPersist(junOrder)
 
-	jackOrder := entities.NewOrder("jack", "ETHUSD", false, entities.LimitOrderType, 9, 105)
-	ex.PlaceLimitOrderAndPersist(*jackOrder)
+	jackOrder := entities.NewOrder("jack", "ETHUSD", false, entities.LimitOrderType, dec(9), dec(105))
+	ex.PlaceLimitOrderAndPersist(jackOrder)
 
 	ex.CancelOrder(jimOrder.GetId(), "ETHUSD")
-	assert.Equal(t, 2000.0, ex.GetUsersMap()["jim"].Balance["ETH"])
-	assert.Equal(t, 2000.0, ex.GetUsersMap()["jim"].Balance["USD"])
+	assert.Equal(t, dec(2000.0), ex.GetUsersMap()["jim"].GetAvailable("ETH"))
+	assert.Equal(t, dec(2000.0), ex.GetUsersMap()["jim"].GetAvailable("USD"))
 
-	lilyOrder := entities.NewOrder("lily", "ETHUSD", true, entities.MarketOrderType, 1, 0)
-	ex.PlaceMarketOrder(*lilyOrder)
+	lilyOrder := entities.NewOrder("lily", "ETHUSD", true, entities.MarketOrderType, dec(1), dec(0))
+	ex.PlaceMarketOrder(lilyOrder)
 
-	assert.Equal(t, 1996.0, ex.GetUsersMap()["jane"].Balance["ETH"])
-	assert.Equal(t, 2000.0, ex.GetUsersMap()["jane"].Balance["USD"])
+	assert.Equal(t, dec(1996.0), ex.GetUsersMap()["jane"].GetAvailable("ETH"))
+	assert.Equal(t, dec(2000.0), ex.GetUsersMap()["jane"].GetAvailable("USD"))
 
-	assert.Equal(t, 1991.0, ex.GetUsersMap()["jun"].Balance["ETH"])
-	assert.Equal(t, 2000.0, ex.GetUsersMap()["jun"].Balance["USD"])
+	assert.Equal(t, dec(1991.0), ex.GetUsersMap()["jun"].GetAvailable("ETH"))
+	assert.Equal(t, dec(2000.0), ex.GetUsersMap()["jun"].GetAvailable("USD"))
 
-	assert.Equal(t, 1991.0, ex.GetUsersMap()["jack"].Balance["ETH"])
-	assert.Equal(t, 2000.0, ex.GetUsersMap()["jack"].Balance["USD"])
+	assert.Equal(t, dec(1991.0), ex.GetUsersMap()["jack"].GetAvailable("ETH"))
+	assert.Equal(t, dec(2000.0), ex.GetUsersMap()["jack"].GetAvailable("USD"))
 
 	// jim's balance is restored
-	assert.Equal(t, 2000.0, ex.GetUsersMap()["jim"].Balance["ETH"])
-	assert.Equal(t, 2000.0, ex.GetUsersMap()["jim"].Balance["USD"])
+	assert.Equal(t, dec(2000.0), ex.GetUsersMap()["jim"].GetAvailable("ETH"))
+	assert.Equal(t, dec(2000.0), ex.GetUsersMap()["jim"].GetAvailable("USD"))
 	// john matched with lily
-	assert.Equal(t, 1999.0, ex.GetUsersMap()["john"].Balance["ETH"])
-	assert.Equal(t, 2100.0, ex.GetUsersMap()["john"].Balance["USD"])
+	assert.Equal(t, dec(1999.0), ex.GetUsersMap()["john"].GetAvailable("ETH"))
+	assert.Equal(t, dec(2100.0), ex.GetUsersMap()["john"].GetAvailable("USD"))
+
+	assert.Equal(t, dec(2001.0), ex.GetUsersMap()["lily"].GetAvailable("ETH"))
+	assert.Equal(t, dec(1900.0), ex.GetUsersMap()["lily"].GetAvailable("USD"))
+}
+
+func TestPlaceCrossingLimitOrderExchange(t *testing.T) {
+	defer setupTest()()
+
+	ex.RegisterUserWithBalance("john",
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
+		})
+	ex.RegisterUserWithBalance("jim",
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
+		})
+	ex.RegisterUserWithBalance("lily",
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
+		})
+
+	johnOrder := entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(100))
+	ex.PlaceLimitOrderAndPersist(johnOrder)
+
+	jimOrder := entities.NewOrder("jim", "ETHUSD", false, entities.LimitOrderType, dec(2), dec(90))
+	ex.PlaceLimitOrderAndPersist(jimOrder)
+
+	// lily fills jim's 2 at 90 and john's 1 at 100, the last 1 rests at 110
+	lilyOrder := entities.NewOrder("lily", "ETHUSD", true, entities.LimitOrderType, dec(4), dec(110))
+	trades, err := ex.PlaceLimitOrderAndPersist(lilyOrder)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(trades))
+
+	assert.Equal(t, dec(1998.0), ex.GetUsersMap()["jim"].GetAvailable("ETH"))
+	assert.Equal(t, dec(2180.0), ex.GetUsersMap()["jim"].GetAvailable("USD"))
+	assert.Equal(t, 0, len(ex.GetUsersMap()["jim"].OpenOrders))
+
+	assert.Equal(t, dec(1999.0), ex.GetUsersMap()["john"].GetAvailable("ETH"))
+	assert.Equal(t, dec(2100.0), ex.GetUsersMap()["john"].GetAvailable("USD"))
+	assert.Equal(t, 0, len(ex.GetUsersMap()["john"].OpenOrders))
+
+	// paid 280 for the fills, 110 still blocked by the resting order
+	assert.Equal(t, dec(2003.0), ex.GetUsersMap()["lily"].GetAvailable("ETH"))
+	assert.Equal(t, dec(1610.0), ex.GetUsersMap()["lily"].GetAvailable("USD"))
+	assert.Equal(t, dec(1.0), ex.GetUsersMap()["lily"].OpenOrders[lilyOrder.GetId()].GetSize())
+	assert.Equal(t, dec(110.0), ex.GetBestBuy("ETHUSD"))
+	assert.Equal(t, dec(0.0), ex.GetBestSell("ETHUSD"))
+}
+
+func TestRiskCheckExchange(t *testing.T) {
+	defer setupTest()()
+
+	ex.RegisterUserWithBalance("john",
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
+		})
+	ex.RegisterUserWithBalance("lily",
+		map[string]entities.Decimal{
+			"ETH": dec(1.0),
+			"USD": dec(250.0),
+		})
+
+	johnOrder := entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(100))
+	ex.PlaceLimitOrderAndPersist(johnOrder)
+	johnOrder = entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(2), dec(200))
+	ex.PlaceLimitOrderAndPersist(johnOrder)
+
+	var rejectedErr *usecases.OrderRejectedError
+
+	// 2 * 130 > 250
+	lilyOrder := entities.NewOrder("lily", "ETHUSD", true, entities.LimitOrderType, dec(2), dec(130))
+	_, err := ex.PlaceLimitOrderAndPersist(lilyOrder)
+	if assert.ErrorAs(t, err, &rejectedErr) {
+		assert.Equal(t, usecases.InsufficientBalanceReason, rejectedErr.Reason)
+	}
+
+	lilyOrder = entities.NewOrder("lily", "ETHUSD", false, entities.LimitOrderType, dec(2), dec(130))
+	_, err = ex.PlaceLimitOrderAndPersist(lilyOrder)
+	if assert.ErrorAs(t, err, &rejectedErr) {
+		assert.Equal(t, usecases.InsufficientBalanceReason, rejectedErr.Reason)
+	}
+
+	// worst case is 1 * 100 + 1 * 200 > 250 even though the best ask is 100
+	lilyOrder = entities.NewOrder("lily", "ETHUSD", true, entities.MarketOrderType, dec(2), dec(0))
+	_, err = ex.PlaceMarketOrder(lilyOrder)
+	if assert.ErrorAs(t, err, &rejectedErr) {
+		assert.Equal(t, usecases.InsufficientBalanceReason, rejectedErr.Reason)
+	}
+
+	lilyOrder = entities.NewOrder("lily", "ETHUSD", true, entities.MarketOrderType, dec(4), dec(0))
+	_, err = ex.PlaceMarketOrder(lilyOrder)
+	if assert.ErrorAs(t, err, &rejectedErr) {
+		assert.Equal(t, usecases.NoLiquidityReason, rejectedErr.Reason)
+	}
+
+	// nothing moved
+	assert.Equal(t, dec(1.0), ex.GetUsersMap()["lily"].GetAvailable("ETH"))
+	assert.Equal(t, dec(250.0), ex.GetUsersMap()["lily"].GetAvailable("USD"))
+	assert.Equal(t, dec(1997.0), ex.GetUsersMap()["john"].GetAvailable("ETH"))
+
+	trades, err := ex.PlaceMarketOrder(entities.NewOrder("lily", "ETHUSD", true, entities.MarketOrderType, dec(1), dec(0)))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(trades))
+	assert.Equal(t, dec(150.0), ex.GetUsersMap()["lily"].GetAvailable("USD"))
+}
+
+func TestLockedBalanceExchange(t *testing.T) {
+	defer setupTest()()
+
+	ex.RegisterUserWithBalance("john",
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
+		})
+	ex.RegisterUserWithBalance("lily",
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
+		})
+
+	johnOrder := entities.NewOrder("john", "ETHUSD", true, entities.LimitOrderType, dec(4), dec(100))
+	ex.PlaceLimitOrderAndPersist(johnOrder)
+	assert.Equal(t, dec(1600.0), ex.GetUsersMap()["john"].GetAvailable("USD"))
+	assert.Equal(t, dec(400.0), ex.GetUsersMap()["john"].GetLocked("USD"))
+	assert.Equal(t, dec(2000.0), ex.GetUsersMap()["john"].Balance["USD"].Total())
+
+	// partial fill: john pays 100 out of the locked funds and gets 1 ETH
+	lilyOrder := entities.NewOrder("lily", "ETHUSD", false, entities.MarketOrderType, dec(1), dec(0))
+	_, err := ex.PlaceMarketOrder(lilyOrder)
+	assert.NoError(t, err)
+	assert.Equal(t, dec(1600.0), ex.GetUsersMap()["john"].GetAvailable("USD"))
+	assert.Equal(t, dec(300.0), ex.GetUsersMap()["john"].GetLocked("USD"))
+	assert.Equal(t, dec(2001.0), ex.GetUsersMap()["john"].GetAvailable("ETH"))
+	assert.Equal(t, dec(3.0), ex.GetUsersMap()["john"].OpenOrders[johnOrder.GetId()].GetSize())
+
+	assert.Equal(t, dec(1999.0), ex.GetUsersMap()["lily"].GetAvailable("ETH"))
+	assert.Equal(t, dec(0.0), ex.GetUsersMap()["lily"].GetLocked("ETH"))
+	assert.Equal(t, dec(2100.0), ex.GetUsersMap()["lily"].GetAvailable("USD"))
+
+	// lily's limit sell is locked then taken by john's bid
+	lilyOrder = entities.NewOrder("lily", "ETHUSD", false, entities.LimitOrderType, dec(2), dec(100))
+	ex.PlaceLimitOrderAndPersist(lilyOrder)
+	assert.Equal(t, dec(1997.0), ex.GetUsersMap()["lily"].GetAvailable("ETH"))
+	assert.Equal(t, dec(0.0), ex.GetUsersMap()["lily"].GetLocked("ETH"))
+	assert.Equal(t, dec(100.0), ex.GetUsersMap()["john"].GetLocked("USD"))
+
+	// cancel releases the rest
+	ex.CancelOrder(johnOrder.GetId(), "ETHUSD")
+	assert.Equal(t, dec(1700.0), ex.GetUsersMap()["john"].GetAvailable("USD"))
+	assert.Equal(t, dec(0.0), ex.GetUsersMap()["john"].GetLocked("USD"))
+	assert.Equal(t, dec(2003.0), ex.GetUsersMap()["john"].GetAvailable("ETH"))
+	assert.Equal(t, 0, len(ex.GetUsersMap()["john"].OpenOrders))
+
+	// a copy: matching does not change it, nor does it change the exchange
+	john, ok := ex.GetUser("john")
+	assert.True(t, ok)
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", true, entities.LimitOrderType, dec(1), dec(90)))
+	assert.Equal(t, dec(1700.0), john.GetAvailable("USD"))
+	assert.Equal(t, 0, len(john.OpenOrders))
+	john.Credit("USD", dec(1000))
+	john, _ = ex.GetUser("john")
+	assert.Equal(t, dec(1610.0), john.GetAvailable("USD"))
+	assert.Equal(t, 1, len(john.OpenOrders))
+	_, ok = ex.GetUser("bob")
+	assert.False(t, ok)
+}
+
+func TestMultiMarketExchange(t *testing.T) {
+	filePath, dbHandler := setup()
+	defer teardown(filePath, dbHandler)
+
+	ex = usecases.NewExchangeWithInstruments([]entities.Instrument{
+		{Ticker: "ETHUSD", BaseAsset: "ETH", QuoteAsset: "USD", TickSize: dec(0.01), LotSize: dec(0.001)},
+		{Ticker: "BTCUSDT", BaseAsset: "BTC", QuoteAsset: "USDT", TickSize: dec(0.01), LotSize: dec(0.0001), MinNotional: dec(5)},
+		{Ticker: "USDCUSD", BaseAsset: "USDC", QuoteAsset: "USD", TickSize: dec(0.0001), LotSize: dec(1), MinNotional: dec(1)},
+	})
+	ex.OrdersRepo = controllers.NewOrdersRepoImpl(dbHandler)
+	ex.UsersRepo = controllers.NewUsersRepoImpl(dbHandler)
+	ex.SequencesRepo = controllers.NewSequencesRepoImpl(dbHandler)
+	ex.LastTradesRepo = controllers.NewLastTradesRepoImpl(dbHandler)
+	ex.FeesRepo = controllers.NewFeesRepoImpl(dbHandler)
+	ex.CandlesRepo = controllers.NewCandlesRepoImpl(dbHandler)
+	ex.TransactionManager = dbHandler
+
+	ex.RegisterUserWithBalance("john",
+		map[string]entities.Decimal{
+			"BTC":  dec(1.0),
+			"USDC": dec(100.0),
+		})
+	ex.RegisterUserWithBalance("lily",
+		map[string]entities.Decimal{
+			"USDT": dec(30000.0),
+			"USD":  dec(100.0),
+		})
+	// every asset of every instrument is there
+	assert.Equal(t, dec(0.0), ex.GetUsersMap()["john"].GetAvailable("ETH"))
+	assert.Equal(t, 5, len(ex.GetUsersMap()["john"].Balance))
+
+	_, err := ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "BTCUSDT", false, entities.LimitOrderType, dec(0.5), dec(27000)))
+	assert.NoError(t, err)
+	_, err = ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "USDCUSD", false, entities.LimitOrderType, dec(50), dec(0.9999)))
+	assert.NoError(t, err)
+
+	_, err = ex.PlaceMarketOrder(entities.NewOrder("lily", "BTCUSDT", true, entities.MarketOrderType, dec(0.1), dec(0)))
+	assert.NoError(t, err)
+	_, err = ex.PlaceMarketOrder(entities.NewOrder("lily", "USDCUSD", true, entities.MarketOrderType, dec(10), dec(0)))
+	assert.NoError(t, err)
+
+	assert.Equal(t, dec(0.1), ex.GetUsersMap()["lily"].GetAvailable("BTC"))
+	assert.Equal(t, dec(27300.0), ex.GetUsersMap()["lily"].GetAvailable("USDT"))
+	assert.Equal(t, dec(10.0), ex.GetUsersMap()["lily"].GetAvailable("USDC"))
+	assert.Equal(t, dec(90.001), ex.GetUsersMap()["lily"].GetAvailable("USD"))
+	assert.Equal(t, dec(2700.0), ex.GetUsersMap()["john"].GetAvailable("USDT"))
+	assert.Equal(t, dec(0.4), ex.GetUsersMap()["john"].GetLocked("BTC"))
+	assert.Equal(t, dec(9.999), ex.GetUsersMap()["john"].GetAvailable("USD"))
+	assert.Equal(t, dec(0.0), ex.GetLastPrice("ETHUSD"))
+
+	var rejectedErr *usecases.OrderRejectedError
+	_, err = ex.PlaceLimitOrderAndPersist(entities.NewOrder("lily", "BTCUSDT", true, entities.LimitOrderType, dec(0.1), dec(27000.005)))
+	if assert.ErrorAs(t, err, &rejectedErr) {
+		assert.Equal(t, usecases.InvalidTickSizeReason, rejectedErr.Reason)
+	}
+	_, err = ex.PlaceLimitOrderAndPersist(entities.NewOrder("lily", "BTCUSDT", true, entities.LimitOrderType, dec(0.00015), dec(27000)))
+	if assert.ErrorAs(t, err, &rejectedErr) {
+		assert.Equal(t, usecases.InvalidLotSizeReason, rejectedErr.Reason)
+	}
+	_, err = ex.PlaceLimitOrderAndPersist(entities.NewOrder("lily", "BTCUSDT", true, entities.LimitOrderType, dec(0.0001), dec(100)))
+	if assert.ErrorAs(t, err, &rejectedErr) {
+		assert.Equal(t, usecases.MinNotionalReason, rejectedErr.Reason)
+	}
+
+	var unknownTickerErr *usecases.UnknownTickerError
+	_, err = ex.PlaceMarketOrder(entities.NewOrder("lily", "DOGEUSD", true, entities.MarketOrderType, dec(1), dec(0)))
+	assert.ErrorAs(t, err, &unknownTickerErr)
+	_, err = ex.GetInstrument("DOGEUSD")
+	assert.ErrorAs(t, err, &unknownTickerErr)
+}
+
+func TestOrderAndTradeIdsExchange(t *testing.T) {
+	filePath, dbHandler := setup()
+	defer teardown(filePath, dbHandler)
+
+	ex.RegisterUserWithBalance("john",
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
+		})
+	ex.RegisterUserWithBalance("lily",
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
+		})
+
+	johnOrder := entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(100))
+	ex.PlaceLimitOrderAndPersist(johnOrder)
+	johnOrder2 := entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(110))
+	ex.PlaceLimitOrderAndPersist(johnOrder2)
+	assert.Equal(t, int64(1), johnOrder.GetId())
+	assert.Equal(t, int64(2), johnOrder2.GetId())
+	assert.Contains(t, ex.GetUsersMap()["john"].OpenOrders, int64(1))
+	assert.Contains(t, ex.GetUsersMap()["john"].OpenOrders, int64(2))
+
+	// a rejected order does not get an id
+	rejectedOrder := entities.NewOrder("lily", "ETHUSD", true, entities.LimitOrderType, dec(1000), dec(100))
+	_, err := ex.PlaceLimitOrderAndPersist(rejectedOrder)
+	assert.Error(t, err)
+	assert.Equal(t, int64(0), rejectedOrder.GetId())
+
+	lilyOrder := entities.NewOrder("lily", "ETHUSD", true, entities.MarketOrderType, dec(2), dec(0))
+	trades, err := ex.PlaceMarketOrder(lilyOrder)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), lilyOrder.GetId())
+	assert.Equal(t, int64(1), trades[0].GetId())
+	assert.Equal(t, int64(2), trades[1].GetId())
+
+	// ids keep increasing after a restart even though the orders are gone from the database
+	recovered := usecases.NewExchange()
+	recovered.OrdersRepo = ex.OrdersRepo
+	recovered.UsersRepo = ex.UsersRepo
+	recovered.LastTradesRepo = ex.LastTradesRepo
+	recovered.SequencesRepo = ex.SequencesRepo
+	recovered.FeesRepo = ex.FeesRepo
+	recovered.CandlesRepo = ex.CandlesRepo
+	recovered.TransactionManager = ex.TransactionManager
+	recovered.Recover()
+	recovered.RegisterUserWithBalance("jim",
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
+		})
+	jimOrder := entities.NewOrder("jim", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(100))
+	recovered.PlaceLimitOrderAndPersist(jimOrder)
+	assert.Equal(t, int64(4), jimOrder.GetId())
+	trades, err = recovered.PlaceMarketOrder(entities.NewOrder("jim", "ETHUSD", true, entities.MarketOrderType, dec(1), dec(0)))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), trades[0].GetId())
+}
+
+func TestTimeInForceExchange(t *testing.T) {
+	defer setupTest()()
+
+	ex.RegisterUserWithBalance("john",
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
+		})
+	ex.RegisterUserWithBalance("lily",
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
+		})
+
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(100)))
+
+	// IOC: 1 bought at 100, the 2 others are cancelled and their funds released
+	iocOrder := entities.NewOrder("lily", "ETHUSD", true, entities.LimitOrderType, dec(3), dec(110))
+	iocOrder.SetTimeInForce(entities.ImmediateOrCancel, 0)
+	trades, err := ex.PlaceLimitOrderAndPersist(iocOrder)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(trades))
+	assert.Equal(t, dec(1900), ex.GetUsersMap()["lily"].GetAvailable("USD"))
+	assert.Equal(t, dec(0), ex.GetUsersMap()["lily"].GetLocked("USD"))
+	assert.Equal(t, 0, len(ex.GetUsersMap()["lily"].OpenOrders))
+
+	// FOK: the book is empty, killed
+	fokOrder := entities.NewOrder("lily", "ETHUSD", true, entities.LimitOrderType, dec(1), dec(110))
+	fokOrder.SetTimeInForce(entities.FillOrKill, 0)
+	trades, err = ex.PlaceLimitOrderAndPersist(fokOrder)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(trades))
+	assert.Equal(t, dec(1900), ex.GetUsersMap()["lily"].GetAvailable("USD"))
+	assert.Equal(t, dec(0), ex.GetUsersMap()["lily"].GetLocked("USD"))
+
+	// GTD: rests until it expires
+	expiresAt := time.Now().Add(time.Hour).UnixNano()
+	gtdOrder := entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(2), dec(120))
+	gtdOrder.SetTimeInForce(entities.GoodTillDate, expiresAt)
+	_, err = ex.PlaceLimitOrderAndPersist(gtdOrder)
+	assert.NoError(t, err)
+	assert.Equal(t, dec(2), ex.GetUsersMap()["john"].GetLocked("ETH"))
+	assert.Equal(t, 0, len(ex.ExpireOrders(expiresAt-1)))
+	expiredUsers := ex.ExpireOrders(expiresAt)
+	assert.Equal(t, 1, len(expiredUsers))
+	assert.Equal(t, "john", expiredUsers[0].GetUserId())
+	assert.Equal(t, dec(0), ex.GetUsersMap()["john"].GetLocked("ETH"))
+	assert.Equal(t, dec(1999), ex.GetUsersMap()["john"].GetAvailable("ETH"))
+	assert.Equal(t, 0, len(ex.GetUsersMap()["john"].OpenOrders))
+	assert.Empty(t, ex.GetBestSells("ETHUSD", 1))
+
+	var rejectedErr *usecases.OrderRejectedError
+	pastGtdOrder := entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(120))
+	pastGtdOrder.SetTimeInForce(entities.GoodTillDate, time.Now().Add(-time.Second).UnixNano())
+	_, err = ex.PlaceLimitOrderAndPersist(pastGtdOrder)
+	if assert.ErrorAs(t, err, &rejectedErr) {
+		assert.Equal(t, usecases.InvalidExpiryReason, rejectedErr.Reason)
+	}
+	unknownOrder := entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(120))
+	unknownOrder.SetTimeInForce("DAY", 0)
+	_, err = ex.PlaceLimitOrderAndPersist(unknownOrder)
+	if assert.ErrorAs(t, err, &rejectedErr) {
+		assert.Equal(t, usecases.InvalidTimeInForceReason, rejectedErr.Reason)
+	}
+}
+
+func TestPostOnlyExchange(t *testing.T) {
+	defer setupTest()()
+
+	ex.RegisterUserWithBalance("john",
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
+		})
+	ex.RegisterUserWithBalance("maker",
+		map[string]entities.Decimal{
+			"ETH": dec(2000.0),
+			"USD": dec(2000.0),
+		})
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(100)))
+
+	// would take john's ask
+	var rejectedErr *usecases.OrderRejectedError
+	postOnlyOrder := entities.NewOrder("maker", "ETHUSD", true, entities.LimitOrderType, dec(1), dec(100))
+	postOnlyOrder.SetPostOnly(true, false)
+	_, err := ex.PlaceLimitOrderAndPersist(postOnlyOrder)
+	if assert.ErrorAs(t, err, &rejectedErr) {
+		assert.Equal(t, usecases.PostOnlyWouldCrossReason, rejectedErr.Reason)
+	}
+	assert.Equal(t, dec(2000), ex.GetUsersMap()["maker"].GetAvailable("USD"))
+	assert.Equal(t, dec(1), ex.GetUsersMap()["john"].GetLocked("ETH"))
+
+	// repriced one tick under the best ask, nothing is matched
+	postOnlyOrder = entities.NewOrder("maker", "ETHUSD", true, entities.LimitOrderType, dec(1), dec(105))
+	postOnlyOrder.SetPostOnly(true, true)
+	trades, err := ex.PlaceLimitOrderAndPersist(postOnlyOrder)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(trades))
+	assert.Equal(t, dec(99.99), postOnlyOrder.GetLimitPrice())
+	assert.Equal(t, dec(99.99), ex.GetBestBuy("ETHUSD"))
+	assert.Equal(t, dec(99.99), ex.GetUsersMap()["maker"].GetLocked("USD"))
+
+	// not crossing, placed as is
+	postOnlyOrder = entities.NewOrder("maker", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(101))
+	postOnlyOrder.SetPostOnly(true, false)
+	_, err = ex.PlaceLimitOrderAndPersist(postOnlyOrder)
+	assert.NoError(t, err)
+	assert.Equal(t, dec(100), ex.GetBestSell("ETHUSD"))
+
+	postOnlyOrder = entities.NewOrder("maker", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(101))
+	postOnlyOrder.SetPostOnly(true, false)
+	postOnlyOrder.SetTimeInForce(entities.ImmediateOrCancel, 0)
+	_, err = ex.PlaceLimitOrderAndPersist(postOnlyOrder)
+	if assert.ErrorAs(t, err, &rejectedErr) {
+		assert.Equal(t, usecases.InvalidTimeInForceReason, rejectedErr.Reason)
+	}
+}
+
+func TestStopOrdersExchange(t *testing.T) {
+	defer setupTest()()
+
+	for _, userId := range []string{"john", "jim", "lily", "stopper"} {
+		ex.RegisterUserWithBalance(userId,
+			map[string]entities.Decimal{
+				"ETH": dec(2000.0),
+				"USD": dec(2000.0),
+			})
+	}
+	triggeredList := make([]usecases.StopOrderTriggered, 0)
+	ex.OnStopOrderTriggered = func(triggered usecases.StopOrderTriggered) {
+		triggeredList = append(triggeredList, triggered)
+	}
+
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", true, entities.LimitOrderType, dec(1), dec(100)))
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", true, entities.LimitOrderType, dec(2), dec(90)))
+	ex.PlaceMarketOrder(entities.NewOrder("jim", "ETHUSD", false, entities.MarketOrderType, dec(0.5), dec(0)))
+	assert.Equal(t, dec(100), ex.GetLastPrice("ETHUSD"))
+
+	var rejectedErr *usecases.OrderRejectedError
+	// would be triggered right away
+	stopOrder := entities.NewOrder("stopper", "ETHUSD", false, entities.StopMarketOrderType, dec(1), dec(0))
+	stopOrder.SetStopPrice(dec(100))
+	if assert.ErrorAs(t, ex.PlaceStopOrder(stopOrder), &rejectedErr) {
+		assert.Equal(t, usecases.InvalidStopPriceReason, rejectedErr.Reason)
+	}
+
+	// sell 1 if the price drops to 95, nothing locked until then
+	stopOrder = entities.NewOrder("stopper", "ETHUSD", false, entities.StopMarketOrderType, dec(1), dec(0))
+	stopOrder.SetStopPrice(dec(95))
+	assert.NoError(t, ex.PlaceStopOrder(stopOrder))
+	assert.Equal(t, entities.StopMarketOrderType, ex.GetUsersMap()["stopper"].OpenOrders[stopOrder.GetId()].GetOrderType())
+	assert.Equal(t, dec(0), ex.GetUsersMap()["stopper"].GetLocked("ETH"))
+
+	// cancelled through the usual path
+	cancelledStopOrder := entities.NewOrder("stopper", "ETHUSD", true, entities.StopLimitOrderType, dec(1), dec(130))
+	cancelledStopOrder.SetStopPrice(dec(120))
+	assert.NoError(t, ex.PlaceStopOrder(cancelledStopOrder))
+	assert.NotNil(t, ex.CancelOrder(cancelledStopOrder.GetId(), "ETHUSD"))
+	assert.NotContains(t, ex.GetUsersMap()["stopper"].OpenOrders, cancelledStopOrder.GetId())
+
+	// 0.5 left at 100, then 2 at 90: the stop is triggered and sells at 90
+	ex.PlaceMarketOrder(entities.NewOrder("lily", "ETHUSD", false, entities.MarketOrderType, dec(1), dec(0)))
+	assert.Equal(t, 1, len(triggeredList))
+	assert.NoError(t, triggeredList[0].Err)
+	assert.Equal(t, stopOrder.GetId(), triggeredList[0].Order.GetId())
+	assert.Equal(t, 1, len(triggeredList[0].Trades))
+	assert.Equal(t, dec(90), triggeredList[0].Trades[0].GetPrice())
+	assert.Equal(t, dec(1), triggeredList[0].Trades[0].GetSize())
+	assert.Equal(t, 0, len(ex.GetUsersMap()["stopper"].OpenOrders))
+	assert.Equal(t, dec(1999), ex.GetUsersMap()["stopper"].GetAvailable("ETH"))
+	assert.Equal(t, dec(2090), ex.GetUsersMap()["stopper"].GetAvailable("USD"))
+	// saved with the trades
+	assert.Equal(t, triggeredList[0].Trades[0].GetId(), ex.SequencesRepo.Read("trades"))
+}
+
+func TestAmendOrderExchange(t *testing.T) {
+	filePath, dbHandler := setup()
+	defer teardown(filePath, dbHandler)
+
+	for _, userId := range []string{"john", "jane", "lily"} {
+		ex.RegisterUserWithBalance(userId,
+			map[string]entities.Decimal{
+				"ETH": dec(2000.0),
+				"USD": dec(2000.0),
+			})
+	}
+
+	johnOrder := entities.NewOrder("john", "ETHUSD", true, entities.LimitOrderType, dec(2), dec(100))
+	ex.PlaceLimitOrderAndPersist(johnOrder)
+	janeOrder := entities.NewOrder("jane", "ETHUSD", true, entities.LimitOrderType, dec(1), dec(100))
+	ex.PlaceLimitOrderAndPersist(janeOrder)
+	assert.Equal(t, dec(200), ex.GetUsersMap()["john"].GetLocked("USD"))
+
+	// size decrease: john keeps his place, half of his funds are released
+	amendedOrder, trades, err := ex.AmendOrder(johnOrder.GetId(), "ETHUSD", "john", dec(1), dec(0))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(trades))
+	assert.Equal(t, dec(1), amendedOrder.GetSize())
+	assert.Equal(t, dec(100), ex.GetUsersMap()["john"].GetLocked("USD"))
+	assert.Equal(t, dec(1900), ex.GetUsersMap()["john"].GetAvailable("USD"))
+	assert.Equal(t, dec(1), ex.GetUsersMap()["john"].OpenOrders[johnOrder.GetId()].GetSize())
+	assert.Equal(t, "john", ex.GetBestBuys("ETHUSD", 1)[0].GetAllOrders()[0].GetUserId())
+
+	// price change: jane goes to a better level, and locks more
+	amendedOrder, _, err = ex.AmendOrder(janeOrder.GetId(), "ETHUSD", "jane", dec(0), dec(110))
+	assert.NoError(t, err)
+	assert.Equal(t, dec(110), amendedOrder.GetLimitPrice())
+	assert.Equal(t, dec(110), ex.GetUsersMap()["jane"].GetLocked("USD"))
+	assert.Equal(t, dec(110), ex.GetBestBuy("ETHUSD"))
+
+	// the rows are updated in the same step
+	rows := dbHandler.Query("SELECT size, price FROM buyOrders WHERE id = ?", janeOrder.GetId())
+	var size, price int64
+	assert.True(t, rows.Next())
+	rows.Scan(&size, &price)
+	// the last Next releases the connection
+	assert.False(t, rows.Next())
+	assert.Equal(t, dec(1).Units(), size)
+	assert.Equal(t, dec(110).Units(), price)
+
+	var rejectedErr *usecases.OrderRejectedError
+	_, _, err = ex.AmendOrder(johnOrder.GetId(), "ETHUSD", "john", dec(100), dec(0))
+	if assert.ErrorAs(t, err, &rejectedErr) {
+		assert.Equal(t, usecases.InsufficientBalanceReason, rejectedErr.Reason)
+	}
+	// nothing changed
+	assert.Equal(t, dec(100), ex.GetUsersMap()["john"].GetLocked("USD"))
+	assert.Equal(t, dec(1), ex.GetUsersMap()["john"].OpenOrders[johnOrder.GetId()].GetSize())
+
+	var notFoundErr *usecases.OrderNotFoundError
+	_, _, err = ex.AmendOrder(12345, "ETHUSD", "john", dec(1), dec(0))
+	assert.ErrorAs(t, err, &notFoundErr)
+
+	// only by its owner
+	var notOwnedErr *usecases.OrderNotOwnedError
+	_, _, err = ex.AmendOrder(johnOrder.GetId(), "ETHUSD", "lily", dec(0.5), dec(0))
+	if assert.ErrorAs(t, err, &notOwnedErr) {
+		assert.Equal(t, johnOrder.GetId(), notOwnedErr.OrderId)
+	}
+	assert.Equal(t, dec(1), ex.GetUsersMap()["john"].OpenOrders[johnOrder.GetId()].GetSize())
+
+	// a new price crossing the book is matched, the better price is refunded
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("lily", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(120)))
+	_, trades, err = ex.AmendOrder(johnOrder.GetId(), "ETHUSD", "john", dec(0), dec(130))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(trades))
+	assert.Equal(t, dec(120), trades[0].GetPrice())
+	assert.NotContains(t, ex.GetUsersMap()["john"].OpenOrders, johnOrder.GetId())
+	assert.Equal(t, dec(0), ex.GetUsersMap()["john"].GetLocked("USD"))
+	assert.Equal(t, dec(1880), ex.GetUsersMap()["john"].GetAvailable("USD"))
+	assert.Equal(t, dec(2001), ex.GetUsersMap()["john"].GetAvailable("ETH"))
+	rows = dbHandler.Query("SELECT size, price FROM buyOrders WHERE id = ?", johnOrder.GetId())
+	assert.False(t, rows.Next())
+}
+
+func TestSelfTradePreventionExchange(t *testing.T) {
+	defer setupTest()()
+
+	for _, userId := range []string{"john", "jane"} {
+		ex.RegisterUserWithBalance(userId,
+			map[string]entities.Decimal{
+				"ETH": dec(2000.0),
+				"USD": dec(2000.0),
+			})
+	}
+	selfTradesPrevented := make([]usecases.SelfTradePrevented, 0)
+	ex.OnSelfTradePrevented = func(selfTradePrevented usecases.SelfTradePrevented) {
+		selfTradesPrevented = append(selfTradesPrevented, selfTradePrevented)
+	}
 
-	assert.Equal(t, 2001.0, ex.GetUsersMap()["lily"].Balance["ETH"])
-	assert.Equal(t, 1900.0, ex.GetUsersMap()["lily"].Balance["USD"])
+	johnAsk := entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(100))
+	ex.PlaceLimitOrderAndPersist(johnAsk)
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(100)))
+	assert.Equal(t, dec(1), ex.GetUsersMap()["john"].GetLocked("ETH"))
+
+	var rejectedErr *usecases.OrderRejectedError
+	err := ex.SetSelfTradePrevention("john", "CANCEL_EVERYTHING")
+	if assert.ErrorAs(t, err, &rejectedErr) {
+		assert.Equal(t, usecases.InvalidSelfTradePreventionReason, rejectedErr.Reason)
+	}
+	assert.Error(t, ex.SetSelfTradePrevention("nobody", entities.CancelOldest))
+	assert.NoError(t, ex.SetSelfTradePrevention("john", entities.CancelOldest))
+	assert.Equal(t, entities.CancelOldest, ex.GetUsersMap()["john"].GetSelfTradePrevention())
+
+	// the default of the account: john's ask is cancelled and its funds released, jane's ask is matched
+	johnBid := entities.NewOrder("john", "ETHUSD", true, entities.LimitOrderType, dec(1.5), dec(100))
+	trades, err := ex.PlaceLimitOrderAndPersist(johnBid)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(trades))
+	assert.Equal(t, "jane", trades[0].GetSeller().GetUserId())
+	assert.NotContains(t, ex.GetUsersMap()["john"].OpenOrders, johnAsk.GetId())
+	assert.Equal(t, dec(0), ex.GetUsersMap()["john"].GetLocked("ETH"))
+	assert.Equal(t, dec(2001), ex.GetUsersMap()["john"].GetAvailable("ETH"))
+	// 0.5 rests
+	assert.Equal(t, dec(50), ex.GetUsersMap()["john"].GetLocked("USD"))
+	assert.Equal(t, dec(1850), ex.GetUsersMap()["john"].GetAvailable("USD"))
+	if assert.Equal(t, 1, len(selfTradesPrevented)) {
+		assert.Equal(t, "john", selfTradesPrevented[0].UserId)
+		assert.Equal(t, 1, len(selfTradesPrevented[0].Cancels))
+		assert.Equal(t, johnAsk.GetId(), selfTradesPrevented[0].Cancels[0].Order.GetId())
+		assert.True(t, selfTradesPrevented[0].Cancels[0].IsResting)
+	}
+
+	// the mode of the order wins: the new ask is cancelled, nothing stays locked for it
+	johnAsk = entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(100))
+	johnAsk.SetSelfTradePrevention(entities.CancelNewest)
+	trades, err = ex.PlaceLimitOrderAndPersist(johnAsk)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(trades))
+	assert.NotContains(t, ex.GetUsersMap()["john"].OpenOrders, johnAsk.GetId())
+	assert.Contains(t, ex.GetUsersMap()["john"].OpenOrders, johnBid.GetId())
+	assert.Equal(t, dec(0), ex.GetUsersMap()["john"].GetLocked("ETH"))
+	assert.Equal(t, dec(2001), ex.GetUsersMap()["john"].GetAvailable("ETH"))
+	assert.Equal(t, dec(50), ex.GetUsersMap()["john"].GetLocked("USD"))
+	if assert.Equal(t, 2, len(selfTradesPrevented)) {
+		assert.False(t, selfTradesPrevented[1].Cancels[0].IsResting)
+		assert.Equal(t, dec(1), selfTradesPrevented[1].Cancels[0].Size)
+	}
+
+	invalidOrder := entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(100))
+	invalidOrder.SetSelfTradePrevention("CANCEL_EVERYTHING")
+	_, err = ex.PlaceLimitOrderAndPersist(invalidOrder)
+	if assert.ErrorAs(t, err, &rejectedErr) {
+		assert.Equal(t, usecases.InvalidSelfTradePreventionReason, rejectedErr.Reason)
+	}
+}
+
+func TestSelfTradePreventionMarketBuyCost(t *testing.T) {
+	defer setupTest()()
+	ex.RegisterUserWithBalance("john", map[string]entities.Decimal{"ETH": dec(1), "USD": dec(150)})
+	ex.RegisterUserWithBalance("jane", map[string]entities.Decimal{"ETH": dec(1)})
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(100)))
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(200)))
+
+	// his own ask would be cancelled and the buy filled by jane: 200, not 100
+	var rejectedErr *usecases.OrderRejectedError
+	johnBuy := entities.NewOrder("john", "ETHUSD", true, entities.MarketOrderType, dec(1), dec(0))
+	johnBuy.SetSelfTradePrevention(entities.CancelOldest)
+	_, err := ex.PlaceMarketOrder(johnBuy)
+	if assert.ErrorAs(t, err, &rejectedErr) {
+		assert.Equal(t, usecases.InsufficientBalanceReason, rejectedErr.Reason)
+	}
+	assert.Equal(t, dec(150), ex.GetUsersMap()["john"].GetAvailable("USD"))
+	assert.Equal(t, 1, len(ex.GetUsersMap()["john"].OpenOrders))
+
+	// with enough of it, the balance does not go below 0
+	assert.NoError(t, ex.Deposit("john", "USD", dec(50)))
+	johnBuy = entities.NewOrder("john", "ETHUSD", true, entities.MarketOrderType, dec(1), dec(0))
+	johnBuy.SetSelfTradePrevention(entities.CancelOldest)
+	trades, err := ex.PlaceMarketOrder(johnBuy)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(trades)) {
+		assert.Equal(t, dec(200), trades[0].GetPrice())
+	}
+	assert.False(t, ex.GetUsersMap()["john"].GetAvailable("USD").IsNegative())
+	assert.Equal(t, 0, len(ex.GetUsersMap()["john"].OpenOrders))
+}
+
+func TestFeesExchange(t *testing.T) {
+	filePath, dbHandler := setup()
+	defer teardown(filePath, dbHandler)
+
+	ex = usecases.NewExchangeWithInstruments([]entities.Instrument{
+		{Ticker: "ETHUSD", BaseAsset: "ETH", QuoteAsset: "USD", TickSize: dec(0.01), LotSize: dec(0.001),
+			FeeSchedule: entities.FeeSchedule{
+				{MinVolume: dec(0), MakerRate: dec(0.001), TakerRate: dec(0.002)},
+				{MinVolume: dec(1000), MakerRate: dec(0), TakerRate: dec(0.001)},
+			}},
+		{Ticker: "BTCUSDT", BaseAsset: "BTC", QuoteAsset: "USDT", TickSize: dec(0.01), LotSize: dec(0.0001)},
+	})
+	ex.FeeSchedule = entities.FeeSchedule{{MinVolume: dec(0), MakerRate: dec(0.01), TakerRate: dec(0.01)}}
+	ex.OrdersRepo = controllers.NewOrdersRepoImpl(dbHandler)
+	ex.UsersRepo = controllers.NewUsersRepoImpl(dbHandler)
+	ex.SequencesRepo = controllers.NewSequencesRepoImpl(dbHandler)
+	ex.LastTradesRepo = controllers.NewLastTradesRepoImpl(dbHandler)
+	ex.FeesRepo = controllers.NewFeesRepoImpl(dbHandler)
+	ex.CandlesRepo = controllers.NewCandlesRepoImpl(dbHandler)
+	ex.TransactionManager = dbHandler
+
+	ex.RegisterUserWithBalance("john",
+		map[string]entities.Decimal{
+			"ETH":  dec(10),
+			"BTC":  dec(1),
+			"USD":  dec(10000),
+			"USDT": dec(10000),
+		})
+	ex.RegisterUserWithBalance("lily",
+		map[string]entities.Decimal{
+			"ETH":  dec(10),
+			"USD":  dec(10000),
+			"USDT": dec(10000),
+		})
+
+	// john makes, lily takes. Each pays in what it receives
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(1000)))
+	trades, err := ex.PlaceMarketOrder(entities.NewOrder("lily", "ETHUSD", true, entities.MarketOrderType, dec(1), dec(0)))
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(trades)) {
+		assert.Equal(t, dec(0.002), trades[0].GetBuyerFee())
+		assert.Equal(t, dec(1), trades[0].GetSellerFee())
+		assert.Equal(t, trades, ex.GetLastTrades("ETHUSD", 1))
+	}
+	assert.Equal(t, dec(10.998), ex.GetUsersMap()["lily"].GetAvailable("ETH"))
+	assert.Equal(t, dec(9000), ex.GetUsersMap()["lily"].GetAvailable("USD"))
+	assert.Equal(t, dec(9), ex.GetUsersMap()["john"].GetAvailable("ETH"))
+	assert.Equal(t, dec(10999), ex.GetUsersMap()["john"].GetAvailable("USD"))
+	assert.Equal(t, dec(0.002), ex.GetUsersMap()[usecases.FeeAccountId].GetAvailable("ETH"))
+	assert.Equal(t, dec(1), ex.GetUsersMap()[usecases.FeeAccountId].GetAvailable("USD"))
+
+	// 1000 traded in the last 30 days: next tier, but only on ETHUSD and only for 30 days
+	now := time.Now().UnixNano()
+	makerRate, takerRate := ex.GetFeeRates("john", "ETHUSD", now)
+	assert.Equal(t, dec(0), makerRate)
+	assert.Equal(t, dec(0.001), takerRate)
+	makerRate, _ = ex.GetFeeRates("john", "ETHUSD", now+entities.FeeVolumeWindow)
+	assert.Equal(t, dec(0.001), makerRate)
+
+	// the lily limit order takes: 0.1% in USD for john, nothing for the maker lily
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("lily", "ETHUSD", true, entities.LimitOrderType, dec(1), dec(900)))
+	trades, err = ex.PlaceMarketOrder(entities.NewOrder("john", "ETHUSD", false, entities.MarketOrderType, dec(1), dec(0)))
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(trades)) {
+		assert.Equal(t, dec(0), trades[0].GetBuyerFee())
+		assert.Equal(t, dec(0.9), trades[0].GetSellerFee())
+	}
+	assert.Equal(t, dec(11.998), ex.GetUsersMap()["lily"].GetAvailable("ETH"))
+	assert.Equal(t, dec(1.9), ex.GetUsersMap()[usecases.FeeAccountId].GetAvailable("USD"))
+
+	// no schedule for BTCUSDT: the one of the exchange
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "BTCUSDT", false, entities.LimitOrderType, dec(0.1), dec(20000)))
+	trades, err = ex.PlaceMarketOrder(entities.NewOrder("lily", "BTCUSDT", true, entities.MarketOrderType, dec(0.1), dec(0)))
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(trades)) {
+		assert.Equal(t, dec(0.001), trades[0].GetBuyerFee())
+		assert.Equal(t, dec(20), trades[0].GetSellerFee())
+	}
+	assert.Equal(t, dec(0.099), ex.GetUsersMap()["lily"].GetAvailable("BTC"))
+	assert.Equal(t, dec(20), ex.GetUsersMap()[usecases.FeeAccountId].GetAvailable("USDT"))
+
+	// the ledger and the fees of the trades are back after a restart
+	recovered := usecases.NewExchangeWithInstruments(ex.GetInstruments())
+	recovered.OrdersRepo = ex.OrdersRepo
+	recovered.UsersRepo = ex.UsersRepo
+	recovered.LastTradesRepo = ex.LastTradesRepo
+	recovered.SequencesRepo = ex.SequencesRepo
+	recovered.FeesRepo = ex.FeesRepo
+	recovered.CandlesRepo = ex.CandlesRepo
+	recovered.TransactionManager = ex.TransactionManager
+	recovered.Recover()
+	makerRate, takerRate = recovered.GetFeeRates("john", "ETHUSD", now)
+	assert.Equal(t, dec(0), makerRate)
+	assert.Equal(t, dec(0.001), takerRate)
+	lastTrades := recovered.GetLastTrades("ETHUSD", 2)
+	if assert.Equal(t, 2, len(lastTrades)) {
+		assert.Equal(t, dec(0.002), lastTrades[0].GetBuyerFee())
+		assert.Equal(t, dec(1), lastTrades[0].GetSellerFee())
+		assert.Equal(t, dec(0.9), lastTrades[1].GetSellerFee())
+	}
+}
+
+func TestTransactionalPersistence(t *testing.T) {
+	filePath, dbHandler := setup()
+	defer teardown(filePath, dbHandler)
+
+	for _, userId := range []string{"john", "lily"} {
+		ex.RegisterUserWithBalance(userId,
+			map[string]entities.Decimal{
+				"ETH": dec(2000.0),
+				"USD": dec(2000.0),
+			})
+	}
+	johnOrder := entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(2), dec(100))
+	ex.PlaceLimitOrderAndPersist(johnOrder)
+
+	// the trade can't be written: nothing of the match is, as if it crashed before
+	assert.NoError(t, dbHandler.Exec(`ALTER TABLE lastTrades RENAME TO lastTradesOld`))
+	_, err := ex.PlaceMarketOrder(entities.NewOrder("lily", "ETHUSD", true, entities.MarketOrderType, dec(1), dec(0)))
+	assert.NoError(t, err)
+	assert.Equal(t, dec(1), ex.GetUsersMap()["john"].OpenOrders[johnOrder.GetId()].GetSize())
+
+	rows := dbHandler.Query("SELECT size FROM sellOrders WHERE id = ?", johnOrder.GetId())
+	var size int64
+	assert.True(t, rows.Next())
+	rows.Scan(&size)
+	assert.False(t, rows.Next())
+	assert.Equal(t, dec(2).Units(), size)
+	rows = dbHandler.Query(`SELECT asset, available FROM balances WHERE userid = ? ORDER BY asset`, "lily")
+	var asset string
+	var available int64
+	for _, expectedAsset := range []string{"ETH", "USD"} {
+		assert.True(t, rows.Next())
+		rows.Scan(&asset, &available)
+		assert.Equal(t, expectedAsset, asset)
+		assert.Equal(t, dec(2000).Units(), available)
+	}
+	assert.False(t, rows.Next())
+
+	// the next match is written as a whole
+	assert.NoError(t, dbHandler.Exec(`ALTER TABLE lastTradesOld RENAME TO lastTrades`))
+	_, err = ex.PlaceMarketOrder(entities.NewOrder("lily", "ETHUSD", true, entities.MarketOrderType, dec(1), dec(0)))
+	assert.NoError(t, err)
+
+	recovered := usecases.NewExchange()
+	recovered.OrdersRepo = ex.OrdersRepo
+	recovered.UsersRepo = ex.UsersRepo
+	recovered.LastTradesRepo = ex.LastTradesRepo
+	recovered.SequencesRepo = ex.SequencesRepo
+	recovered.FeesRepo = ex.FeesRepo
+	recovered.CandlesRepo = ex.CandlesRepo
+	recovered.TransactionManager = ex.TransactionManager
+	recovered.Recover()
+	assert.Equal(t, 0, len(recovered.GetUsersMap()["john"].OpenOrders))
+	assert.Equal(t, dec(2200), recovered.GetUsersMap()["john"].GetAvailable("USD"))
+	assert.Equal(t, dec(2002), recovered.GetUsersMap()["lily"].GetAvailable("ETH"))
+	assert.Equal(t, 1, len(recovered.GetLastTrades("ETHUSD", 10)))
+}
+
+// everything replaying the journal must reproduce: the book in priority order, the balances, the trades and their fees
+func dumpExchange(exchange *usecases.Exchange, now int64) string {
+	dump := ""
+	for _, instrument := range exchange.GetInstruments() {
+		buys, _, sells, _ := exchange.GetBook(instrument.Ticker)
+		for _, limit := range append(buys, sells...) {
+			dump += fmt.Sprintf("%s limit %s %s\n", instrument.Ticker, limit.GetLimitPrice(), limit.GetTotalVolume())
+			for _, order := range limit.GetAllOrders() {
+				dump += fmt.Sprintf("  %s %s %d\n", order, order.GetTimeInForce(), order.GetExpiresAt())
+			}
+		}
+		// only the latest trades are kept in memory after Recover
+		dump += fmt.Sprintf("%s last price %s\n", instrument.Ticker, exchange.GetLastPrice(instrument.Ticker))
+		trades, _ := exchange.GetTradeHistory(instrument.Ticker, usecases.TradeHistoryQuery{Limit: 100})
+		for i := len(trades) - 1; i >= 0; i-- {
+			trade := trades[i]
+			dump += fmt.Sprintf("%s trade %d %s@%s %t %d fees %s/%s\n", instrument.Ticker,
+				trade.GetId(), trade.GetSize(), trade.GetPrice(),
+				trade.GetIsBuyerMaker(), trade.GetTimeStamp(), trade.GetBuyerFee(), trade.GetSellerFee())
+		}
+	}
+	users := exchange.GetUsersMap()
+	userIds := make([]string, 0)
+	for userId := range users {
+		userIds = append(userIds, userId)
+	}
+	sort.Strings(userIds)
+	for _, userId := range userIds {
+		user := users[userId]
+		dump += fmt.Sprintf("user %s %s\n", userId, user.GetSelfTradePrevention())
+		assets := make([]string, 0)
+		for asset := range user.Balance {
+			assets = append(assets, asset)
+		}
+		sort.Strings(assets)
+		for _, asset := range assets {
+			dump += fmt.Sprintf("  %s %s/%s\n", asset, user.GetAvailable(asset), user.GetLocked(asset))
+		}
+		orderIds := make([]int64, 0)
+		for orderId := range user.OpenOrders {
+			orderIds = append(orderIds, orderId)
+		}
+		sort.Slice(orderIds, func(i, j int) bool { return orderIds[i] < orderIds[j] })
+		for _, orderId := range orderIds {
+			order := user.OpenOrders[orderId]
+			dump += fmt.Sprintf("  %s %s %s\n", order, order.GetTimeInForce(), order.GetStopPrice())
+		}
+		makerRate, takerRate := exchange.GetFeeRates(userId, "ETHUSD", now)
+		dump += fmt.Sprintf("  rates %s/%s\n", makerRate, takerRate)
+	}
+	return dump
+}
+
+func TestJournalReplay(t *testing.T) {
+	filePath, dbHandler := setup()
+	defer teardown(filePath, dbHandler)
+	journalPath := "./test_journal.log"
+	os.Remove(journalPath)
+	defer os.Remove(journalPath)
+	journal, err := infrastructure.NewFileJournal(journalPath)
+	assert.NoError(t, err)
+	defer journal.Close()
+	ex.Journal = journal
+	ex.FeeSchedule = entities.FeeSchedule{{MinVolume: dec(0), MakerRate: dec(0.001), TakerRate: dec(0.002)}}
+
+	ex.RegisterUserWithBalance("john", map[string]entities.Decimal{"ETH": dec(100), "USD": dec(100000)})
+	ex.RegisterUserWithBalance("lily", map[string]entities.Decimal{"ETH": dec(100), "USD": dec(100000)})
+	ex.RegisterUser("bob")
+	assert.NoError(t, ex.Deposit("bob", "USD", dec(5000)))
+	// rejected, not journaled
+	assert.Error(t, ex.Deposit("bob", "DOGE", dec(1)))
+	assert.NoError(t, ex.SetSelfTradePrevention("john", entities.CancelOldest))
+
+	now := time.Now().UnixNano()
+	expiring := entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(110))
+	expiring.SetTimeInForce(entities.GoodTillDate, now+int64(time.Hour))
+	_, err = ex.PlaceLimitOrderAndPersist(expiring)
+	assert.NoError(t, err)
+	_, err = ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(2), dec(100)))
+	assert.NoError(t, err)
+	_, err = ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(3), dec(102)))
+	assert.NoError(t, err)
+	repriced := entities.NewOrder("lily", "ETHUSD", true, entities.LimitOrderType, dec(1), dec(100))
+	repriced.SetPostOnly(true, true)
+	_, err = ex.PlaceLimitOrderAndPersist(repriced)
+	assert.NoError(t, err)
+	stop := entities.NewOrder("bob", "ETHUSD", true, entities.StopMarketOrderType, dec(1), dec(0))
+	stop.SetStopPrice(dec(100))
+	assert.NoError(t, ex.PlaceStopOrder(stop))
+
+	// trades at 100, triggers the stop of bob which takes the rest of the level and some of the next one
+	trades, err := ex.PlaceMarketOrder(entities.NewOrder("lily", "ETHUSD", true, entities.MarketOrderType, dec(1.5), dec(0)))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(trades))
+	assert.Equal(t, 0, len(ex.GetUsersMap()["bob"].OpenOrders))
+	// the buy of john cancels its own resting sell first
+	_, err = ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", true, entities.LimitOrderType, dec(1), dec(102)))
+	assert.NoError(t, err)
+	_, _, err = ex.AmendOrder(expiring.GetId(), "ETHUSD", "john", dec(0.5), dec(0))
+	assert.NoError(t, err)
+	assert.NotNil(t, ex.CancelOrder(repriced.GetId(), "ETHUSD"))
+	ex.ExpireOrders(now + 2*int64(time.Hour))
+	_, ok := ex.GetUsersMap()["john"].OpenOrders[expiring.GetId()]
+	assert.False(t, ok)
+	commands, err := journal.ReadAll()
+	assert.NoError(t, err)
+
+	// nothing from the database: the book, the balances and the trades only come from the journal
+	recovered := usecases.NewExchange()
+	recovered.OrdersRepo = ex.OrdersRepo
+	recovered.UsersRepo = ex.UsersRepo
+	recovered.LastTradesRepo = ex.LastTradesRepo
+	recovered.SequencesRepo = ex.SequencesRepo
+	recovered.FeesRepo = ex.FeesRepo
+	recovered.CandlesRepo = ex.CandlesRepo
+	recovered.TransactionManager = ex.TransactionManager
+	recovered.FeeSchedule = ex.FeeSchedule
+	recovered.Journal = journal
+	recovered.Recover()
+	assert.Equal(t, dumpExchange(ex, now), dumpExchange(recovered, now))
+
+	// the database was already up to date, nothing is written twice
+	rows := dbHandler.Query(`SELECT COUNT(*) FROM lastTrades`)
+	var count int
+	assert.True(t, rows.Next())
+	rows.Scan(&count)
+	assert.False(t, rows.Next())
+	assert.Equal(t, len(ex.GetLastTrades("ETHUSD", 100)), count)
+
+	// the database is behind the journal .e.g. lost: it is written again from what was replayed
+	emptyDbPath := "./test_replay.db"
+	deleteDb(emptyDbPath)
+	emptyDbHandler := infrastructure.NewSqliteDbHandler(emptyDbPath)
+	defer teardown(emptyDbPath, emptyDbHandler)
+	assert.NoError(t, controllers.Migrate(emptyDbHandler))
+	replayed := usecases.NewExchange()
+	replayed.OrdersRepo = controllers.NewOrdersRepoImpl(emptyDbHandler)
+	replayed.UsersRepo = controllers.NewUsersRepoImpl(emptyDbHandler)
+	replayed.LastTradesRepo = controllers.NewLastTradesRepoImpl(emptyDbHandler)
+	replayed.SequencesRepo = controllers.NewSequencesRepoImpl(emptyDbHandler)
+	replayed.FeesRepo = controllers.NewFeesRepoImpl(emptyDbHandler)
+	replayed.CandlesRepo = controllers.NewCandlesRepoImpl(emptyDbHandler)
+	replayed.TransactionManager = emptyDbHandler
+	replayed.FeeSchedule = ex.FeeSchedule
+	replayed.Journal = journal
+	replayed.Recover()
+	assert.Equal(t, dumpExchange(ex, now), dumpExchange(replayed, now))
+	fromDb := usecases.NewExchange()
+	fromDb.OrdersRepo = replayed.OrdersRepo
+	fromDb.UsersRepo = replayed.UsersRepo
+	fromDb.LastTradesRepo = replayed.LastTradesRepo
+	fromDb.SequencesRepo = replayed.SequencesRepo
+	fromDb.FeesRepo = replayed.FeesRepo
+	fromDb.CandlesRepo = replayed.CandlesRepo
+	fromDb.TransactionManager = replayed.TransactionManager
+	fromDb.FeeSchedule = ex.FeeSchedule
+	fromDb.Recover()
+	assert.Equal(t, dumpExchange(ex, now), dumpExchange(fromDb, now))
+
+	// the journal goes on where it stopped
+	assert.NoError(t, recovered.Deposit("bob", "ETH", dec(1)))
+	journaled, err := journal.ReadAll()
+	assert.NoError(t, err)
+	if assert.Equal(t, len(commands)+1, len(journaled)) {
+		assert.Equal(t, int64(len(journaled)), journaled[len(journaled)-1].Sequence)
+	}
+
+	// not journaled, not applied
+	journal.Close()
+	var journalError *usecases.JournalError
+	assert.ErrorAs(t, recovered.RegisterUser("alice"), &journalError)
+	_, ok = recovered.GetUsersMap()["alice"]
+	assert.False(t, ok)
+}
+
+// the commands of the journal can be dropped from the test, unlike the ones of a file
+type memoryJournal struct {
+	commands []usecases.Command
+}
+
+func (journal *memoryJournal) Append(command usecases.Command) error {
+	journal.commands = append(journal.commands, command)
+	return nil
+}
+
+func (journal *memoryJournal) ReadAll() ([]usecases.Command, error) {
+	return journal.commands, nil
+}
+
+func TestSnapshotRecovery(t *testing.T) {
+	filePath, dbHandler := setup()
+	defer teardown(filePath, dbHandler)
+	snapshotDir, err := os.MkdirTemp("", "snapshots")
+	assert.NoError(t, err)
+	defer os.RemoveAll(snapshotDir)
+	store, err := infrastructure.NewFileSnapshotStore(snapshotDir, 2)
+	assert.NoError(t, err)
+	journal := &memoryJournal{}
+	ex.Journal = journal
+	ex.SnapshotStore = store
+	// the trades before are read back from the database
+	ex.RecentTrades = 1
+	ex.FeeSchedule = entities.FeeSchedule{{MinVolume: dec(0), MakerRate: dec(0.001), TakerRate: dec(0.002)}}
+
+	ex.RegisterUserWithBalance("john", map[string]entities.Decimal{"ETH": dec(100), "USD": dec(100000)})
+	ex.RegisterUserWithBalance("lily", map[string]entities.Decimal{"ETH": dec(100), "USD": dec(100000)})
+	now := time.Now().UnixNano()
+	expiring := entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(110))
+	expiring.SetTimeInForce(entities.GoodTillDate, now+int64(time.Hour))
+	ex.PlaceLimitOrderAndPersist(expiring)
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(2), dec(100)))
+	assert.NoError(t, ex.SaveSnapshot())
+	// nothing new, no snapshot
+	assert.NoError(t, ex.SaveSnapshot())
+
+	ex.PlaceMarketOrder(entities.NewOrder("lily", "ETHUSD", true, entities.MarketOrderType, dec(1), dec(0)))
+	_, _, err = ex.AmendOrder(expiring.GetId(), "ETHUSD", "john", dec(0.5), dec(0))
+	assert.NoError(t, err)
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("lily", "ETHUSD", true, entities.LimitOrderType, dec(1), dec(99)))
+	assert.NoError(t, ex.SetSelfTradePrevention("john", entities.CancelOldest))
+	assert.NoError(t, ex.SaveSnapshot())
+	sequences, err := store.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{8, 4}, sequences)
+
+	// the one before the 13th command is written in the background, the oldest one is dropped
+	ex.SnapshotEveryCommands = 6
+	ex.RegisterUser("bob")
+	assert.NoError(t, ex.Deposit("bob", "USD", dec(1000)))
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("bob", "ETHUSD", true, entities.LimitOrderType, dec(1), dec(100)))
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(105)))
+	ex.PlaceMarketOrder(entities.NewOrder("lily", "ETHUSD", true, entities.MarketOrderType, dec(0.2), dec(0)))
+	assert.Equal(t, 13, len(journal.commands))
+	assert.Eventually(t, func() bool {
+		sequences, err = store.List()
+		return err == nil && len(sequences) == 2 && sequences[0] == 12
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []int64{12, 8}, sequences)
+	snapshot, err := store.Read(12)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(ex.GetLastTrades("ETHUSD", 100)))
+	for _, snapshotOrderbook := range snapshot.Orderbooks {
+		if snapshotOrderbook.Ticker == "ETHUSD" {
+			assert.Equal(t, 1, len(snapshotOrderbook.LastTrades))
+		}
+	}
+
+	newExchange := func(commands []usecases.Command) *usecases.Exchange {
+		recovered := usecases.NewExchange()
+		recovered.OrdersRepo = ex.OrdersRepo
+		recovered.UsersRepo = ex.UsersRepo
+		recovered.LastTradesRepo = ex.LastTradesRepo
+		recovered.SequencesRepo = ex.SequencesRepo
+		recovered.FeesRepo = ex.FeesRepo
+		recovered.CandlesRepo = ex.CandlesRepo
+		recovered.TransactionManager = ex.TransactionManager
+		recovered.FeeSchedule = ex.FeeSchedule
+		recovered.SnapshotStore = store
+		recovered.Journal = &memoryJournal{commands: commands}
+		recovered.Recover()
+		return recovered
+	}
+
+	// the commands before the snapshot are not needed anymore
+	recovered := newExchange(journal.commands[12:])
+	assert.Equal(t, dumpExchange(ex, now), dumpExchange(recovered, now))
+	// the trade of the snapshot and the one replayed, the first one is only in the database
+	assert.Equal(t, 2, len(recovered.GetLastTrades("ETHUSD", 100)))
+	// and the commands go on after the last one
+	assert.NoError(t, recovered.Deposit("bob", "ETH", dec(1)))
+	commands, _ := recovered.Journal.ReadAll()
+	assert.Equal(t, int64(14), commands[len(commands)-1].Sequence)
+
+	// corrupted: the one before is used
+	snapshotFiles, err := filepath.Glob(filepath.Join(snapshotDir, "snapshot-*"))
+	assert.NoError(t, err)
+	sort.Strings(snapshotFiles)
+	latest := snapshotFiles[len(snapshotFiles)-1]
+	content, err := os.ReadFile(latest)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(latest, bytes.Replace(content, []byte(`"john"`), []byte(`"jahn"`), 1), 0644))
+	_, err = store.Read(12)
+	assert.Error(t, err)
+	recovered = newExchange(journal.commands[8:])
+	assert.Equal(t, dumpExchange(ex, now), dumpExchange(recovered, now))
+}
+
+func TestJournalOverDatabase(t *testing.T) {
+	filePath, dbHandler := setup()
+	defer teardown(filePath, dbHandler)
+	snapshotDir, err := os.MkdirTemp("", "snapshots")
+	assert.NoError(t, err)
+	defer os.RemoveAll(snapshotDir)
+	store, err := infrastructure.NewFileSnapshotStore(snapshotDir, 2)
+	assert.NoError(t, err)
+
+	// only in the database, from before the journal
+	ex.RegisterUserWithBalance("jane", map[string]entities.Decimal{"ETH": dec(10)})
+	ex.RegisterUserWithBalance("john", map[string]entities.Decimal{"USD": dec(10000)})
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, dec(2), dec(100)))
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(110)))
+
+	newExchange := func(journal usecases.Journal) *usecases.Exchange {
+		recovered := usecases.NewExchange()
+		recovered.OrdersRepo = ex.OrdersRepo
+		recovered.UsersRepo = ex.UsersRepo
+		recovered.LastTradesRepo = ex.LastTradesRepo
+		recovered.SequencesRepo = ex.SequencesRepo
+		recovered.FeesRepo = ex.FeesRepo
+		recovered.CandlesRepo = ex.CandlesRepo
+		recovered.TransactionManager = ex.TransactionManager
+		recovered.SnapshotStore = store
+		recovered.Journal = journal
+		recovered.Recover()
+		return recovered
+	}
+
+	journal := &memoryJournal{}
+	journaled := newExchange(journal)
+	sequences, err := store.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{0}, sequences)
+	journaled.PlaceMarketOrder(entities.NewOrder("john", "ETHUSD", true, entities.MarketOrderType, dec(1), dec(0)))
+	assert.Equal(t, 1, len(journal.commands))
+
+	// crash before any snapshot: the commands are replayed on the state of the database
+	now := time.Now().UnixNano()
+	recovered := newExchange(&memoryJournal{commands: journal.commands})
+	assert.Equal(t, dumpExchange(journaled, now), dumpExchange(recovered, now))
+	assert.Equal(t, 2, len(ex.OrdersRepo.ReadAll("sell")))
+	for _, trade := range recovered.GetLastTrades("ETHUSD", 10) {
+		assert.Equal(t, "jane", trade.GetSellerUserId())
+	}
+
+	// the commands before the first one of the journal are in no snapshot
+	for _, sequence := range sequences {
+		assert.NoError(t, store.Delete(sequence))
+	}
+	assert.Panics(t, func() {
+		newExchange(&memoryJournal{commands: []usecases.Command{{Sequence: 2}}})
+	})
+}
+
+func TestMarketDataEvents(t *testing.T) {
+	defer setupTest()()
+	ex.RegisterUserWithBalance("jane", map[string]entities.Decimal{"ETH": dec(10)})
+	ex.RegisterUserWithBalance("john", map[string]entities.Decimal{"USD": dec(10000)})
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, dec(2), dec(100)))
+
+	_, err := ex.SubscribeMarketData("DOGEUSD", 8)
+	assert.Error(t, err)
+	sub, err := ex.SubscribeMarketData("ETHUSD", 8)
+	assert.NoError(t, err)
+	defer sub.Close()
+	next := func() usecases.MarketDataEvent {
+		select {
+		case event := <-sub.Events():
+			return event
+		default:
+			t.Fatal("no market data event")
+			return usecases.MarketDataEvent{}
+		}
+	}
+
+	// the market as it is
+	event := next()
+	assert.True(t, event.BuysChanged)
+	assert.Equal(t, 0, len(event.BestBuys))
+	assert.True(t, event.SellsChanged)
+	assert.Equal(t, []usecases.PriceLevel{{Price: dec(100), Volume: dec(2)}}, event.BestSells)
+
+	// only the side that changed
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", true, entities.LimitOrderType, dec(1), dec(90)))
+	event = next()
+	assert.Equal(t, 0, len(event.Trades))
+	assert.True(t, event.BuysChanged)
+	assert.Equal(t, []usecases.PriceLevel{{Price: dec(90), Volume: dec(1)}}, event.BestBuys)
+	assert.False(t, event.SellsChanged)
+
+	trades, _ := ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", true, entities.LimitOrderType, dec(0.5), dec(100)))
+	event = next()
+	if assert.Equal(t, 1, len(event.Trades)) {
+		assert.Equal(t, trades[0].GetId(), event.Trades[0].GetId())
+		assert.Equal(t, "jane", event.Trades[0].GetSellerUserId())
+	}
+	assert.False(t, event.BuysChanged)
+	assert.Equal(t, []usecases.PriceLevel{{Price: dec(100), Volume: dec(1.5)}}, event.BestSells)
+
+	// nothing changed in the book
+	ex.Deposit("john", "USD", dec(1))
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", true, entities.LimitOrderType, dec(1), dec(1000000)))
+	select {
+	case event := <-sub.Events():
+		t.Fatalf("unexpected event %+v", event)
+	default:
+	}
+}
+
+func TestMarketDataSlowConsumer(t *testing.T) {
+	defer setupTest()()
+	ex.RegisterUserWithBalance("jane", map[string]entities.Decimal{"ETH": dec(10)})
+	sub, err := ex.SubscribeMarketData("ETHUSD", 2)
+	assert.NoError(t, err)
+
+	// never read: matching goes on without it
+	for i := 0; i < 5; i++ {
+		ex.PlaceLimitOrderAndPersist(entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(100+float64(i))))
+	}
+	assert.True(t, sub.Dropped())
+	events := 0
+	for range sub.Events() {
+		events += 1
+	}
+	assert.Equal(t, 2, events)
+	// already gone
+	sub.Close()
+}
+
+func TestL2BookSequence(t *testing.T) {
+	defer setupTest()()
+	ex.RegisterUserWithBalance("jane", map[string]entities.Decimal{"ETH": dec(10)})
+	ex.RegisterUserWithBalance("john", map[string]entities.Decimal{"USD": dec(10000)})
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, dec(2), dec(100)))
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(101)))
+
+	_, err := ex.GetL2Book("DOGEUSD")
+	assert.Error(t, err)
+	// no subscription: the sequence goes on anyway
+	book, err := ex.GetL2Book("ETHUSD")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), book.Sequence)
+	assert.Equal(t, 0, len(book.Bids))
+	assert.Equal(t, []usecases.PriceLevel{{Price: dec(100), Volume: dec(2)}, {Price: dec(101), Volume: dec(1)}}, book.Asks)
+
+	sub, err := ex.SubscribeMarketData("ETHUSD", 8)
+	assert.NoError(t, err)
+	defer sub.Close()
+	event := <-sub.Events()
+	assert.Equal(t, &book, event.Book)
+	assert.Equal(t, book.Sequence, event.BookSequence)
+
+	// sweeps both levels and rests 0.5 at 101
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", true, entities.LimitOrderType, dec(3.5), dec(101)))
+	event = <-sub.Events()
+	assert.Nil(t, event.Book)
+	assert.Equal(t, book.Sequence+1, event.BookSequence)
+	assert.Equal(t, []entities.LevelChange{
+		{IsBid: false, Price: dec(100), Volume: entities.ZeroDecimal},
+		{IsBid: false, Price: dec(101), Volume: entities.ZeroDecimal},
+	}, event.LevelChanges[1:])
+	assert.Equal(t, entities.LevelChange{IsBid: true, Price: dec(101), Volume: dec(0.5)}, event.LevelChanges[0])
+
+	// the snapshot is the one after the last event
+	book, _ = ex.GetL2Book("ETHUSD")
+	assert.Equal(t, event.BookSequence, book.Sequence)
+	assert.Equal(t, []usecases.PriceLevel{{Price: dec(101), Volume: dec(0.5)}}, book.Bids)
+	assert.Equal(t, 0, len(book.Asks))
+}
+
+func TestMarketDataOrderEvents(t *testing.T) {
+	defer setupTest()()
+	ex.RegisterUserWithBalance("jane", map[string]entities.Decimal{"ETH": dec(10)})
+	ex.RegisterUserWithBalance("john", map[string]entities.Decimal{"USD": dec(10000)})
+	first := entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, dec(2), dec(100))
+	ex.PlaceLimitOrderAndPersist(first)
+
+	sub, err := ex.SubscribeMarketData("ETHUSD", 8)
+	assert.NoError(t, err)
+	defer sub.Close()
+	event := <-sub.Events()
+	assert.Equal(t, int64(1), event.Orders.Sequence)
+	assert.Equal(t, 0, len(event.Orders.Bids))
+	assert.Equal(t, []usecases.L3Order{{OrderId: first.GetId(), Price: dec(100), Size: dec(2), Timestamp: first.GetTimeStamp()}}, event.Orders.Asks)
+
+	second := entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(100))
+	ex.PlaceLimitOrderAndPersist(second)
+	trades, _ := ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", true, entities.LimitOrderType, dec(2.5), dec(100)))
+	ex.AmendOrder(second.GetId(), "ETHUSD", "jane", dec(0.25), dec(100))
+	ex.CancelOrder(second.GetId(), "ETHUSD")
+
+	type summary struct {
+		Sequence      int64
+		Type          entities.OrderEventType
+		OrderId       int64
+		Size          entities.Decimal
+		RemainingSize entities.Decimal
+		TradeId       int64
+	}
+	summaries := make([]summary, 0)
+	for i := 0; i < 4; i++ {
+		event = <-sub.Events()
+		for _, orderEvent := range event.OrderEvents {
+			assert.False(t, orderEvent.IsBid)
+			assert.Equal(t, dec(100), orderEvent.Price)
+			summaries = append(summaries, summary{orderEvent.Sequence, orderEvent.Type, orderEvent.OrderId, orderEvent.Size, orderEvent.RemainingSize, orderEvent.TradeId})
+		}
+	}
+	// the incoming order is filled: it is never in the book
+	assert.Equal(t, []summary{
+		{2, entities.OrderAdded, second.GetId(), dec(1), dec(1), 0},
+		{3, entities.OrderExecuted, first.GetId(), dec(2), entities.ZeroDecimal, trades[0].GetId()},
+		{4, entities.OrderExecuted, second.GetId(), dec(0.5), dec(0.5), trades[1].GetId()},
+		{5, entities.OrderReduced, second.GetId(), dec(0.25), dec(0.25), 0},
+		{6, entities.OrderRemoved, second.GetId(), dec(0.25), entities.ZeroDecimal, 0},
+	}, summaries)
+}
+
+func TestCandles(t *testing.T) {
+	filePath, dbHandler := setup()
+	defer teardown(filePath, dbHandler)
+	ex.RegisterUserWithBalance("jane", map[string]entities.Decimal{"ETH": dec(10)})
+	ex.RegisterUserWithBalance("john", map[string]entities.Decimal{"USD": dec(10000)})
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(100)))
+	ex.PlaceLimitOrderAndPersist(entities.NewOrder("jane", "ETHUSD", false, entities.LimitOrderType, dec(1), dec(110)))
+	sub, err := ex.SubscribeMarketData("ETHUSD", 8)
+	assert.NoError(t, err)
+	defer sub.Close()
+	// no trade yet, no candle
+	assert.Equal(t, 0, len((<-sub.Events()).Candles))
+
+	trades, _ := ex.PlaceLimitOrderAndPersist(entities.NewOrder("john", "ETHUSD", true, entities.LimitOrderType, dec(1.5), dec(110)))
+	assert.Equal(t, 2, len(trades))
+	event := <-sub.Events()
+	// one per interval
+	if assert.Equal(t, len(entities.CandleIntervals), len(event.Candles)) {
+		for i, candle := range event.Candles {
+			assert.Equal(t, entities.CandleIntervals[i], candle.Interval)
+			assert.Equal(t, candle.Interval.OpenTime(trades[0].GetTimeStamp()), candle.OpenTime)
+		}
+	}
+	candles := ex.GetCandles("ETHUSD", entities.FiveMinutes, usecases.CandleQuery{})
+	if assert.Equal(t, 1, len(candles)) {
+		assert.Equal(t, event.Candles[1], candles[0])
+		assert.Equal(t, dec(100), candles[0].Open)
+		assert.Equal(t, dec(110), candles[0].High)
+		assert.Equal(t, dec(100), candles[0].Low)
+		assert.Equal(t, dec(110), candles[0].Close)
+		assert.Equal(t, dec(1.5), candles[0].Volume)
+		assert.Equal(t, dec(155), candles[0].QuoteVolume)
+		assert.Equal(t, int64(2), candles[0].Trades)
+	}
+	assert.Equal(t, 0, len(ex.GetCandles("ETHUSD", entities.FiveMinutes, usecases.CandleQuery{From: candles[0].CloseTime()})))
+
+	// trades of other minutes, and a database from before the candles
+	assert.NoError(t, dbHandler.Exec("DELETE FROM candles"))
+	minute := int64(60 * 1e9)
+	start := entities.OneHour.OpenTime(trades[0].GetTimeStamp()) + 2*entities.OneHour.Duration()
+	for i, price := range []float64{120, 130, 90} {
+		trade := entities.NewTradeRecord(int64(10+i), "ETHUSD", 1, "john", 2, "jane", dec(price), dec(1), false, start+int64(i)*3*minute+1)
+		ex.LastTradesRepo.Create(*trade)
+	}
+	recovered := usecases.NewExchange()
+	recovered.OrdersRepo = ex.OrdersRepo
+	recovered.UsersRepo = ex.UsersRepo
+	recovered.LastTradesRepo = ex.LastTradesRepo
+	recovered.SequencesRepo = ex.SequencesRepo
+	recovered.FeesRepo = ex.FeesRepo
+	recovered.CandlesRepo = ex.CandlesRepo
+	recovered.TransactionManager = ex.TransactionManager
+	recovered.Recover()
+
+	candles = recovered.GetCandles("ETHUSD", entities.OneMinute, usecases.CandleQuery{From: start})
+	if assert.Equal(t, 3, len(candles)) {
+		for i, candle := range candles {
+			assert.Equal(t, start+int64(i)*3*minute, candle.OpenTime)
+			assert.Equal(t, int64(1), candle.Trades)
+		}
+		assert.Equal(t, dec(90), candles[2].Close)
+	}
+	// the latest ones of the range, oldest first
+	candles = recovered.GetCandles("ETHUSD", entities.OneMinute, usecases.CandleQuery{Limit: 2})
+	if assert.Equal(t, 2, len(candles)) {
+		assert.Equal(t, start+3*minute, candles[0].OpenTime)
+		assert.Equal(t, start+6*minute, candles[1].OpenTime)
+	}
+	candles = recovered.GetCandles("ETHUSD", entities.FiveMinutes, usecases.CandleQuery{From: start})
+	if assert.Equal(t, 2, len(candles)) {
+		assert.Equal(t, dec(120), candles[0].Open)
+		assert.Equal(t, dec(130), candles[0].High)
+		assert.Equal(t, dec(90), candles[1].Open)
+	}
+	// the candle the trades of before are in did not change
+	candles = recovered.GetCandles("ETHUSD", entities.OneHour, usecases.CandleQuery{})
+	if assert.Equal(t, 2, len(candles)) {
+		assert.Equal(t, dec(1.5), candles[0].Volume)
+		assert.Equal(t, dec(3), candles[1].Volume)
+	}
 }
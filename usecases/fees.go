@@ -0,0 +1,132 @@
+package usecases
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/trandinhkhoa/crypto-exchange/entities"
+)
+
+// the house account the fees are credited to, created with the first fee
+const FeeAccountId = "fees"
+
+// fee rates of userId on ticker right now, they depend on what the user traded on it over the last 30 days
+func (ex *Exchange) GetFeeRates(userId string, ticker string, now int64) (makerRate entities.Decimal, takerRate entities.Decimal) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	return ex.feeSchedule(Ticker(ticker)).Rates(ex.tradedVolume(userId, Ticker(ticker), now))
+}
+
+// the fee schedule of the instrument, the one of the exchange if it has none
+func (ex *Exchange) feeSchedule(ticker Ticker) entities.FeeSchedule {
+	if schedule := ex.instruments[ticker].FeeSchedule; len(schedule) > 0 {
+		return schedule
+	}
+	return ex.FeeSchedule
+}
+
+// size * price traded by userId on ticker during the 30 days before now
+// the entries expired since the last one of the user are still in the ledger, they are dropped with the next one
+// MUST be called with ex.mu held
+func (ex *Exchange) tradedVolume(userId string, ticker Ticker, now int64) entities.Decimal {
+	volume := ex.tradedVolumes[userId][ticker]
+	for _, entry := range ex.feeLedger[userId] {
+		if entry.Timestamp > now-entities.FeeVolumeWindow {
+			break
+		}
+		if entry.Ticker == string(ticker) {
+			volume = volume.Sub(entry.Notional)
+		}
+	}
+	return volume
+}
+
+// take the fees of both sides of the trade, set them on the trade and credit them to the house account
+// the fees are taken from what each side receives, what was locked for the trade does not change
+// MUST be called with ex.mu held
+func (ex *Exchange) chargeFees(ticker Ticker, trade *entities.Trade) {
+	instrument := ex.instruments[ticker]
+	schedule := ex.feeSchedule(ticker)
+	notional := trade.GetSize().Mul(trade.GetPrice())
+
+	buyerId := trade.GetBuyer().GetUserId()
+	buyerMakerRate, buyerTakerRate := schedule.Rates(ex.tradedVolume(buyerId, ticker, trade.GetTimeStamp()))
+	buyerFee := trade.GetSize().Mul(pickRate(trade.GetIsBuyerMaker(), buyerMakerRate, buyerTakerRate))
+
+	sellerId := trade.GetSeller().GetUserId()
+	sellerMakerRate, sellerTakerRate := schedule.Rates(ex.tradedVolume(sellerId, ticker, trade.GetTimeStamp()))
+	sellerFee := notional.Mul(pickRate(!trade.GetIsBuyerMaker(), sellerMakerRate, sellerTakerRate))
+
+	trade.SetFees(buyerFee, sellerFee)
+	ex.orderbooksMap[ticker].SetLastTradeFees(*trade)
+
+	ex.recordFee(entities.FeeLedgerEntry{
+		TradeId:   trade.GetId(),
+		UserId:    buyerId,
+		Ticker:    string(ticker),
+		Asset:     instrument.BaseAsset,
+		Fee:       buyerFee,
+		Notional:  notional,
+		IsMaker:   trade.GetIsBuyerMaker(),
+		Timestamp: trade.GetTimeStamp(),
+	})
+	ex.recordFee(entities.FeeLedgerEntry{
+		TradeId:   trade.GetId(),
+		UserId:    sellerId,
+		Ticker:    string(ticker),
+		Asset:     instrument.QuoteAsset,
+		Fee:       sellerFee,
+		Notional:  notional,
+		IsMaker:   !trade.GetIsBuyerMaker(),
+		Timestamp: trade.GetTimeStamp(),
+	})
+}
+
+func pickRate(isMaker bool, makerRate entities.Decimal, takerRate entities.Decimal) entities.Decimal {
+	if isMaker {
+		return makerRate
+	}
+	return takerRate
+}
+
+// credit the fee to the house account and add the entry to the ledger
+// every side of every trade gets an entry, even without fee: its volume counts toward the tier of the user
+// MUST be called with ex.mu held
+func (ex *Exchange) recordFee(entry entities.FeeLedgerEntry) {
+	if entry.Fee.IsPositive() {
+		ex.feeAccount().Credit(entry.Asset, entry.Fee)
+	}
+	ex.addToFeeLedger(entry)
+	ex.FeesRepo.Create(entry)
+	logrus.WithFields(logrus.Fields{
+		"fee": entry,
+	}).Debug("Fee Charged")
+}
+
+// the entries older than 30 days are dropped, they do not count anymore
+func (ex *Exchange) addToFeeLedger(entry entities.FeeLedgerEntry) {
+	ex.expireFees(entry.UserId, entry.Timestamp-entities.FeeVolumeWindow)
+	ex.feeLedger[entry.UserId] = append(ex.feeLedger[entry.UserId], entry)
+	if ex.tradedVolumes[entry.UserId] == nil {
+		ex.tradedVolumes[entry.UserId] = make(map[Ticker]entities.Decimal, 0)
+	}
+	ticker := Ticker(entry.Ticker)
+	ex.tradedVolumes[entry.UserId][ticker] = ex.tradedVolumes[entry.UserId][ticker].Add(entry.Notional)
+}
+
+// drop the entries of userId up to the timestamp, their volume with them
+func (ex *Exchange) expireFees(userId string, timestamp int64) {
+	entries := ex.feeLedger[userId]
+	for len(entries) > 0 && entries[0].Timestamp <= timestamp {
+		ticker := Ticker(entries[0].Ticker)
+		ex.tradedVolumes[userId][ticker] = ex.tradedVolumes[userId][ticker].Sub(entries[0].Notional)
+		entries = entries[1:]
+	}
+	ex.feeLedger[userId] = entries
+}
+
+// MUST be called with ex.mu held
+func (ex *Exchange) feeAccount() *entities.User {
+	if _, ok := ex.usersMap[FeeAccountId]; !ok {
+		ex.registerUser(FeeAccountId, nil)
+	}
+	return ex.usersMap[FeeAccountId]
+}
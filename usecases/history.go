@@ -0,0 +1,42 @@
+package usecases
+
+import "github.com/trandinhkhoa/crypto-exchange/entities"
+
+// when the query does not say, and at most
+const DefaultTradeHistoryLimit = 100
+const MaxTradeHistoryLimit = 1000
+
+// the trades of the ticker, newest first
+// returns the Before of the next page too, 0 if this one is the last
+func (ex *Exchange) GetTradeHistory(ticker string, query TradeHistoryQuery) ([]entities.Trade, int64) {
+	query = withHistoryLimit(query)
+	// no ex.mu: the trades of the command in progress are not committed yet, they are not read
+	trades := ex.LastTradesRepo.ReadForTicker(ticker, query)
+	return trades, nextHistoryPage(trades, query)
+}
+
+// the trades the user was on one side of, or both, newest first
+// returns the Before of the next page too, 0 if this one is the last
+func (ex *Exchange) GetUserTrades(userId string, query TradeHistoryQuery) ([]entities.Trade, int64) {
+	query = withHistoryLimit(query)
+	trades := ex.LastTradesRepo.ReadForUser(userId, query)
+	return trades, nextHistoryPage(trades, query)
+}
+
+func withHistoryLimit(query TradeHistoryQuery) TradeHistoryQuery {
+	if query.Limit <= 0 {
+		query.Limit = DefaultTradeHistoryLimit
+	}
+	if query.Limit > MaxTradeHistoryLimit {
+		query.Limit = MaxTradeHistoryLimit
+	}
+	return query
+}
+
+// a full page may not be the last one
+func nextHistoryPage(trades []entities.Trade, query TradeHistoryQuery) int64 {
+	if len(trades) < query.Limit {
+		return 0
+	}
+	return trades[len(trades)-1].GetId()
+}
@@ -0,0 +1,326 @@
+package usecases
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trandinhkhoa/crypto-exchange/entities"
+)
+
+type CommandType string
+
+const (
+	RegisterUserCommand           CommandType = "REGISTER_USER"
+	DepositCommand                CommandType = "DEPOSIT"
+	SetSelfTradePreventionCommand CommandType = "SET_SELF_TRADE_PREVENTION"
+	PlaceOrderCommand             CommandType = "PLACE_ORDER"
+	CancelOrderCommand            CommandType = "CANCEL_ORDER"
+	AmendOrderCommand             CommandType = "AMEND_ORDER"
+	ExpireOrdersCommand           CommandType = "EXPIRE_ORDERS"
+)
+
+// what the exchange was asked to do, appended to the Journal before it is applied
+// only the fields of its type are set
+type Command struct {
+	// 1, 2, 3... no gap
+	Sequence int64
+	Type     CommandType
+	// unix nano, the clock of the exchange while the command is applied: time of the trades, expiry of the GTD orders...
+	Timestamp int64
+	UserId    string
+	Ticker    string
+	// REGISTER_USER
+	Balance map[string]entities.Decimal
+	// DEPOSIT
+	Asset  string
+	Amount entities.Decimal
+	// SET_SELF_TRADE_PREVENTION
+	SelfTradePrevention entities.SelfTradePrevention
+	// PLACE_ORDER, without its id: it is given again when the command is replayed
+	Order *JournaledOrder
+	// CANCEL_ORDER and AMEND_ORDER
+	OrderId int64
+	// AMEND_ORDER, zero keeps the current one
+	Size  entities.Decimal
+	Price entities.Decimal
+}
+
+// everything the exchange needs to place the order again
+type JournaledOrder struct {
+	UserId              string
+	Ticker              string
+	IsBid               bool
+	OrderType           entities.OrderType
+	Size                entities.Decimal
+	LimitPrice          entities.Decimal
+	Timestamp           int64
+	TimeInForce         entities.TimeInForce
+	ExpiresAt           int64
+	PostOnly            bool
+	PostOnlyReprice     bool
+	StopPrice           entities.Decimal
+	SelfTradePrevention entities.SelfTradePrevention
+}
+
+func toJournaledOrder(o entities.Order) *JournaledOrder {
+	return &JournaledOrder{
+		UserId:              o.GetUserId(),
+		Ticker:              o.GetTicker(),
+		IsBid:               o.GetIsBid(),
+		OrderType:           o.GetOrderType(),
+		Size:                o.GetSize(),
+		LimitPrice:          o.GetLimitPrice(),
+		Timestamp:           o.GetTimeStamp(),
+		TimeInForce:         o.GetTimeInForce(),
+		ExpiresAt:           o.GetExpiresAt(),
+		PostOnly:            o.GetPostOnly(),
+		PostOnlyReprice:     o.GetPostOnlyReprice(),
+		StopPrice:           o.GetStopPrice(),
+		SelfTradePrevention: o.GetSelfTradePrevention(),
+	}
+}
+
+func (jo JournaledOrder) toOrder() entities.Order {
+	order := entities.NewOrderWithIdAndTimeStamp(0, jo.UserId, jo.Ticker, jo.IsBid, jo.OrderType, jo.Size, jo.LimitPrice, jo.Timestamp)
+	order.SetTimeInForce(jo.TimeInForce, jo.ExpiresAt)
+	order.SetPostOnly(jo.PostOnly, jo.PostOnlyReprice)
+	order.SetStopPrice(jo.StopPrice)
+	order.SetSelfTradePrevention(jo.SelfTradePrevention)
+	return *order
+}
+
+// the command was not applied: it could not be written to the journal first
+type JournalError struct {
+	Err error
+}
+
+func (e JournalError) Error() string {
+	return fmt.Sprintf("unable to journal the command: %s", e.Err)
+}
+
+func (e JournalError) Unwrap() error {
+	return e.Err
+}
+
+// the time of the command being applied, see Command.Timestamp
+// MUST be called with ex.mu held, at the beginning of each command
+func (ex *Exchange) tick() {
+	ex.now = time.Now().UnixNano()
+}
+
+// append the command to the journal before it is applied, so Recover can apply it again
+// commands rejected by the checks are not journaled, but an amendment is checked once its order is out of the book
+// MUST be called with ex.mu held, after tick
+func (ex *Exchange) journal(command Command) error {
+	if ex.Journal == nil {
+		return nil
+	}
+	// the state is the one of every command journaled so far
+	ex.maybeSaveSnapshot()
+	command.Sequence = ex.commandIds.Last() + 1
+	command.Timestamp = ex.now
+	if err := ex.Journal.Append(command); err != nil {
+		logrus.Errorf("Unable to journal command %d %s: %s", command.Sequence, command.Type, err)
+		return &JournalError{Err: err}
+	}
+	ex.commandIds.AdvanceTo(command.Sequence)
+	return nil
+}
+
+// apply the journaled commands again, through the same code, in the same order and at the same time
+// the book, the balances, the trades and the fees come out as they were.
+// the database is written once at the end instead of once per command
+// MUST be called with ex.mu held, on an exchange with no user nor order yet, or with only the snapshot the commands follow
+func (ex *Exchange) replayJournal(commands []Command) {
+	// the trades of the snapshot are already in the database
+	lastTradeId := ex.tradeIds.Last()
+	replayedCandles := make(bufferedCandlesRepo, 0)
+	ordersRepo, usersRepo, lastTradesRepo, sequencesRepo, feesRepo, candlesRepo, transactionManager :=
+		ex.OrdersRepo, ex.UsersRepo, ex.LastTradesRepo, ex.SequencesRepo, ex.FeesRepo, ex.CandlesRepo, ex.TransactionManager
+	ex.OrdersRepo, ex.UsersRepo, ex.LastTradesRepo, ex.SequencesRepo, ex.FeesRepo, ex.CandlesRepo, ex.TransactionManager =
+		noopOrdersRepo{}, noopUsersRepo{}, noopLastTradesRepo{}, noopSequencesRepo{}, noopFeesRepo{}, replayedCandles, noopTransactionManager{}
+
+	for _, command := range commands {
+		if command.Sequence != ex.commandIds.Last()+1 {
+			logrus.Warnf("Journal goes from command %d to command %d", ex.commandIds.Last(), command.Sequence)
+		}
+		ex.commandIds.AdvanceTo(command.Sequence)
+		ex.replay(command)
+	}
+	// nobody to notify
+	ex.popSelfTradesPrevented()
+
+	ex.OrdersRepo, ex.UsersRepo, ex.LastTradesRepo, ex.SequencesRepo, ex.FeesRepo, ex.CandlesRepo, ex.TransactionManager =
+		ordersRepo, usersRepo, lastTradesRepo, sequencesRepo, feesRepo, candlesRepo, transactionManager
+	ex.persistSnapshot(lastTradeId, replayedCandles)
+}
+
+// what the public method of each command does once it is journaled, minus the notifications
+// MUST be called with ex.mu held
+func (ex *Exchange) replay(command Command) {
+	ex.now = command.Timestamp
+	switch command.Type {
+	case RegisterUserCommand:
+		ex.registerUser(command.UserId, command.Balance)
+	case DepositCommand:
+		ex.deposit(command.UserId, command.Asset, command.Amount)
+	case SetSelfTradePreventionCommand:
+		ex.setSelfTradePrevention(command.UserId, command.SelfTradePrevention)
+	case PlaceOrderCommand:
+		order := command.Order.toOrder()
+		switch {
+		case order.GetOrderType() == entities.LimitOrderType:
+			ex.placeLimitOrder(&order)
+		case order.GetOrderType() == entities.MarketOrderType:
+			ex.placeMarketOrder(&order)
+		case order.GetOrderType().IsStop():
+			ex.placeStopOrder(&order)
+		}
+		ex.triggerStopOrders(Ticker(order.GetTicker()))
+	case CancelOrderCommand:
+		ex.cancelOrder(command.OrderId, Ticker(command.Ticker))
+	case AmendOrderCommand:
+		if _, _, err := ex.amendOrder(command.OrderId, Ticker(command.Ticker), command.Size, command.Price); err == nil {
+			ex.triggerStopOrders(Ticker(command.Ticker))
+		}
+	case ExpireOrdersCommand:
+		ex.expireOrders(command.Timestamp)
+	default:
+		logrus.Warnf("Skipping command %d of unknown type %s", command.Sequence, command.Type)
+	}
+}
+
+// write what was replayed to the database, which might be behind the journal .e.g. crash before the commit
+// only the trades after lastTradeId and the fees still in the ledger are looked up, the ones before are already in it
+// MUST be called with ex.mu held
+func (ex *Exchange) persistSnapshot(lastTradeId int64, replayedCandles bufferedCandlesRepo) {
+	ex.beginTransaction()
+	defer ex.commitTransaction()
+
+	storedUsers := make(map[string]bool, 0)
+	for _, user := range ex.UsersRepo.ReadAll() {
+		storedUsers[user.GetUserId()] = true
+	}
+	openOrders := make(map[int64]entities.Order, 0)
+	for _, user := range ex.usersMap {
+		if storedUsers[user.GetUserId()] {
+			ex.UsersRepo.Update(*user)
+		} else {
+			ex.UsersRepo.Create(*user)
+		}
+		for orderId, order := range user.OpenOrders {
+			openOrders[orderId] = order
+		}
+	}
+
+	storedOrders := make(map[int64]bool, 0)
+	for _, side := range []string{"buy", "sell", "stop"} {
+		for _, order := range ex.OrdersRepo.ReadAll(side) {
+			if _, ok := openOrders[order.GetId()]; ok {
+				storedOrders[order.GetId()] = true
+			} else {
+				ex.OrdersRepo.Delete(order)
+			}
+		}
+	}
+	for orderId, order := range openOrders {
+		if storedOrders[orderId] {
+			ex.OrdersRepo.Update(order)
+		} else {
+			ex.OrdersRepo.Create(order)
+		}
+	}
+
+	storedTrades := make(map[int64]bool, 0)
+	for _, trade := range ex.LastTradesRepo.ReadAfter(lastTradeId) {
+		storedTrades[trade.GetId()] = true
+	}
+	for _, orderbook := range ex.orderbooksMap {
+		for _, trade := range orderbook.GetLastTrades() {
+			if trade.GetId() > lastTradeId && !storedTrades[trade.GetId()] {
+				ex.LastTradesRepo.Create(trade)
+			}
+		}
+	}
+
+	// the fees older than 30 days were dropped from the ledger in memory, they are already in the database anyway
+	oldestFee := int64(0)
+	for _, entries := range ex.feeLedger {
+		if len(entries) > 0 && (oldestFee == 0 || entries[0].Timestamp < oldestFee) {
+			oldestFee = entries[0].Timestamp
+		}
+	}
+	storedFees := make(map[string]bool, 0)
+	for _, entry := range ex.FeesRepo.ReadSince(oldestFee) {
+		storedFees[feeEntryKey(entry)] = true
+	}
+	for _, entries := range ex.feeLedger {
+		for _, entry := range entries {
+			if !storedFees[feeEntryKey(entry)] {
+				ex.FeesRepo.Create(entry)
+			}
+		}
+	}
+
+	for _, candle := range replayedCandles {
+		ex.CandlesRepo.Save(candle)
+	}
+
+	ex.persistSequences()
+}
+
+// the buyer and the seller of a trade pay in different assets, even when they are the same user
+func feeEntryKey(entry entities.FeeLedgerEntry) string {
+	return fmt.Sprintf("%d/%s/%s", entry.TradeId, entry.UserId, entry.Asset)
+}
+
+// used while the journal is replayed
+type noopOrdersRepo struct{}
+
+func (noopOrdersRepo) Create(entities.Order)           {}
+func (noopOrdersRepo) ReadAll(string) []entities.Order { return nil }
+func (noopOrdersRepo) Update(entities.Order)           {}
+func (noopOrdersRepo) Delete(entities.Order)           {}
+
+type noopUsersRepo struct{}
+
+func (noopUsersRepo) Create(entities.User)     {}
+func (noopUsersRepo) ReadAll() []entities.User { return nil }
+func (noopUsersRepo) Update(entities.User)     {}
+
+type noopLastTradesRepo struct{}
+
+func (noopLastTradesRepo) Create(entities.Trade)            {}
+func (noopLastTradesRepo) ReadAfter(int64) []entities.Trade { return nil }
+func (noopLastTradesRepo) ReadForTicker(string, TradeHistoryQuery) []entities.Trade {
+	return nil
+}
+func (noopLastTradesRepo) ReadForUser(string, TradeHistoryQuery) []entities.Trade {
+	return nil
+}
+
+type noopSequencesRepo struct{}
+
+func (noopSequencesRepo) Read(string) int64    { return 0 }
+func (noopSequencesRepo) Update(string, int64) {}
+
+type noopFeesRepo struct{}
+
+func (noopFeesRepo) Create(entities.FeeLedgerEntry)            {}
+func (noopFeesRepo) ReadSince(int64) []entities.FeeLedgerEntry { return nil }
+
+// the candles saved while the journal is replayed, the latest version of each
+type bufferedCandlesRepo map[string]entities.Candle
+
+func (candles bufferedCandlesRepo) Save(candle entities.Candle) {
+	candles[fmt.Sprintf("%s/%s/%d", candle.Ticker, candle.Interval, candle.OpenTime)] = candle
+}
+func (bufferedCandlesRepo) Read(string, entities.CandleInterval, CandleQuery) []entities.Candle {
+	return nil
+}
+
+type noopTransactionManager struct{}
+
+func (noopTransactionManager) Begin() error  { return nil }
+func (noopTransactionManager) Commit() error { return nil }
@@ -0,0 +1,336 @@
+package usecases
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trandinhkhoa/crypto-exchange/entities"
+)
+
+// number of price levels of each side in the market data
+const MarketDataDepth = 50
+
+// number of trades in the first event of a subscription
+const MarketDataTrades = 15
+
+type PriceLevel struct {
+	Price  entities.Decimal
+	Volume entities.Decimal
+}
+
+// what changed in the market of a ticker after a command
+// the first event of a subscription is the market as it is: the last trades and both sides
+type MarketDataEvent struct {
+	Ticker string
+	// the trades since the event before, oldest first. Without their orders
+	Trades []entities.Trade
+	// best first, set when the side changed
+	BestBuys     []PriceLevel
+	BestSells    []PriceLevel
+	BuysChanged  bool
+	SellsChanged bool
+	// the whole book, in the first event only
+	Book *L2Book
+	// the price levels whose volume changed, and the book sequence once they are applied
+	LevelChanges []entities.LevelChange
+	BookSequence int64
+	// every order of the book, in the first event only
+	Orders *L3Book
+	// the changes of the book order by order, oldest first
+	OrderEvents []entities.OrderEvent
+	// the latest candle of each interval, set with the trades and in the first event
+	Candles []entities.Candle
+}
+
+// every price level of both sides, best first
+// Sequence is the book sequence of the orderbook: the level changes of a greater one come after it
+type L2Book struct {
+	Sequence int64
+	Bids     []PriceLevel
+	Asks     []PriceLevel
+}
+
+// every order of both sides, best price first then time priority
+// Sequence is the order sequence of the orderbook: the order events after it come next
+type L3Book struct {
+	Sequence int64
+	Bids     []L3Order
+	Asks     []L3Order
+}
+
+// an order resting in the book, without its user
+type L3Order struct {
+	OrderId   int64
+	Price     entities.Decimal
+	Size      entities.Decimal
+	Timestamp int64
+}
+
+// the market data of one ticker, for one consumer
+type MarketDataSubscription struct {
+	ticker string
+	events chan MarketDataEvent
+	bus    *marketDataBus
+	// set before events is closed
+	dropped bool
+}
+
+// closed by Close, or when the consumer was too slow: see Dropped
+func (sub *MarketDataSubscription) Events() <-chan MarketDataEvent {
+	return sub.events
+}
+
+// true once the events channel is closed because it was full, events were lost
+func (sub *MarketDataSubscription) Dropped() bool {
+	sub.bus.mu.Lock()
+	defer sub.bus.mu.Unlock()
+	return sub.dropped
+}
+
+func (sub *MarketDataSubscription) Close() {
+	sub.bus.remove(sub, false)
+}
+
+// the subscriptions by ticker. Publishing never waits for a consumer
+type marketDataBus struct {
+	mu            sync.Mutex
+	subscriptions map[string]map[*MarketDataSubscription]bool
+}
+
+func newMarketDataBus() *marketDataBus {
+	return &marketDataBus{
+		subscriptions: make(map[string]map[*MarketDataSubscription]bool, 0),
+	}
+}
+
+func (bus *marketDataBus) add(sub *MarketDataSubscription) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	if bus.subscriptions[sub.ticker] == nil {
+		bus.subscriptions[sub.ticker] = make(map[*MarketDataSubscription]bool, 0)
+	}
+	bus.subscriptions[sub.ticker][sub] = true
+}
+
+func (bus *marketDataBus) remove(sub *MarketDataSubscription, dropped bool) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	if !bus.subscriptions[sub.ticker][sub] {
+		return
+	}
+	delete(bus.subscriptions[sub.ticker], sub)
+	sub.dropped = dropped
+	close(sub.events)
+}
+
+func (bus *marketDataBus) hasSubscriptions(ticker string) bool {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	return len(bus.subscriptions[ticker]) > 0
+}
+
+// a subscription with a full buffer is dropped rather than waited for
+func (bus *marketDataBus) publish(event MarketDataEvent) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	for sub := range bus.subscriptions[event.Ticker] {
+		select {
+		case sub.events <- event:
+		default:
+			logrus.Warnf("Dropping a slow subscription to the market data of %s", event.Ticker)
+			delete(bus.subscriptions[event.Ticker], sub)
+			sub.dropped = true
+			close(sub.events)
+		}
+	}
+}
+
+// what the subscriptions of a ticker were last told
+type publishedMarketData struct {
+	// number of trades of the orderbook
+	trades    int
+	bestBuys  []PriceLevel
+	bestSells []PriceLevel
+}
+
+// buffer is the number of events the consumer can be behind before it is dropped, at least 1
+// the first event is the market as it is
+func (ex *Exchange) SubscribeMarketData(ticker string, buffer int) (*MarketDataSubscription, error) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	orderbook, ok := ex.orderbooksMap[Ticker(ticker)]
+	if !ok {
+		return nil, &UnknownTickerError{Ticker: ticker}
+	}
+	if buffer < 1 {
+		buffer = 1
+	}
+	// the book is the one after the changes that were published
+	ex.publishMarketData()
+
+	published := ex.publishedMarketData[Ticker(ticker)]
+	trades := orderbook.GetLastTrades()
+	published.trades = len(trades)
+	published.bestBuys = toPriceLevels(orderbook.GetBestBuyLimits(MarketDataDepth))
+	published.bestSells = toPriceLevels(orderbook.GetBestSellLimits(MarketDataDepth))
+	if len(trades) > MarketDataTrades {
+		trades = trades[len(trades)-MarketDataTrades:]
+	}
+
+	sub := &MarketDataSubscription{
+		ticker: ticker,
+		events: make(chan MarketDataEvent, buffer),
+		bus:    ex.marketData,
+	}
+	book := toL2Book(orderbook)
+	orders := toL3Book(orderbook)
+	sub.events <- MarketDataEvent{
+		Ticker:       ticker,
+		Trades:       detachTrades(trades),
+		BestBuys:     published.bestBuys,
+		BestSells:    published.bestSells,
+		BuysChanged:  true,
+		SellsChanged: true,
+		Book:         &book,
+		BookSequence: book.Sequence,
+		Orders:       &orders,
+		Candles:      ex.latestCandles(Ticker(ticker)),
+	}
+	ex.marketData.add(sub)
+	return sub, nil
+}
+
+// tell the subscriptions what changed in each orderbook since they were last told
+// MUST be called with ex.mu held, at the end of every command that changes an orderbook
+func (ex *Exchange) publishMarketData() {
+	for ticker, orderbook := range ex.orderbooksMap {
+		published := ex.publishedMarketData[ticker]
+		trades := orderbook.GetLastTrades()
+		newTrades := trades[published.trades:]
+		published.trades = len(trades)
+		// the book sequence goes on without subscriptions too
+		levelChanges := orderbook.PopLevelChanges()
+		orderEvents := orderbook.PopOrderEvents()
+		// SubscribeMarketData starts from the orderbook as it is then
+		if !ex.marketData.hasSubscriptions(string(ticker)) {
+			continue
+		}
+
+		event := MarketDataEvent{
+			Ticker:       string(ticker),
+			Trades:       detachTrades(newTrades),
+			LevelChanges: levelChanges,
+			BookSequence: orderbook.GetBookSequence(),
+			OrderEvents:  orderEvents,
+		}
+		if len(newTrades) > 0 {
+			event.Candles = ex.latestCandles(ticker)
+		}
+		bestBuys := toPriceLevels(orderbook.GetBestBuyLimits(MarketDataDepth))
+		if !SamePriceLevels(bestBuys, published.bestBuys) {
+			event.BestBuys, event.BuysChanged = bestBuys, true
+			published.bestBuys = bestBuys
+		}
+		bestSells := toPriceLevels(orderbook.GetBestSellLimits(MarketDataDepth))
+		if !SamePriceLevels(bestSells, published.bestSells) {
+			event.BestSells, event.SellsChanged = bestSells, true
+			published.bestSells = bestSells
+		}
+		if len(event.Trades) > 0 || event.BuysChanged || event.SellsChanged || len(event.LevelChanges) > 0 || len(event.OrderEvents) > 0 {
+			ex.marketData.publish(event)
+		}
+	}
+}
+
+// the whole book with its sequence, to resync after a gap in the level changes
+func (ex *Exchange) GetL2Book(ticker string) (L2Book, error) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	orderbook, ok := ex.orderbooksMap[Ticker(ticker)]
+	if !ok {
+		return L2Book{}, &UnknownTickerError{Ticker: ticker}
+	}
+	ex.publishMarketData()
+	return toL2Book(orderbook), nil
+}
+
+// every order of the book with its sequence, to resync after a gap in the order events
+func (ex *Exchange) GetL3Book(ticker string) (L3Book, error) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	orderbook, ok := ex.orderbooksMap[Ticker(ticker)]
+	if !ok {
+		return L3Book{}, &UnknownTickerError{Ticker: ticker}
+	}
+	ex.publishMarketData()
+	return toL3Book(orderbook), nil
+}
+
+// MUST be called with ex.mu held, with no level change left to publish
+func toL2Book(orderbook *entities.Orderbook) L2Book {
+	return L2Book{
+		Sequence: orderbook.GetBookSequence(),
+		Bids:     toPriceLevels(orderbook.GetBuyLimits()),
+		Asks:     toPriceLevels(orderbook.GetSellLimits()),
+	}
+}
+
+// MUST be called with ex.mu held, with no order event left to publish
+func toL3Book(orderbook *entities.Orderbook) L3Book {
+	return L3Book{
+		Sequence: orderbook.GetOrderSequence(),
+		Bids:     toL3Orders(orderbook.GetBuyLimits()),
+		Asks:     toL3Orders(orderbook.GetSellLimits()),
+	}
+}
+
+func toL3Orders(limits []*entities.Limit) []L3Order {
+	orders := make([]L3Order, 0)
+	for _, limit := range limits {
+		for _, order := range limit.GetAllOrders() {
+			orders = append(orders, L3Order{
+				OrderId:   order.GetId(),
+				Price:     order.GetLimitPrice(),
+				Size:      order.Size,
+				Timestamp: order.GetTimeStamp(),
+			})
+		}
+	}
+	return orders
+}
+
+func toPriceLevels(limits []*entities.Limit) []PriceLevel {
+	levels := make([]PriceLevel, 0, len(limits))
+	for _, limit := range limits {
+		levels = append(levels, PriceLevel{
+			Price:  limit.GetLimitPrice(),
+			Volume: limit.GetTotalVolume(),
+		})
+	}
+	return levels
+}
+
+func SamePriceLevels(a []PriceLevel, b []PriceLevel) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// the orders of the trades go on changing in the orderbook, the consumers read the events concurrently
+func detachTrades(trades []entities.Trade) []entities.Trade {
+	detached := make([]entities.Trade, 0, len(trades))
+	for _, trade := range trades {
+		record := entities.NewTradeRecord(trade.GetId(), trade.GetTicker(),
+			trade.GetBuyerOrderId(), trade.GetBuyerUserId(), trade.GetSellerOrderId(), trade.GetSellerUserId(),
+			trade.GetPrice(), trade.GetSize(), trade.GetIsBuyerMaker(), trade.GetTimeStamp())
+		record.SetFees(trade.GetBuyerFee(), trade.GetSellerFee())
+		detached = append(detached, *record)
+	}
+	return detached
+}
@@ -20,5 +20,69 @@ type UsersRepository interface {
 
 type LastTradesRepository interface {
 	Create(entities.Trade)
-	ReadAll() []entities.Trade
+	// the trades with a greater id, oldest first
+	ReadAfter(id int64) []entities.Trade
+	// newest first, the trades are read back without their orders
+	ReadForTicker(ticker string, query TradeHistoryQuery) []entities.Trade
+	ReadForUser(userId string, query TradeHistoryQuery) []entities.Trade
+}
+
+// a page of the trade history, newest first
+type TradeHistoryQuery struct {
+	// unix nano, from included to excluded, 0 for no bound
+	From int64
+	To   int64
+	// only the trades with a smaller id, 0 for the latest ones
+	// the id of the last trade of a page gives the next one
+	Before int64
+	Limit  int
+}
+
+// created, or replaced if there is one of the same ticker, interval and open time
+type CandlesRepository interface {
+	Save(entities.Candle)
+	// oldest first
+	Read(ticker string, interval entities.CandleInterval, query CandleQuery) []entities.Candle
+}
+
+// the latest candles of a range of open times
+type CandleQuery struct {
+	// unix nano, from included to excluded, 0 for no bound
+	From  int64
+	To    int64
+	Limit int
+}
+
+// last id handed out by each sequence of the exchange .e.g. "orders", "trades"
+type SequencesRepository interface {
+	Read(name string) int64
+	Update(name string, last int64)
+}
+
+type FeesRepository interface {
+	Create(entities.FeeLedgerEntry)
+	// oldest first
+	ReadSince(timestamp int64) []entities.FeeLedgerEntry
+}
+
+// the writes to the repositories between Begin and Commit are saved all together or not at all
+type TransactionManager interface {
+	Begin() error
+	Commit() error
+}
+
+// append-only, the commands come back in the order they were appended
+type Journal interface {
+	Append(Command) error
+	ReadAll() ([]Command, error)
+}
+
+// keeps the latest snapshots, see Exchange.SaveSnapshot
+type SnapshotStore interface {
+	Save(Snapshot) error
+	// newest first
+	List() ([]int64, error)
+	// an error if the snapshot can't be trusted .e.g. corrupted
+	Read(sequence int64) (Snapshot, error)
+	Delete(sequence int64) error
 }
@@ -0,0 +1,195 @@
+package usecases
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/trandinhkhoa/crypto-exchange/entities"
+)
+
+type RejectionReason string
+
+const (
+	UnknownUserReason         RejectionReason = "UNKNOWN_USER"
+	InvalidSizeReason         RejectionReason = "INVALID_SIZE"
+	InvalidPriceReason        RejectionReason = "INVALID_PRICE"
+	InsufficientBalanceReason RejectionReason = "INSUFFICIENT_BALANCE"
+	NoLiquidityReason         RejectionReason = "NO_LIQUIDITY"
+	InvalidTickSizeReason     RejectionReason = "INVALID_TICK_SIZE"
+	InvalidLotSizeReason      RejectionReason = "INVALID_LOT_SIZE"
+	MinNotionalReason         RejectionReason = "BELOW_MIN_NOTIONAL"
+	InvalidTimeInForceReason  RejectionReason = "INVALID_TIME_IN_FORCE"
+	InvalidExpiryReason       RejectionReason = "INVALID_EXPIRY"
+	PostOnlyWouldCrossReason  RejectionReason = "POST_ONLY_WOULD_CROSS"
+	InvalidStopPriceReason    RejectionReason = "INVALID_STOP_PRICE"
+	// also returned by Exchange.SetSelfTradePrevention
+	InvalidSelfTradePreventionReason RejectionReason = "INVALID_SELF_TRADE_PREVENTION"
+	// returned by Exchange.Deposit
+	InvalidDepositReason RejectionReason = "INVALID_DEPOSIT"
+)
+
+// returned when an order does not pass the pre-trade checks.
+// nothing in the orderbook or in the users' balances has been touched at that point
+type OrderRejectedError struct {
+	Reason RejectionReason
+	msg    string
+}
+
+func (e OrderRejectedError) Error() string {
+	return e.msg
+}
+
+func newOrderRejectedError(reason RejectionReason, format string, a ...any) *OrderRejectedError {
+	return &OrderRejectedError{
+		Reason: reason,
+		msg:    fmt.Sprintf(format, a...),
+	}
+}
+
+// pre-trade checks, MUST be called with ex.mu held and before the order reaches the orderbook
+func (ex *Exchange) checkRisk(o entities.Order) error {
+	ticker := Ticker(o.GetTicker())
+	instrument, ok := ex.instruments[ticker]
+	if !ok {
+		return &UnknownTickerError{Ticker: o.GetTicker()}
+	}
+	ticker1 := instrument.BaseAsset
+	ticker2 := instrument.QuoteAsset
+
+	user, ok := ex.usersMap[o.GetUserId()]
+	if !ok {
+		return newOrderRejectedError(UnknownUserReason, "userId %s does not exist", o.GetUserId())
+	}
+	if !o.GetSize().IsPositive() {
+		return newOrderRejectedError(InvalidSizeReason, "size must be positive, got %s", o.GetSize())
+	}
+	if !instrument.IsValidSize(o.GetSize()) {
+		return newOrderRejectedError(InvalidLotSizeReason, "size %s is not a multiple of the lot size %s", o.GetSize(), instrument.LotSize)
+	}
+	if !o.GetSelfTradePrevention().IsValid() {
+		return newOrderRejectedError(InvalidSelfTradePreventionReason, "unknown self-trade prevention %s", o.GetSelfTradePrevention())
+	}
+
+	if o.GetOrderType() == entities.MarketOrderType {
+		// worst case: the whole size is walked across the price levels of the other side
+		// the orders of the user are not filled, it depends on the self-trade prevention of the order
+		resolved := o
+		ex.resolveSelfTradePrevention(&resolved)
+		cost, err := ex.orderbooksMap[ticker].GetCostToFill(resolved)
+		if err != nil {
+			var noLiquidError *entities.NoLiquidityError
+			if errors.As(err, &noLiquidError) {
+				return newOrderRejectedError(NoLiquidityReason, noLiquidError.Error())
+			}
+			return err
+		}
+		if cost.LessThan(instrument.MinNotional) {
+			return newOrderRejectedError(MinNotionalReason, "order value %s is below the minimum %s", cost, instrument.MinNotional)
+		}
+		if o.GetIsBid() && user.GetAvailable(ticker2).LessThan(cost) {
+			return newOrderRejectedError(InsufficientBalanceReason,
+				"market buy might cost up to %s %s, available %s %s", cost, ticker2, user.GetAvailable(ticker2), ticker2)
+		}
+	} else {
+		if !o.GetLimitPrice().IsPositive() {
+			return newOrderRejectedError(InvalidPriceReason, "price must be positive, got %s", o.GetLimitPrice())
+		}
+		if !o.GetTimeInForce().IsValid() {
+			return newOrderRejectedError(InvalidTimeInForceReason, "unknown time in force %s", o.GetTimeInForce())
+		}
+		if o.GetPostOnly() && (o.GetTimeInForce() == entities.ImmediateOrCancel || o.GetTimeInForce() == entities.FillOrKill) {
+			return newOrderRejectedError(InvalidTimeInForceReason, "a post only order can't be %s, it has to rest in the book", o.GetTimeInForce())
+		}
+		if o.GetTimeInForce() == entities.GoodTillDate && o.GetExpiresAt() <= ex.now {
+			return newOrderRejectedError(InvalidExpiryReason, "GTD order expires at %d, which is in the past", o.GetExpiresAt())
+		}
+		if !instrument.IsValidPrice(o.GetLimitPrice()) {
+			return newOrderRejectedError(InvalidTickSizeReason, "price %s is not a multiple of the tick size %s", o.GetLimitPrice(), instrument.TickSize)
+		}
+		value := o.GetSize().Mul(o.GetLimitPrice())
+		if value.LessThan(instrument.MinNotional) {
+			return newOrderRejectedError(MinNotionalReason, "order value %s is below the minimum %s", value, instrument.MinNotional)
+		}
+		if o.GetIsBid() && user.GetAvailable(ticker2).LessThan(value) {
+			return newOrderRejectedError(InsufficientBalanceReason,
+				"limit buy needs %s %s, available %s %s", value, ticker2, user.GetAvailable(ticker2), ticker2)
+		}
+	}
+
+	if !o.GetIsBid() && user.GetAvailable(ticker1).LessThan(o.GetSize()) {
+		return newOrderRejectedError(InsufficientBalanceReason,
+			"sell needs %s %s, available %s %s", o.GetSize(), ticker1, user.GetAvailable(ticker1), ticker1)
+	}
+	return nil
+}
+
+// a post only order that would take liquidity is rejected, or moved one tick away from the other side if it asks for it.
+// MUST be called with ex.mu held, after checkRisk
+func (ex *Exchange) checkPostOnly(o *entities.Order) error {
+	if !o.GetPostOnly() || o.GetOrderType() != entities.LimitOrderType {
+		return nil
+	}
+	ticker := Ticker(o.GetTicker())
+	orderbook := ex.orderbooksMap[ticker]
+	if !orderbook.WouldCross(*o) {
+		return nil
+	}
+	if !o.GetPostOnlyReprice() {
+		return newOrderRejectedError(PostOnlyWouldCrossReason, "post only order at %s would take liquidity", o.GetLimitPrice())
+	}
+	passivePrice := orderbook.GetPassivePrice(*o, ex.instruments[ticker].TickSize)
+	if !passivePrice.IsPositive() {
+		return newOrderRejectedError(PostOnlyWouldCrossReason, "post only order can't be repriced below %s", o.GetLimitPrice())
+	}
+	o.SetLimitPrice(passivePrice)
+	// the order is worth less for a buy
+	return ex.checkRisk(*o)
+}
+
+// checks of a stop order before it goes to the trigger book, MUST be called with ex.mu held
+// the balance is only checked when the order is triggered, by checkRisk
+func (ex *Exchange) checkStopOrder(o entities.Order) error {
+	ticker := Ticker(o.GetTicker())
+	instrument, ok := ex.instruments[ticker]
+	if !ok {
+		return &UnknownTickerError{Ticker: o.GetTicker()}
+	}
+	if _, ok := ex.usersMap[o.GetUserId()]; !ok {
+		return newOrderRejectedError(UnknownUserReason, "userId %s does not exist", o.GetUserId())
+	}
+	if !o.GetSize().IsPositive() {
+		return newOrderRejectedError(InvalidSizeReason, "size must be positive, got %s", o.GetSize())
+	}
+	if !instrument.IsValidSize(o.GetSize()) {
+		return newOrderRejectedError(InvalidLotSizeReason, "size %s is not a multiple of the lot size %s", o.GetSize(), instrument.LotSize)
+	}
+	if !o.GetSelfTradePrevention().IsValid() {
+		return newOrderRejectedError(InvalidSelfTradePreventionReason, "unknown self-trade prevention %s", o.GetSelfTradePrevention())
+	}
+	if !o.GetStopPrice().IsPositive() {
+		return newOrderRejectedError(InvalidStopPriceReason, "stop price must be positive, got %s", o.GetStopPrice())
+	}
+	if !instrument.IsValidPrice(o.GetStopPrice()) {
+		return newOrderRejectedError(InvalidTickSizeReason, "stop price %s is not a multiple of the tick size %s", o.GetStopPrice(), instrument.TickSize)
+	}
+	if o.GetOrderType() == entities.StopLimitOrderType {
+		if !o.GetLimitPrice().IsPositive() {
+			return newOrderRejectedError(InvalidPriceReason, "price must be positive, got %s", o.GetLimitPrice())
+		}
+		if !instrument.IsValidPrice(o.GetLimitPrice()) {
+			return newOrderRejectedError(InvalidTickSizeReason, "price %s is not a multiple of the tick size %s", o.GetLimitPrice(), instrument.TickSize)
+		}
+		if !o.GetTimeInForce().IsValid() {
+			return newOrderRejectedError(InvalidTimeInForceReason, "unknown time in force %s", o.GetTimeInForce())
+		}
+	}
+	// it would be triggered right away
+	lastTradedPrice := ex.orderbooksMap[ticker].GetLastTradedPrice()
+	if !lastTradedPrice.IsZero() && o.IsTriggeredBy(lastTradedPrice) {
+		if o.GetIsBid() {
+			return newOrderRejectedError(InvalidStopPriceReason, "buy stop price %s must be above the last price %s", o.GetStopPrice(), lastTradedPrice)
+		}
+		return newOrderRejectedError(InvalidStopPriceReason, "sell stop price %s must be below the last price %s", o.GetStopPrice(), lastTradedPrice)
+	}
+	return nil
+}
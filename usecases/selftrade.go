@@ -0,0 +1,104 @@
+package usecases
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/trandinhkhoa/crypto-exchange/entities"
+)
+
+// the orders of one user cancelled, fully or partially, by self-trade prevention while one of its orders was matched
+type SelfTradePrevented struct {
+	UserId  string
+	Cancels []entities.SelfTradeCancel
+}
+
+// called after self-trade prevention cancelled orders, ex.mu is not held
+type SelfTradePreventedListener func(SelfTradePrevented)
+
+// the default of the orders of the user that do not set their own
+func (ex *Exchange) SetSelfTradePrevention(userId string, selfTradePrevention entities.SelfTradePrevention) error {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	ex.tick()
+	if _, ok := ex.usersMap[userId]; !ok {
+		return newOrderRejectedError(UnknownUserReason, "userId %s does not exist", userId)
+	}
+	if !selfTradePrevention.IsValid() {
+		return newOrderRejectedError(InvalidSelfTradePreventionReason, "unknown self-trade prevention %s", selfTradePrevention)
+	}
+	if err := ex.journal(Command{Type: SetSelfTradePreventionCommand, UserId: userId, SelfTradePrevention: selfTradePrevention}); err != nil {
+		return err
+	}
+	ex.setSelfTradePrevention(userId, selfTradePrevention)
+	return nil
+}
+
+// MUST be called with ex.mu held
+func (ex *Exchange) setSelfTradePrevention(userId string, selfTradePrevention entities.SelfTradePrevention) {
+	user := ex.usersMap[userId]
+	user.SetSelfTradePrevention(selfTradePrevention)
+	ex.UsersRepo.Update(*user)
+}
+
+// an order that does not set its own mode takes the one of its user. MUST be called with ex.mu held
+func (ex *Exchange) resolveSelfTradePrevention(o *entities.Order) {
+	if o.GetSelfTradePrevention() != entities.SelfTradePreventionUnset {
+		return
+	}
+	if user, ok := ex.usersMap[o.GetUserId()]; ok {
+		o.SetSelfTradePrevention(user.GetSelfTradePrevention())
+	}
+}
+
+// release and persist what the resting orders cancelled by self-trade prevention were holding
+// the incoming order is settled by whoever placed it. MUST be called with ex.mu held, after each match
+func (ex *Exchange) settleSelfTradeCancels(ticker Ticker) {
+	orderbook := ex.orderbooksMap[ticker]
+	selfTradeCancels := orderbook.PopSelfTradeCancels()
+	if len(selfTradeCancels) == 0 {
+		return
+	}
+	instrument := ex.instruments[ticker]
+	for _, selfTradeCancel := range selfTradeCancels {
+		order := selfTradeCancel.Order
+		logrus.WithFields(logrus.Fields{
+			"order": order,
+			"size":  selfTradeCancel.Size,
+		}).Info("Self-Trade Prevented")
+		if !selfTradeCancel.IsResting {
+			continue
+		}
+		user := ex.usersMap[order.GetUserId()]
+		ex.releaseFunds(user, instrument, order.GetIsBid(), order.GetLimitPrice(), selfTradeCancel.Size)
+		ex.refreshOpenOrder(user, ticker, order.GetId())
+
+		// TODO: persist should be async
+		ex.UsersRepo.Update(*user)
+		restingOrder, err := orderbook.GetOrderbyId(order.GetId())
+		if err != nil {
+			ex.OrdersRepo.Delete(order)
+		} else {
+			ex.OrdersRepo.Update(restingOrder)
+		}
+	}
+	// both sides of a self-trade belong to the same user
+	ex.selfTradesPrevented = append(ex.selfTradesPrevented, SelfTradePrevented{
+		UserId:  selfTradeCancels[0].Order.GetUserId(),
+		Cancels: selfTradeCancels,
+	})
+}
+
+// MUST be called with ex.mu held, the result is passed to notifySelfTradesPrevented once it is released
+func (ex *Exchange) popSelfTradesPrevented() []SelfTradePrevented {
+	selfTradesPrevented := ex.selfTradesPrevented
+	ex.selfTradesPrevented = make([]SelfTradePrevented, 0)
+	return selfTradesPrevented
+}
+
+func (ex *Exchange) notifySelfTradesPrevented(selfTradesPrevented []SelfTradePrevented) {
+	if ex.OnSelfTradePrevented == nil {
+		return
+	}
+	for _, selfTradePrevented := range selfTradesPrevented {
+		ex.OnSelfTradePrevented(selfTradePrevented)
+	}
+}
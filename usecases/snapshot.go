@@ -0,0 +1,330 @@
+package usecases
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trandinhkhoa/crypto-exchange/entities"
+)
+
+// the trades before are only in the database, see Exchange.RecentTrades
+const DefaultRecentTrades = 1000
+
+// the state of the exchange once the journaled commands up to Sequence were applied
+// Recover loads the latest one and only replays the commands after it
+type Snapshot struct {
+	Sequence int64
+	// unix nano, the clock of the exchange when it was taken
+	Timestamp   int64
+	LastOrderId int64
+	LastTradeId int64
+	Users       []SnapshotUser
+	Orderbooks  []SnapshotOrderbook
+	// the last 30 days, oldest first for each user
+	FeeLedger []entities.FeeLedgerEntry
+	// the latest candle of each ticker and interval, the trades after the snapshot go on in them
+	Candles []entities.Candle
+}
+
+type SnapshotUser struct {
+	UserId              string
+	Balance             map[string]entities.Balance
+	SelfTradePrevention entities.SelfTradePrevention
+	OpenOrders          []SnapshotOrder
+}
+
+type SnapshotOrderbook struct {
+	Ticker string
+	// buys highest price first then sells lowest price first, each price level in time priority
+	RestingOrders []SnapshotOrder
+	StopOrders    []SnapshotOrder
+	// the latest ones, oldest first. See DefaultRecentTrades
+	LastTrades []SnapshotTrade
+}
+
+// Size is what is left of the order
+type SnapshotOrder struct {
+	Id int64
+	JournaledOrder
+}
+
+// without its orders, like the trades read back from LastTradesRepo
+type SnapshotTrade struct {
+	Id            int64
+	BuyerOrderId  int64
+	BuyerUserId   string
+	SellerOrderId int64
+	SellerUserId  string
+	Price         entities.Decimal
+	Size          entities.Decimal
+	IsBuyerMaker  bool
+	Timestamp     int64
+	BuyerFee      entities.Decimal
+	SellerFee     entities.Decimal
+}
+
+func toSnapshotOrder(o entities.Order) SnapshotOrder {
+	return SnapshotOrder{Id: o.GetId(), JournaledOrder: *toJournaledOrder(o)}
+}
+
+func toSnapshotOrders(orders []entities.Order) []SnapshotOrder {
+	snapshotOrders := make([]SnapshotOrder, 0, len(orders))
+	for _, order := range orders {
+		snapshotOrders = append(snapshotOrders, toSnapshotOrder(order))
+	}
+	return snapshotOrders
+}
+
+func (so SnapshotOrder) toOrder() entities.Order {
+	order := so.JournaledOrder.toOrder()
+	order.SetId(so.Id)
+	return order
+}
+
+// take a snapshot now and write it, the exchange goes on matching while it is written
+func (ex *Exchange) SaveSnapshot() error {
+	ex.mu.Lock()
+	snapshot, ok := ex.takeSnapshot()
+	ex.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return ex.SnapshotStore.Save(snapshot)
+}
+
+func (ex *Exchange) SaveSnapshotEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := ex.SaveSnapshot(); err != nil {
+			logrus.Errorf("Unable to save snapshot: %s", err)
+		}
+	}
+}
+
+// every SnapshotEveryCommands commands, the snapshot is written in the background
+// MUST be called with ex.mu held, before the next command is journaled
+func (ex *Exchange) maybeSaveSnapshot() {
+	if ex.SnapshotEveryCommands <= 0 || ex.commandIds.Last()%ex.SnapshotEveryCommands != 0 {
+		return
+	}
+	snapshot, ok := ex.takeSnapshot()
+	if !ok {
+		return
+	}
+	go func() {
+		if err := ex.SnapshotStore.Save(snapshot); err != nil {
+			logrus.Errorf("Unable to save snapshot %d: %s", snapshot.Sequence, err)
+		}
+	}()
+}
+
+// a copy of the state, false if there is nothing new since the last snapshot
+// without a journal there is nothing to replay the snapshot with
+// MUST be called with ex.mu held
+func (ex *Exchange) takeSnapshot() (Snapshot, bool) {
+	if ex.SnapshotStore == nil || ex.Journal == nil || ex.commandIds.Last() <= ex.lastSnapshotSequence {
+		return Snapshot{}, false
+	}
+	snapshot := ex.snapshotState()
+	ex.lastSnapshotSequence = snapshot.Sequence
+	return snapshot, true
+}
+
+// the state recovered from the database is the one the journal starts from, its commands are applied to it by the next Recover.
+// without it, a crash before the first snapshot would replay them on an exchange that has none of the users and orders of the database
+// MUST be called with ex.mu held, with an empty journal
+func (ex *Exchange) saveBaselineSnapshot() {
+	if ex.Journal == nil {
+		return
+	}
+	if ex.SnapshotStore == nil {
+		if len(ex.usersMap) > 0 {
+			panic("A journal over a database that is not empty needs a snapshot store")
+		}
+		return
+	}
+	sequences, err := ex.SnapshotStore.List()
+	if err != nil {
+		panic(fmt.Sprintf("Unable to list the snapshots: %s", err))
+	}
+	// left by a journal that is gone, they are ahead of the new one
+	for _, sequence := range sequences {
+		if sequence > ex.commandIds.Last() {
+			if err := ex.SnapshotStore.Delete(sequence); err != nil {
+				panic(fmt.Sprintf("Unable to delete snapshot %d: %s", sequence, err))
+			}
+		}
+	}
+	snapshot := ex.snapshotState()
+	if err := ex.SnapshotStore.Save(snapshot); err != nil {
+		panic(fmt.Sprintf("Unable to save the snapshot the journal starts from: %s", err))
+	}
+	ex.lastSnapshotSequence = snapshot.Sequence
+}
+
+// MUST be called with ex.mu held
+func (ex *Exchange) snapshotState() Snapshot {
+	snapshot := Snapshot{
+		Sequence:    ex.commandIds.Last(),
+		Timestamp:   ex.now,
+		LastOrderId: ex.orderIds.Last(),
+		LastTradeId: ex.tradeIds.Last(),
+		Users:       make([]SnapshotUser, 0, len(ex.usersMap)),
+		Orderbooks:  make([]SnapshotOrderbook, 0, len(ex.orderbooksMap)),
+		FeeLedger:   make([]entities.FeeLedgerEntry, 0),
+		Candles:     make([]entities.Candle, 0),
+	}
+
+	userIds := make([]string, 0, len(ex.usersMap))
+	for userId := range ex.usersMap {
+		userIds = append(userIds, userId)
+	}
+	sort.Strings(userIds)
+	for _, userId := range userIds {
+		user := ex.usersMap[userId]
+		balance := make(map[string]entities.Balance, len(user.Balance))
+		for asset, assetBalance := range user.Balance {
+			balance[asset] = assetBalance
+		}
+		openOrders := make([]entities.Order, 0, len(user.OpenOrders))
+		for _, order := range user.OpenOrders {
+			openOrders = append(openOrders, order)
+		}
+		sort.Slice(openOrders, func(i, j int) bool {
+			return openOrders[i].GetId() < openOrders[j].GetId()
+		})
+		snapshot.Users = append(snapshot.Users, SnapshotUser{
+			UserId:              userId,
+			Balance:             balance,
+			SelfTradePrevention: user.GetSelfTradePrevention(),
+			OpenOrders:          toSnapshotOrders(openOrders),
+		})
+		snapshot.FeeLedger = append(snapshot.FeeLedger, ex.feeLedger[userId]...)
+	}
+
+	tickers := make([]string, 0, len(ex.orderbooksMap))
+	for ticker := range ex.orderbooksMap {
+		tickers = append(tickers, string(ticker))
+	}
+	sort.Strings(tickers)
+	for _, ticker := range tickers {
+		snapshot.Candles = append(snapshot.Candles, ex.latestCandles(Ticker(ticker))...)
+		orderbook := ex.orderbooksMap[Ticker(ticker)]
+		restingOrders := make([]entities.Order, 0)
+		for _, limit := range append(orderbook.GetBuyLimits(), orderbook.GetSellLimits()...) {
+			restingOrders = append(restingOrders, limit.GetAllOrders()...)
+		}
+		trades := orderbook.GetLastTrades()
+		if len(trades) > ex.recentTrades() {
+			trades = trades[len(trades)-ex.recentTrades():]
+		}
+		lastTrades := make([]SnapshotTrade, 0, len(trades))
+		for _, trade := range trades {
+			lastTrades = append(lastTrades, SnapshotTrade{
+				Id:            trade.GetId(),
+				BuyerOrderId:  trade.GetBuyerOrderId(),
+				BuyerUserId:   trade.GetBuyerUserId(),
+				SellerOrderId: trade.GetSellerOrderId(),
+				SellerUserId:  trade.GetSellerUserId(),
+				Price:         trade.GetPrice(),
+				Size:          trade.GetSize(),
+				IsBuyerMaker:  trade.GetIsBuyerMaker(),
+				Timestamp:     trade.GetTimeStamp(),
+				BuyerFee:      trade.GetBuyerFee(),
+				SellerFee:     trade.GetSellerFee(),
+			})
+		}
+		snapshot.Orderbooks = append(snapshot.Orderbooks, SnapshotOrderbook{
+			Ticker:        ticker,
+			RestingOrders: toSnapshotOrders(restingOrders),
+			StopOrders:    toSnapshotOrders(ex.triggerBooksMap[Ticker(ticker)].GetAllOrders()),
+			LastTrades:    lastTrades,
+		})
+	}
+	return snapshot
+}
+
+func (ex *Exchange) recentTrades() int {
+	if ex.RecentTrades <= 0 {
+		return DefaultRecentTrades
+	}
+	return ex.RecentTrades
+}
+
+// the latest snapshot that can be read, an unreadable one .e.g. corrupted is skipped for the one before
+// returns the sequence of the snapshot loaded, 0 if none
+// MUST be called with ex.mu held, on an exchange with no user nor order yet
+func (ex *Exchange) loadLatestSnapshot() int64 {
+	if ex.SnapshotStore == nil {
+		return 0
+	}
+	sequences, err := ex.SnapshotStore.List()
+	if err != nil {
+		logrus.Errorf("Unable to list the snapshots, replaying the whole journal: %s", err)
+		return 0
+	}
+	for _, sequence := range sequences {
+		snapshot, err := ex.SnapshotStore.Read(sequence)
+		if err != nil {
+			logrus.Warnf("Skipping snapshot %d: %s", sequence, err)
+			continue
+		}
+		ex.restoreSnapshot(snapshot)
+		logrus.Infof("Exchange state loaded from snapshot %d", sequence)
+		return sequence
+	}
+	return 0
+}
+
+// MUST be called with ex.mu held, on an exchange with no user nor order yet
+func (ex *Exchange) restoreSnapshot(snapshot Snapshot) {
+	for _, snapshotUser := range snapshot.Users {
+		user := entities.NewUser(snapshotUser.UserId, snapshotUser.Balance)
+		user.SetSelfTradePrevention(snapshotUser.SelfTradePrevention)
+		for _, snapshotOrder := range snapshotUser.OpenOrders {
+			user.OpenOrders[snapshotOrder.Id] = snapshotOrder.toOrder()
+		}
+		ex.usersMap[user.GetUserId()] = user
+	}
+
+	for _, snapshotOrderbook := range snapshot.Orderbooks {
+		orderbook, ok := ex.orderbooksMap[Ticker(snapshotOrderbook.Ticker)]
+		if !ok {
+			logrus.Warnf("Skipping snapshot of unknown ticker %s", snapshotOrderbook.Ticker)
+			continue
+		}
+		// nothing crosses: each order goes at the tail of its price level
+		for _, snapshotOrder := range snapshotOrderbook.RestingOrders {
+			orderbook.PlaceLimitOrder(snapshotOrder.toOrder())
+		}
+		for _, snapshotOrder := range snapshotOrderbook.StopOrders {
+			ex.triggerBooksMap[Ticker(snapshotOrderbook.Ticker)].AddOrder(snapshotOrder.toOrder())
+		}
+		for _, snapshotTrade := range snapshotOrderbook.LastTrades {
+			trade := entities.NewTradeRecord(snapshotTrade.Id, snapshotOrderbook.Ticker,
+				snapshotTrade.BuyerOrderId, snapshotTrade.BuyerUserId, snapshotTrade.SellerOrderId, snapshotTrade.SellerUserId,
+				snapshotTrade.Price, snapshotTrade.Size, snapshotTrade.IsBuyerMaker, snapshotTrade.Timestamp)
+			trade.SetFees(snapshotTrade.BuyerFee, snapshotTrade.SellerFee)
+			orderbook.AddLastTrade(*trade)
+		}
+	}
+
+	for _, entry := range snapshot.FeeLedger {
+		ex.addToFeeLedger(entry)
+	}
+	for _, candle := range snapshot.Candles {
+		if _, ok := ex.candles[Ticker(candle.Ticker)]; !ok {
+			continue
+		}
+		candle := candle
+		ex.candles[Ticker(candle.Ticker)][candle.Interval] = &candle
+	}
+	ex.orderIds.AdvanceTo(snapshot.LastOrderId)
+	ex.tradeIds.AdvanceTo(snapshot.LastTradeId)
+	ex.commandIds.AdvanceTo(snapshot.Sequence)
+	ex.now = snapshot.Timestamp
+	ex.lastSnapshotSequence = snapshot.Sequence
+}
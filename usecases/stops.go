@@ -0,0 +1,100 @@
+package usecases
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/trandinhkhoa/crypto-exchange/entities"
+)
+
+// a stop order whose stop price was reached
+type StopOrderTriggered struct {
+	// the MARKET/LIMIT order the stop order turned into
+	Order  entities.Order
+	Trades []entities.Trade
+	// not nil if the triggered order did not pass the risk checks, it is dropped
+	Err error
+}
+
+// called after a stop order is triggered, ex.mu is not held
+type StopOrderTriggeredListener func(StopOrderTriggered)
+
+// the stop order waits in the trigger book of its ticker, no funds are locked until it is triggered
+// the id of the order is set once it passes the checks
+func (ex *Exchange) PlaceStopOrder(o *entities.Order) error {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	ex.tick()
+	if err := ex.checkStopOrder(*o); err != nil {
+		return err
+	}
+	if err := ex.journal(Command{Type: PlaceOrderCommand, UserId: o.GetUserId(), Ticker: o.GetTicker(), Order: toJournaledOrder(*o)}); err != nil {
+		return err
+	}
+	ex.beginTransaction()
+	defer ex.commitTransaction()
+	ex.placeStopOrder(o)
+	return nil
+}
+
+// the order already passed the checks
+// MUST be called with ex.mu held
+func (ex *Exchange) placeStopOrder(o *entities.Order) {
+	o.SetId(ex.orderIds.Next())
+	ex.triggerBooksMap[Ticker(o.GetTicker())].AddOrder(*o)
+	ex.usersMap[o.GetUserId()].OpenOrders[o.GetId()] = *o
+
+	ex.OrdersRepo.Create(*o)
+	ex.persistSequences()
+}
+
+// MUST be called with ex.mu held, after each order that might have traded
+// a triggered order can trade and trigger more stop orders
+func (ex *Exchange) triggerStopOrders(ticker Ticker) []StopOrderTriggered {
+	triggeredList := make([]StopOrderTriggered, 0)
+	triggerBook, ok := ex.triggerBooksMap[ticker]
+	if !ok {
+		return triggeredList
+	}
+	for {
+		lastTradedPrice := ex.orderbooksMap[ticker].GetLastTradedPrice()
+		// no trade yet
+		if lastTradedPrice.IsZero() {
+			return triggeredList
+		}
+		stopOrders := triggerBook.PopTriggeredOrders(lastTradedPrice)
+		if len(stopOrders) == 0 {
+			return triggeredList
+		}
+		for _, stopOrder := range stopOrders {
+			delete(ex.usersMap[stopOrder.GetUserId()].OpenOrders, stopOrder.GetId())
+			ex.OrdersRepo.Delete(stopOrder)
+
+			triggered := StopOrderTriggered{Order: stopOrder.Trigger()}
+			if err := ex.checkRisk(triggered.Order); err != nil {
+				triggered.Err = err
+			} else if triggered.Order.GetOrderType() == entities.MarketOrderType {
+				triggered.Trades, triggered.Err = ex.executeMarketOrder(triggered.Order)
+			} else {
+				triggered.Trades = ex.executeLimitOrder(triggered.Order)
+			}
+			if triggered.Err != nil {
+				logrus.Infof("Stop order %d triggered at %s but dropped: %s", stopOrder.GetId(), lastTradedPrice, triggered.Err)
+			} else {
+				logrus.WithFields(logrus.Fields{
+					"order": triggered.Order,
+				}).Info("Stop Order Triggered")
+			}
+			triggeredList = append(triggeredList, triggered)
+		}
+		// the trades of the triggered orders took new ids
+		ex.persistSequences()
+	}
+}
+
+func (ex *Exchange) notifyStopOrdersTriggered(triggeredList []StopOrderTriggered) {
+	if ex.OnStopOrderTriggered == nil {
+		return
+	}
+	for _, triggered := range triggeredList {
+		ex.OnStopOrderTriggered(triggered)
+	}
+}